@@ -2,12 +2,19 @@ package isuports
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
 	"github.com/labstack/echo/v4"
 )
 
@@ -19,39 +26,68 @@ type TenantsAddHandlerResult struct {
 // テナントを追加する
 // POST /api/admin/tenants/add
 func tenantsAddHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	displayName := c.FormValue("display_name")
+	name := c.FormValue("name")
+	storage := c.FormValue("storage")
+
+	tenant, err := addTenant(context.Background(), name, displayName, storage)
+	if err != nil {
+		return err
+	}
+
+	res := TenantsAddHandlerResult{
+		Tenant: *tenant,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// SaaS管理者用APIを呼べるViewerか確認する
+func authorizeAdmin(c echo.Context) (*Viewer, error) {
 	v, err := parseViewer(c)
 	if err != nil {
-		return fmt.Errorf("error parseViewer: %w", err)
+		return nil, fmt.Errorf("error parseViewer: %w", err)
 	}
 	if v.tenantName != "admin" {
 		// admin: SaaS管理者用の特別なテナント名
-		return echo.NewHTTPError(
-			http.StatusNotFound,
-			fmt.Sprintf("%s has not this API", v.tenantName),
-		)
+		return nil, apperr.NotFound(
+			"%s has not this API", v.tenantName,
+		).WithCode(ErrAPINotAvailable.Code)
 	}
 	if v.role != RoleAdmin {
-		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+		return nil, ErrRoleAdminRequired
 	}
+	return v, nil
+}
 
-	displayName := c.FormValue("display_name")
-	name := c.FormValue("name")
+// テナントを作成する
+// tenantテーブルに行を追加して、テナントDBを作る
+// storageが空の場合はデフォルトの保存先に作る
+func addTenant(ctx context.Context, name, displayName, storage string) (*TenantWithBilling, error) {
 	if err := validateTenantName(name); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return nil, apperr.Validation("%s", err).WithCode(ErrInvalidTenant.Code)
+	}
+	if storage == "" {
+		storage = defaultTenantStorage()
+	}
+	if err := validateTenantStorage(storage); err != nil {
+		return nil, apperr.Validation("%s", err).WithCode(ErrInvalidTenant.Code)
 	}
 
-	ctx := context.Background()
 	now := time.Now().Unix()
 	insertRes, err := adminDB.ExecContext(
 		ctx,
-		"INSERT INTO tenant (name, display_name, created_at, updated_at) VALUES (?, ?, ?, ?)",
-		name, displayName, now, now,
+		"INSERT INTO tenant (name, display_name, storage, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		name, displayName, storage, now, now,
 	)
 	if err != nil {
 		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // duplicate entry
-			return echo.NewHTTPError(http.StatusBadRequest, "duplicate tenant")
+			return nil, ErrTenantDuplicate
 		}
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"error Insert tenant: name=%s, displayName=%s, createdAt=%d, updatedAt=%d, %w",
 			name, displayName, now, now, err,
 		)
@@ -59,22 +95,114 @@ func tenantsAddHandler(c echo.Context) error {
 
 	id, err := insertRes.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("error get LastInsertId: %w", err)
+		return nil, fmt.Errorf("error get LastInsertId: %w", err)
 	}
 	// NOTE: 先にadminDBに書き込まれることでこのAPIの処理中に
 	//       /api/admin/tenants/billingにアクセスされるとエラーになりそう
 	//       ロックなどで対処したほうが良さそう
-	if err := createTenantDB(id); err != nil {
-		return fmt.Errorf("error createTenantDB: id=%d name=%s %w", id, name, err)
+	if err := createTenantDB(id, storage); err != nil {
+		return nil, fmt.Errorf("error createTenantDB: id=%d name=%s %w", id, name, err)
 	}
+	hooks.tenantCreated(ctx, TenantCreatedEvent{
+		TenantID:    id,
+		Name:        name,
+		DisplayName: displayName,
+	})
 
-	res := TenantsAddHandlerResult{
-		Tenant: TenantWithBilling{
-			ID:          strconv.FormatInt(id, 10),
-			Name:        name,
-			DisplayName: displayName,
-			BillingYen:  0,
-		},
+	return &TenantWithBilling{
+		ID:          strconv.FormatInt(id, 10),
+		Name:        name,
+		DisplayName: displayName,
+		BillingYen:  0,
+	}, nil
+}
+
+type TenantsBulkAddRequest struct {
+	Tenants []struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		Storage     string `json:"storage"`
+	} `json:"tenants"`
+}
+
+type TenantsBulkAddResult struct {
+	Name    string             `json:"name"`
+	Success bool               `json:"success"`
+	Tenant  *TenantWithBilling `json:"tenant,omitempty"`
+	Message string             `json:"message,omitempty"`
+}
+
+type TenantsBulkAddHandlerResult struct {
+	Results   []TenantsBulkAddResult `json:"results"`
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+}
+
+// 一括作成で同時に作成するテナント数
+const tenantsBulkAddConcurrency = 8
+
+// 一度に作成できるテナント数
+const tenantsBulkAddMaxTenants = 1000
+
+// SasS管理者用API
+// テナントを一括で追加する
+// POST /api/admin/tenants/bulk_add
+// 一部のテナントの作成に失敗しても残りは作成し、テナントごとの結果を返す
+func tenantsBulkAddHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	var req TenantsBulkAddRequest
+	if err := c.Bind(&req); err != nil {
+		return apperr.Validation("invalid request body: %s", err).WithCode(ErrInvalidRequestBody.Code)
+	}
+	if len(req.Tenants) == 0 {
+		return apperr.InvalidField("tenants", "tenants required")
+	}
+	if len(req.Tenants) > tenantsBulkAddMaxTenants {
+		return apperr.Validation(
+			"too many tenants: max=%d", tenantsBulkAddMaxTenants,
+		).WithCode(ErrInvalidRequestBody.Code)
+	}
+
+	ctx := context.Background()
+	results := make([]TenantsBulkAddResult, len(req.Tenants))
+	sem := make(chan struct{}, tenantsBulkAddConcurrency)
+	wg := sync.WaitGroup{}
+	for i := range req.Tenants {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			t := req.Tenants[i]
+			results[i].Name = t.Name
+			tenant, err := addTenant(ctx, t.Name, t.DisplayName, t.Storage)
+			if err != nil {
+				if ae, ok := apperr.As(err); ok {
+					results[i].Message = ae.Message
+				} else {
+					c.Logger().Errorf("error addTenant: name=%s, %s", t.Name, err)
+					results[i].Message = "internal error"
+				}
+				return
+			}
+			results[i].Success = true
+			results[i].Tenant = tenant
+		}(i)
+	}
+	wg.Wait()
+
+	res := TenantsBulkAddHandlerResult{Results: results}
+	for _, r := range results {
+		if r.Success {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
 	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
@@ -91,14 +219,22 @@ type TenantWithBilling struct {
 	ID          string `json:"id"`
 	Name        string `json:"name"`
 	DisplayName string `json:"display_name"`
+	Plan        string `json:"plan"`
 	BillingYen  int64  `json:"billing"`
 	tenantID    int64  `json:"-"`
 }
 
 type TenantsBillingHandlerResult struct {
-	Tenants []TenantWithBilling `json:"tenants"`
+	Tenants      []TenantWithBilling `json:"tenants"`
+	HasNext      bool                `json:"has_next"`
+	TotalTenants int64               `json:"total_tenants"` // 課金対象のテナントの総数 before, limitに関係しない
 }
 
+const (
+	defaultTenantsBillingLimit = 10
+	maxTenantsBillingLimit     = 100
+)
+
 type ScoredPlayer struct {
 	ID            string `db:"pid"`
 	CompetitionID string `db:"competition_id"`
@@ -108,6 +244,7 @@ type ScoredPlayer struct {
 // テナントごとの課金レポートを最大10件、テナントのid降順で取得する
 // GET /api/admin/tenants/billing
 // URL引数beforeを指定した場合、指定した値よりもidが小さいテナントの課金レポートを取得する
+// URL引数from, to(unix秒)を指定した場合、終了日時がその範囲の大会だけを集計する
 // func tenantsBillingHandler(c echo.Context) error {
 // 	if host := c.Request().Host; host != getEnv("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev") {
 // 		return echo.NewHTTPError(
@@ -179,7 +316,7 @@ type ScoredPlayer struct {
 // 	for i := range tenantBillings {
 // 		tenantDB, _ := connectToTenantDB(tenantBillings[i].tenantID)
 
-// 		fl, err := flockByTenantID(tenantBillings[i].tenantID)
+// 		fl, err := flockByTenantID(ctx, tenantBillings[i].tenantID)
 // 		if err != nil {
 // 			return fmt.Errorf("error flockByTenantID: %w", err)
 // 		}
@@ -250,19 +387,57 @@ type ScoredPlayer struct {
 // 	})
 // }
 
+// SaaS管理者用API
+// テナントごとの課金レポートをテナントのid降順で取得する
+// GET /api/admin/tenants/billing
+// URL引数
+//   before: 指定した値よりもidが小さいテナントを取得する 次のページは前のページの最後のidを指定する
+//   limit: 取得する件数 デフォルトは10
+//   from, to: 終了日時(unix秒)がその範囲の大会だけを集計する
 func tenantsBillingHandler(c echo.Context) error {
-	if host := c.Request().Host; host != getEnv("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev") {
-		return echo.NewHTTPError(
-			http.StatusNotFound,
-			fmt.Sprintf("invalid hostname %s", host),
-		)
+	ctx := context.Background()
+	beforeID, period, err := parseTenantsBillingRequest(c)
+	if err != nil {
+		return err
+	}
+	limit := int64(defaultTenantsBillingLimit)
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil || limit < 1 || limit > maxTenantsBillingLimit {
+			return apperr.Validation(
+				"query parameter 'limit' must be between 1 and %d", maxTenantsBillingLimit,
+			).WithCode(ErrInvalidQuery.Code)
+		}
 	}
 
-	ctx := context.Background()
-	if v, err := parseViewer(c); err != nil {
+	res := TenantsBillingHandlerResult{
+		Tenants: make([]TenantWithBilling, 0, limit),
+	}
+	if err := adminDB.GetContext(ctx, &res.TotalTenants, "SELECT COUNT(*) FROM tenant WHERE sandbox_of IS NULL"); err != nil {
+		return fmt.Errorf("error Select count tenant: %w", err)
+	}
+	res.HasNext, err = eachTenantBilling(ctx, beforeID, limit, period, func(tb TenantWithBilling) error {
+		res.Tenants = append(res.Tenants, tb)
+		return nil
+	})
+	if err != nil {
 		return err
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// tenantsBillingHandlerとtenantsBillingExportHandler(billing_export.go)の認可とURL引数before, from, toの解釈
+func parseTenantsBillingRequest(c echo.Context) (int64, BillingPeriod, error) {
+	if host := c.Request().Host; host != appConfig.Hostname.Admin {
+		return 0, BillingPeriod{}, apperr.NotFound(
+			"invalid hostname %s", host,
+		).WithCode(ErrAPINotAvailable.Code)
+	}
+
+	if v, err := parseViewer(c); err != nil {
+		return 0, BillingPeriod{}, err
 	} else if v.role != RoleAdmin {
-		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+		return 0, BillingPeriod{}, ErrRoleAdminRequired
 	}
 
 	before := c.QueryParam("before")
@@ -271,70 +446,715 @@ func tenantsBillingHandler(c echo.Context) error {
 		var err error
 		beforeID, err = strconv.ParseInt(before, 10, 64)
 		if err != nil {
-			return echo.NewHTTPError(
-				http.StatusBadRequest,
-				fmt.Sprintf("failed to parse query parameter 'before': %s", err.Error()),
-			)
+			return 0, BillingPeriod{}, apperr.Validation(
+				"failed to parse query parameter 'before': %s", err,
+			).WithCode(ErrInvalidQuery.Code)
 		}
 	}
+	period, err := parseBillingPeriod(c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return 0, period, err
+	}
+	return beforeID, period, nil
+}
+
+// idがbeforeIDより小さいテナントの課金を、テナントのid降順にlimit件まで1件ずつfnに渡す
+// beforeIDが0なら先頭から、limitが0なら全てのテナント 続きのテナントがある場合はtrueを返す
+// RESTのAPIとCSVのエクスポート(billing_export.go)で共通の処理
+func eachTenantBilling(ctx context.Context, beforeID, limit int64, period BillingPeriod, fn func(TenantWithBilling) error) (bool, error) {
 	// テナントごとに
 	//   大会ごとに
-	//     scoreが登録されているplayer * 100
-	//     scoreが登録されていないplayerでアクセスした人 * 10
+	//     scoreが登録されているplayer * 100 (billing_planで変更できる)
+	//     scoreが登録されていないplayerでアクセスした人 * 10 (billing_planで変更できる)
 	//   を合計したものを
 	// テナントの課金とする
+	// サンドボックスのテナントは課金しない
+	query := "SELECT * FROM tenant WHERE sandbox_of IS NULL"
+	tenantArgs := []any{}
+	if beforeID != 0 {
+		query += " AND id < ?"
+		tenantArgs = append(tenantArgs, beforeID)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		// 続きがあるか判定するために1件多く取得する
+		query += " LIMIT ?"
+		tenantArgs = append(tenantArgs, limit+1)
+	}
 	ts := []TenantRow{}
-	if err := adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id DESC"); err != nil {
-		return fmt.Errorf("error Select tenant: %w", err)
+	if err := adminDB.SelectContext(ctx, &ts, query, tenantArgs...); err != nil {
+		return false, fmt.Errorf("error Select tenant: %w", err)
 	}
-	tenantBillings := make([]TenantWithBilling, 0, len(ts))
+	hasNext := false
+	if limit > 0 && int64(len(ts)) > limit {
+		hasNext = true
+		ts = ts[:limit]
+	}
+
+	cond, args := period.condition()
 	for _, t := range ts {
-		if beforeID != 0 && beforeID <= t.ID {
-			continue
+		tb := TenantWithBilling{
+			ID:          strconv.FormatInt(t.ID, 10),
+			Name:        t.Name,
+			DisplayName: t.DisplayName,
 		}
-		err := func(t TenantRow) error {
-			tb := TenantWithBilling{
-				ID:          strconv.FormatInt(t.ID, 10),
-				Name:        t.Name,
-				DisplayName: t.DisplayName,
-			}
-			tenantDB, err := connectToTenantDB(t.ID)
+		plan, err := retrieveBillingPlan(ctx, t.ID)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieveBillingPlan: %w", err)
+		}
+		tb.Plan = plan.Tier
+		tenantDB, err := connectToTenantDB(t.ID)
+		if err != nil {
+			return false, fmt.Errorf("failed to connectToTenantDB: %w", err)
+		}
+		cs := []CompetitionRow{}
+		if err := tenantDB.SelectContext(
+			ctx,
+			&cs,
+			"SELECT * FROM competition WHERE tenant_id=?"+cond,
+			append([]any{t.ID}, args...)...,
+		); err != nil {
+			return false, fmt.Errorf("failed to Select competition: %w", err)
+		}
+		for _, comp := range cs {
+			report, err := billingReportByCompetition(ctx, tenantDB, t.ID, comp.ID)
 			if err != nil {
-				return fmt.Errorf("failed to connectToTenantDB: %w", err)
-			}
-			cs := []CompetitionRow{}
-			if err := tenantDB.SelectContext(
-				ctx,
-				&cs,
-				"SELECT * FROM competition WHERE tenant_id=?",
-				t.ID,
-			); err != nil {
-				return fmt.Errorf("failed to Select competition: %w", err)
-			}
-			for _, comp := range cs {
-				report, err := billingReportByCompetition(ctx, tenantDB, t.ID, comp.ID)
-				if err != nil {
-					return fmt.Errorf("failed to billingReportByCompetition: %w", err)
-				}
-				tb.BillingYen += report.BillingYen
+				return false, fmt.Errorf("failed to billingReportByCompetition: %w", err)
 			}
-			tenantBillings = append(tenantBillings, tb)
-			return nil
-		}(t)
+			tb.BillingYen += report.BillingYen
+		}
+		if err := fn(tb); err != nil {
+			return false, err
+		}
+	}
+	return hasNext, nil
+}
+
+type TenantDeleteHandlerResult struct {
+	Tenant TenantDetail `json:"tenant"`
+}
+
+// SasS管理者用API
+// テナントを削除する
+// POST /api/admin/tenant/:tenant_id/delete
+// テナントDBのファイル、tenantテーブルの行、visit_historyを消してテナントに関するキャッシュを捨てる
+func tenantDeleteHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	var tenant TenantRow
+	if err := adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", tenantID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTenantNotFound
+		}
+		return fmt.Errorf("error Select tenant: id=%d, %w", tenantID, err)
+	}
+
+	if err := deleteTenant(ctx, tenantID); err != nil {
+		return fmt.Errorf("error deleteTenant: id=%d, %w", tenantID, err)
+	}
+
+	res := TenantDeleteHandlerResult{
+		Tenant: TenantDetail{
+			Name:        tenant.Name,
+			DisplayName: tenant.DisplayName,
+		},
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナントを削除する
+func deleteTenant(ctx context.Context, tenantID int64) error {
+	// 削除中にスコアの登録などが走らないようにロックする
+	fl, err := flockByTenantID(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer func() {
+		fl.Close()
+		os.Remove(lockFilePath(tenantID))
+	}()
+
+	// キャッシュを捨てるためにテナント内のIDを集めておく
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+	competitionIDs := []string{}
+	if err := tenantDB.SelectContext(ctx, &competitionIDs, "SELECT id FROM competition WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select competition: %w", err)
+	}
+	playerIDs := []string{}
+	if err := tenantDB.SelectContext(ctx, &playerIDs, "SELECT id FROM player WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select player: %w", err)
+	}
+
+	if err := deleteTenantData(ctx, tenantID); err != nil {
+		return fmt.Errorf("error deleteTenantData: %w", err)
+	}
+
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM visit_history WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete visit_history: %w", err)
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM billing_plan WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete billing_plan: %w", err)
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM credential WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete credential: %w", err)
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM billing_receipt WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete billing_receipt: tenantID=%d, %w", tenantID, err)
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM billing_report WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete billing_report: tenantID=%d, %w", tenantID, err)
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM ip_allowlist WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete ip_allowlist: %w", err)
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM tenant WHERE id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Delete tenant: %w", err)
+	}
+
+	for _, id := range competitionIDs {
+		competitionCache.Delete(id)
+		invalidateRanking(id)
+		billingReportCache.Delete(strconv.FormatInt(tenantID, 10) + id)
+	}
+	for _, id := range playerIDs {
+		playerCache.Delete(id)
+	}
+	vhsCache.Delete(tenantID)
+	scoredPlayerCache.Delete(tenantID)
+	tenantCache.Delete(tenantID)
+	billingPlanCache.Delete(tenantID)
+	tenantStorageCache.Delete(tenantID)
+	ipAllowlistCache.Reset()
+	searchIndexCache.Delete(tenantID)
+	return nil
+}
+
+type TenantStatusHandlerResult struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Status      string `json:"status"`
+}
+
+// SasS管理者用API
+// テナントを停止する
+// POST /api/admin/tenant/:tenant_id/suspend
+// 停止中のテナントでは課金以外のテナント管理者向けAPI、参加者向けAPIが403になる
+func tenantSuspendHandler(c echo.Context) error {
+	return updateTenantStatus(c, TenantStatusSuspended)
+}
+
+// SasS管理者用API
+// 停止したテナントを再開する
+// POST /api/admin/tenant/:tenant_id/reactivate
+func tenantReactivateHandler(c echo.Context) error {
+	return updateTenantStatus(c, TenantStatusActive)
+}
+
+func updateTenantStatus(c echo.Context, status string) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	now := time.Now().Unix()
+	if _, err := adminDB.ExecContext(
+		ctx,
+		"UPDATE tenant SET status = ?, updated_at = ? WHERE id = ?",
+		status, now, tenantID,
+	); err != nil {
+		return fmt.Errorf("error Update tenant: status=%s, updatedAt=%d, id=%d, %w", status, now, tenantID, err)
+	}
+
+	var tenant TenantRow
+	if err := adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", tenantID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTenantNotFound
+		}
+		return fmt.Errorf("error Select tenant: id=%d, %w", tenantID, err)
+	}
+
+	res := TenantStatusHandlerResult{
+		ID:          strconv.FormatInt(tenant.ID, 10),
+		Name:        tenant.Name,
+		DisplayName: tenant.DisplayName,
+		Status:      tenant.Status,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type TenantListDetail struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Status      string `json:"status"`
+	SandboxOf   string `json:"sandbox_of,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+type TenantsListHandlerResult struct {
+	Tenants []TenantListDetail `json:"tenants"`
+	HasNext bool               `json:"has_next"`
+}
+
+const (
+	defaultTenantsListLimit = 20
+	maxTenantsListLimit     = 100
+)
+
+// LIKEの特殊文字をエスケープする
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SaaS管理者用API
+// テナントの一覧をidの降順で取得する
+// GET /api/admin/tenants
+// URL引数
+//   name: テナント名または表示名に含まれる文字列
+//   created_from, created_to: 作成日時(unix秒)の範囲 両端を含む
+//   before: 指定した値よりもidが小さいテナントを取得する
+//   limit: 取得する件数
+func tenantsListHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	parseInt := func(key string) (int64, bool, error) {
+		s := c.QueryParam(key)
+		if s == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, false, apperr.Validation(
+				"failed to parse query parameter '%s': %s", key, err,
+			).WithCode(ErrInvalidQuery.Code)
+		}
+		return n, true, nil
+	}
+
+	where := []string{"1 = 1"}
+	args := []any{}
+	if name := c.QueryParam("name"); name != "" {
+		pattern := "%" + likeEscaper.Replace(name) + "%"
+		where = append(where, "(name LIKE ? OR display_name LIKE ?)")
+		args = append(args, pattern, pattern)
+	}
+	for _, f := range []struct {
+		key  string
+		cond string
+	}{
+		{"created_from", "created_at >= ?"},
+		{"created_to", "created_at <= ?"},
+		{"before", "id < ?"},
+	} {
+		n, ok, err := parseInt(f.key)
 		if err != nil {
 			return err
 		}
-		if len(tenantBillings) >= 10 {
-			break
+		if ok {
+			where = append(where, f.cond)
+			args = append(args, n)
+		}
+	}
+	limit, ok, err := parseInt("limit")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		limit = defaultTenantsListLimit
+	}
+	if limit < 1 || limit > maxTenantsListLimit {
+		return apperr.Validation(
+			"query parameter 'limit' must be between 1 and %d", maxTenantsListLimit,
+		).WithCode(ErrInvalidQuery.Code)
+	}
+	// 次のページがあるか判定するために1件多く取得する
+	args = append(args, limit+1)
+
+	ts := []TenantRow{}
+	if err := adminDB.SelectContext(
+		context.Background(),
+		&ts,
+		"SELECT * FROM tenant WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?",
+		args...,
+	); err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+
+	res := TenantsListHandlerResult{
+		Tenants: make([]TenantListDetail, 0, len(ts)),
+	}
+	if int64(len(ts)) > limit {
+		res.HasNext = true
+		ts = ts[:limit]
+	}
+	for _, t := range ts {
+		d := TenantListDetail{
+			ID:          strconv.FormatInt(t.ID, 10),
+			Name:        t.Name,
+			DisplayName: t.DisplayName,
+			Status:      t.Status,
+			CreatedAt:   t.CreatedAt,
+		}
+		if t.IsSandbox() {
+			d.SandboxOf = strconv.FormatInt(t.SandboxOf.Int64, 10)
+		}
+		res.Tenants = append(res.Tenants, d)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type TenantStatsHandlerResult struct {
+	TenantID             string   `json:"tenant_id"`
+	Name                 string   `json:"name"`
+	Storage              string   `json:"storage"`
+	PlayerCount          int64    `json:"player_count"`
+	FinishedCompetitions int64    `json:"finished_competitions"`
+	OngoingCompetitions  int64    `json:"ongoing_competitions"`
+	ScoreRows            int64    `json:"score_rows"`
+	VisitHistoryRows     int64    `json:"visit_history_rows"`
+	DBFileSizeBytes      int64    `json:"db_file_size_bytes"`
+	WALSizeBytes         int64    `json:"wal_size_bytes"`
+	WAL                  WALStats `json:"wal"`
+	Tier                 string   `json:"tier"`
+}
+
+// SasS管理者用API
+// テナントの利用状況を取得する
+// GET /api/admin/tenant/:tenant_id/stats
+func tenantStatsHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	var tenant TenantRow
+	if err := adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", tenantID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTenantNotFound
+		}
+		return fmt.Errorf("error Select tenant: id=%d, %w", tenantID, err)
+	}
+
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+
+	res := TenantStatsHandlerResult{
+		TenantID: strconv.FormatInt(tenant.ID, 10),
+		Name:     tenant.Name,
+		Storage:  tenant.Storage,
+	}
+	for _, q := range []struct {
+		dest  *int64
+		query string
+	}{
+		{&res.PlayerCount, "SELECT COUNT(*) FROM player WHERE tenant_id = ? AND deleted_at IS NULL"},
+		{&res.FinishedCompetitions, "SELECT COUNT(*) FROM competition WHERE tenant_id = ? AND finished_at IS NOT NULL"},
+		{&res.OngoingCompetitions, "SELECT COUNT(*) FROM competition WHERE tenant_id = ? AND finished_at IS NULL"},
+		{&res.ScoreRows, "SELECT COUNT(*) FROM player_score WHERE tenant_id = ?"},
+	} {
+		if err := tenantDB.GetContext(ctx, q.dest, q.query, tenantID); err != nil {
+			return fmt.Errorf("error %s: %w", q.query, err)
+		}
+	}
+	if err := adminDB.GetContext(
+		ctx,
+		&res.VisitHistoryRows,
+		"SELECT COUNT(*) FROM visit_history WHERE tenant_id = ?",
+		tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select count visit_history: %w", err)
+	}
+
+	// WALなどの付随するファイルも含める
+	p := tenantDBPath(tenantID)
+	for _, f := range []string{p, p + "-wal", p + "-shm", p + "-journal"} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("error os.Stat: path=%s, %w", f, err)
 		}
+		res.DBFileSizeBytes += fi.Size()
+	}
+	res.WALSizeBytes, err = tenantDBWALSize(tenantID)
+	if err != nil {
+		return fmt.Errorf("error tenantDBWALSize: %w", err)
+	}
+	res.WAL, _ = walStatsCache.Get(tenantID)
+	res.Tier = retrieveTenantTier(tenantID)
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type BillingPlanDetail struct {
+	TenantID   string `json:"tenant_id"`
+	PlayerYen  int64  `json:"player_yen"`
+	VisitorYen int64  `json:"visitor_yen"`
+	Tier       string `json:"tier"`
+}
+
+type BillingPlanHandlerResult struct {
+	BillingPlan BillingPlanDetail `json:"billing_plan"`
+}
+
+// SasS管理者用API
+// テナントの課金単価とプランを取得する
+// GET /api/admin/tenant/:tenant_id/billing_plan
+func billingPlanHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
 	}
 
-	vhsCache.Reset()
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+	plan, err := retrieveBillingPlan(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveBillingPlan: %w", err)
+	}
 
-	return c.JSON(http.StatusOK, SuccessResult{
-		Status: true,
-		Data: TenantsBillingHandlerResult{
-			Tenants: tenantBillings,
+	res := BillingPlanHandlerResult{
+		BillingPlan: BillingPlanDetail{
+			TenantID:   strconv.FormatInt(tenantID, 10),
+			PlayerYen:  plan.PlayerYen,
+			VisitorYen: plan.VisitorYen,
+			Tier:       plan.Tier,
 		},
-	})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// SasS管理者用API
+// テナントの課金単価を設定する
+// POST /api/admin/tenant/:tenant_id/billing_plan
+// フォームで player_yen, visitor_yen を受け取る
+func billingPlanUpdateHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	playerYen, err := strconv.ParseInt(c.FormValue("player_yen"), 10, 64)
+	if err != nil || playerYen < 0 {
+		return apperr.InvalidField("player_yen", "invalid player_yen")
+	}
+	visitorYen, err := strconv.ParseInt(c.FormValue("visitor_yen"), 10, 64)
+	if err != nil || visitorYen < 0 {
+		return apperr.InvalidField("visitor_yen", "invalid visitor_yen")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if _, err := adminDB.ExecContext(
+		ctx,
+		"INSERT INTO billing_plan (tenant_id, player_yen, visitor_yen, created_at, updated_at) VALUES (?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE player_yen = VALUES(player_yen), visitor_yen = VALUES(visitor_yen), updated_at = VALUES(updated_at)",
+		tenantID, playerYen, visitorYen, now, now,
+	); err != nil {
+		return fmt.Errorf(
+			"error Insert billing_plan: tenantID=%d, playerYen=%d, visitorYen=%d, %w",
+			tenantID, playerYen, visitorYen, err,
+		)
+	}
+	// 単価が変わったのでテナントの課金レポートを計算し直す
+	return billingPlanUpdated(ctx, c, tenantID)
+}
+
+// SasS管理者用API
+// テナントの課金プランを設定する
+// POST /api/admin/tenant/:tenant_id/billing_plan/tier
+// フォームで tier (free, standard, enterprise) を受け取る 単価はそのまま
+func billingPlanTierUpdateHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	tier := c.FormValue("tier")
+	switch tier {
+	case BillingTierFree, BillingTierStandard, BillingTierEnterprise:
+	default:
+		return apperr.InvalidField("tier", "tier must be one of free, standard, enterprise")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if _, err := adminDB.ExecContext(
+		ctx,
+		"INSERT INTO billing_plan (tenant_id, player_yen, visitor_yen, tier, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE tier = VALUES(tier), updated_at = VALUES(updated_at)",
+		tenantID, defaultBillingPlayerYen, defaultBillingVisitorYen, tier, now, now,
+	); err != nil {
+		return fmt.Errorf("error Insert billing_plan: tenantID=%d, tier=%s, %w", tenantID, tier, err)
+	}
+
+	// プランが変わったのでテナントの課金レポートを計算し直す
+	return billingPlanUpdated(ctx, c, tenantID)
+}
+
+// billing_planを更新した後に、テナントの課金レポートを捨てて更新後の課金プランを返す
+func billingPlanUpdated(ctx context.Context, c echo.Context, tenantID int64) error {
+	billingPlanCache.Delete(tenantID)
+
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+	competitionIDs := []string{}
+	if err := tenantDB.SelectContext(ctx, &competitionIDs, "SELECT id FROM competition WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select competition: %w", err)
+	}
+	if err := invalidateBillingReports(ctx, tenantID, competitionIDs); err != nil {
+		return fmt.Errorf("error invalidateBillingReports: %w", err)
+	}
+
+	plan, err := retrieveBillingPlan(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveBillingPlan: %w", err)
+	}
+	res := BillingPlanHandlerResult{
+		BillingPlan: BillingPlanDetail{
+			TenantID:   strconv.FormatInt(tenantID, 10),
+			PlayerYen:  plan.PlayerYen,
+			VisitorYen: plan.VisitorYen,
+			Tier:       plan.Tier,
+		},
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナントを取得する 存在しない場合は404
+func retrieveTenant(ctx context.Context, tenantID int64) (*TenantRow, error) {
+	var tenant TenantRow
+	if err := adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", tenantID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTenantNotFound
+		}
+		return nil, fmt.Errorf("error Select tenant: id=%d, %w", tenantID, err)
+	}
+	return &tenant, nil
+}
+
+type TenantDBReopenHandlerResult struct {
+	TenantID string `json:"tenant_id"`
+	Reopened bool   `json:"reopened"` // キャッシュしていた接続を閉じた場合はtrue
+}
+
+// SasS管理者用API
+// テナントDBへの接続を閉じて開き直す
+// POST /api/admin/tenants/:tenant_id/db/reopen
+// 接続が壊れたテナントDBを、プロセスを再起動せずに復旧するために使う
+func tenantDBReopenHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+
+	reopened, err := reopenTenantDB(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error reopenTenantDB: id=%d, %w", tenantID, err)
+	}
+
+	res := TenantDBReopenHandlerResult{
+		TenantID: strconv.FormatInt(tenantID, 10),
+		Reopened: reopened,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// キャッシュしているテナントDBへの接続を閉じて開き直す
+// ロックを取るので、ロックを取って書き込んでいる処理が終わるのを待ってから閉じる
+// sql.DB.Close は実行中のクエリが終わるまで待つ
+func reopenTenantDB(ctx context.Context, tenantID int64) (bool, error) {
+	fl, err := flockByTenantID(ctx, tenantID)
+	if err != nil {
+		return false, fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	storage, err := retrieveTenantStorage(ctx, tenantID)
+	if err != nil {
+		return false, fmt.Errorf("error retrieveTenantStorage: %w", err)
+	}
+	if storage == TenantStorageMySQL {
+		// 全テナントで共有している接続なので閉じずに疎通だけ確認する
+		db, err := connectTenantMySQLDB()
+		if err != nil {
+			return false, err
+		}
+		return false, db.PingContext(ctx)
+	}
+
+	old, reopened := tenantDBCache.GetAndDelete(tenantID)
+	if reopened {
+		if err := old.Close(); err != nil {
+			// 壊れた接続は閉じるときにエラーになることがあるが、開き直せればよい
+			log.Printf("error close tenant DB: id=%d, %s", tenantID, err)
+		}
+	}
+
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return reopened, fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+	if err := tenantDB.PingContext(ctx); err != nil {
+		tenantDBCache.Delete(tenantID)
+		tenantDB.Close()
+		return reopened, fmt.Errorf("error Ping tenant DB: %w", err)
+	}
+	return reopened, nil
 }
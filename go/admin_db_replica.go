@@ -0,0 +1,183 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 管理用DBのリードレプリカ
+// 設定(config.go の DBConfig.Replicas)にレプリカがあれば、一部の読み込みだけのクエリをadminReadDBでレプリカに送る
+// 書き込みと、書いた直後に読む必要があるクエリ、結果を保存したりキャッシュしたりするクエリ、認可に使うクエリはこれまでどおりadminDB(プライマリ)に送る
+// レプリカは定期的に死活を確認し、応答しないか遅れが大きいものには送らない 全て使えなければプライマリに送る
+// 遅れの上限(ISUCON_DB_REPLICA_MAX_LAG_SECONDS)を設定していなければ、どれだけ遅れているかわからないのでレプリカには送らない
+
+type adminDBReplica struct {
+	addr    string
+	db      *sqlx.DB
+	healthy int32 // 1なら使える
+	// 最後の確認の結果 debug_state.go で返す
+	lastError atomic.Value // string
+}
+
+func (r *adminDBReplica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+var (
+	// 起動時に設定から作り、以降は変更しない
+	adminDBReplicas    []*adminDBReplica
+	adminDBReplicaNext uint32
+)
+
+// レプリカの死活を確認する間隔(ミリ秒)
+// 環境変数 ISUCON_DB_REPLICA_HEALTH_CHECK_MS で変更できる
+func adminDBReplicaHealthCheckIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_DB_REPLICA_HEALTH_CHECK_MS", "1000"))
+	if err != nil || n <= 0 {
+		return 1000
+	}
+	return n
+}
+
+// レプリカへの送信をやめるレプリケーションの遅れ(秒)
+// 環境変数 ISUCON_DB_REPLICA_MAX_LAG_SECONDS で指定する 0の場合は遅れを確認しない
+// 確認にはレプリカのユーザーに REPLICATION CLIENT の権限が必要
+func adminDBReplicaMaxLagSeconds() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_DB_REPLICA_MAX_LAG_SECONDS", "0"), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// 設定されたレプリカに接続し、最初の死活確認をする
+// 接続できないレプリカがあっても起動は続け、確認に成功するまで使わない
+func connectAdminDBReplicas() error {
+	adminDBReplicas = nil
+	for _, addr := range appConfig.AdminDB.Replicas {
+		db, err := connectAdminDBAt(addr)
+		if err != nil {
+			return fmt.Errorf("error connectAdminDBAt: addr=%s, %w", addr, err)
+		}
+		db.SetMaxOpenConns(appConfig.AdminDB.MaxOpenConns)
+		db.SetMaxIdleConns(appConfig.AdminDB.MaxIdleConns)
+		db.SetConnMaxLifetime(time.Duration(appConfig.AdminDB.ConnMaxLifetimeMs) * time.Millisecond)
+		db.SetConnMaxIdleTime(time.Duration(appConfig.AdminDB.ConnMaxIdleTimeMs) * time.Millisecond)
+		adminDBReplicas = append(adminDBReplicas, &adminDBReplica{addr: addr, db: db})
+	}
+	if len(adminDBReplicas) > 0 && adminDBReplicaMaxLagSeconds() == 0 {
+		log.Printf("admin DB replicas are not used: ISUCON_DB_REPLICA_MAX_LAG_SECONDS is not set")
+	}
+	adminDBReplicaHealthCheckJob()
+	return nil
+}
+
+func closeAdminDBReplicas() {
+	for _, r := range adminDBReplicas {
+		r.db.Close()
+	}
+}
+
+// 読み込みだけのクエリを送るDBを返す
+// 使えるレプリカを順番に返し、なければプライマリを返す
+func adminReadDB() *sqlx.DB {
+	n := len(adminDBReplicas)
+	if n == 0 || adminDBReplicaMaxLagSeconds() == 0 {
+		return adminDB
+	}
+	start := int(atomic.AddUint32(&adminDBReplicaNext, 1))
+	for i := 0; i < n; i++ {
+		if r := adminDBReplicas[(start+i)%n]; r.isHealthy() {
+			return r.db
+		}
+	}
+	return adminDB
+}
+
+// 全てのレプリカの死活を確認する
+func adminDBReplicaHealthCheckJob() {
+	maxLag := adminDBReplicaMaxLagSeconds()
+	timeout := time.Duration(adminDBReplicaHealthCheckIntervalMs()) * time.Millisecond
+	for _, r := range adminDBReplicas {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := checkAdminDBReplica(ctx, r.db, maxLag)
+		cancel()
+
+		healthy := int32(1)
+		r.lastError.Store("")
+		if err != nil {
+			healthy = 0
+			r.lastError.Store(err.Error())
+		}
+		if old := atomic.SwapInt32(&r.healthy, healthy); old != healthy {
+			if err != nil {
+				log.Printf("admin DB replica is unhealthy: addr=%s, %s", r.addr, err)
+			} else {
+				log.Printf("admin DB replica is healthy: addr=%s", r.addr)
+			}
+		}
+	}
+}
+
+func checkAdminDBReplica(ctx context.Context, db *sqlx.DB, maxLag int64) error {
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("error PingContext: %w", err)
+	}
+	if maxLag == 0 {
+		return nil
+	}
+	lag, err := adminDBReplicaLag(ctx, db)
+	if err != nil {
+		return err
+	}
+	if !lag.Valid {
+		return fmt.Errorf("replication is not running")
+	}
+	if lag.Int64 > maxLag {
+		return fmt.Errorf("replication lag is too large: %ds", lag.Int64)
+	}
+	return nil
+}
+
+// レプリケーションの遅れ(秒)を返す レプリケーションが止まっている場合はNULL
+// MySQLのバージョンによって列名が Seconds_Behind_Master か Seconds_Behind_Source になる
+func adminDBReplicaLag(ctx context.Context, db *sqlx.DB) (sql.NullInt64, error) {
+	rows, err := db.QueryxContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return sql.NullInt64{}, fmt.Errorf("error SHOW SLAVE STATUS: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return sql.NullInt64{}, fmt.Errorf("not a replica")
+	}
+	status := map[string]any{}
+	if err := rows.MapScan(status); err != nil {
+		return sql.NullInt64{}, fmt.Errorf("error MapScan: %w", err)
+	}
+	for _, col := range []string{"Seconds_Behind_Master", "Seconds_Behind_Source"} {
+		v, ok := status[col]
+		if !ok {
+			continue
+		}
+		if v == nil {
+			return sql.NullInt64{}, nil
+		}
+		b, ok := v.([]byte)
+		if !ok {
+			return sql.NullInt64{}, fmt.Errorf("unexpected %s: %v", col, v)
+		}
+		n, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			return sql.NullInt64{}, fmt.Errorf("error parse %s: %w", col, err)
+		}
+		return sql.NullInt64{Int64: n, Valid: true}, nil
+	}
+	return sql.NullInt64{}, fmt.Errorf("replication lag column is not found")
+}
@@ -0,0 +1,334 @@
+package isuports
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/logica0419/helpisu"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ログインAPIでJWTに署名する秘密鍵
+// 環境変数 ISUCON_JWT_SIGNING_KEY_FILE にPEMファイルのパスを設定すると /api/auth/login が使えるようになる
+// 対応する公開鍵は ISUCON_JWT_KEY_FILE に、拡張子を除いて同じファイル名で置くこと(ファイル名がkidになる)
+func jwtSigningKeyFile() string {
+	return getEnv("ISUCON_JWT_SIGNING_KEY_FILE", "")
+}
+
+// ログインAPIで発行するセッションの有効期間(秒)
+func sessionTTLSeconds() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_SESSION_TTL_SECONDS", "86400"), 10, 64)
+	if err != nil || n <= 0 {
+		return 86400
+	}
+	return n
+}
+
+var jwtSigningKeyCache = helpisu.NewCache[bool, jwk.Key]()
+
+// JWTに署名する秘密鍵を返す
+func retrieveJWTSigningKey() (jwk.Key, error) {
+	if key, ok := jwtSigningKeyCache.Get(true); ok {
+		return key, nil
+	}
+	p := jwtSigningKeyFile()
+	keysrc, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", p, err)
+	}
+	raw, _, err := jwk.DecodePEM(keysrc)
+	if err != nil {
+		return nil, fmt.Errorf("error jwk.DecodePEM: keyFilename=%s: %w", p, err)
+	}
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error jwk.FromRaw: keyFilename=%s: %w", p, err)
+	}
+	if err := key.Set(jwk.KeyIDKey, strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))); err != nil {
+		return nil, fmt.Errorf("error set kid: %w", err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("error PublicKey: %w", err)
+	}
+	alg, err := jwtAlgorithmForKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("error jwtAlgorithmForKey: keyFilename=%s: %w", p, err)
+	}
+	if err := key.Set(jwk.AlgorithmKey, alg); err != nil {
+		return nil, fmt.Errorf("error set alg: %w", err)
+	}
+	jwtSigningKeyCache.Set(true, key)
+	return key, nil
+}
+
+type CredentialRow struct {
+	TenantID     int64  `db:"tenant_id"`
+	LoginID      string `db:"login_id"`
+	Role         string `db:"role"`
+	PasswordHash string `db:"password_hash"`
+	CreatedAt    int64  `db:"created_at"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+// パスワードを保存する
+// 参加者の場合はlogin_idに参加者IDを使う
+func saveCredential(ctx context.Context, tenantID int64, loginID, role, password string) error {
+	if password == "" {
+		return apperr.InvalidField("password", "password required")
+	}
+	// テナント管理者と参加者で同じlogin_idは使えない
+	var current string
+	if err := adminDB.GetContext(
+		ctx,
+		&current,
+		"SELECT role FROM credential WHERE tenant_id = ? AND login_id = ?",
+		tenantID, loginID,
+	); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error Select credential: tenantID=%d, loginID=%s, %w", tenantID, loginID, err)
+	}
+	if current != "" && current != role {
+		return apperr.Conflict("login_id %s is already used by %s", loginID, current).WithCode(ErrLoginIDDuplicate.Code)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error bcrypt.GenerateFromPassword: %w", err)
+	}
+	now := time.Now().Unix()
+	if _, err := adminDB.ExecContext(
+		ctx,
+		"INSERT INTO credential (tenant_id, login_id, role, password_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE password_hash = VALUES(password_hash), updated_at = VALUES(updated_at)",
+		tenantID, loginID, role, string(hash), now, now,
+	); err != nil {
+		return fmt.Errorf("error Insert credential: tenantID=%d, loginID=%s, %w", tenantID, loginID, err)
+	}
+	return nil
+}
+
+// ログアウトしたセッションのjtiをキャッシュする
+// 無効になったセッションが有効に戻ることはないので、無効だった場合だけキャッシュする
+// 有効だった場合もキャッシュすると、他のプロセスでログアウトしたセッションを使い続けられてしまう
+var revokedSessionCache = helpisu.NewCache[string, bool]()
+
+// ログアウト済みのセッションか
+func isSessionRevoked(ctx context.Context, jti string) (bool, error) {
+	if _, ok := revokedSessionCache.Get(jti); ok {
+		return true, nil
+	}
+	var n int64
+	if err := adminDB.GetContext(ctx, &n, "SELECT COUNT(*) FROM revoked_session WHERE jti = ?", jti); err != nil {
+		return false, fmt.Errorf("error Select revoked_session: jti=%s, %w", jti, err)
+	}
+	if n > 0 {
+		revokedSessionCache.Set(jti, true)
+	}
+	return n > 0, nil
+}
+
+type LoginHandlerResult struct {
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// 共通API
+// POST /api/auth/login
+// フォームのlogin_idとpasswordで認証し、署名したJWTをisuports_sessionクッキーに設定する
+// 参加者はlogin_idに参加者IDを使う
+func loginHandler(c echo.Context) error {
+	if jwtSigningKeyFile() == "" {
+		return ErrLoginDisabled
+	}
+	ctx := context.Background()
+
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTenantNotFound
+		}
+		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	if tenant.Name == "admin" {
+		return apperr.NotFound("%s has not this API", tenant.Name).WithCode(ErrAPINotAvailable.Code)
+	}
+	if tenant.IsSuspended() {
+		return ErrTenantSuspended
+	}
+
+	loginID := c.FormValue("login_id")
+	password := c.FormValue("password")
+	if loginID == "" {
+		return apperr.InvalidField("login_id", "login_id required")
+	}
+	var cred CredentialRow
+	if err := adminDB.GetContext(
+		ctx,
+		&cred,
+		"SELECT * FROM credential WHERE tenant_id = ? AND login_id = ?",
+		tenant.ID, loginID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCredentials
+		}
+		return fmt.Errorf("error Select credential: tenantID=%d, loginID=%s, %w", tenant.ID, loginID, err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	// 失格や削除済みの参加者は他のAPIと同じように弾く
+	if cred.Role == RolePlayer {
+		tenantDB, err := connectToTenantDB(tenant.ID)
+		if err != nil {
+			return err
+		}
+		if err := authorizePlayer(ctx, tenantDB, cred.LoginID); err != nil {
+			return err
+		}
+	}
+
+	key, err := retrieveJWTSigningKey()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error rand.Read: %w", err)
+	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(sessionTTLSeconds()) * time.Second)
+	token, err := jwt.NewBuilder().
+		Subject(cred.LoginID).
+		Audience([]string{tenant.Name}).
+		JwtID(hex.EncodeToString(b)).
+		IssuedAt(now).
+		Expiration(expiresAt).
+		Claim("role", cred.Role).
+		Build()
+	if err != nil {
+		return fmt.Errorf("error jwt.Build: %w", err)
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(key.Algorithm(), key))
+	if err != nil {
+		return fmt.Errorf("error jwt.Sign: %w", err)
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     cookieName,
+		Value:    string(signed),
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	res := LoginHandlerResult{
+		Role:      cred.Role,
+		ExpiresAt: expiresAt.Unix(),
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 共通API
+// POST /api/auth/logout
+// isuports_sessionクッキーを消し、ログインAPIで発行したセッションを無効にする
+func logoutHandler(c echo.Context) error {
+	ctx := context.Background()
+	cookie, err := c.Request().Cookie(cookieName)
+	if err == nil {
+		// 無効なトークンでもクッキーは消す
+		if token, err := parseJWT(cookie.Value); err == nil && token.JwtID() != "" {
+			if _, err := adminDB.ExecContext(
+				ctx,
+				"INSERT IGNORE INTO revoked_session (jti, expires_at) VALUES (?, ?)",
+				token.JwtID(), token.Expiration().Unix(),
+			); err != nil {
+				return fmt.Errorf("error Insert revoked_session: jti=%s, %w", token.JwtID(), err)
+			}
+			revokedSessionCache.Set(token.JwtID(), true)
+		}
+		jwtTokenCache.Delete(cookie.Value)
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     cookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/credential
+// 参加者がログインAPIで使うパスワードを設定する
+func playerCredentialHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+	playerID := c.Param("player_id")
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPlayerNotFound
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	if p.DeletedAt.Valid {
+		return ErrPlayerNotFound
+	}
+	if err := saveCredential(ctx, v.tenantID, p.ID, RolePlayer, c.FormValue("password")); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// SasS管理者用API
+// POST /api/admin/tenant/:tenant_id/organizer_credential
+// テナント管理者がログインAPIで使うlogin_idとパスワードを設定する
+func organizerCredentialHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+	loginID := c.FormValue("login_id")
+	if loginID == "" {
+		return apperr.InvalidField("login_id", "login_id required")
+	}
+	if err := saveCredential(ctx, tenantID, loginID, RoleOrganizer, c.FormValue("password")); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
@@ -3,28 +3,37 @@ package isuports
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
+	"time"
 
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
 	"github.com/logica0419/helpisu"
 )
 
 type BillingReport struct {
 	CompetitionID     string `json:"competition_id"`
 	CompetitionTitle  string `json:"competition_title"`
+	FinishedAt        *int64 `json:"finished_at"`         // 大会の終了日時 開催中ならnull
 	PlayerCount       int64  `json:"player_count"`        // スコアを登録した参加者数
 	VisitorCount      int64  `json:"visitor_count"`       // ランキングを閲覧だけした(スコアを登録していない)参加者数
 	BillingPlayerYen  int64  `json:"billing_player_yen"`  // 請求金額 スコアを登録した参加者分
 	BillingVisitorYen int64  `json:"billing_visitor_yen"` // 請求金額 ランキングを閲覧だけした(スコアを登録していない)参加者分
-	BillingYen        int64  `json:"billing_yen"`         // 合計請求金額
+	Plan              string `json:"plan"`                // 適用したプラン BillingTier*
+	DiscountYen       int64  `json:"discount_yen"`        // プランによる値引き
+	BillingYen        int64  `json:"billing_yen"`         // 合計請求金額 値引き後
 }
 
+// jsonのタグは閲覧履歴のジャーナル(visit_history_journal.go)の書式
 type VisitHistoryRow struct {
-	PlayerID      string `db:"player_id"`
-	TenantID      int64  `db:"tenant_id"`
-	CompetitionID string `db:"competition_id"`
-	CreatedAt     int64  `db:"created_at"`
-	UpdatedAt     int64  `db:"updated_at"`
+	PlayerID      string `db:"player_id" json:"player_id"`
+	TenantID      int64  `db:"tenant_id" json:"tenant_id"`
+	CompetitionID string `db:"competition_id" json:"competition_id"`
+	CreatedAt     int64  `db:"created_at" json:"created_at"`
+	UpdatedAt     int64  `db:"updated_at" json:"updated_at"`
 }
 
 type VisitHistorySummaryRow struct {
@@ -39,9 +48,122 @@ var scoredPlayerCache = helpisu.NewCache[int64, []ScoredPlayer]()
 
 var billingReportCache = helpisu.NewCache[string, BillingReport]()
 
-// 大会ごとの課金レポートを計算する
+const (
+	defaultBillingPlayerYen  = 100 // スコアを登録した参加者1人あたりの請求金額
+	defaultBillingVisitorYen = 10  // ランキングを閲覧だけした参加者1人あたりの請求金額
+)
+
+// テナントの課金プラン
+const (
+	BillingTierFree       = "free"       // 大会ごとの請求金額がfreeTierThresholdYen未満なら請求しない
+	BillingTierStandard   = "standard"   // 単価どおりに請求する
+	BillingTierEnterprise = "enterprise" // 大会ごとの請求金額が大きいほど値引きする
+)
+
+// 無料プランで請求しない大会ごとの請求金額の上限 この金額以上なら全額を請求する
+const freeTierThresholdYen = 10000
+
+// エンタープライズプランの値引き率
+// 大会ごとの請求金額のうち、overYenを超えた部分をpercentだけ値引きする
+var enterpriseVolumeDiscounts = []struct {
+	overYen int64
+	percent int64
+}{
+	{overYen: 100000, percent: 10},
+	{overYen: 1000000, percent: 20},
+}
+
+// 値引き前の請求金額に対するプランの値引き額を返す
+func billingTierDiscount(tier string, yen int64) int64 {
+	switch tier {
+	case BillingTierFree:
+		if yen < freeTierThresholdYen {
+			return yen
+		}
+	case BillingTierEnterprise:
+		var discount int64
+		for i, d := range enterpriseVolumeDiscounts {
+			if yen <= d.overYen {
+				break
+			}
+			upper := yen
+			if i+1 < len(enterpriseVolumeDiscounts) && enterpriseVolumeDiscounts[i+1].overYen < upper {
+				upper = enterpriseVolumeDiscounts[i+1].overYen
+			}
+			discount += (upper - d.overYen) * d.percent / 100
+		}
+		return discount
+	}
+	return 0
+}
+
+type BillingPlanRow struct {
+	TenantID   int64  `db:"tenant_id"`
+	PlayerYen  int64  `db:"player_yen"`
+	VisitorYen int64  `db:"visitor_yen"`
+	Tier       string `db:"tier"`
+	CreatedAt  int64  `db:"created_at"`
+	UpdatedAt  int64  `db:"updated_at"`
+}
+
+var billingPlanCache = helpisu.NewCache[int64, BillingPlanRow]()
+
+// テナントの課金単価を取得する
+// billing_planに行がないテナントはデフォルトの単価
+func retrieveBillingPlan(ctx context.Context, tenantID int64) (*BillingPlanRow, error) {
+	if plan, ok := billingPlanCache.Get(tenantID); ok {
+		return &plan, nil
+	}
+
+	plan, err := selectBillingPlan(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	billingPlanCache.Set(tenantID, *plan)
+	return plan, nil
+}
+
+// キャッシュを使わずにbilling_planから課金単価を読む
+func selectBillingPlan(ctx context.Context, tenantID int64) (*BillingPlanRow, error) {
+	var plan BillingPlanRow
+	if err := adminDB.GetContext(ctx, &plan, "SELECT * FROM billing_plan WHERE tenant_id = ?", tenantID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("error Select billing_plan: tenantID=%d, %w", tenantID, err)
+		}
+		plan = BillingPlanRow{
+			TenantID:   tenantID,
+			PlayerYen:  defaultBillingPlayerYen,
+			VisitorYen: defaultBillingVisitorYen,
+			Tier:       BillingTierStandard,
+		}
+	}
+	return &plan, nil
+}
+
+// 終了した大会の課金レポート
+// 大会の終了時に計算して保存し、課金レポートのAPIはこれを読むだけにする
+// 請求金額が変わる操作(単価の変更、異議申し立てによるスコアの訂正、参加者の統合)では行を消し、次に読んだときに計算し直す
+type BillingReportRow struct {
+	TenantID          int64  `db:"tenant_id"`
+	CompetitionID     string `db:"competition_id"`
+	FinishedAt        int64  `db:"finished_at"`
+	PlayerCount       int64  `db:"player_count"`
+	VisitorCount      int64  `db:"visitor_count"`
+	BillingPlayerYen  int64  `db:"billing_player_yen"`
+	BillingVisitorYen int64  `db:"billing_visitor_yen"`
+	Plan              string `db:"plan"`
+	DiscountYen       int64  `db:"discount_yen"`
+	BillingYen        int64  `db:"billing_yen"`
+	CreatedAt         int64  `db:"created_at"`
+	UpdatedAt         int64  `db:"updated_at"`
+}
+
+// 大会ごとの課金レポートを返す
+// 開催中の大会は請求金額が確定していないので0
+// 終了した大会はbilling_reportから読み、行がなければ計算して保存する
 func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) (*BillingReport, error) {
 	billingReport, ok := billingReportCache.Get(strconv.Itoa(int(tenantID)) + competitionID)
+	billingReportCacheStats.record(ok)
 	if ok {
 		return &billingReport, nil
 	}
@@ -51,8 +173,212 @@ func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID i
 		return nil, fmt.Errorf("error retrieveCompetition: %w", err)
 	}
 
+	billingReport = BillingReport{
+		CompetitionID:    comp.ID,
+		CompetitionTitle: comp.Title,
+	}
+	if !comp.FinishedAt.Valid {
+		plan, err := retrieveBillingPlan(ctx, tenantID)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieveBillingPlan: %w", err)
+		}
+		billingReport.Plan = plan.Tier
+	} else {
+		var row BillingReportRow
+		err := adminDB.GetContext(
+			ctx,
+			&row,
+			"SELECT * FROM billing_report WHERE tenant_id = ? AND competition_id = ?",
+			tenantID, comp.ID,
+		)
+		switch {
+		case err == nil:
+			finishedAt := row.FinishedAt
+			billingReport.FinishedAt = &finishedAt
+			billingReport.PlayerCount = row.PlayerCount
+			billingReport.VisitorCount = row.VisitorCount
+			billingReport.BillingPlayerYen = row.BillingPlayerYen
+			billingReport.BillingVisitorYen = row.BillingVisitorYen
+			billingReport.Plan = row.Plan
+			billingReport.DiscountYen = row.DiscountYen
+			billingReport.BillingYen = row.BillingYen
+		case errors.Is(err, sql.ErrNoRows):
+			r, err := saveBillingReport(ctx, tenantDB, tenantID, comp)
+			if err != nil {
+				return nil, err
+			}
+			billingReport = *r
+		default:
+			return nil, fmt.Errorf("error Select billing_report: tenantID=%d, competitionID=%s, %w", tenantID, comp.ID, err)
+		}
+	}
+
+	billingReportCache.Set(strconv.Itoa(int(tenantID))+competitionID, billingReport)
+
+	return &billingReport, nil
+}
+
+// 終了した大会の課金レポートを計算してbilling_reportに保存する
+// competitionFinishHandlerから大会の終了時に呼ぶ
+func saveBillingReport(ctx context.Context, tenantDB dbOrTx, tenantID int64, comp *CompetitionRow) (*BillingReport, error) {
+	r, err := calculateBillingReport(ctx, tenantDB, tenantID, comp)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeBillingReport(ctx, tenantID, comp, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 課金レポートをbilling_reportに書き込み、キャッシュにも載せる
+func storeBillingReport(ctx context.Context, tenantID int64, comp *CompetitionRow, r *BillingReport) error {
+	now := time.Now().Unix()
+	if _, err := adminDB.NamedExecContext(
+		ctx,
+		"INSERT INTO billing_report (tenant_id, competition_id, finished_at, player_count, visitor_count, billing_player_yen, billing_visitor_yen, plan, discount_yen, billing_yen, created_at, updated_at) "+
+			"VALUES (:tenant_id, :competition_id, :finished_at, :player_count, :visitor_count, :billing_player_yen, :billing_visitor_yen, :plan, :discount_yen, :billing_yen, :created_at, :updated_at) "+
+			"ON DUPLICATE KEY UPDATE finished_at = VALUES(finished_at), player_count = VALUES(player_count), visitor_count = VALUES(visitor_count), "+
+			"billing_player_yen = VALUES(billing_player_yen), billing_visitor_yen = VALUES(billing_visitor_yen), plan = VALUES(plan), discount_yen = VALUES(discount_yen), "+
+			"billing_yen = VALUES(billing_yen), updated_at = VALUES(updated_at)",
+		BillingReportRow{
+			TenantID:          tenantID,
+			CompetitionID:     comp.ID,
+			FinishedAt:        comp.FinishedAt.Int64,
+			PlayerCount:       r.PlayerCount,
+			VisitorCount:      r.VisitorCount,
+			BillingPlayerYen:  r.BillingPlayerYen,
+			BillingVisitorYen: r.BillingVisitorYen,
+			Plan:              r.Plan,
+			DiscountYen:       r.DiscountYen,
+			BillingYen:        r.BillingYen,
+			CreatedAt:         now,
+			UpdatedAt:         now,
+		},
+	); err != nil {
+		return fmt.Errorf("error Insert billing_report: tenantID=%d, competitionID=%s, %w", tenantID, comp.ID, err)
+	}
+	billingReportCache.Set(strconv.Itoa(int(tenantID))+comp.ID, *r)
+	return nil
+}
+
+// スコアの訂正や削除でスコアだけが変わったときに、保存した課金レポートの参加者数を計算し直す
+// 閲覧履歴は保持期間を過ぎると削除する(visit_history_purge.go)ので、閲覧者数は保存した値より少なくしない
+// billing_reportの行がない大会は、次に読んだときに計算するので何もしない
+// player_scoreを読むので、呼び出し元でテナントのロックを取得しておくこと
+func recalculateBillingReportPlayers(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) error {
+	billingReportCache.Delete(strconv.FormatInt(tenantID, 10) + competitionID)
+	var row BillingReportRow
+	if err := adminDB.GetContext(
+		ctx,
+		&row,
+		"SELECT * FROM billing_report WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, competitionID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("error Select billing_report: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	plan, err := retrieveBillingPlan(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveBillingPlan: %w", err)
+	}
+
+	vhs := []VisitHistorySummaryRow{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&vhs,
+		"SELECT player_id, MIN(created_at) AS min_created_at, competition_id FROM visit_history WHERE tenant_id = ? AND competition_id = ? GROUP BY player_id, competition_id",
+		tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	scoredPlayers := []ScoredPlayer{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&scoredPlayers,
+		"SELECT DISTINCT(player_id) AS pid, competition_id FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+
+	r := newBillingReport(comp, plan, vhs, scoredPlayers)
+	if r.VisitorCount < row.VisitorCount {
+		r.VisitorCount = row.VisitorCount
+		applyBillingPlan(r, plan)
+	}
+	return storeBillingReport(ctx, tenantID, comp, r)
+}
+
+// 保存した課金レポートを捨てる 次に読んだときに計算し直す
+func invalidateBillingReports(ctx context.Context, tenantID int64, competitionIDs []string) error {
+	if len(competitionIDs) == 0 {
+		return nil
+	}
+	for _, id := range competitionIDs {
+		billingReportCache.Delete(strconv.FormatInt(tenantID, 10) + id)
+	}
+	query, args, err := sqlx.In("DELETE FROM billing_report WHERE tenant_id = ? AND competition_id IN (?)", tenantID, competitionIDs)
+	if err != nil {
+		return fmt.Errorf("error sqlx.In: %w", err)
+	}
+	if _, err := adminDB.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("error Delete billing_report: tenantID=%d, %w", tenantID, err)
+	}
+	return nil
+}
+
+// 課金レポートの計算に使うデータが変わったときに、テナントと大会ごとに呼ぶ
+// スコアのアップロードと閲覧履歴の書き込みの後に呼ぶ
+// 保存した課金レポート(billing_report)は終了した大会のものなので捨てない 遅れて書き込んだ閲覧履歴はresaveBillingReportForLateVisitsで反映する
+func invalidateBillingInputs(tenantID int64, competitionID string) {
+	vhsCache.Delete(tenantID)
+	scoredPlayerCache.Delete(tenantID)
+	billingReportCache.Delete(strconv.FormatInt(tenantID, 10) + competitionID)
+}
+
+// 終了した大会の終了日時以前の閲覧履歴を大会の終了後に書き込んだ場合、保存した課金レポートを計算し直す
+// 他のプロセスやジャーナルに溜まっていた閲覧履歴は、大会の終了(finishCompetition)での書き込みに間に合わないことがある
+// earliestは書き込んだ閲覧履歴のうち最も古い閲覧日時 delayedInsertVisitHistoryから呼ぶ
+func resaveBillingReportForLateVisits(ctx context.Context, tenantID int64, competitionID string, earliest int64) {
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		log.Printf("error connectToTenantDB: tenantID=%d, %s", tenantID, err)
+		return
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("error retrieveCompetition: tenantID=%d, competitionID=%s, %s", tenantID, competitionID, err)
+		}
+		return
+	}
+	if !comp.FinishedAt.Valid || earliest > comp.FinishedAt.Int64 {
+		return
+	}
+	if _, err := saveBillingReport(ctx, tenantDB, tenantID, comp); err != nil {
+		log.Printf("error saveBillingReport: tenantID=%d, competitionID=%s, %s", tenantID, competitionID, err)
+	}
+}
+
+// 大会の課金レポートを計算する
+func calculateBillingReport(ctx context.Context, tenantDB dbOrTx, tenantID int64, comp *CompetitionRow) (*BillingReport, error) {
+	competitionID := comp.ID
+	plan, err := retrieveBillingPlan(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieveBillingPlan: %w", err)
+	}
+
 	// ランキングにアクセスした参加者のIDを取得する
+	// 結果はbilling_reportに保存し、vhsCacheにも載せるので、レプリカの遅れで少なく数えないようにプライマリから読む
 	vhs, ok := vhsCache.Get(tenantID)
+	vhsCacheStats.record(ok)
 	if !ok {
 		if err := adminDB.SelectContext(
 			ctx,
@@ -63,24 +389,12 @@ func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID i
 			return nil, fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", tenantID, comp.ID, err)
 		}
 	}
-	billingMap := map[string]string{}
-	for i := range vhs {
-		if vhs[i].CompetitionID != comp.ID {
-			continue
-		}
-
-		// competition.finished_atよりもあとの場合は、終了後に訪問したとみなして大会開催内アクセス済みとみなさない
-		if comp.FinishedAt.Valid && comp.FinishedAt.Int64 < vhs[i].MinCreatedAt {
-			continue
-		}
-		billingMap[vhs[i].PlayerID] = "visitor"
-	}
 	vhsCache.Set(tenantID, vhs)
 
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(tenantID)
+	fl, err := rlockByTenantID(ctx, tenantID)
 	if err != nil {
-		return nil, fmt.Errorf("error flockByTenantID: %w", err)
+		return nil, fmt.Errorf("error rlockByTenantID: %w", err)
 	}
 	defer fl.Close()
 
@@ -96,6 +410,25 @@ func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID i
 			return nil, fmt.Errorf("error Select count player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
 		}
 	}
+
+	return newBillingReport(comp, plan, vhs, scoredPlayers), nil
+}
+
+// 閲覧履歴とスコアを登録した参加者から大会の課金レポートを組み立てる
+// vhs, scoredPlayersはテナント全体のもので、compの大会の行だけを数える
+func newBillingReport(comp *CompetitionRow, plan *BillingPlanRow, vhs []VisitHistorySummaryRow, scoredPlayers []ScoredPlayer) *BillingReport {
+	billingMap := map[string]string{}
+	for i := range vhs {
+		if vhs[i].CompetitionID != comp.ID {
+			continue
+		}
+
+		// competition.finished_atよりもあとの場合は、終了後に訪問したとみなして大会開催内アクセス済みとみなさない
+		if comp.FinishedAt.Valid && comp.FinishedAt.Int64 < vhs[i].MinCreatedAt {
+			continue
+		}
+		billingMap[vhs[i].PlayerID] = "visitor"
+	}
 	for i := range scoredPlayers {
 		if scoredPlayers[i].CompetitionID != comp.ID {
 			continue
@@ -118,17 +451,171 @@ func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID i
 		}
 	}
 
-	billingReport = BillingReport{
-		CompetitionID:     comp.ID,
-		CompetitionTitle:  comp.Title,
-		PlayerCount:       playerCount,
-		VisitorCount:      visitorCount,
-		BillingPlayerYen:  100 * playerCount, // スコアを登録した参加者は100円
-		BillingVisitorYen: 10 * visitorCount, // ランキングを閲覧だけした(スコアを登録していない)参加者は10円
-		BillingYen:        100*playerCount + 10*visitorCount,
+	billingReport := BillingReport{
+		CompetitionID:    comp.ID,
+		CompetitionTitle: comp.Title,
+		PlayerCount:      playerCount,
+		VisitorCount:     visitorCount,
 	}
+	applyBillingPlan(&billingReport, plan)
 
-	billingReportCache.Set(strconv.Itoa(int(tenantID))+competitionID, billingReport)
+	if comp.FinishedAt.Valid {
+		finishedAt := comp.FinishedAt.Int64
+		billingReport.FinishedAt = &finishedAt
+	}
+	return &billingReport
+}
 
-	return &billingReport, nil
+// 参加者数と閲覧者数からプランの請求金額を計算する
+func applyBillingPlan(r *BillingReport, plan *BillingPlanRow) {
+	r.BillingPlayerYen = plan.PlayerYen * r.PlayerCount    // スコアを登録した参加者 デフォルトは100円
+	r.BillingVisitorYen = plan.VisitorYen * r.VisitorCount // ランキングを閲覧だけした(スコアを登録していない)参加者 デフォルトは10円
+	r.Plan = plan.Tier
+	// プランの値引きは大会ごとの請求金額に対して適用する
+	gross := r.BillingPlayerYen + r.BillingVisitorYen
+	r.DiscountYen = billingTierDiscount(plan.Tier, gross)
+	r.BillingYen = gross - r.DiscountYen
+}
+
+// 課金レポートで返す項目
+// クエリパラメータ fields で指定する
+const (
+	BillingFieldsAll    = "all"    // 全て
+	BillingFieldsCounts = "counts" // 参加者数だけ
+	BillingFieldsYen    = "yen"    // 請求金額だけ
+)
+
+// 請求金額の表記
+// クエリパラメータ locale で指定すると、数値に加えて*_formattedに整形した文字列を返す
+var billingYenFormatters = map[string]func(yen int64) string{
+	"ja-JP": func(yen int64) string { return groupDigits(yen, ",") + "円" },
+	"en-US": func(yen int64) string { return "¥" + groupDigits(yen, ",") },
+	"de-DE": func(yen int64) string { return groupDigits(yen, ".") + " ¥" },
+	"fr-FR": func(yen int64) string { return groupDigits(yen, " ") + " ¥" },
+}
+
+// 3桁ごとに区切る
+func groupDigits(n int64, sep string) string {
+	s := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	head := len(s) % 3
+	if head == 0 {
+		head = 3
+	}
+	out := s[:head]
+	for i := head; i < len(s); i += 3 {
+		out += sep + s[i:i+3]
+	}
+	return sign + out
+}
+
+type BillingReportOptions struct {
+	Fields string
+	Locale string
+}
+
+// クエリパラメータから課金レポートの出力方法を読む
+func parseBillingReportOptions(fields, locale string) (BillingReportOptions, error) {
+	opts := BillingReportOptions{Fields: BillingFieldsAll, Locale: locale}
+	switch fields {
+	case "":
+	case BillingFieldsAll, BillingFieldsCounts, BillingFieldsYen:
+		opts.Fields = fields
+	default:
+		return opts, apperr.InvalidField("fields", "fields must be one of all, counts, yen")
+	}
+	if locale != "" {
+		if _, ok := billingYenFormatters[locale]; !ok {
+			return opts, apperr.InvalidField("locale", "unsupported locale: %s", locale)
+		}
+	}
+	return opts, nil
+}
+
+// 課金レポートに含める大会の終了日時(finished_at)の範囲(unix秒)
+// Fromを含みToを含まない 0なら制限しない
+// どちらかを指定した場合は開催中の大会を含めない
+type BillingPeriod struct {
+	From int64
+	To   int64
+}
+
+// クエリパラメータfrom, toから課金レポートに含める期間を読む
+func parseBillingPeriod(from, to string) (BillingPeriod, error) {
+	var p BillingPeriod
+	var err error
+	if from != "" {
+		if p.From, err = strconv.ParseInt(from, 10, 64); err != nil || p.From < 0 {
+			return p, apperr.InvalidField("from", "from must be a non-negative integer (unix seconds)")
+		}
+	}
+	if to != "" {
+		if p.To, err = strconv.ParseInt(to, 10, 64); err != nil || p.To < 0 {
+			return p, apperr.InvalidField("to", "to must be a non-negative integer (unix seconds)")
+		}
+	}
+	if p.From != 0 && p.To != 0 && p.From >= p.To {
+		return p, apperr.InvalidField("to", "to must be greater than from")
+	}
+	return p, nil
+}
+
+// competitionテーブルを絞り込むWHERE句の条件 先頭にANDを付けて返す
+func (p BillingPeriod) condition() (string, []any) {
+	cond, args := "", []any{}
+	if p.From != 0 {
+		cond += " AND finished_at >= ?"
+		args = append(args, p.From)
+	}
+	if p.To != 0 {
+		cond += " AND finished_at < ?"
+		args = append(args, p.To)
+	}
+	return cond, args
+}
+
+// 出力方法に合わせた課金レポート
+// 選ばなかった項目は出力しない
+type BillingReportDetail struct {
+	CompetitionID              string `json:"competition_id"`
+	CompetitionTitle           string `json:"competition_title"`
+	FinishedAt                 *int64 `json:"finished_at"`
+	Plan                       string `json:"plan"`
+	PlayerCount                *int64 `json:"player_count,omitempty"`
+	VisitorCount               *int64 `json:"visitor_count,omitempty"`
+	BillingPlayerYen           *int64 `json:"billing_player_yen,omitempty"`
+	BillingVisitorYen          *int64 `json:"billing_visitor_yen,omitempty"`
+	DiscountYen                *int64 `json:"discount_yen,omitempty"`
+	BillingYen                 *int64 `json:"billing_yen,omitempty"`
+	BillingPlayerYenFormatted  string `json:"billing_player_yen_formatted,omitempty"`
+	BillingVisitorYenFormatted string `json:"billing_visitor_yen_formatted,omitempty"`
+	BillingYenFormatted        string `json:"billing_yen_formatted,omitempty"`
+}
+
+func (r *BillingReport) Detail(opts BillingReportOptions) BillingReportDetail {
+	d := BillingReportDetail{
+		CompetitionID:    r.CompetitionID,
+		CompetitionTitle: r.CompetitionTitle,
+		FinishedAt:       r.FinishedAt,
+		Plan:             r.Plan,
+	}
+	if opts.Fields != BillingFieldsYen {
+		d.PlayerCount = &r.PlayerCount
+		d.VisitorCount = &r.VisitorCount
+	}
+	if opts.Fields != BillingFieldsCounts {
+		d.BillingPlayerYen = &r.BillingPlayerYen
+		d.BillingVisitorYen = &r.BillingVisitorYen
+		d.DiscountYen = &r.DiscountYen
+		d.BillingYen = &r.BillingYen
+		if format, ok := billingYenFormatters[opts.Locale]; ok {
+			d.BillingPlayerYenFormatted = format(r.BillingPlayerYen)
+			d.BillingVisitorYenFormatted = format(r.BillingVisitorYen)
+			d.BillingYenFormatted = format(r.BillingYen)
+		}
+	}
+	return d
 }
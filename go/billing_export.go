@@ -0,0 +1,137 @@
+package isuports
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 課金レポートを会計ソフトに取り込むためのCSVのエクスポート
+// JSONのAPIと同じ関数で集計し、集計した行から順にレスポンスに書き出す
+// 書き出し始めた後にエラーになった場合はステータスコードを変えられないので、途中で切れたCSVになる
+// (エラーはRequestLoggerのログに残る)
+
+// テナント管理者向けAPI
+// GET /api/organizer/billing/export
+// テナント内の課金レポートをCSVで取得する
+// URL引数fields, locale, from, toはGET /api/organizer/billingと同じ 選ばなかった項目の列は出力しない
+func billingExportHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+	opts, err := parseBillingReportOptions(c.QueryParam("fields"), c.QueryParam("locale"))
+	if err != nil {
+		return err
+	}
+	period, err := parseBillingPeriod(c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return err
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+	reports, err := tenantBillingReports(ctx, tenantDB, v.tenantID, period)
+	if err != nil {
+		return err
+	}
+
+	header := []string{"competition_id", "competition_title", "finished_at", "plan"}
+	if opts.Fields != BillingFieldsYen {
+		header = append(header, "player_count", "visitor_count")
+	}
+	_, formatted := billingYenFormatters[opts.Locale]
+	if opts.Fields != BillingFieldsCounts {
+		header = append(header, "billing_player_yen", "billing_visitor_yen", "discount_yen", "billing_yen")
+		if formatted {
+			header = append(header, "billing_player_yen_formatted", "billing_visitor_yen_formatted", "billing_yen_formatted")
+		}
+	}
+
+	w := startCSVResponse(c, fmt.Sprintf("billing_%s.csv", v.tenantName))
+	w.Write(header)
+	for _, report := range reports {
+		d := report.Detail(opts)
+		row := []string{d.CompetitionID, d.CompetitionTitle, formatCSVInt(d.FinishedAt), d.Plan}
+		if opts.Fields != BillingFieldsYen {
+			row = append(row, formatCSVInt(d.PlayerCount), formatCSVInt(d.VisitorCount))
+		}
+		if opts.Fields != BillingFieldsCounts {
+			row = append(row, formatCSVInt(d.BillingPlayerYen), formatCSVInt(d.BillingVisitorYen), formatCSVInt(d.DiscountYen), formatCSVInt(d.BillingYen))
+			if formatted {
+				row = append(row, d.BillingPlayerYenFormatted, d.BillingVisitorYenFormatted, d.BillingYenFormatted)
+			}
+		}
+		w.Write(row)
+	}
+	return flushCSVResponse(c, w)
+}
+
+// SaaS管理者用API
+// GET /api/admin/tenants/billing/export
+// テナントごとの課金レポートをテナントのid降順でCSVで取得する
+// JSONのAPIと違ってlimitはなく全てのテナントを返す URL引数before, from, toはJSONのAPIと同じ
+func tenantsBillingExportHandler(c echo.Context) error {
+	beforeID, period, err := parseTenantsBillingRequest(c)
+	if err != nil {
+		return err
+	}
+
+	// 1件目の集計が終わるまではエラーをJSONで返せるようにレスポンスを書き始めない
+	var w *csv.Writer
+	start := func() {
+		w = startCSVResponse(c, fmt.Sprintf("tenants_billing_%s.csv", time.Now().Format("20060102")))
+		w.Write([]string{"tenant_id", "tenant_name", "tenant_display_name", "plan", "billing_yen"})
+	}
+	if _, err := eachTenantBilling(context.Background(), beforeID, 0, period, func(tb TenantWithBilling) error {
+		if w == nil {
+			start()
+		}
+		w.Write([]string{tb.ID, tb.Name, tb.DisplayName, tb.Plan, strconv.FormatInt(tb.BillingYen, 10)})
+		return flushCSVResponse(c, w)
+	}); err != nil {
+		return err
+	}
+	if w == nil {
+		start()
+	}
+	return flushCSVResponse(c, w)
+}
+
+// CSVのレスポンスを書き始める
+func startCSVResponse(c echo.Context, filename string) *csv.Writer {
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	h.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().WriteHeader(http.StatusOK)
+	return csv.NewWriter(c.Response())
+}
+
+// 書いた行をクライアントに送る
+func flushCSVResponse(c echo.Context, w *csv.Writer) error {
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("error csv.Writer: %w", err)
+	}
+	c.Response().Flush()
+	return nil
+}
+
+// nilなら空文字列
+func formatCSVInt(n *int64) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.FormatInt(*n, 10)
+}
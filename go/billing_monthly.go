@@ -0,0 +1,105 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// 月次の請求で使うタイムゾーン 日本時間の暦月で締める
+var billingLocation = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+type TenantMonthlyBillingHandlerResult struct {
+	TenantID          string          `json:"tenant_id"`
+	Year              int             `json:"year"`
+	Month             int             `json:"month"`
+	Plan              string          `json:"plan"` // 現在のプラン 大会ごとに適用したプランはreportsのplan
+	From              int64           `json:"from"` // 集計期間の開始(unix秒) この時刻を含む
+	To                int64           `json:"to"`   // 集計期間の終了(unix秒) この時刻を含まない
+	PlayerCount       int64           `json:"player_count"`
+	VisitorCount      int64           `json:"visitor_count"`
+	BillingPlayerYen  int64           `json:"billing_player_yen"`
+	BillingVisitorYen int64           `json:"billing_visitor_yen"`
+	DiscountYen       int64           `json:"discount_yen"`
+	BillingYen        int64           `json:"billing_yen"`
+	Reports           []BillingReport `json:"reports"` // 集計した大会 終了日時の昇順
+}
+
+// SasS管理者用API
+// GET /api/admin/tenants/:tenant_id/billing/monthly?year=&month=
+// テナントの課金を、大会の終了日時(finished_at)が日本時間で指定した月に含まれる大会について合計する
+// 開催中の大会は含めない
+func tenantMonthlyBillingHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	year, err := strconv.Atoi(c.QueryParam("year"))
+	if err != nil || year < 1970 || year > 9999 {
+		return apperr.InvalidField("year", "year must be an integer between 1970 and 9999")
+	}
+	month, err := strconv.Atoi(c.QueryParam("month"))
+	if err != nil || month < 1 || month > 12 {
+		return apperr.InvalidField("month", "month must be an integer between 1 and 12")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: id=%d, %w", tenantID, err)
+	}
+
+	plan, err := retrieveBillingPlan(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveBillingPlan: %w", err)
+	}
+
+	start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, billingLocation)
+	res := TenantMonthlyBillingHandlerResult{
+		TenantID: strconv.FormatInt(tenantID, 10),
+		Year:     year,
+		Month:    month,
+		Plan:     plan.Tier,
+		From:     start.Unix(),
+		To:       start.AddDate(0, 1, 0).Unix(),
+		Reports:  []BillingReport{},
+	}
+
+	cond, args := BillingPeriod{From: res.From, To: res.To}.condition()
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id = ?"+cond+" ORDER BY finished_at ASC",
+		append([]any{tenantID}, args...)...,
+	); err != nil {
+		return fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	for _, comp := range cs {
+		report, err := billingReportByCompetition(ctx, tenantDB, tenantID, comp.ID)
+		if err != nil {
+			return fmt.Errorf("error billingReportByCompetition: %w", err)
+		}
+		res.PlayerCount += report.PlayerCount
+		res.VisitorCount += report.VisitorCount
+		res.BillingPlayerYen += report.BillingPlayerYen
+		res.BillingVisitorYen += report.BillingVisitorYen
+		res.DiscountYen += report.DiscountYen
+		res.BillingYen += report.BillingYen
+		res.Reports = append(res.Reports, *report)
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,270 @@
+package isuports
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// 大会の終了時に確定した請求の記録
+// 一度作ったら更新しない 後から異議申し立てがあったときに、どのデータから請求金額を計算したかを確かめるためのもの
+type BillingReceiptRow struct {
+	TenantID      int64  `db:"tenant_id"`
+	CompetitionID string `db:"competition_id"`
+	FinishedAt    int64  `db:"finished_at"`
+	PlayerCount   int64  `db:"player_count"`
+	VisitorCount  int64  `db:"visitor_count"`
+	PlayerYen     int64  `db:"player_yen"`  // スコアを登録した参加者1人あたりの単価
+	VisitorYen    int64  `db:"visitor_yen"` // ランキングを閲覧だけした参加者1人あたりの単価
+	BillingYen    int64  `db:"billing_yen"`
+	ScoresHash    string `db:"scores_hash"` // player_scoreの行のSHA-256
+	VisitsHash    string `db:"visits_hash"` // 終了までに閲覧した参加者と初回の閲覧日時のSHA-256
+	InputHash     string `db:"input_hash"`  // スコア、閲覧、単価、終了日時をまとめたSHA-256
+	CreatedAt     int64  `db:"created_at"`
+}
+
+// 請求の計算に使ったデータのハッシュと参加者数
+type billingReceiptInputs struct {
+	PlayerCount  int64
+	VisitorCount int64
+	ScoresHash   string
+	VisitsHash   string
+}
+
+// 請求の計算に使うデータを読んでハッシュを計算する
+// 行の順番でハッシュが変わらないように、IDの順に並べてからハッシュにする
+func readBillingReceiptInputs(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, finishedAt int64) (*billingReceiptInputs, error) {
+	visits := []VisitHistorySummaryRow{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&visits,
+		"SELECT player_id, MIN(created_at) AS min_created_at FROM visit_history WHERE tenant_id = ? AND competition_id = ? GROUP BY player_id ORDER BY player_id",
+		tenantID, competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := rlockByTenantID(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	defer fl.Close()
+	scores := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&scores,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY id",
+		tenantID, competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+
+	in := &billingReceiptInputs{}
+	scored := map[string]bool{}
+	h := sha256.New()
+	for _, ps := range scores {
+		fmt.Fprintf(h, "%s\t%s\t%d\t%d\n", ps.ID, ps.PlayerID, ps.Score, ps.RowNum)
+		if !scored[ps.PlayerID] {
+			scored[ps.PlayerID] = true
+			in.PlayerCount++
+		}
+	}
+	in.ScoresHash = hex.EncodeToString(h.Sum(nil))
+
+	h = sha256.New()
+	for _, vh := range visits {
+		// 終了後に閲覧した参加者は請求しない billingReportByCompetition と同じ
+		if finishedAt < vh.MinCreatedAt {
+			continue
+		}
+		fmt.Fprintf(h, "%s\t%d\n", vh.PlayerID, vh.MinCreatedAt)
+		if !scored[vh.PlayerID] {
+			in.VisitorCount++
+		}
+	}
+	in.VisitsHash = hex.EncodeToString(h.Sum(nil))
+	return in, nil
+}
+
+func billingReceiptInputHash(finishedAt, playerYen, visitorYen int64, scoresHash, visitsHash string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "finished_at:%d\nplayer_yen:%d\nvisitor_yen:%d\nscores:%s\nvisits:%s\n",
+		finishedAt, playerYen, visitorYen, scoresHash, visitsHash,
+	)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 終了した大会の請求を確定して記録する
+// 既に記録がある場合は上書きしない
+func createBillingReceipt(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, finishedAt int64) error {
+	plan, err := retrieveBillingPlan(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveBillingPlan: %w", err)
+	}
+	in, err := readBillingReceiptInputs(ctx, tenantDB, tenantID, competitionID, finishedAt)
+	if err != nil {
+		return err
+	}
+	r := BillingReceiptRow{
+		TenantID:      tenantID,
+		CompetitionID: competitionID,
+		FinishedAt:    finishedAt,
+		PlayerCount:   in.PlayerCount,
+		VisitorCount:  in.VisitorCount,
+		PlayerYen:     plan.PlayerYen,
+		VisitorYen:    plan.VisitorYen,
+		BillingYen:    plan.PlayerYen*in.PlayerCount + plan.VisitorYen*in.VisitorCount,
+		ScoresHash:    in.ScoresHash,
+		VisitsHash:    in.VisitsHash,
+		InputHash:     billingReceiptInputHash(finishedAt, plan.PlayerYen, plan.VisitorYen, in.ScoresHash, in.VisitsHash),
+		CreatedAt:     time.Now().Unix(),
+	}
+	if _, err := adminDB.NamedExecContext(
+		ctx,
+		"INSERT IGNORE INTO billing_receipt (tenant_id, competition_id, finished_at, player_count, visitor_count, player_yen, visitor_yen, billing_yen, scores_hash, visits_hash, input_hash, created_at) "+
+			"VALUES (:tenant_id, :competition_id, :finished_at, :player_count, :visitor_count, :player_yen, :visitor_yen, :billing_yen, :scores_hash, :visits_hash, :input_hash, :created_at)",
+		r,
+	); err != nil {
+		return fmt.Errorf("error Insert billing_receipt: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	return nil
+}
+
+type BillingReceiptDetail struct {
+	TenantID      string `json:"tenant_id"`
+	CompetitionID string `json:"competition_id"`
+	FinishedAt    int64  `json:"finished_at"`
+	PlayerCount   int64  `json:"player_count"`
+	VisitorCount  int64  `json:"visitor_count"`
+	PlayerYen     int64  `json:"player_yen"`
+	VisitorYen    int64  `json:"visitor_yen"`
+	BillingYen    int64  `json:"billing_yen"`
+	ScoresHash    string `json:"scores_hash"`
+	VisitsHash    string `json:"visits_hash"`
+	InputHash     string `json:"input_hash"`
+	CreatedAt     int64  `json:"created_at"`
+	// 現在のデータから計算し直したハッシュ 記録と異なる場合は確定後にデータが変わっている
+	CurrentScoresHash string `json:"current_scores_hash"`
+	CurrentVisitsHash string `json:"current_visits_hash"`
+	CurrentInputHash  string `json:"current_input_hash"`
+	Verified          bool   `json:"verified"` // 現在のデータが記録と一致する場合はtrue
+}
+
+type BillingReceiptHandlerResult struct {
+	Receipt BillingReceiptDetail `json:"receipt"`
+}
+
+// 請求の記録を読み、現在のデータと照合する
+// 単価は記録したものを使うので、確定後に単価を変えても照合には影響しない
+func verifyBillingReceipt(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) (*BillingReceiptDetail, error) {
+	var r BillingReceiptRow
+	if err := adminDB.GetContext(
+		ctx,
+		&r,
+		"SELECT * FROM billing_receipt WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, competitionID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrBillingReceiptNotFound
+		}
+		return nil, fmt.Errorf("error Select billing_receipt: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	in, err := readBillingReceiptInputs(ctx, tenantDB, tenantID, competitionID, r.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	current := billingReceiptInputHash(r.FinishedAt, r.PlayerYen, r.VisitorYen, in.ScoresHash, in.VisitsHash)
+	return &BillingReceiptDetail{
+		TenantID:          strconv.FormatInt(r.TenantID, 10),
+		CompetitionID:     r.CompetitionID,
+		FinishedAt:        r.FinishedAt,
+		PlayerCount:       r.PlayerCount,
+		VisitorCount:      r.VisitorCount,
+		PlayerYen:         r.PlayerYen,
+		VisitorYen:        r.VisitorYen,
+		BillingYen:        r.BillingYen,
+		ScoresHash:        r.ScoresHash,
+		VisitsHash:        r.VisitsHash,
+		InputHash:         r.InputHash,
+		CreatedAt:         r.CreatedAt,
+		CurrentScoresHash: in.ScoresHash,
+		CurrentVisitsHash: in.VisitsHash,
+		CurrentInputHash:  current,
+		Verified:          current == r.InputHash,
+	}, nil
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/billing_receipt
+// 大会の終了時に確定した請求の記録を返す
+func competitionBillingReceiptHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	d, err := verifyBillingReceipt(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: BillingReceiptHandlerResult{Receipt: *d}})
+}
+
+// SasS管理者用API
+// GET /api/admin/tenant/:tenant_id/competition/:competition_id/billing_receipt
+// 大会の終了時に確定した請求の記録を返す
+func adminBillingReceiptHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: id=%d, %w", tenantID, err)
+	}
+
+	d, err := verifyBillingReceipt(ctx, tenantDB, tenantID, c.Param("competition_id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: BillingReceiptHandlerResult{Receipt: *d}})
+}
@@ -0,0 +1,187 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// 課金レポートの突き合わせ
+// 障害の後などにキャッシュ(billingReportCache, vhsCache, scoredPlayerCache)や保存した課金レポート(billing_report)が
+// 正しいかを確かめるため、生のplayer_scoreとvisit_historyから計算し直して比較する
+// 計算し直した結果はキャッシュにもbilling_reportにも書かない
+
+// 課金レポートの項目の食い違い
+type BillingRecomputeDiff struct {
+	Source     string `json:"source"` // 比較した相手 "cache" または "persisted"
+	Field      string `json:"field"`
+	Recomputed any    `json:"recomputed"`
+	Actual     any    `json:"actual"`
+}
+
+type BillingRecomputeCompetition struct {
+	CompetitionID    string                 `json:"competition_id"`
+	CompetitionTitle string                 `json:"competition_title"`
+	Recomputed       BillingReport          `json:"recomputed"`
+	Cached           *BillingReport         `json:"cached"`    // billingReportCacheになければnull
+	Persisted        *BillingReport         `json:"persisted"` // billing_reportになければnull 開催中の大会は常にnull
+	Diffs            []BillingRecomputeDiff `json:"diffs"`
+}
+
+type BillingRecomputeHandlerResult struct {
+	TenantID     string                        `json:"tenant_id"`
+	Mismatched   int64                         `json:"mismatched"` // 食い違いがあった大会の数
+	Competitions []BillingRecomputeCompetition `json:"competitions"`
+}
+
+// SasS管理者用API
+// GET /api/admin/tenant/:tenant_id/billing/recompute
+// テナントの全ての大会の課金レポートをキャッシュを使わずに計算し直し、キャッシュとbilling_reportとの差分を返す
+func billingRecomputeHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: id=%d, %w", tenantID, err)
+	}
+
+	plan, err := selectBillingPlan(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	vhs := []VisitHistorySummaryRow{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&vhs,
+		"SELECT player_id, MIN(created_at) AS min_created_at, competition_id FROM visit_history WHERE tenant_id = ? GROUP BY player_id, competition_id",
+		tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select visit_history: tenantID=%d, %w", tenantID, err)
+	}
+
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := rlockByTenantID(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(ctx, &cs, "SELECT * FROM competition WHERE tenant_id = ? ORDER BY created_at ASC", tenantID); err != nil {
+		return fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	scoredPlayers := []ScoredPlayer{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&scoredPlayers,
+		"SELECT DISTINCT(player_id) AS pid, competition_id FROM player_score WHERE tenant_id = ?",
+		tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, %w", tenantID, err)
+	}
+
+	res := BillingRecomputeHandlerResult{
+		TenantID:     strconv.FormatInt(tenantID, 10),
+		Competitions: make([]BillingRecomputeCompetition, 0, len(cs)),
+	}
+	for i := range cs {
+		comp := &cs[i]
+		rc := BillingRecomputeCompetition{
+			CompetitionID:    comp.ID,
+			CompetitionTitle: comp.Title,
+			Recomputed:       *newBillingReport(comp, plan, vhs, scoredPlayers),
+			Diffs:            []BillingRecomputeDiff{},
+		}
+		if cached, ok := billingReportCache.Get(strconv.FormatInt(tenantID, 10) + comp.ID); ok {
+			rc.Cached = &cached
+			rc.Diffs = append(rc.Diffs, diffBillingReports("cache", &rc.Recomputed, rc.Cached)...)
+		}
+		if comp.FinishedAt.Valid {
+			persisted, err := selectPersistedBillingReport(ctx, tenantID, comp)
+			if err != nil {
+				return err
+			}
+			if persisted != nil {
+				rc.Persisted = persisted
+				rc.Diffs = append(rc.Diffs, diffBillingReports("persisted", &rc.Recomputed, rc.Persisted)...)
+			}
+		}
+		if len(rc.Diffs) > 0 {
+			res.Mismatched++
+		}
+		res.Competitions = append(res.Competitions, rc)
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// billing_reportに保存した課金レポートを読む 行がなければnil
+func selectPersistedBillingReport(ctx context.Context, tenantID int64, comp *CompetitionRow) (*BillingReport, error) {
+	var row BillingReportRow
+	if err := adminDB.GetContext(
+		ctx,
+		&row,
+		"SELECT * FROM billing_report WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, comp.ID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Select billing_report: tenantID=%d, competitionID=%s, %w", tenantID, comp.ID, err)
+	}
+	finishedAt := row.FinishedAt
+	return &BillingReport{
+		CompetitionID:     comp.ID,
+		CompetitionTitle:  comp.Title,
+		FinishedAt:        &finishedAt,
+		PlayerCount:       row.PlayerCount,
+		VisitorCount:      row.VisitorCount,
+		BillingPlayerYen:  row.BillingPlayerYen,
+		BillingVisitorYen: row.BillingVisitorYen,
+		Plan:              row.Plan,
+		DiscountYen:       row.DiscountYen,
+		BillingYen:        row.BillingYen,
+	}, nil
+}
+
+// 計算し直した課金レポートと比べて値が違う項目を返す
+func diffBillingReports(source string, recomputed, actual *BillingReport) []BillingRecomputeDiff {
+	diffs := []BillingRecomputeDiff{}
+	add := func(field string, r, a any) {
+		if r != a {
+			diffs = append(diffs, BillingRecomputeDiff{Source: source, Field: field, Recomputed: r, Actual: a})
+		}
+	}
+	var recomputedFinishedAt, actualFinishedAt int64
+	if recomputed.FinishedAt != nil {
+		recomputedFinishedAt = *recomputed.FinishedAt
+	}
+	if actual.FinishedAt != nil {
+		actualFinishedAt = *actual.FinishedAt
+	}
+	add("finished_at", recomputedFinishedAt, actualFinishedAt)
+	add("player_count", recomputed.PlayerCount, actual.PlayerCount)
+	add("visitor_count", recomputed.VisitorCount, actual.VisitorCount)
+	add("billing_player_yen", recomputed.BillingPlayerYen, actual.BillingPlayerYen)
+	add("billing_visitor_yen", recomputed.BillingVisitorYen, actual.BillingVisitorYen)
+	add("plan", recomputed.Plan, actual.Plan)
+	add("discount_yen", recomputed.DiscountYen, actual.DiscountYen)
+	add("billing_yen", recomputed.BillingYen, actual.BillingYen)
+	return diffs
+}
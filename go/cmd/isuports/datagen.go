@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/datagen"
+)
+
+// isuports datagen [flags]
+// ベンチマーク用のデータを生成する
+func datagenMain(args []string) {
+	cfg := datagen.DefaultConfig()
+	fs := flag.NewFlagSet("datagen", flag.ExitOnError)
+	fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed")
+	fs.IntVar(&cfg.Tenants, "tenants", cfg.Tenants, "number of tenants")
+	fs.Int64Var(&cfg.FirstTenantID, "first-tenant-id", cfg.FirstTenantID, "id of the first tenant")
+	fs.IntVar(&cfg.PlayersPerTenant, "players", cfg.PlayersPerTenant, "players per tenant")
+	fs.IntVar(&cfg.CompetitionsPerTenant, "competitions", cfg.CompetitionsPerTenant, "competitions per tenant")
+	fs.Float64Var(&cfg.DisqualifiedRate, "disqualified-rate", cfg.DisqualifiedRate, "rate of disqualified players")
+	fs.Float64Var(&cfg.FinishedRate, "finished-rate", cfg.FinishedRate, "rate of finished competitions")
+	fs.Float64Var(&cfg.ScoreRate, "score-rate", cfg.ScoreRate, "rate of players who have a score in each competition")
+	fs.IntVar(&cfg.RowsPerPlayer, "rows-per-player", cfg.RowsPerPlayer, "CSV rows per player in each competition")
+	fs.StringVar(&cfg.ScoreDistribution, "score-distribution", cfg.ScoreDistribution, "uniform, normal or exponential")
+	fs.Int64Var(&cfg.MaxScore, "max-score", cfg.MaxScore, "max score")
+	fs.Float64Var(&cfg.VisitRate, "visit-rate", cfg.VisitRate, "rate of players who view the ranking of each competition")
+	fs.IntVar(&cfg.VisitsPerVisitor, "visits-per-visitor", cfg.VisitsPerVisitor, "max visits per visitor")
+	fs.Int64Var(&cfg.BaseTime, "base-time", cfg.BaseTime, "start time of the first competition (unix seconds)")
+	fs.Int64Var(&cfg.CompetitionInterval, "competition-interval", cfg.CompetitionInterval, "interval between competitions (seconds)")
+	fs.Int64Var(&cfg.CompetitionDuration, "competition-duration", cfg.CompetitionDuration, "duration of competitions (seconds)")
+	fs.StringVar(&cfg.TenantDBSchemaFile, "schema", cfg.TenantDBSchemaFile, "tenant DB schema file")
+	fs.StringVar(&cfg.OutDir, "out", cfg.OutDir, "output directory")
+	fs.Parse(args)
+
+	if err := datagen.Generate(context.Background(), cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "datagen: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,9 +1,27 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	isuports "github.com/isucon/isucon12-qualify/webapp/go"
 )
 
+// isuports [-config path]
+// 設定ファイルを指定しない場合は環境変数 ISUCON_CONFIG_FILE を使う
 func main() {
-	isuports.Run()
+	if len(os.Args) > 1 && os.Args[1] == "datagen" {
+		datagenMain(os.Args[2:])
+		return
+	}
+	configPath := flag.String("config", os.Getenv("ISUCON_CONFIG_FILE"), "config file (YAML)")
+	flag.Parse()
+
+	cfg, err := isuports.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "isuports: %s\n", err)
+		os.Exit(1)
+	}
+	isuports.Run(cfg)
 }
@@ -0,0 +1,201 @@
+package isuports
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// サーバーの設定
+// DefaultConfigの値に設定ファイル(YAML)の値を上書きし、さらに環境変数があればそれで上書きする
+// 同じホストで複数のインスタンスを動かす場合は、インスタンスごとに設定ファイルを用意して -config で渡す
+type Config struct {
+	Server   ServerConfig   `yaml:"server" json:"server"`
+	AdminDB  DBConfig       `yaml:"admin_db" json:"admin_db"`
+	Hostname HostnameConfig `yaml:"hostname" json:"hostname"`
+	TLS      TLSConfig      `yaml:"tls" json:"tls"`
+	Cache    CacheConfig    `yaml:"cache" json:"cache"`
+	// 上記以外の設定 キーは環境変数の名前(ISUCON_TENANT_DB_WAL など)で、値は環境変数と同じ書式
+	// 環境変数が設定されている場合は環境変数を使う
+	Env map[string]string `yaml:"env" json:"env,omitempty"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port" json:"port"` // SERVER_APP_PORT
+}
+
+type DBConfig struct {
+	Host              string `yaml:"host" json:"host"`                                   // ISUCON_DB_HOST
+	Port              string `yaml:"port" json:"port"`                                   // ISUCON_DB_PORT
+	User              string `yaml:"user" json:"user"`                                   // ISUCON_DB_USER
+	Password          string `yaml:"password" json:"password"`                           // ISUCON_DB_PASSWORD
+	Name              string `yaml:"name" json:"name"`                                   // ISUCON_DB_NAME
+	MaxOpenConns      int    `yaml:"max_open_conns" json:"max_open_conns"`               // ISUCON_DB_MAX_OPEN_CONNS
+	MaxIdleConns      int    `yaml:"max_idle_conns" json:"max_idle_conns"`               // ISUCON_DB_MAX_IDLE_CONNS
+	ConnMaxLifetimeMs int    `yaml:"conn_max_lifetime_ms" json:"conn_max_lifetime_ms"`   // ISUCON_DB_CONN_MAX_LIFETIME_MS 0なら制限しない
+	ConnMaxIdleTimeMs int    `yaml:"conn_max_idle_time_ms" json:"conn_max_idle_time_ms"` // ISUCON_DB_CONN_MAX_IDLE_TIME_MS 0なら制限しない
+	// 読み込みだけを送るリードレプリカの ホスト:ポート ユーザー、パスワード、データベース名はプライマリと同じ
+	// admin_db_replica.go を参照
+	Replicas []string `yaml:"replicas" json:"replicas"` // ISUCON_DB_REPLICAS カンマ区切り
+}
+
+type HostnameConfig struct {
+	Base  string `yaml:"base" json:"base"`   // ISUCON_BASE_HOSTNAME テナント名の後ろに付くドメイン
+	Admin string `yaml:"admin" json:"admin"` // ISUCON_ADMIN_HOSTNAME
+}
+
+// HTTPSで直接受け付ける設定 tls.go を参照
+// cert_fileとkey_fileを指定するか、autocertを有効にするとHTTPSになる
+type TLSConfig struct {
+	CertFile         string `yaml:"cert_file" json:"cert_file"`                   // ISUCON_TLS_CERT_FILE
+	KeyFile          string `yaml:"key_file" json:"key_file"`                     // ISUCON_TLS_KEY_FILE
+	Autocert         bool   `yaml:"autocert" json:"autocert"`                     // ISUCON_TLS_AUTOCERT Let's Encryptから証明書を取得する
+	AutocertCacheDir string `yaml:"autocert_cache_dir" json:"autocert_cache_dir"` // ISUCON_TLS_AUTOCERT_CACHE_DIR 取得した証明書を保存するディレクトリ
+	AutocertEmail    string `yaml:"autocert_email" json:"autocert_email"`         // ISUCON_TLS_AUTOCERT_EMAIL
+	HTTPPort         string `yaml:"http_port" json:"http_port"`                   // ISUCON_TLS_HTTP_PORT HTTPSへリダイレクトするポート 空ならlistenしない
+}
+
+// プロセスのメモリ上のキャッシュの上限 lru_cache.go を参照
+type CacheConfig struct {
+	Player   CacheLimitConfig `yaml:"player" json:"player"`       // ISUCON_CACHE_PLAYER_*
+	JWTToken CacheLimitConfig `yaml:"jwt_token" json:"jwt_token"` // ISUCON_CACHE_JWT_TOKEN_*
+}
+
+type CacheLimitConfig struct {
+	TTLMs      int `yaml:"ttl_ms" json:"ttl_ms"`           // *_TTL_MS 0なら期限なし
+	MaxEntries int `yaml:"max_entries" json:"max_entries"` // *_MAX_ENTRIES 0なら制限しない
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: "3000",
+		},
+		AdminDB: DBConfig{
+			Host:         "127.0.0.1",
+			Port:         "3306",
+			User:         "isucon",
+			Password:     "isucon",
+			Name:         "isuports",
+			MaxOpenConns: 10,
+			MaxIdleConns: 1024,
+		},
+		Hostname: HostnameConfig{
+			Base:  ".t.isucon.dev",
+			Admin: "admin.t.isucon.dev",
+		},
+		TLS: TLSConfig{
+			AutocertCacheDir: "../autocert",
+		},
+		Cache: CacheConfig{
+			Player:   CacheLimitConfig{TTLMs: 60000, MaxEntries: 100000},
+			JWTToken: CacheLimitConfig{TTLMs: 300000, MaxEntries: 100000},
+		},
+		Env: map[string]string{},
+	}
+}
+
+// 設定を読み込む pathが空の場合は設定ファイルを読まない
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error os.ReadFile: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		// 書き間違えた設定が黙って無視されないようにする
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("error decode config %s: %w", path, err)
+		}
+		if cfg.Env == nil {
+			cfg.Env = map[string]string{}
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 環境変数で上書きする
+func (cfg *Config) applyEnv() error {
+	strs := []struct {
+		key string
+		p   *string
+	}{
+		{"SERVER_APP_PORT", &cfg.Server.Port},
+		{"ISUCON_DB_HOST", &cfg.AdminDB.Host},
+		{"ISUCON_DB_PORT", &cfg.AdminDB.Port},
+		{"ISUCON_DB_USER", &cfg.AdminDB.User},
+		{"ISUCON_DB_PASSWORD", &cfg.AdminDB.Password},
+		{"ISUCON_DB_NAME", &cfg.AdminDB.Name},
+		{"ISUCON_BASE_HOSTNAME", &cfg.Hostname.Base},
+		{"ISUCON_ADMIN_HOSTNAME", &cfg.Hostname.Admin},
+		{"ISUCON_TLS_CERT_FILE", &cfg.TLS.CertFile},
+		{"ISUCON_TLS_KEY_FILE", &cfg.TLS.KeyFile},
+		{"ISUCON_TLS_AUTOCERT_CACHE_DIR", &cfg.TLS.AutocertCacheDir},
+		{"ISUCON_TLS_AUTOCERT_EMAIL", &cfg.TLS.AutocertEmail},
+		{"ISUCON_TLS_HTTP_PORT", &cfg.TLS.HTTPPort},
+	}
+	for _, s := range strs {
+		if v, ok := os.LookupEnv(s.key); ok {
+			*s.p = v
+		}
+	}
+	ints := []struct {
+		key string
+		p   *int
+	}{
+		{"ISUCON_DB_MAX_OPEN_CONNS", &cfg.AdminDB.MaxOpenConns},
+		{"ISUCON_DB_MAX_IDLE_CONNS", &cfg.AdminDB.MaxIdleConns},
+		{"ISUCON_DB_CONN_MAX_LIFETIME_MS", &cfg.AdminDB.ConnMaxLifetimeMs},
+		{"ISUCON_DB_CONN_MAX_IDLE_TIME_MS", &cfg.AdminDB.ConnMaxIdleTimeMs},
+		{"ISUCON_CACHE_PLAYER_TTL_MS", &cfg.Cache.Player.TTLMs},
+		{"ISUCON_CACHE_PLAYER_MAX_ENTRIES", &cfg.Cache.Player.MaxEntries},
+		{"ISUCON_CACHE_JWT_TOKEN_TTL_MS", &cfg.Cache.JWTToken.TTLMs},
+		{"ISUCON_CACHE_JWT_TOKEN_MAX_ENTRIES", &cfg.Cache.JWTToken.MaxEntries},
+	}
+	for _, i := range ints {
+		v, ok := os.LookupEnv(i.key)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", i.key, v)
+		}
+		*i.p = n
+	}
+	if v, ok := os.LookupEnv("ISUCON_DB_REPLICAS"); ok {
+		cfg.AdminDB.Replicas = nil
+		for _, r := range strings.Split(v, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				cfg.AdminDB.Replicas = append(cfg.AdminDB.Replicas, r)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON_TLS_AUTOCERT"); ok {
+		cfg.TLS.Autocert = v == "1"
+	}
+	return nil
+}
+
+// 実行中のサーバーの設定
+// Runより前に読まれる場合に備えて、環境変数だけを反映した設定で初期化しておく
+var appConfig = defaultConfigFromEnv()
+
+func defaultConfigFromEnv() *Config {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		log.Printf("error LoadConfig: %s", err)
+		return DefaultConfig()
+	}
+	return cfg
+}
@@ -0,0 +1,70 @@
+package isuports
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	csrfCookieName = "isuports_csrf"
+	csrfFormName   = "csrf_token"
+)
+
+// クッキー認証のPOSTをCSRFトークンで保護するか
+// 環境変数 ISUCON_CSRF_PROTECTION=1 で有効になる
+// 有効な場合、/api/ へのGETで isuports_csrf クッキーにトークンを発行し、
+// /api/admin/, /api/organizer/, /api/player/ へのPOSTでは同じ値を X-CSRF-Token ヘッダか csrf_token フォームで送る必要がある
+func csrfProtectionEnabled() bool {
+	return getEnv("ISUCON_CSRF_PROTECTION", "0") == "1"
+}
+
+// CSRFトークンの検証を行わないルート
+// クッキーを使わずに認証するAPIを追加したときはここにc.Path()の形で登録する
+var csrfExemptPaths = map[string]bool{}
+
+// CSRFトークンの発行と検証を行うか
+// セッションのクッキーを持たないリクエストと、Authorizationヘッダで認証するリクエストはブラウザから偽造されないので検証しない
+func csrfSkipper(c echo.Context) bool {
+	if !csrfProtectionEnabled() {
+		return true
+	}
+	req := c.Request()
+	if !strings.HasPrefix(req.URL.Path, "/api/") {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		// トークンの発行だけ行う
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, "/api/admin/") &&
+		!strings.HasPrefix(req.URL.Path, "/api/organizer/") &&
+		!strings.HasPrefix(req.URL.Path, "/api/player/") {
+		return true
+	}
+	if csrfExemptPaths[c.Path()] {
+		return true
+	}
+	if req.Header.Get(echo.HeaderAuthorization) != "" {
+		return true
+	}
+	if _, err := req.Cookie(cookieName); err != nil {
+		return true
+	}
+	return false
+}
+
+// 二重送信クッキー方式でCSRFを防ぐ
+// フロントエンドのJavaScriptから読めるように、トークンのクッキーはHttpOnlyにしない
+func CSRFProtection() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        csrfSkipper,
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken + ",form:" + csrfFormName,
+		CookieName:     csrfCookieName,
+		CookiePath:     "/",
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+}
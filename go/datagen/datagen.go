@@ -0,0 +1,400 @@
+// Package datagen はベンチマーク用のデータを生成する
+//
+// 同じ Config からは常に同じデータが生成されるので、
+// 性能の比較を同じデータセットで行うことができる
+// テナントDB(SQLite)のファイルと、管理用DB(MySQL)に流し込むSQLファイルを出力する
+package datagen
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	ScoreDistributionUniform     = "uniform"
+	ScoreDistributionNormal      = "normal"
+	ScoreDistributionExponential = "exponential"
+
+	// テナント内のIDはテナントごとにこの個数ずつ割り当てる
+	idsPerTenant = 10_000_000
+	// アプリケーションが払い出すIDの開始値 (sql/init.sql)
+	// 生成するIDはこれ未満にしてアプリケーションが払い出すIDと衝突しないようにする
+	dispensedIDStart = 2678400000
+
+	// visit_historyのINSERTをまとめる行数
+	visitHistoryBulkSize = 1000
+)
+
+type Config struct {
+	Seed int64
+
+	Tenants       int
+	FirstTenantID int64
+
+	PlayersPerTenant      int
+	CompetitionsPerTenant int
+	DisqualifiedRate      float64 // 失格になっている参加者の割合
+	FinishedRate          float64 // 終了している大会の割合
+
+	ScoreRate         float64 // 大会ごとにスコアを登録する参加者の割合
+	RowsPerPlayer     int     // 参加者ごとのCSVの行数 最後の行が有効なスコアになる
+	ScoreDistribution string
+	MaxScore          int64
+
+	VisitRate        float64 // 大会ごとにランキングを閲覧する参加者の割合
+	VisitsPerVisitor int     // 閲覧する参加者ごとの最大閲覧回数
+
+	BaseTime            int64 // 最初の大会の開始日時(unix秒)
+	CompetitionInterval int64 // 大会の開始日時の間隔(秒)
+	CompetitionDuration int64 // 大会の開催期間(秒)
+
+	TenantDBSchemaFile string
+	OutDir             string
+}
+
+// DefaultConfig はデフォルトの設定を返す
+func DefaultConfig() Config {
+	return Config{
+		Seed:                  1,
+		Tenants:               10,
+		FirstTenantID:         1,
+		PlayersPerTenant:      300,
+		CompetitionsPerTenant: 20,
+		DisqualifiedRate:      0.05,
+		FinishedRate:          0.8,
+		ScoreRate:             0.6,
+		RowsPerPlayer:         3,
+		ScoreDistribution:     ScoreDistributionNormal,
+		MaxScore:              100000,
+		VisitRate:             0.5,
+		VisitsPerVisitor:      5,
+		BaseTime:              1654009200,
+		CompetitionInterval:   3600,
+		CompetitionDuration:   7200,
+		TenantDBSchemaFile:    "../sql/tenant/10_schema.sql",
+		OutDir:                "./datagen_out",
+	}
+}
+
+// Validate は設定が生成可能な範囲にあるか確認する
+func (c Config) Validate() error {
+	switch {
+	case c.Tenants <= 0:
+		return fmt.Errorf("tenants must be positive")
+	case c.FirstTenantID <= 0:
+		return fmt.Errorf("first tenant id must be positive")
+	case (c.FirstTenantID+int64(c.Tenants))*idsPerTenant > dispensedIDStart:
+		return fmt.Errorf("too many tenants: last tenant id must be less than %d", dispensedIDStart/idsPerTenant)
+	case c.PlayersPerTenant < 0 || c.CompetitionsPerTenant < 0 || c.RowsPerPlayer <= 0 || c.VisitsPerVisitor <= 0:
+		return fmt.Errorf("counts must not be negative")
+	case int64(c.PlayersPerTenant)+int64(c.CompetitionsPerTenant)*(1+int64(c.PlayersPerTenant)*int64(c.RowsPerPlayer)) >= idsPerTenant:
+		return fmt.Errorf("too many rows per tenant: must be less than %d", idsPerTenant)
+	case c.MaxScore <= 0:
+		return fmt.Errorf("max score must be positive")
+	}
+	for _, r := range []float64{c.DisqualifiedRate, c.FinishedRate, c.ScoreRate, c.VisitRate} {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("rates must be between 0 and 1")
+		}
+	}
+	switch c.ScoreDistribution {
+	case ScoreDistributionUniform, ScoreDistributionNormal, ScoreDistributionExponential:
+	default:
+		return fmt.Errorf("unknown score distribution: %s", c.ScoreDistribution)
+	}
+	return nil
+}
+
+// Generate はデータを生成して OutDir に出力する
+//   OutDir/tenant_db/{tenant_id}.db: テナントDB
+//   OutDir/admin.sql: tenantとvisit_historyのINSERT文
+func Generate(ctx context.Context, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	schema, err := os.ReadFile(cfg.TenantDBSchemaFile)
+	if err != nil {
+		return fmt.Errorf("error os.ReadFile: %w", err)
+	}
+	tenantDBDir := filepath.Join(cfg.OutDir, "tenant_db")
+	if err := os.MkdirAll(tenantDBDir, 0755); err != nil {
+		return fmt.Errorf("error os.MkdirAll: %w", err)
+	}
+
+	f, err := os.Create(filepath.Join(cfg.OutDir, "admin.sql"))
+	if err != nil {
+		return fmt.Errorf("error os.Create: %w", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "-- generated by datagen: seed=%d\n", cfg.Seed)
+
+	for i := 0; i < cfg.Tenants; i++ {
+		tenantID := cfg.FirstTenantID + int64(i)
+		// テナントごとに乱数を分けて、テナント数を変えても他のテナントのデータが変わらないようにする
+		g := &generator{
+			cfg:      cfg,
+			tenantID: tenantID,
+			rand:     rand.New(rand.NewSource(cfg.Seed*1_000_003 + tenantID)),
+			nextID:   tenantID * idsPerTenant,
+		}
+		t := g.generateTenant()
+		if err := writeTenantDB(ctx, filepath.Join(tenantDBDir, fmt.Sprintf("%d.db", tenantID)), string(schema), t); err != nil {
+			return fmt.Errorf("error writeTenantDB: tenantID=%d, %w", tenantID, err)
+		}
+		writeAdminSQL(w, t)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error Flush admin.sql: %w", err)
+	}
+	return f.Close()
+}
+
+type tenant struct {
+	ID           int64
+	Name         string
+	DisplayName  string
+	CreatedAt    int64
+	Players      []player
+	Competitions []competition
+	Scores       []score
+	Visits       []visit
+}
+
+type player struct {
+	ID             string
+	DisplayName    string
+	IsDisqualified bool
+	CreatedAt      int64
+}
+
+type competition struct {
+	ID         string
+	Title      string
+	FinishedAt *int64
+	CreatedAt  int64
+	UpdatedAt  int64
+}
+
+type score struct {
+	ID            string
+	PlayerID      string
+	CompetitionID string
+	Score         int64
+	RowNum        int64
+	CreatedAt     int64
+}
+
+type visit struct {
+	PlayerID      string
+	CompetitionID string
+	CreatedAt     int64
+}
+
+type generator struct {
+	cfg      Config
+	tenantID int64
+	rand     *rand.Rand
+	nextID   int64
+}
+
+// アプリケーションと同じ16進数の形式でIDを払い出す
+func (g *generator) dispenseID() string {
+	id := g.nextID
+	g.nextID++
+	return fmt.Sprintf("%x", id)
+}
+
+func (g *generator) generateTenant() *tenant {
+	cfg := g.cfg
+	t := &tenant{
+		ID:          g.tenantID,
+		Name:        fmt.Sprintf("bench-%d", g.tenantID),
+		DisplayName: fmt.Sprintf("ベンチマークテナント%d", g.tenantID),
+		CreatedAt:   cfg.BaseTime - 86400,
+	}
+
+	t.Players = make([]player, 0, cfg.PlayersPerTenant)
+	for i := 0; i < cfg.PlayersPerTenant; i++ {
+		t.Players = append(t.Players, player{
+			ID:             g.dispenseID(),
+			DisplayName:    fmt.Sprintf("参加者%d", i+1),
+			IsDisqualified: g.rand.Float64() < cfg.DisqualifiedRate,
+			CreatedAt:      t.CreatedAt + int64(i),
+		})
+	}
+
+	for i := 0; i < cfg.CompetitionsPerTenant; i++ {
+		createdAt := cfg.BaseTime + int64(i)*cfg.CompetitionInterval
+		c := competition{
+			ID:        g.dispenseID(),
+			Title:     fmt.Sprintf("大会%d", i+1),
+			CreatedAt: createdAt,
+			UpdatedAt: createdAt,
+		}
+		if g.rand.Float64() < cfg.FinishedRate {
+			finishedAt := createdAt + cfg.CompetitionDuration
+			c.FinishedAt = &finishedAt
+			c.UpdatedAt = finishedAt
+		}
+		t.Competitions = append(t.Competitions, c)
+
+		scored := map[string]struct{}{}
+		rows := []score{}
+		for _, p := range t.Players {
+			if g.rand.Float64() >= cfg.ScoreRate {
+				continue
+			}
+			scored[p.ID] = struct{}{}
+			for r := 0; r < cfg.RowsPerPlayer; r++ {
+				rows = append(rows, score{
+					PlayerID:      p.ID,
+					CompetitionID: c.ID,
+					Score:         g.score(),
+				})
+			}
+		}
+		// CSVの行の並びはシャッフルする
+		g.rand.Shuffle(len(rows), func(a, b int) { rows[a], rows[b] = rows[b], rows[a] })
+		uploadedAt := createdAt + cfg.CompetitionDuration/2
+		for j := range rows {
+			rows[j].ID = g.dispenseID()
+			rows[j].RowNum = int64(j + 1)
+			rows[j].CreatedAt = uploadedAt
+		}
+		t.Scores = append(t.Scores, rows...)
+
+		for _, p := range t.Players {
+			if g.rand.Float64() >= cfg.VisitRate {
+				continue
+			}
+			// スコアを登録した参加者はスコアの登録後に、それ以外は大会の開催中に閲覧する
+			from := createdAt
+			if _, ok := scored[p.ID]; ok {
+				from = uploadedAt
+			}
+			n := 1 + g.rand.Intn(cfg.VisitsPerVisitor)
+			for k := 0; k < n; k++ {
+				t.Visits = append(t.Visits, visit{
+					PlayerID:      p.ID,
+					CompetitionID: c.ID,
+					CreatedAt:     from + g.rand.Int63n(createdAt+cfg.CompetitionDuration-from+1),
+				})
+			}
+		}
+	}
+	sort.SliceStable(t.Visits, func(a, b int) bool { return t.Visits[a].CreatedAt < t.Visits[b].CreatedAt })
+	return t
+}
+
+// 設定した分布に従ってスコアを生成する
+func (g *generator) score() int64 {
+	max := float64(g.cfg.MaxScore)
+	var v float64
+	switch g.cfg.ScoreDistribution {
+	case ScoreDistributionNormal:
+		v = max/2 + g.rand.NormFloat64()*max/6
+	case ScoreDistributionExponential:
+		v = g.rand.ExpFloat64() * max / 5
+	default:
+		v = g.rand.Float64() * max
+	}
+	return int64(math.Max(0, math.Min(max, math.Round(v))))
+}
+
+func writeTenantDB(ctx context.Context, path, schema string, t *tenant) error {
+	for _, f := range []string{path, path + "-wal", path + "-shm", path + "-journal"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error os.Remove: %w", err)
+		}
+	}
+	db, err := sqlx.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=OFF&_synchronous=OFF", path))
+	if err != nil {
+		return fmt.Errorf("error sqlx.Open: %w", err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("error apply schema: %w", err)
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, p := range t.Players {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			p.ID, t.ID, p.DisplayName, p.IsDisqualified, p.CreatedAt, p.CreatedAt,
+		); err != nil {
+			return fmt.Errorf("error Insert player: %w", err)
+		}
+	}
+	for _, c := range t.Competitions {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO competition (id, tenant_id, title, finished_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			c.ID, t.ID, c.Title, c.FinishedAt, c.CreatedAt, c.UpdatedAt,
+		); err != nil {
+			return fmt.Errorf("error Insert competition: %w", err)
+		}
+	}
+	for _, table := range []string{"player_score", "player_score_history"} {
+		stmt, err := tx.PreparexContext(
+			ctx,
+			"INSERT INTO "+table+" (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		)
+		if err != nil {
+			return fmt.Errorf("error Prepare %s: %w", table, err)
+		}
+		for _, s := range t.Scores {
+			if _, err := stmt.ExecContext(ctx, s.ID, t.ID, s.PlayerID, s.CompetitionID, s.Score, s.RowNum, s.CreatedAt, s.CreatedAt); err != nil {
+				stmt.Close()
+				return fmt.Errorf("error Insert %s: %w", table, err)
+			}
+		}
+		stmt.Close()
+	}
+	return tx.Commit()
+}
+
+func writeAdminSQL(w *bufio.Writer, t *tenant) {
+	fmt.Fprintf(
+		w,
+		"INSERT INTO tenant (id, name, display_name, created_at, updated_at) VALUES (%d, %s, %s, %d, %d);\n",
+		t.ID, quote(t.Name), quote(t.DisplayName), t.CreatedAt, t.CreatedAt,
+	)
+	for i := 0; i < len(t.Visits); i += visitHistoryBulkSize {
+		end := i + visitHistoryBulkSize
+		if end > len(t.Visits) {
+			end = len(t.Visits)
+		}
+		w.WriteString("INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES ")
+		for j, v := range t.Visits[i:end] {
+			if j > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, "(%s, %d, %s, %d, %d)", quote(v.PlayerID), t.ID, quote(v.CompetitionID), v.CreatedAt, v.CreatedAt)
+		}
+		w.WriteString(";\n")
+	}
+}
+
+var sqlQuoteReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func quote(s string) string {
+	return "'" + sqlQuoteReplacer.Replace(s) + "'"
+}
@@ -0,0 +1,240 @@
+package isuports
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// キャッシュの統計と手動での破棄
+// 古いキャッシュを返している疑いがあるときに、どのキャッシュにどれだけ載っていて、どれだけ当たっているかを見るためのもの
+
+// キャッシュを引いた回数
+type cacheStats struct {
+	hits   int64
+	misses int64
+}
+
+func (s *cacheStats) record(ok bool) {
+	if ok {
+		atomic.AddInt64(&s.hits, 1)
+	} else {
+		atomic.AddInt64(&s.misses, 1)
+	}
+}
+
+func (s *cacheStats) reset() {
+	atomic.StoreInt64(&s.hits, 0)
+	atomic.StoreInt64(&s.misses, 0)
+}
+
+var (
+	playerCacheStats        cacheStats
+	competitionCacheStats   cacheStats
+	tenantDBCacheStats      cacheStats
+	billingReportCacheStats cacheStats
+	vhsCacheStats           cacheStats
+)
+
+// 統計を見られるキャッシュ
+type debugCache struct {
+	name  string
+	stats *cacheStats
+	// 要素数とメモリの見積もり(バイト)
+	size func() (int, int64)
+	// 全ての要素を捨て、捨てた数を返す
+	flush func(ctx context.Context) int
+}
+
+// 構造体の大きさに文字列の長さを足したものをメモリの見積もりにする
+// mapのバケットなどのオーバーヘッドは含まない
+var debugCaches = []debugCache{
+	{
+		name:  "player",
+		stats: &playerCacheStats,
+		size: func() (n int, bytes int64) {
+			playerCache.Range(func(k string, v PlayerRow) bool {
+				n++
+				bytes += int64(len(k)+len(v.ID)+len(v.DisplayName)) + int64(unsafe.Sizeof(v))
+				return true
+			})
+			return n, bytes
+		},
+		flush: func(_ context.Context) int {
+			n := playerCache.Len()
+			playerCache.Reset()
+			return n
+		},
+	},
+	{
+		name:  "competition",
+		stats: &competitionCacheStats,
+		size: func() (n int, bytes int64) {
+			cacheRange(competitionCache, func(k string, v CompetitionRow) bool {
+				n++
+				bytes += int64(len(k)+len(v.ID)+len(v.Title)+len(v.TieBreak)) + int64(unsafe.Sizeof(v))
+				return true
+			})
+			return n, bytes
+		},
+		flush: func(_ context.Context) int {
+			n := cacheLen(competitionCache)
+			competitionCache.Reset()
+			return n
+		},
+	},
+	{
+		// 接続やSQLiteのページキャッシュのメモリは含まない
+		name:  "tenant_db",
+		stats: &tenantDBCacheStats,
+		size: func() (n int, bytes int64) {
+			cacheRange(tenantDBCache, func(_ int64, _ *sqlx.DB) bool {
+				n++
+				bytes += int64(unsafe.Sizeof(sqlx.DB{}))
+				return true
+			})
+			return n, bytes
+		},
+		flush: func(_ context.Context) int {
+			// インメモリのテナントDBは閉じるとデータが消えるので閉じない tenant_db_pool.go と同じ
+			if tenantDBMemoryEnabled() {
+				return 0
+			}
+			ids := []int64{}
+			cacheRange(tenantDBCache, func(id int64, _ *sqlx.DB) bool {
+				ids = append(ids, id)
+				return true
+			})
+			for _, id := range ids {
+				evictTenantDB(id)
+			}
+			return len(ids)
+		},
+	},
+	{
+		name:  "billing_report",
+		stats: &billingReportCacheStats,
+		size: func() (n int, bytes int64) {
+			cacheRange(billingReportCache, func(k string, v BillingReport) bool {
+				n++
+				bytes += int64(len(k)+len(v.CompetitionID)+len(v.CompetitionTitle)) + int64(unsafe.Sizeof(v))
+				return true
+			})
+			return n, bytes
+		},
+		flush: func(_ context.Context) int {
+			n := cacheLen(billingReportCache)
+			billingReportCache.Reset()
+			return n
+		},
+	},
+	{
+		name:  "visit_history_summary",
+		stats: &vhsCacheStats,
+		size: func() (n int, bytes int64) {
+			cacheRange(vhsCache, func(_ int64, v []VisitHistorySummaryRow) bool {
+				n++
+				bytes += int64(unsafe.Sizeof(v))
+				for _, r := range v {
+					bytes += int64(len(r.PlayerID)+len(r.CompetitionID)) + int64(unsafe.Sizeof(r))
+				}
+				return true
+			})
+			return n, bytes
+		},
+		flush: func(_ context.Context) int {
+			n := cacheLen(vhsCache)
+			vhsCache.Reset()
+			return n
+		},
+	},
+}
+
+func findDebugCache(name string) (debugCache, bool) {
+	for _, dc := range debugCaches {
+		if dc.name == name {
+			return dc, true
+		}
+	}
+	return debugCache{}, false
+}
+
+// キャッシュの統計を全て0にする 初期化で呼ぶ
+func resetCacheStats() {
+	for _, dc := range debugCaches {
+		dc.stats.reset()
+	}
+}
+
+type DebugCacheDetail struct {
+	Name           string  `json:"name"`
+	Entries        int     `json:"entries"`
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRatio       float64 `json:"hit_ratio"` // まだ引いていなければ0
+	EstimatedBytes int64   `json:"estimated_bytes"`
+}
+
+func debugCacheDetail(dc debugCache) DebugCacheDetail {
+	d := DebugCacheDetail{
+		Name:   dc.name,
+		Hits:   atomic.LoadInt64(&dc.stats.hits),
+		Misses: atomic.LoadInt64(&dc.stats.misses),
+	}
+	d.Entries, d.EstimatedBytes = dc.size()
+	if total := d.Hits + d.Misses; total > 0 {
+		d.HitRatio = float64(d.Hits) / float64(total)
+	}
+	return d
+}
+
+type DebugCachesHandlerResult struct {
+	Caches []DebugCacheDetail `json:"caches"`
+}
+
+// SasS管理者用API
+// GET /debug/caches
+// キャッシュごとの要素数、ヒット率、メモリの見積もりを返す
+// ヒット率は起動か初期化の後に引いた分
+func debugCachesHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	res := DebugCachesHandlerResult{Caches: make([]DebugCacheDetail, 0, len(debugCaches))}
+	for _, dc := range debugCaches {
+		res.Caches = append(res.Caches, debugCacheDetail(dc))
+	}
+	sort.Slice(res.Caches, func(i, j int) bool { return res.Caches[i].Name < res.Caches[j].Name })
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type DebugCacheFlushHandlerResult struct {
+	Name    string `json:"name"`
+	Flushed int    `json:"flushed"`
+}
+
+// SasS管理者用API
+// POST /debug/caches/:name/flush
+// キャッシュの要素を全て捨てる ヒット率の統計はそのまま残す
+// tenant_dbは接続をキャッシュから外し、しばらくしてから閉じる インメモリのテナントDBの場合は何もしない
+func debugCacheFlushHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	dc, ok := findDebugCache(c.Param("name"))
+	if !ok {
+		return ErrCacheNotFound
+	}
+	res := DebugCacheFlushHandlerResult{
+		Name:    dc.name,
+		Flushed: dc.flush(c.Request().Context()),
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
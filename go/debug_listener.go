@@ -0,0 +1,46 @@
+package isuports
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// pprofとexpvar(/debug/pprof/, /debug/vars)を返すデバッグ用のlistener
+// 本番では必要なときだけ有効にできるように、ISUCON_DEBUG_LISTENER=1 のときだけ起動する
+// ISUCON_DEBUG_LISTENER_ADDR でlistenするアドレスを変更できる
+// ISUCON_DEBUG_LISTENER_TOKEN を設定した場合は、Authorization: Bearer <token> かクエリパラメータ token が一致しないと401を返す
+// go tool pprof はヘッダを付けられないので、クエリパラメータでも受け付ける
+func startDebugListener() {
+	if getEnv("ISUCON_DEBUG_LISTENER", "0") != "1" {
+		return
+	}
+	addr := getEnv("ISUCON_DEBUG_LISTENER_ADDR", ":6060")
+	var h http.Handler = http.DefaultServeMux
+	if token := getEnv("ISUCON_DEBUG_LISTENER_TOKEN", ""); token != "" {
+		h = debugTokenAuth(token, h)
+	} else {
+		log.Printf("debug listener on %s has no token, set ISUCON_DEBUG_LISTENER_TOKEN to protect it", addr)
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, h); err != nil {
+			log.Printf("error debug listener: addr=%s, %s", addr, err)
+		}
+	}()
+}
+
+func debugTokenAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,337 @@
+package isuports
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// 実行中のプロセスの設定と状態
+// ベンチマーク中や障害対応中に、環境変数やコードを読まずに実際の動作を確かめるためのもの
+
+// getEnvで読んだ環境変数と実際に使った値
+// 値を読むのは最初に使ったときなので、まだ使っていない設定は含まれない
+// getEnvはリクエストごとに呼ばれるものもあるので、ロックを取らないsync.Mapに入れる
+var envLookups sync.Map // map[string]envLookup
+
+type envLookup struct {
+	value     string
+	isDefault bool
+}
+
+func recordEnvLookup(key, value string, isDefault bool) {
+	l := envLookup{value: value, isDefault: isDefault}
+	if old, ok := envLookups.Load(key); ok && old.(envLookup) == l {
+		return
+	}
+	envLookups.Store(key, l)
+}
+
+// 値を返してはいけない環境変数
+func isSecretEnv(key string) bool {
+	for _, s := range []string{"PASSWORD", "SECRET", "TOKEN"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 起動したticker
+type tickerState struct {
+	intervalMs int
+	runs       int64
+	lastRunAt  int64 // unixナノ秒
+	lastTookNs int64
+}
+
+var (
+	tickerStates   = map[string]*tickerState{}
+	tickerStatesMu sync.Mutex
+)
+
+// helpisu.Tickerを起動して、実行した回数と時間を記録する
+// 同じ名前で起動し直した場合は記録を引き継ぐ
+func startTicker(name string, intervalMs int, f func()) *helpisu.Ticker {
+	tickerStatesMu.Lock()
+	s, ok := tickerStates[name]
+	if !ok {
+		s = &tickerState{}
+		tickerStates[name] = s
+	}
+	s.intervalMs = intervalMs
+	tickerStatesMu.Unlock()
+
+	t := helpisu.NewTicker(intervalMs, func() {
+		start := time.Now()
+		f()
+		atomic.AddInt64(&s.runs, 1)
+		atomic.StoreInt64(&s.lastRunAt, start.UnixNano())
+		atomic.StoreInt64(&s.lastTookNs, int64(time.Since(start)))
+	})
+	go t.Start()
+	return t
+}
+
+// テナントのロックの統計 lockByTenantID で記録する
+var lockStats struct {
+	acquired  int64
+	abandoned int64 // contextが終わって諦めた
+	failed    int64
+	waitNs    int64
+	maxWaitNs int64
+}
+
+func recordLockWait(wait time.Duration, err error) {
+	switch {
+	case err == nil:
+		atomic.AddInt64(&lockStats.acquired, 1)
+	case err == ErrLockUnavailable:
+		atomic.AddInt64(&lockStats.abandoned, 1)
+	default:
+		atomic.AddInt64(&lockStats.failed, 1)
+	}
+	atomic.AddInt64(&lockStats.waitNs, int64(wait))
+	for {
+		max := atomic.LoadInt64(&lockStats.maxWaitNs)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&lockStats.maxWaitNs, max, int64(wait)) {
+			return
+		}
+	}
+}
+
+// helpisu.Cacheの全ての要素を読む
+// helpisu.Cacheは要素を列挙するメソッドがないので、中のsync.Mapを直接読む
+// go.modで固定している helpisu v0.9.1 の構造体のレイアウト(フィールドは m *sync.Map のみ)に依存している
+func cacheRange[K comparable, V any](c *helpisu.Cache[K, V], f func(K, V) bool) {
+	m := (*struct{ m *sync.Map })(unsafe.Pointer(c)).m
+	m.Range(func(k, v any) bool {
+		return f(k.(K), v.(V))
+	})
+}
+
+func cacheLen[K comparable, V any](c *helpisu.Cache[K, V]) int {
+	n := 0
+	cacheRange(c, func(_ K, _ V) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+type DebugConfigEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	IsDefault bool   `json:"is_default"`
+}
+
+type DebugPoolStats struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMs     int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
+
+func debugPoolStats(s sql.DBStats) DebugPoolStats {
+	return DebugPoolStats{
+		MaxOpenConnections: s.MaxOpenConnections,
+		OpenConnections:    s.OpenConnections,
+		InUse:              s.InUse,
+		Idle:               s.Idle,
+		WaitCount:          s.WaitCount,
+		WaitDurationMs:     s.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      s.MaxIdleClosed,
+		MaxLifetimeClosed:  s.MaxLifetimeClosed,
+	}
+}
+
+type DebugAdminDBReplica struct {
+	Addr      string         `json:"addr"`
+	Healthy   bool           `json:"healthy"`
+	LastError string         `json:"last_error"` // 最後の死活確認のエラー 成功していれば空
+	Pool      DebugPoolStats `json:"pool"`
+}
+
+type DebugTickerState struct {
+	Name       string `json:"name"`
+	IntervalMs int    `json:"interval_ms"`
+	Runs       int64  `json:"runs"`
+	LastRunAt  int64  `json:"last_run_at"` // unix秒 実行していなければ0
+	LastTookMs int64  `json:"last_took_ms"`
+}
+
+type DebugLockStats struct {
+	Acquired      int64 `json:"acquired"`
+	Abandoned     int64 `json:"abandoned"`
+	Failed        int64 `json:"failed"`
+	TotalWaitMs   int64 `json:"total_wait_ms"`
+	MaxWaitMs     int64 `json:"max_wait_ms"`
+	WaitTimeoutMs int64 `json:"wait_timeout_ms"` // 0なら制限なし
+}
+
+type DebugStateHandlerResult struct {
+	Hostname     string             `json:"hostname"`
+	PID          int                `json:"pid"`
+	GoVersion    string             `json:"go_version"`
+	Goroutines   int                `json:"goroutines"`
+	HeapAllocMB  uint64             `json:"heap_alloc_mb"`
+	Settings     Config             `json:"settings"` // 設定ファイルと環境変数から読んだ設定 パスワードは返さない
+	Config       []DebugConfigEntry `json:"config"`
+	FeatureFlags map[string]bool    `json:"feature_flags"`
+	AdminDBPool  DebugPoolStats     `json:"admin_db_pool"`
+	// リードレプリカ admin_db_replica.go を参照
+	AdminDBReplicas []DebugAdminDBReplica `json:"admin_db_replicas"`
+	TenantDBs       int                   `json:"tenant_dbs"` // 接続をキャッシュしているテナントDBの数
+	TenantDBPool    DebugPoolStats        `json:"tenant_db_pool"`
+	CacheSizes      map[string]int        `json:"cache_sizes"`
+	Tickers         []DebugTickerState    `json:"tickers"`
+	Locks           DebugLockStats        `json:"locks"`
+}
+
+// SasS管理者用API
+// GET /debug/state
+// 実際に使っている設定、接続プール、キャッシュの要素数、tickerの実行状況、ロックの統計、有効な機能をまとめて返す
+// パスワードなどの秘密の値は返さない
+func debugStateHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	res := DebugStateHandlerResult{
+		PID:        os.Getpid(),
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	res.Hostname, _ = os.Hostname()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	res.HeapAllocMB = ms.HeapAlloc / 1024 / 1024
+
+	res.Settings = *appConfig
+	res.Settings.AdminDB.Password = "(redacted)"
+	res.Settings.Env = nil
+	envLookups.Range(func(k, v any) bool {
+		l := v.(envLookup)
+		e := DebugConfigEntry{Key: k.(string), Value: l.value, IsDefault: l.isDefault}
+		if isSecretEnv(e.Key) && e.Value != "" {
+			e.Value = "(redacted)"
+		}
+		res.Config = append(res.Config, e)
+		return true
+	})
+	sort.Slice(res.Config, func(i, j int) bool { return res.Config[i].Key < res.Config[j].Key })
+
+	res.FeatureFlags = map[string]bool{
+		"csrf_protection":       csrfProtectionEnabled(),
+		"ip_allowlist":          ipAllowlistEnabled(),
+		"tenant_db_wal":         tenantDBWALEnabled(),
+		"tenant_db_memory":      tenantDBMemoryEnabled(),
+		"tenant_db_standby":     tenantDBStandbyDir() != "",
+		"tenant_db_evict":       tenantDBEvictionEnabled(),
+		"tenant_tiering":        tenantTieringEnabled(),
+		"tenant_schema_check":   tenantSchemaCheckEnabled(),
+		"tenant_schema_migrate": tenantSchemaAutoMigrateEnabled(),
+		"tenant_id_namespace":   tenantIDNamespaceEnabled(),
+		"sqlite_slow_query_log": slowQueryLogDetail().Enabled,
+		"sqlite_trace":          traceLogEncoder != nil,
+		"jwks":                  jwtJWKSURL() != "",
+		"ranking_share":         rankingShareSocketPath() != "",
+		"memory_governor":       memoryLimitBytes() > 0,
+		"debug_listener":        getEnv("ISUCON_DEBUG_LISTENER", "0") == "1",
+		"multiple_listeners":    listenerCount() > 1,
+		"tls":                   tlsEnabled(),
+		"tls_autocert":          appConfig.TLS.Autocert,
+		"grpc":                  grpcAddr() != "",
+		"request_validation":    requestValidationEnabled(),
+		"admin_db_replicas":     len(adminDBReplicas) > 0 && adminDBReplicaMaxLagSeconds() > 0,
+	}
+
+	res.AdminDBPool = debugPoolStats(adminDB.Stats())
+	res.AdminDBReplicas = make([]DebugAdminDBReplica, 0, len(adminDBReplicas))
+	for _, r := range adminDBReplicas {
+		lastError, _ := r.lastError.Load().(string)
+		res.AdminDBReplicas = append(res.AdminDBReplicas, DebugAdminDBReplica{
+			Addr:      r.addr,
+			Healthy:   r.isHealthy(),
+			LastError: lastError,
+			Pool:      debugPoolStats(r.db.Stats()),
+		})
+	}
+	var tenantPool sql.DBStats
+	cacheRange(tenantDBCache, func(_ int64, db *sqlx.DB) bool {
+		s := db.Stats()
+		res.TenantDBs++
+		tenantPool.MaxOpenConnections += s.MaxOpenConnections
+		tenantPool.OpenConnections += s.OpenConnections
+		tenantPool.InUse += s.InUse
+		tenantPool.Idle += s.Idle
+		tenantPool.WaitCount += s.WaitCount
+		tenantPool.WaitDuration += s.WaitDuration
+		tenantPool.MaxIdleClosed += s.MaxIdleClosed
+		tenantPool.MaxLifetimeClosed += s.MaxLifetimeClosed
+		return true
+	})
+	res.TenantDBPool = debugPoolStats(tenantPool)
+
+	res.CacheSizes = map[string]int{
+		"tenant_db":            cacheLen(tenantDBCache),
+		"jwt_token":            jwtTokenCache.Len(),
+		"player":               playerCache.Len(),
+		"competition":          cacheLen(competitionCache),
+		"tenant":               cacheLen(tenantCache),
+		"billing_report":       cacheLen(billingReportCache),
+		"billing_plan":         cacheLen(billingPlanCache),
+		"tenant_storage":       cacheLen(tenantStorageCache),
+		"impersonation":        cacheLen(impersonationCache),
+		"revoked_session":      cacheLen(revokedSessionCache),
+		"ranking_version":      cacheLen(rankingVersionCache),
+		"ranking_page":         cacheLen(rankingPageCache),
+		"materialized_ranking": cacheLen(materializedRankingCache),
+		"latest_scores":        cacheLen(latestScoresCache),
+		"search_index":         cacheLen(searchIndexCache),
+		"ip_allowlist":         cacheLen(ipAllowlistCache),
+		"visited_competition":  cacheLen(visitedCompetitionCache),
+	}
+
+	tickerStatesMu.Lock()
+	for name, s := range tickerStates {
+		t := DebugTickerState{
+			Name:       name,
+			IntervalMs: s.intervalMs,
+			Runs:       atomic.LoadInt64(&s.runs),
+			LastTookMs: time.Duration(atomic.LoadInt64(&s.lastTookNs)).Milliseconds(),
+		}
+		if last := atomic.LoadInt64(&s.lastRunAt); last != 0 {
+			t.LastRunAt = time.Unix(0, last).Unix()
+		}
+		res.Tickers = append(res.Tickers, t)
+	}
+	tickerStatesMu.Unlock()
+	sort.Slice(res.Tickers, func(i, j int) bool { return res.Tickers[i].Name < res.Tickers[j].Name })
+
+	res.Locks = DebugLockStats{
+		Acquired:      atomic.LoadInt64(&lockStats.acquired),
+		Abandoned:     atomic.LoadInt64(&lockStats.abandoned),
+		Failed:        atomic.LoadInt64(&lockStats.failed),
+		TotalWaitMs:   time.Duration(atomic.LoadInt64(&lockStats.waitNs)).Milliseconds(),
+		MaxWaitMs:     time.Duration(atomic.LoadInt64(&lockStats.maxWaitNs)).Milliseconds(),
+		WaitTimeoutMs: lockWaitTimeout().Milliseconds(),
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,416 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// 異議申し立ての状態
+const (
+	DisputeStatusOpen     = "open"     // 未対応
+	DisputeStatusAccepted = "accepted" // 認められた
+	DisputeStatusRejected = "rejected" // 却下された
+)
+
+type ScoreDisputeRow struct {
+	ID             string         `db:"id"`
+	TenantID       int64          `db:"tenant_id"`
+	CompetitionID  string         `db:"competition_id"`
+	PlayerID       string         `db:"player_id"`
+	Reason         string         `db:"reason"`
+	ClaimedScore   sql.NullInt64  `db:"claimed_score"`
+	Status         string         `db:"status"`
+	Resolution     sql.NullString `db:"resolution"`
+	CorrectedScore sql.NullInt64  `db:"corrected_score"`
+	ResolvedAt     sql.NullInt64  `db:"resolved_at"`
+	CreatedAt      int64          `db:"created_at"`
+	UpdatedAt      int64          `db:"updated_at"`
+}
+
+type ScoreDisputeDetail struct {
+	ID                string `json:"id"`
+	CompetitionID     string `json:"competition_id"`
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	Reason            string `json:"reason"`
+	ClaimedScore      *int64 `json:"claimed_score"`
+	Status            string `json:"status"`
+	Resolution        string `json:"resolution"`
+	CorrectedScore    *int64 `json:"corrected_score"`
+	ResolvedAt        *int64 `json:"resolved_at"`
+	CreatedAt         int64  `json:"created_at"`
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	v := n.Int64
+	return &v
+}
+
+func toScoreDisputeDetail(ctx context.Context, tenantDB dbOrTx, d ScoreDisputeRow) (ScoreDisputeDetail, error) {
+	p, err := retrievePlayer(ctx, tenantDB, d.PlayerID)
+	if err != nil {
+		return ScoreDisputeDetail{}, fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	return ScoreDisputeDetail{
+		ID:                d.ID,
+		CompetitionID:     d.CompetitionID,
+		PlayerID:          d.PlayerID,
+		PlayerDisplayName: p.DisplayName,
+		Reason:            d.Reason,
+		ClaimedScore:      nullInt64Ptr(d.ClaimedScore),
+		Status:            d.Status,
+		Resolution:        d.Resolution.String,
+		CorrectedScore:    nullInt64Ptr(d.CorrectedScore),
+		ResolvedAt:        nullInt64Ptr(d.ResolvedAt),
+		CreatedAt:         d.CreatedAt,
+	}, nil
+}
+
+// 整数のフォームの値を読む 空ならValidがfalse
+func parseOptionalIntForm(c echo.Context, name string) (sql.NullInt64, error) {
+	s := c.FormValue(name)
+	if s == "" {
+		return sql.NullInt64{}, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, apperr.InvalidField(name, "invalid %s: %s", name, s)
+	}
+	return sql.NullInt64{Int64: n, Valid: true}, nil
+}
+
+type ScoreDisputeHandlerResult struct {
+	Dispute ScoreDisputeDetail `json:"dispute"`
+}
+
+// 参加者向けAPI
+// POST /api/player/competition/:competition_id/dispute
+// 終了した大会の自分のスコアに異議を申し立てる
+// フォームのreasonに理由、claimed_scoreに正しいと主張するスコアを指定する
+// 未対応の申し立てがある間は同じ大会に申し立てられない
+func playerDisputeHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id is required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if !comp.FinishedAt.Valid {
+		return ErrCompetitionNotFinished
+	}
+	reason := c.FormValue("reason")
+	if reason == "" {
+		return apperr.InvalidField("reason", "reason is required")
+	}
+	claimedScore, err := parseOptionalIntForm(c, "claimed_score")
+	if err != nil {
+		return err
+	}
+
+	fl, err := flockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	var openCount int64
+	if err := tenantDB.GetContext(
+		ctx,
+		&openCount,
+		"SELECT COUNT(*) FROM score_dispute WHERE tenant_id = ? AND competition_id = ? AND player_id = ? AND status = ?",
+		v.tenantID, competitionID, v.playerID, DisputeStatusOpen,
+	); err != nil {
+		return fmt.Errorf("error Select count score_dispute: %w", err)
+	}
+	if openCount > 0 {
+		return ErrDisputeAlreadyOpen
+	}
+
+	id, err := dispenseTenantID(ctx, v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error dispenseTenantID: %w", err)
+	}
+	now := time.Now().Unix()
+	d := ScoreDisputeRow{
+		ID:            id,
+		TenantID:      v.tenantID,
+		CompetitionID: competitionID,
+		PlayerID:      v.playerID,
+		Reason:        reason,
+		ClaimedScore:  claimedScore,
+		Status:        DisputeStatusOpen,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"INSERT INTO score_dispute (id, tenant_id, competition_id, player_id, reason, claimed_score, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		d.ID, d.TenantID, d.CompetitionID, d.PlayerID, d.Reason, d.ClaimedScore, d.Status, d.CreatedAt, d.UpdatedAt,
+	); err != nil {
+		return fmt.Errorf("error Insert score_dispute: id=%s, %w", id, err)
+	}
+
+	dd, err := toScoreDisputeDetail(ctx, tenantDB, d)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: ScoreDisputeHandlerResult{Dispute: dd}})
+}
+
+type ScoreDisputesHandlerResult struct {
+	Disputes []ScoreDisputeDetail `json:"disputes"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/disputes
+// 大会への異議申し立ての一覧を古い順に取得する
+// statusを指定するとその状態のものだけを返す
+func competitionDisputesHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	query := "SELECT * FROM score_dispute WHERE tenant_id = ? AND competition_id = ?"
+	args := []interface{}{v.tenantID, competitionID}
+	switch status := c.QueryParam("status"); status {
+	case "":
+	case DisputeStatusOpen, DisputeStatusAccepted, DisputeStatusRejected:
+		query += " AND status = ?"
+		args = append(args, status)
+	default:
+		return apperr.InvalidField("status", "invalid status: %s", status)
+	}
+	ds := []ScoreDisputeRow{}
+	if err := tenantDB.SelectContext(ctx, &ds, query+" ORDER BY created_at ASC, id ASC", args...); err != nil {
+		return fmt.Errorf("error Select score_dispute: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+
+	res := ScoreDisputesHandlerResult{Disputes: make([]ScoreDisputeDetail, 0, len(ds))}
+	for _, d := range ds {
+		dd, err := toScoreDisputeDetail(ctx, tenantDB, d)
+		if err != nil {
+			return err
+		}
+		res.Disputes = append(res.Disputes, dd)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/dispute/:dispute_id/resolve
+// 異議申し立てを認めるか却下する
+// フォームのstatusにacceptedかrejected、resolutionに回答を指定する
+// acceptedの場合にcorrected_scoreを指定すると、その参加者の有効なスコアを訂正する
+func disputeResolveHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	disputeID := c.Param("dispute_id")
+	status := c.FormValue("status")
+	if status != DisputeStatusAccepted && status != DisputeStatusRejected {
+		return apperr.InvalidField("status", "status must be accepted or rejected")
+	}
+	correctedScore, err := parseOptionalIntForm(c, "corrected_score")
+	if err != nil {
+		return err
+	}
+	if correctedScore.Valid && status != DisputeStatusAccepted {
+		return apperr.InvalidField("corrected_score", "corrected_score requires status accepted")
+	}
+	resolution := sql.NullString{String: c.FormValue("resolution"), Valid: c.FormValue("resolution") != ""}
+
+	fl, err := flockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	var d ScoreDisputeRow
+	if err := tenantDB.GetContext(
+		ctx,
+		&d,
+		"SELECT * FROM score_dispute WHERE tenant_id = ? AND id = ?",
+		v.tenantID, disputeID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDisputeNotFound
+		}
+		return fmt.Errorf("error Select score_dispute: id=%s, %w", disputeID, err)
+	}
+	if d.Status != DisputeStatusOpen {
+		return ErrDisputeAlreadyResolved
+	}
+
+	now := time.Now().Unix()
+	if correctedScore.Valid {
+		if _, err := correctPlayerScore(ctx, tenantDB, v.tenantID, d.CompetitionID, d.PlayerID, correctedScore.Int64, now); err != nil {
+			return fmt.Errorf("error correctPlayerScore: %w", err)
+		}
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE score_dispute SET status = ?, resolution = ?, corrected_score = ?, resolved_at = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+		status, resolution, correctedScore, now, now, v.tenantID, disputeID,
+	); err != nil {
+		return fmt.Errorf("error Update score_dispute: id=%s, %w", disputeID, err)
+	}
+	d.Status = status
+	d.Resolution = resolution
+	d.CorrectedScore = correctedScore
+	d.ResolvedAt = sql.NullInt64{Int64: now, Valid: true}
+	d.UpdatedAt = now
+
+	hooks.disputeResolved(ctx, DisputeResolvedEvent{
+		TenantID:       v.tenantID,
+		DisputeID:      d.ID,
+		CompetitionID:  d.CompetitionID,
+		PlayerID:       d.PlayerID,
+		Status:         d.Status,
+		Resolution:     d.Resolution.String,
+		CorrectedScore: nullInt64Ptr(d.CorrectedScore),
+	})
+
+	dd, err := toScoreDisputeDetail(ctx, tenantDB, d)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: ScoreDisputeHandlerResult{Dispute: dd}})
+}
+
+// 参加者の有効なスコアを訂正し、記録したアップロードのIDを返す
+// 終了した大会でもスコアを書き換えられるように、row_numが最大の行を追加してアップロードとして記録する
+// 呼び出し元でテナントのロックを取得しておくこと
+func correctPlayerScore(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID, playerID string, score, now int64) (string, error) {
+	pss := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, competitionID,
+	); err != nil {
+		return "", fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	var maxRowNum int64
+	for _, ps := range pss {
+		if ps.RowNum > maxRowNum {
+			maxRowNum = ps.RowNum
+		}
+	}
+
+	id, err := dispenseTenantID(ctx, tenantID)
+	if err != nil {
+		return "", fmt.Errorf("error dispenseTenantID: %w", err)
+	}
+	ps := PlayerScoreRow{
+		ID:            id,
+		TenantID:      tenantID,
+		PlayerID:      playerID,
+		CompetitionID: competitionID,
+		Score:         score,
+		RowNum:        maxRowNum + 1,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	for _, table := range []string{"player_score", "player_score_history"} {
+		if _, err := tenantDB.ExecContext(
+			ctx,
+			"INSERT INTO "+table+" (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			ps.ID, ps.TenantID, ps.PlayerID, ps.CompetitionID, ps.Score, ps.RowNum, ps.CreatedAt, ps.UpdatedAt,
+		); err != nil {
+			return "", fmt.Errorf("error Insert %s: %w", table, err)
+		}
+	}
+
+	prev := effectiveScores(pss)
+	next := effectiveScores(append(pss, ps))
+	uploadID, err := dispenseTenantID(ctx, tenantID)
+	if err != nil {
+		return "", fmt.Errorf("error dispenseTenantID: %w", err)
+	}
+	if err := insertScoreUpload(
+		ctx,
+		tenantDB,
+		ScoreUploadRow{
+			ID:            uploadID,
+			TenantID:      tenantID,
+			CompetitionID: competitionID,
+			RowCount:      1,
+			CreatedAt:     now,
+		},
+		diffEffectiveScores(uploadID, tenantID, prev, next),
+	); err != nil {
+		return "", fmt.Errorf("error insertScoreUpload: %w", err)
+	}
+
+	invalidateRanking(competitionID)
+	invalidateBillingInputs(tenantID, competitionID)
+	if err := recalculateBillingReportPlayers(ctx, tenantDB, tenantID, competitionID); err != nil {
+		return "", fmt.Errorf("error recalculateBillingReportPlayers: %w", err)
+	}
+	return uploadID, nil
+}
@@ -0,0 +1,100 @@
+package isuports
+
+import (
+	"net/http"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ハンドラが返すエラー
+// レスポンスのerror_codeに識別子を返すので、クライアントはメッセージではなくerror_codeで判定する
+// メッセージに値を含める場合は apperr.NotFound("...: %s", id).WithCode(ErrPlayerNotFound.Code) のようにCodeを揃える
+// ここにないエラーのerror_codeは、InvalidFieldなら invalid_field、それ以外はcodeと同じ
+var (
+	// 認証、権限
+	ErrRoleAdminRequired     = apperr.Forbidden("admin role required").WithCode("role_admin_required")
+	ErrRoleOrganizerRequired = apperr.Forbidden("role organizer required").WithCode("role_organizer_required")
+	ErrRolePlayerRequired    = apperr.Forbidden("role player required").WithCode("role_player_required")
+	ErrInvalidCredentials    = apperr.Unauthorized("invalid login_id or password").WithCode("invalid_credentials")
+	ErrLoginDisabled         = apperr.NotFound("login is not enabled").WithCode("login_disabled")
+	ErrSessionNotFound       = apperr.Unauthorized("cookie %s is not found", cookieName).WithCode("session_not_found")
+	ErrInvalidToken          = apperr.Unauthorized("invalid token").WithCode("invalid_token")
+	ErrTokenExpired          = apperr.Unauthorized("token is expired").WithCode("token_expired")
+	ErrSessionRevoked        = apperr.Unauthorized("session is revoked").WithCode("session_revoked")
+	ErrImpersonationInvalid  = apperr.Unauthorized("impersonation session is expired or not found").WithCode("impersonation_invalid")
+	ErrLockUnavailable       = apperr.Unavailable("lock wait is abandoned").WithCode("lock_unavailable")
+	ErrIPNotAllowed          = apperr.Forbidden("source IP address is not allowed").WithCode("ip_not_allowed")
+	ErrAPINotAvailable       = apperr.NotFound("API is not available on this host").WithCode("api_not_available")
+
+	// テナント
+	ErrTenantNotFound           = apperr.NotFound("tenant not found").WithCode("tenant_not_found")
+	ErrTenantSuspended          = apperr.Forbidden("tenant is suspended").WithCode("tenant_suspended")
+	ErrTenantDuplicate          = apperr.Conflict("duplicate tenant").WithCode("tenant_duplicate")
+	ErrInvalidTenant            = apperr.Validation("invalid tenant").WithCode("invalid_tenant")
+	ErrTenantStorageUnsupported = apperr.Validation("tenant storage is not supported").WithCode("tenant_storage_unsupported")
+
+	// 参加者
+	ErrPlayerNotFound     = apperr.NotFound("player not found").WithCode("player_not_found")
+	ErrPlayerDisqualified = apperr.Forbidden("player is disqualified").WithCode("player_disqualified")
+	ErrPlayerMergeSelf    = apperr.Validation("cannot merge player into itself").WithCode("player_merge_self")
+
+	// 大会、スコア
+	ErrCompetitionNotFound    = apperr.NotFound("competition not found").WithCode("competition_not_found")
+	ErrCompetitionFinished    = apperr.Validation("competition is finished").WithCode("competition_finished")
+	ErrCompetitionNotFinished = apperr.Validation("competition is not finished").WithCode("competition_not_finished")
+	ErrInvalidCSVHeader       = apperr.Validation("invalid CSV headers").WithCode("invalid_csv_header")
+	ErrInvalidCSVRow          = apperr.Validation("invalid CSV row").WithCode("invalid_csv_row")
+	ErrUploadNotFound         = apperr.NotFound("upload not found").WithCode("upload_not_found")
+	ErrPlayerScoreNotFound    = apperr.NotFound("player score not found").WithCode("player_score_not_found")
+
+	// 異議申し立て、請求
+	ErrDisputeNotFound        = apperr.NotFound("dispute not found").WithCode("dispute_not_found")
+	ErrDisputeAlreadyOpen     = apperr.Conflict("open dispute already exists").WithCode("dispute_already_open")
+	ErrDisputeAlreadyResolved = apperr.Conflict("dispute is already resolved").WithCode("dispute_already_resolved")
+	ErrBillingReceiptNotFound = apperr.NotFound("billing receipt not found").WithCode("billing_receipt_not_found")
+
+	// SaaS管理者向けの操作
+	ErrInvalidRequestBody              = apperr.Validation("invalid request body").WithCode("invalid_request_body")
+	ErrInvalidQuery                    = apperr.Validation("invalid query parameter").WithCode("invalid_query")
+	ErrImpersonateAdmin                = apperr.Validation("cannot impersonate admin tenant").WithCode("impersonate_admin")
+	ErrSandboxOfSandbox                = apperr.Validation("cannot create sandbox of sandbox tenant").WithCode("sandbox_of_sandbox")
+	ErrLoginIDDuplicate                = apperr.Conflict("login_id is already used").WithCode("login_id_duplicate")
+	ErrIPAllowlistEntryNotFound        = apperr.NotFound("ip allowlist entry not found").WithCode("ip_allowlist_entry_not_found")
+	ErrIPAllowlistDuplicate            = apperr.Conflict("cidr already exists").WithCode("ip_allowlist_duplicate")
+	ErrIPAllowlistSelfLockout          = apperr.Validation("deleting this entry would block your address").WithCode("ip_allowlist_self_lockout")
+	ErrIndexBuildNotFound              = apperr.NotFound("index build not found").WithCode("index_build_not_found")
+	ErrIndexBuildAlreadyRunning        = apperr.Conflict("index build is already running").WithCode("index_build_already_running")
+	ErrVisitHistoryPurgeNotFound       = apperr.NotFound("visit history purge not found").WithCode("visit_history_purge_not_found")
+	ErrVisitHistoryPurgeAlreadyRunning = apperr.Conflict("visit history purge is already running").WithCode("visit_history_purge_already_running")
+	ErrSlowQueryLogUnavailable         = apperr.Validation("slow query log is not enabled at startup").WithCode("slow_query_log_unavailable")
+	ErrTenantDBStandbyUnavailable      = apperr.Validation("tenant DB standby is not enabled").WithCode("tenant_db_standby_unavailable")
+	ErrTenantDBStandbyNotFound         = apperr.NotFound("verified standby copy is not found").WithCode("tenant_db_standby_not_found")
+	ErrTenantDBAlreadyFailedOver       = apperr.Conflict("tenant DB is already failed over").WithCode("tenant_db_already_failed_over")
+	ErrCacheNotFound                   = apperr.NotFound("cache not found").WithCode("cache_not_found")
+
+	// APIの定義に合わないリクエスト openapi.go を参照
+	ErrRequestValidation = apperr.Unprocessable(nil).WithCode("request_validation_failed")
+)
+
+// ハンドラ以外で発生したエラーのerror_code
+const errorCodeInternal = "internal"
+
+// echoのミドルウェアやルーティングが返したエラーのerror_code
+func httpErrorCode(he *echo.HTTPError) string {
+	if he == middleware.ErrCSRFInvalid {
+		return "csrf_token_invalid"
+	}
+	switch he.Code {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusNotFound:
+		return "route_not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	}
+	return errorCodeInternal
+}
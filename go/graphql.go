@@ -0,0 +1,295 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// 参加者向けの読み取りをまとめて1回で取得するGraphQLのAPI
+// ダッシュボードで大会一覧と大会ごとのランキングと自分のスコアを取るのに
+// playerCompetitionsHandlerと大会の数だけのcompetitionRankingHandlerを呼ばなくてよいようにする
+// 処理はRESTのハンドラと同じ関数(listCompetitions, competitionRankingなど)を呼ぶ
+// ランキングを取得した大会はRESTと同じく閲覧履歴に記録する
+const graphqlSchemaString = `
+schema {
+	query: Query
+}
+
+type Query {
+	# 大会の一覧 新しい順
+	competitions: [Competition!]!
+	# 大会 存在しなければnull
+	competition(id: ID!): Competition
+	# ログインしている参加者
+	me: Me!
+}
+
+type Competition {
+	id: ID!
+	title: String!
+	isFinished: Boolean!
+	# rankAfter位より後のfirst人分 firstは100まで
+	ranking(rankAfter: Int = 0, first: Int = 100): [Rank!]!
+}
+
+type Rank {
+	rank: Int!
+	score: Float!
+	playerId: ID!
+	playerDisplayName: String!
+}
+
+type Me {
+	player: Player!
+	# 大会ごとの最新のスコア 大会の作成順
+	scores: [PlayerScore!]!
+}
+
+type Player {
+	id: ID!
+	displayName: String!
+	isDisqualified: Boolean!
+}
+
+type PlayerScore {
+	competitionTitle: String!
+	score: Float!
+}
+`
+
+// ランキングの1ページの最大の人数 competitionRankingHandlerと同じ
+const graphqlRankingPageSize = 100
+
+var graphqlSchema = graphql.MustParseSchema(
+	graphqlSchemaString,
+	&graphqlResolver{},
+	// 大会ごとにランキングを読むので、深いクエリや大量の同時実行で重くならないように制限する
+	graphql.MaxDepth(5),
+	graphql.MaxParallelism(4),
+)
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// 参加者向けAPI
+// GET, POST /api/graphql
+// 大会の一覧、ランキング、自分のスコアをGraphQLで取得する
+// GETはクエリパラメータ query, operationName, variables(JSON)、POSTはJSONのボディで受け取る
+// レスポンスはGraphQLの形式({"data": ..., "errors": [...]})で返す
+func graphqlHandler(c echo.Context) error {
+	ctx := context.Background()
+
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	var req graphqlRequest
+	if c.Request().Method == http.MethodGet {
+		req.Query = c.QueryParam("query")
+		req.OperationName = c.QueryParam("operationName")
+		if vars := c.QueryParam("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				return apperr.InvalidField("variables", "invalid variables: %s", err)
+			}
+		}
+	} else if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return apperr.Validation("invalid graphql request: %s", err)
+	}
+	if req.Query == "" {
+		return apperr.InvalidField("query", "query is required")
+	}
+
+	gctx := context.WithValue(c.Request().Context(), graphqlViewerKey{}, &graphqlViewer{
+		Viewer:   v,
+		tenantDB: tenantDB,
+	})
+	res := graphqlSchema.Exec(gctx, req.Query, req.OperationName, req.Variables)
+	return c.JSON(http.StatusOK, res)
+}
+
+type graphqlViewerKey struct{}
+
+type graphqlViewer struct {
+	*Viewer
+	tenantDB *sqlx.DB
+}
+
+func graphqlViewerFromContext(ctx context.Context) *graphqlViewer {
+	return ctx.Value(graphqlViewerKey{}).(*graphqlViewer)
+}
+
+// レスポンスのerrorsに入れるエラー
+// apperrのエラーはメッセージとerror_codeを返し、それ以外はログに書いて内容は返さない
+type graphqlError struct {
+	message   string
+	errorCode string
+}
+
+func (e *graphqlError) Error() string {
+	return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"error_code": e.errorCode}
+}
+
+func toGraphQLError(err error) error {
+	if ae, ok := apperr.As(err); ok {
+		return &graphqlError{message: ae.Message, errorCode: ae.ErrorCode()}
+	}
+	appLogger.Error("graphql resolver error", zap.Error(err))
+	return &graphqlError{message: "internal error", errorCode: errorCodeInternal}
+}
+
+type graphqlResolver struct{}
+
+func (r *graphqlResolver) Competitions(ctx context.Context) ([]*graphqlCompetition, error) {
+	gv := graphqlViewerFromContext(ctx)
+	cds, err := listCompetitions(ctx, gv.tenantDB, gv.tenantID)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	res := make([]*graphqlCompetition, 0, len(cds))
+	for _, cd := range cds {
+		res = append(res, &graphqlCompetition{detail: cd})
+	}
+	return res, nil
+}
+
+func (r *graphqlResolver) Competition(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlCompetition, error) {
+	gv := graphqlViewerFromContext(ctx)
+	comp, err := retrieveCompetition(ctx, gv.tenantDB, string(args.ID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, toGraphQLError(fmt.Errorf("error retrieveCompetition: %w", err))
+	}
+	return &graphqlCompetition{detail: CompetitionDetail{
+		ID:         comp.ID,
+		Title:      comp.Title,
+		IsFinished: comp.FinishedAt.Valid,
+	}}, nil
+}
+
+func (r *graphqlResolver) Me(ctx context.Context) (*graphqlMe, error) {
+	gv := graphqlViewerFromContext(ctx)
+	p, err := retrievePlayer(ctx, gv.tenantDB, gv.playerID)
+	if err != nil {
+		return nil, toGraphQLError(fmt.Errorf("error retrievePlayer: %w", err))
+	}
+	return &graphqlMe{player: p}, nil
+}
+
+type graphqlCompetition struct {
+	detail CompetitionDetail
+}
+
+func (c *graphqlCompetition) ID() graphql.ID   { return graphql.ID(c.detail.ID) }
+func (c *graphqlCompetition) Title() string    { return c.detail.Title }
+func (c *graphqlCompetition) IsFinished() bool { return c.detail.IsFinished }
+
+func (c *graphqlCompetition) Ranking(ctx context.Context, args struct {
+	RankAfter int32
+	First     int32
+}) ([]*graphqlRank, error) {
+	gv := graphqlViewerFromContext(ctx)
+	if args.First < 0 || args.First > graphqlRankingPageSize {
+		return nil, toGraphQLError(apperr.InvalidField("first", "first must be between 0 and %d", graphqlRankingPageSize))
+	}
+	if err := recordCompetitionVisit(ctx, gv.tenantID, gv.playerID, c.detail.ID); err != nil {
+		return nil, toGraphQLError(err)
+	}
+
+	ranks, err := competitionRanking(ctx, gv.tenantDB, gv.tenantID, c.detail.ID, rankingVersion(c.detail.ID))
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	start := int(args.RankAfter)
+	if start < 0 {
+		start = 0
+	}
+	if start > len(ranks) {
+		start = len(ranks)
+	}
+	end := start + int(args.First)
+	if end > len(ranks) {
+		end = len(ranks)
+	}
+	res := make([]*graphqlRank, 0, end-start)
+	for i := start; i < end; i++ {
+		res = append(res, &graphqlRank{rank: ranks[i]})
+	}
+	return res, nil
+}
+
+type graphqlRank struct {
+	rank CompetitionRank
+}
+
+func (r *graphqlRank) Rank() int32               { return int32(r.rank.Rank) }
+func (r *graphqlRank) Score() float64            { return float64(r.rank.Score) }
+func (r *graphqlRank) PlayerID() graphql.ID      { return graphql.ID(r.rank.PlayerID) }
+func (r *graphqlRank) PlayerDisplayName() string { return r.rank.PlayerDisplayName }
+
+type graphqlMe struct {
+	player *PlayerRow
+}
+
+func (m *graphqlMe) Player() *graphqlPlayer {
+	return &graphqlPlayer{player: m.player}
+}
+
+func (m *graphqlMe) Scores(ctx context.Context) ([]*graphqlPlayerScore, error) {
+	gv := graphqlViewerFromContext(ctx)
+	psds, err := retrievePlayerScores(ctx, gv.tenantDB, gv.tenantID, m.player.ID)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	res := make([]*graphqlPlayerScore, 0, len(psds))
+	for _, psd := range psds {
+		res = append(res, &graphqlPlayerScore{detail: psd})
+	}
+	return res, nil
+}
+
+type graphqlPlayer struct {
+	player *PlayerRow
+}
+
+func (p *graphqlPlayer) ID() graphql.ID       { return graphql.ID(p.player.ID) }
+func (p *graphqlPlayer) DisplayName() string  { return p.player.DisplayName }
+func (p *graphqlPlayer) IsDisqualified() bool { return p.player.IsDisqualified }
+
+type graphqlPlayerScore struct {
+	detail PlayerScoreDetail
+}
+
+func (s *graphqlPlayerScore) CompetitionTitle() string { return s.detail.CompetitionTitle }
+func (s *graphqlPlayerScore) Score() float64           { return float64(s.detail.Score) }
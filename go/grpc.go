@@ -0,0 +1,384 @@
+package isuports
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/organizerpb"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// テナント管理者向けAPIのgRPC版
+// 定義は proto/isuports/organizer/v1/organizer.proto にある
+// 環境変数 ISUCON_GRPC_ADDR (例: :3001) を設定したときだけ起動する
+// 処理はRESTのハンドラと同じ関数(addPlayers, uploadScoresなど)を呼ぶ
+// 認証もRESTと同じで、メタデータ authorization: Bearer <JWT> と :authority のテナント名をparseViewerで確認する
+// HTTPSの設定(tls.go)がある場合はgRPCもTLSで受け付ける
+func grpcAddr() string {
+	return getEnv("ISUCON_GRPC_ADDR", "")
+}
+
+var (
+	grpcServer *grpc.Server
+	// parseViewerに渡すecho.Contextを作るためのもの ルーティングには使わない
+	grpcEcho *echo.Echo
+)
+
+func startGRPCServer(tlsCfg *tls.Config) error {
+	addr := grpcAddr()
+	var (
+		l   net.Listener
+		err error
+	)
+	if listenerCount() > 1 {
+		// 子プロセスごとに同じポートをlistenする
+		l, err = listenReusePort(addr)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error Listen: address=%s, %w", addr, err)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	grpcEcho = echo.New()
+	grpcEcho.Logger = newZapEchoLogger(appLogger)
+	grpcServer = grpc.NewServer(opts...)
+	organizerpb.RegisterOrganizerServiceServer(grpcServer, &organizerGRPCServer{})
+	go func() {
+		if err := grpcServer.Serve(l); err != nil {
+			log.Printf("error grpc server: address=%s, %s", addr, err)
+		}
+	}()
+	return nil
+}
+
+// 処理中のRPCが終わるのを待って止める ctxの期限を過ぎたら接続を切る
+func stopGRPCServer(ctx context.Context) {
+	if grpcServer == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+}
+
+type grpcViewerKey struct{}
+
+func grpcViewerFromContext(ctx context.Context) *Viewer {
+	v, _ := ctx.Value(grpcViewerKey{}).(*Viewer)
+	return v
+}
+
+// メタデータからテナント管理者を確認する
+// RESTと同じ確認をするため、Hostヘッダとセッションのクッキーを持ったリクエストを作ってparseViewerに渡す
+// 停止中のテナントは全てのRPCを拒否する
+func authorizeGRPC(ctx context.Context, method string) (*Viewer, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := firstMetadata(md, "authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, ErrSessionNotFound
+	}
+	host := firstMetadata(md, ":authority")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	req.Host = host
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: strings.TrimPrefix(auth, "Bearer ")})
+	c := grpcEcho.NewContext(req, discardResponseWriter{})
+	c.SetPath(method)
+	v, err := parseViewer(c)
+	if err != nil {
+		return nil, err
+	}
+	if v.role != RoleOrganizer {
+		return nil, ErrRoleOrganizerRequired
+	}
+
+	// 接続元IPアドレスの許可リスト ip_allowlist.go を参照
+	if ipAllowlistEnabled() {
+		nets, err := retrieveIPAllowlist(ctx, v.tenantName)
+		if err != nil {
+			return nil, err
+		}
+		if !ipAllowed(nets, peerIP(ctx)) {
+			return nil, ErrIPNotAllowed
+		}
+	}
+	return v, nil
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if vs := md.Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func peerIP(ctx context.Context) net.IP {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return http.Header{} }
+func (discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponseWriter) WriteHeader(int)             {}
+
+// apperrのエラーをgRPCのステータスにする
+// error_codeはトレーラーの error-code で返す
+func grpcStatusError(err error) (error, string) {
+	if err == nil {
+		return nil, ""
+	}
+	ae, ok := apperr.As(err)
+	if !ok {
+		return status.Error(codes.Internal, "internal error"), errorCodeInternal
+	}
+	code := codes.Unknown
+	switch ae.Kind {
+	case apperr.KindValidation, apperr.KindUnprocessable:
+		code = codes.InvalidArgument
+	case apperr.KindUnauthorized:
+		code = codes.Unauthenticated
+	case apperr.KindForbidden:
+		code = codes.PermissionDenied
+	case apperr.KindNotFound:
+		code = codes.NotFound
+	case apperr.KindConflict:
+		code = codes.FailedPrecondition
+	case apperr.KindUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, ae.Message), ae.ErrorCode()
+}
+
+// RequestLoggerと同じ形式でRPCごとに1行のログを書く
+func logGRPC(ctx context.Context, method string, start time.Time, v *Viewer, err error, grpcErr error) {
+	st := status.Convert(grpcErr)
+	fields := []zap.Field{
+		zap.String("method", "GRPC"),
+		zap.String("route", method),
+		zap.String("grpc_code", st.Code().String()),
+		zap.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	if ip := peerIP(ctx); ip != nil {
+		fields = append(fields, zap.String("remote_ip", ip.String()))
+	}
+	if v != nil {
+		fields = append(fields,
+			zap.String("tenant_name", v.tenantName),
+			zap.String("role", v.role),
+		)
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	switch st.Code() {
+	case codes.OK:
+		appLogger.Info("request", fields...)
+	case codes.Internal, codes.Unknown:
+		appLogger.Error("request", fields...)
+	default:
+		appLogger.Warn("request", fields...)
+	}
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	v, err := authorizeGRPC(ctx, info.FullMethod)
+	var res any
+	if err == nil {
+		res, err = handler(context.WithValue(ctx, grpcViewerKey{}, v), req)
+	}
+	grpcErr, errorCode := grpcStatusError(err)
+	if errorCode != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("error-code", errorCode))
+	}
+	logGRPC(ctx, info.FullMethod, start, v, err, grpcErr)
+	return res, grpcErr
+}
+
+type grpcViewerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcViewerStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx := ss.Context()
+	v, err := authorizeGRPC(ctx, info.FullMethod)
+	if err == nil {
+		err = handler(srv, &grpcViewerStream{ServerStream: ss, ctx: context.WithValue(ctx, grpcViewerKey{}, v)})
+	}
+	grpcErr, errorCode := grpcStatusError(err)
+	if errorCode != "" {
+		ss.SetTrailer(metadata.Pairs("error-code", errorCode))
+	}
+	logGRPC(ctx, info.FullMethod, start, v, err, grpcErr)
+	return grpcErr
+}
+
+type organizerGRPCServer struct {
+	organizerpb.UnimplementedOrganizerServiceServer
+}
+
+func (s *organizerGRPCServer) AddPlayers(ctx context.Context, req *organizerpb.AddPlayersRequest) (*organizerpb.AddPlayersResponse, error) {
+	v := grpcViewerFromContext(ctx)
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	pds, err := addPlayers(context.Background(), tenantDB, v.tenantID, req.DisplayNames)
+	if err != nil {
+		return nil, err
+	}
+	res := &organizerpb.AddPlayersResponse{Players: make([]*organizerpb.Player, 0, len(pds))}
+	for _, pd := range pds {
+		res.Players = append(res.Players, &organizerpb.Player{
+			Id:             pd.ID,
+			DisplayName:    pd.DisplayName,
+			IsDisqualified: pd.IsDisqualified,
+		})
+	}
+	return res, nil
+}
+
+func (s *organizerGRPCServer) ListCompetitions(ctx context.Context, req *organizerpb.ListCompetitionsRequest) (*organizerpb.ListCompetitionsResponse, error) {
+	v := grpcViewerFromContext(ctx)
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	cds, err := listCompetitions(ctx, tenantDB, v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	res := &organizerpb.ListCompetitionsResponse{Competitions: make([]*organizerpb.Competition, 0, len(cds))}
+	for _, cd := range cds {
+		res.Competitions = append(res.Competitions, competitionToProto(cd))
+	}
+	return res, nil
+}
+
+func (s *organizerGRPCServer) AddCompetition(ctx context.Context, req *organizerpb.AddCompetitionRequest) (*organizerpb.AddCompetitionResponse, error) {
+	v := grpcViewerFromContext(ctx)
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	cd, err := addCompetition(context.Background(), tenantDB, v.tenantID, req.Title)
+	if err != nil {
+		return nil, err
+	}
+	return &organizerpb.AddCompetitionResponse{Competition: competitionToProto(*cd)}, nil
+}
+
+func (s *organizerGRPCServer) FinishCompetition(ctx context.Context, req *organizerpb.FinishCompetitionRequest) (*organizerpb.FinishCompetitionResponse, error) {
+	v := grpcViewerFromContext(ctx)
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := finishCompetition(context.Background(), tenantDB, v.tenantID, req.CompetitionId); err != nil {
+		return nil, err
+	}
+	return &organizerpb.FinishCompetitionResponse{}, nil
+}
+
+// スコアを受け取り終わってからまとめて置き換える
+// 大会の確認は最初のメッセージで行い、存在しない大会や終了した大会なら残りを受け取らずにエラーを返す
+func (s *organizerGRPCServer) UploadScores(stream organizerpb.OrganizerService_UploadScoresServer) error {
+	ctx := stream.Context()
+	v := grpcViewerFromContext(ctx)
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	var competitionID string
+	records := []scoreRecord{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error stream.Recv: %w", err)
+		}
+		if competitionID == "" {
+			competitionID = req.CompetitionId
+			if err := checkCompetitionOpen(ctx, tenantDB, competitionID); err != nil {
+				return err
+			}
+		} else if req.CompetitionId != "" && req.CompetitionId != competitionID {
+			return apperr.InvalidField("competition_id", "competition_id changed in stream: %s", req.CompetitionId)
+		}
+		for _, sc := range req.Scores {
+			records = append(records, scoreRecord{PlayerID: sc.PlayerId, Score: strconv.FormatInt(sc.Score, 10)})
+		}
+	}
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+
+	res, err := uploadScores(ctx, tenantDB, v.tenantID, competitionID, records, ScoreUploadModeReplace)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&organizerpb.UploadScoresResponse{Rows: res.Rows, UploadId: res.UploadID})
+}
+
+func competitionToProto(cd CompetitionDetail) *organizerpb.Competition {
+	return &organizerpb.Competition{
+		Id:         cd.ID,
+		Title:      cd.Title,
+		IsFinished: cd.IsFinished,
+	}
+}
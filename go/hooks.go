@@ -0,0 +1,85 @@
+package isuports
+
+import "context"
+
+// Hooks は各処理が成功した後に呼ばれる拡張ポイント
+// 通知や分析など、ハンドラを書き換えずに処理を追加したい場合に使う
+// ハンドラの中で同期的に呼ばれるので、重い処理はgoroutineで実行すること
+type Hooks struct {
+	OnScoreUploaded       func(ctx context.Context, e ScoreUploadedEvent)
+	OnCompetitionFinished func(ctx context.Context, e CompetitionFinishedEvent)
+	OnTenantCreated       func(ctx context.Context, e TenantCreatedEvent)
+	OnPlayerDisqualified  func(ctx context.Context, e PlayerDisqualifiedEvent)
+	OnDisputeResolved     func(ctx context.Context, e DisputeResolvedEvent)
+}
+
+type ScoreUploadedEvent struct {
+	TenantID      int64
+	CompetitionID string
+	Rows          int64
+}
+
+type CompetitionFinishedEvent struct {
+	TenantID      int64
+	CompetitionID string
+	FinishedAt    int64
+}
+
+type TenantCreatedEvent struct {
+	TenantID    int64
+	Name        string
+	DisplayName string
+}
+
+// 参加者を失格にした
+// テナントのシステムに失格を同期するのに使う
+type PlayerDisqualifiedEvent struct {
+	TenantID int64
+	PlayerID string
+	Reason   string // 指定されなかった場合は空
+}
+
+// 異議申し立てに回答した
+// 参加者への通知に使う
+type DisputeResolvedEvent struct {
+	TenantID       int64
+	DisputeID      string
+	CompetitionID  string
+	PlayerID       string
+	Status         string
+	Resolution     string
+	CorrectedScore *int64 // スコアを訂正しなかった場合はnil
+}
+
+// 実行中のServerに設定されたHooks
+var hooks Hooks
+
+func (h Hooks) scoreUploaded(ctx context.Context, e ScoreUploadedEvent) {
+	if h.OnScoreUploaded != nil {
+		h.OnScoreUploaded(ctx, e)
+	}
+}
+
+func (h Hooks) competitionFinished(ctx context.Context, e CompetitionFinishedEvent) {
+	if h.OnCompetitionFinished != nil {
+		h.OnCompetitionFinished(ctx, e)
+	}
+}
+
+func (h Hooks) tenantCreated(ctx context.Context, e TenantCreatedEvent) {
+	if h.OnTenantCreated != nil {
+		h.OnTenantCreated(ctx, e)
+	}
+}
+
+func (h Hooks) playerDisqualified(ctx context.Context, e PlayerDisqualifiedEvent) {
+	if h.OnPlayerDisqualified != nil {
+		h.OnPlayerDisqualified(ctx, e)
+	}
+}
+
+func (h Hooks) disputeResolved(ctx context.Context, e DisputeResolvedEvent) {
+	if h.OnDisputeResolved != nil {
+		h.OnDisputeResolved(ctx, e)
+	}
+}
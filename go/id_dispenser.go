@@ -0,0 +1,96 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// システム全体で一意なIDの発行
+// id_generatorのidを予約済みのIDの最大値とし、一度に連番をまとめて予約してからプロセスのメモリ上で払い出す
+// 予約は払い出す前にトランザクションで保存するので、プロセスが落ちても同じIDを二度払い出すことはない
+// 使わなかった分は欠番になるが、正常に終了する場合はreleaseIDBlockで返す
+
+// id_generatorから一度に予約するIDの数
+// 環境変数 ISUCON_ID_BLOCK_SIZE で変更できる
+func idBlockSize() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_ID_BLOCK_SIZE", "10000"), 10, 64)
+	if err != nil || n <= 0 {
+		return 10000
+	}
+	return n
+}
+
+// 予約済みのID [next, end)
+var (
+	idBlockMu   sync.Mutex
+	idBlockNext int64
+	idBlockEnd  int64
+)
+
+// 予約済みのIDを捨てる
+// 初期化でid_generatorを戻した後に、初期化前に予約したIDを払い出さないようにする
+func resetIDBlock() {
+	idBlockMu.Lock()
+	defer idBlockMu.Unlock()
+	idBlockNext, idBlockEnd = 0, 0
+}
+
+// システム全体で一意なIDを生成する
+func dispenseID(ctx context.Context) (string, error) {
+	idBlockMu.Lock()
+	defer idBlockMu.Unlock()
+	if idBlockNext >= idBlockEnd {
+		size := idBlockSize()
+		start, err := reserveIDs(ctx, size)
+		if err != nil {
+			return "", fmt.Errorf("error reserveIDs: %w", err)
+		}
+		idBlockNext, idBlockEnd = start, start+size
+	}
+	id := idBlockNext
+	idBlockNext++
+	return fmt.Sprintf("%x", id), nil
+}
+
+// id_generatorからIDをsize個予約し、その先頭を返す
+// 複数のプロセスが同時に予約しても重ならないように、先にUPDATEして行のロックを取ってから読む
+func reserveIDs(ctx context.Context, size int64) (int64, error) {
+	tx, err := adminDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error BeginTxx: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE id_generator SET id = id + ? WHERE stub = 'a'", size); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error Update id_generator: %w", err)
+	}
+	var last int64
+	if err := tx.GetContext(ctx, &last, "SELECT id FROM id_generator WHERE stub = 'a'"); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error Select id_generator: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error tx.Commit: %w", err)
+	}
+	return last - size + 1, nil
+}
+
+// 予約したIDのうち使わなかった分をid_generatorに返す
+// 終了時に呼ぶ 他のプロセスがその後に予約していた場合は返せないので欠番のままにする
+func releaseIDBlock() {
+	idBlockMu.Lock()
+	defer idBlockMu.Unlock()
+	if idBlockNext >= idBlockEnd {
+		return
+	}
+	if _, err := adminDB.Exec(
+		"UPDATE id_generator SET id = ? WHERE stub = 'a' AND id = ?",
+		idBlockNext-1, idBlockEnd-1,
+	); err != nil {
+		log.Printf("error releaseIDBlock: %s", err)
+		return
+	}
+	idBlockNext, idBlockEnd = 0, 0
+}
@@ -0,0 +1,125 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// テナントごとにIDを発行するか
+// 環境変数 ISUCON_TENANT_ID_NAMESPACE=1 で有効になる
+// 有効な場合、参加者、大会、スコアなどのIDは{テナントID}-{テナント内の連番}になり、全テナントで共有する発行元を使わない
+// テナントIDを含むので他のテナントや無効な場合に発行したIDと重複しない
+func tenantIDNamespaceEnabled() bool {
+	return getEnv("ISUCON_TENANT_ID_NAMESPACE", "0") == "1"
+}
+
+// テナントDBから一度に予約する連番の数
+// 予約した連番はプロセスのメモリ上で払い出すので、再起動すると使わなかった分は欠番になる
+func tenantIDBlockSize() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_TENANT_ID_BLOCK_SIZE", "1000"), 10, 64)
+	if err != nil || n <= 0 {
+		return 1000
+	}
+	return n
+}
+
+// テナントごとに予約済みの連番 [next, end)
+type tenantIDBlock struct {
+	mu   sync.Mutex
+	next int64
+	end  int64
+}
+
+var (
+	tenantIDBlocks   = map[int64]*tenantIDBlock{}
+	tenantIDBlocksMu sync.Mutex
+)
+
+func resetTenantIDBlocks() {
+	tenantIDBlocksMu.Lock()
+	defer tenantIDBlocksMu.Unlock()
+	tenantIDBlocks = map[int64]*tenantIDBlock{}
+}
+
+// テナント内で一意なIDを生成する
+// テナントごとに発行しない設定ならdispenseIDと同じ
+// テナントのロックを取得していても呼べるように、連番の予約はテナントDBのトランザクションで行う
+func dispenseTenantID(ctx context.Context, tenantID int64) (string, error) {
+	if !tenantIDNamespaceEnabled() {
+		return dispenseID(ctx)
+	}
+
+	tenantIDBlocksMu.Lock()
+	b, ok := tenantIDBlocks[tenantID]
+	if !ok {
+		b = &tenantIDBlock{}
+		tenantIDBlocks[tenantID] = b
+	}
+	tenantIDBlocksMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next >= b.end {
+		start, err := reserveTenantIDs(ctx, tenantID, tenantIDBlockSize())
+		if err != nil {
+			return "", fmt.Errorf("error reserveTenantIDs: tenantID=%d, %w", tenantID, err)
+		}
+		b.next, b.end = start, start+tenantIDBlockSize()
+	}
+	n := b.next
+	b.next++
+	return fmt.Sprintf("%x-%x", tenantID, n), nil
+}
+
+// テナントDBのid_sequenceから連番をsize個予約し、その先頭を返す
+func reserveTenantIDs(ctx context.Context, tenantID, size int64) (int64, error) {
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return 0, fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+	// 行がない場合に複数のプロセスが同時にINSERTすると片方が失敗するので、一度だけやり直す
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		tx, err := tenantDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return 0, fmt.Errorf("error BeginTxx: %w", err)
+		}
+		// 先にUPDATEして書き込みのロックを取ってから読む
+		res, err := tx.ExecContext(
+			ctx,
+			"UPDATE id_sequence SET next_id = next_id + ? WHERE tenant_id = ?",
+			size, tenantID,
+		)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("error Update id_sequence: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			if _, err := tx.ExecContext(
+				ctx,
+				"INSERT INTO id_sequence (tenant_id, next_id) VALUES (?, ?)",
+				tenantID, 1+size,
+			); err != nil {
+				tx.Rollback()
+				lastErr = fmt.Errorf("error Insert id_sequence: %w", err)
+				continue
+			}
+			if err := tx.Commit(); err != nil {
+				return 0, fmt.Errorf("error tx.Commit: %w", err)
+			}
+			return 1, nil
+		}
+		var next int64
+		if err := tx.GetContext(ctx, &next, "SELECT next_id FROM id_sequence WHERE tenant_id = ?", tenantID); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("error Select id_sequence: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("error tx.Commit: %w", err)
+		}
+		return next - size, nil
+	}
+	return 0, lastErr
+}
@@ -0,0 +1,230 @@
+package isuports
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// なりすましセッションのトークンの接頭辞
+// JWTは秘密鍵を持っていないので発行できないため、サーバー側でセッションを管理する
+const impersonationTokenPrefix = "imp_"
+
+// なりすましセッションの有効期間(秒)
+func impersonationTTLSeconds() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_IMPERSONATION_TTL_SECONDS", "900"), 10, 64)
+	if err != nil || n <= 0 {
+		return 900
+	}
+	return n
+}
+
+type ImpersonationRow struct {
+	ID           int64  `db:"id"`
+	TokenHash    string `db:"token_hash"`
+	AdminSubject string `db:"admin_subject"`
+	TenantID     int64  `db:"tenant_id"`
+	Reason       string `db:"reason"`
+	CreatedAt    int64  `db:"created_at"`
+	ExpiresAt    int64  `db:"expires_at"`
+}
+
+// トークンのハッシュをキーにしたなりすましセッション
+var impersonationCache = helpisu.NewCache[string, ImpersonationRow]()
+
+func hashImpersonationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// なりすましセッションを取得する
+// 期限切れの場合はsql.ErrNoRowsを返す
+func retrieveImpersonation(ctx context.Context, token string) (*ImpersonationRow, error) {
+	hash := hashImpersonationToken(token)
+	imp, ok := impersonationCache.Get(hash)
+	if !ok {
+		if err := adminDB.GetContext(ctx, &imp, "SELECT * FROM impersonation WHERE token_hash = ?", hash); err != nil {
+			return nil, fmt.Errorf("error Select impersonation: %w", err)
+		}
+		impersonationCache.Set(hash, imp)
+	}
+	if imp.ExpiresAt <= time.Now().Unix() {
+		impersonationCache.Delete(hash)
+		return nil, sql.ErrNoRows
+	}
+	return &imp, nil
+}
+
+// なりすましセッションのトークンからViewerを作る
+// テナント管理者として扱い、リクエストごとに監査ログを残す
+func parseImpersonationViewer(c echo.Context, token string) (*Viewer, error) {
+	ctx := context.Background()
+	imp, err := retrieveImpersonation(ctx, token)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrImpersonationInvalid
+		}
+		return nil, fmt.Errorf("error retrieveImpersonation: %w", err)
+	}
+
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, apperr.Unauthorized("tenant not found").WithCode(ErrTenantNotFound.Code)
+		}
+		return nil, fmt.Errorf("error retrieveTenantRowFromHeader at parseImpersonationViewer: %w", err)
+	}
+	if tenant.ID != imp.TenantID {
+		return nil, apperr.Unauthorized("impersonation session is not for this tenant").WithCode(ErrImpersonationInvalid.Code)
+	}
+	if tenant.IsSuspended() {
+		if _, ok := suspendedTenantAllowedPaths[c.Path()]; !ok {
+			return nil, ErrTenantSuspended
+		}
+	}
+
+	recordTenantAccess(tenant.ID)
+
+	c.Logger().Infof(
+		"audit: impersonation: id=%d subject=%s tenant=%s method=%s path=%s",
+		imp.ID, imp.AdminSubject, tenant.Name, c.Request().Method, c.Request().URL.Path,
+	)
+	return &Viewer{
+		role:           RoleOrganizer,
+		playerID:       imp.AdminSubject,
+		tenantName:     tenant.Name,
+		tenantID:       tenant.ID,
+		impersonatedBy: imp.AdminSubject,
+	}, nil
+}
+
+type ImpersonateHandlerResult struct {
+	ID         string `json:"id"`
+	TenantID   string `json:"tenant_id"`
+	TenantName string `json:"tenant_name"`
+	CookieName string `json:"cookie_name"`
+	Token      string `json:"token"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+// SasS管理者用API
+// テナント管理者になりすますための短時間のセッションを発行する
+// POST /api/admin/tenant/:tenant_id/impersonate
+// フォームのreasonに理由を書く 発行したセッションはimpersonationテーブルに記録する
+// 返したtokenをテナントのドメインでisuports_sessionクッキーに設定して使う
+func impersonateHandler(c echo.Context) error {
+	v, err := authorizeAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	reason := strings.TrimSpace(c.FormValue("reason"))
+	if reason == "" {
+		return apperr.InvalidField("reason", "reason required")
+	}
+
+	ctx := context.Background()
+	tenant, err := retrieveTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if tenant.Name == "admin" {
+		return ErrImpersonateAdmin
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error rand.Read: %w", err)
+	}
+	token := impersonationTokenPrefix + hex.EncodeToString(b)
+	now := time.Now().Unix()
+	expiresAt := now + impersonationTTLSeconds()
+	insertRes, err := adminDB.ExecContext(
+		ctx,
+		"INSERT INTO impersonation (token_hash, admin_subject, tenant_id, reason, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		hashImpersonationToken(token), v.playerID, tenantID, reason, now, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error Insert impersonation: subject=%s, tenantID=%d, %w", v.playerID, tenantID, err)
+	}
+	id, err := insertRes.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+	c.Logger().Infof("audit: impersonation issued: id=%d subject=%s tenant=%s reason=%q", id, v.playerID, tenant.Name, reason)
+
+	res := ImpersonateHandlerResult{
+		ID:         strconv.FormatInt(id, 10),
+		TenantID:   strconv.FormatInt(tenantID, 10),
+		TenantName: tenant.Name,
+		CookieName: cookieName,
+		Token:      token,
+		ExpiresAt:  expiresAt,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type ImpersonationDetail struct {
+	ID           string `json:"id"`
+	AdminSubject string `json:"admin_subject"`
+	Reason       string `json:"reason"`
+	CreatedAt    int64  `json:"created_at"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+type ImpersonationsHandlerResult struct {
+	Impersonations []ImpersonationDetail `json:"impersonations"`
+}
+
+// SasS管理者用API
+// テナントに対するなりすましの記録を新しい順に取得する
+// GET /api/admin/tenant/:tenant_id/impersonations
+func impersonationsHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	imps := []ImpersonationRow{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&imps,
+		"SELECT * FROM impersonation WHERE tenant_id = ? ORDER BY id DESC",
+		tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select impersonation: tenantID=%d, %w", tenantID, err)
+	}
+
+	res := ImpersonationsHandlerResult{Impersonations: make([]ImpersonationDetail, 0, len(imps))}
+	for _, imp := range imps {
+		res.Impersonations = append(res.Impersonations, ImpersonationDetail{
+			ID:           strconv.FormatInt(imp.ID, 10),
+			AdminSubject: imp.AdminSubject,
+			Reason:       imp.Reason,
+			CreatedAt:    imp.CreatedAt,
+			ExpiresAt:    imp.ExpiresAt,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,174 @@
+package isuports
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/errgroup"
+)
+
+// 初期化(POST /initialize)
+// sql/init.sh と同じことを、シェルやmysql, sqlite3コマンドを使わずに行う
+// - 管理用DBの初期データ以外の行を消す initialize/admin.sql
+// - テナントDBのファイルを初期データのスナップショットで置き換え、マイグレーションを適用する
+
+//go:embed initialize/admin.sql
+var initializeAdminSQL string
+
+// 初期化で同時に置き換えるテナントDBの数
+// 環境変数 ISUCON_INITIALIZE_CONCURRENCY で変更できる
+func initializeConcurrency() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_INITIALIZE_CONCURRENCY", "8"))
+	if err != nil || n <= 0 {
+		return 8
+	}
+	return n
+}
+
+// 置き換えたテナントDBの数をこの数ごとにログに出す
+const initializeProgressInterval = 20
+
+// テナントDBの初期データのファイルを置いているディレクトリ
+// 環境変数 ISUCON_TENANT_DB_SNAPSHOT_DIR で変更できる
+func tenantDBSnapshotDir() string {
+	return getEnv("ISUCON_TENANT_DB_SNAPSHOT_DIR", "../../initial_data")
+}
+
+// 初期化の処理ごとにかかった時間
+type InitializeStep struct {
+	Name      string `json:"name"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// 初期化の処理を順に実行し、それぞれにかかった時間を記録する
+// 初期化の時間のうち何が長いかを見られるように、開始と終了をログに出す
+type initializeSteps []InitializeStep
+
+func (s *initializeSteps) run(name string, fn func() error) error {
+	log.Printf("initialize: step=%s started", name)
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+	*s = append(*s, InitializeStep{Name: name, ElapsedMs: elapsed.Milliseconds()})
+	if err != nil {
+		log.Printf("initialize: step=%s failed, elapsed=%s, %s", name, elapsed, err)
+		return fmt.Errorf("error initialize %s: %w", name, err)
+	}
+	log.Printf("initialize: step=%s done, elapsed=%s", name, elapsed)
+	return nil
+}
+
+// 埋め込んだSQLで管理用DBを初期化する
+// 管理用DBの接続は複数の文を一度に実行できない設定なので、1文ずつ実行する
+func initializeAdminDB(ctx context.Context) error {
+	lines := []string{}
+	for _, l := range strings.Split(initializeAdminSQL, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(l), "--") {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		if _, err := adminDB.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("error Exec: stmt=%s, %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// テナントDBのファイルを全て消し、初期データのスナップショットをコピーする
+// コピーしたファイルにはsqlite3コマンドで 20_migration.sql を適用していた代わりにマイグレーションを適用する
+// テナントごとのコピーとマイグレーションは並行に行い、置き換えたテナントDBの数を返す
+func restoreTenantDBs(ctx context.Context) (int, error) {
+	dir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	for _, pattern := range []string{"*.db", "*.db-wal", "*.db-shm", "*.db-journal"} {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return 0, fmt.Errorf("error filepath.Glob: %w", err)
+		}
+		for _, f := range files {
+			if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return 0, fmt.Errorf("error remove %s: %w", f, err)
+			}
+		}
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(tenantDBSnapshotDir(), "*.db"))
+	if err != nil {
+		return 0, fmt.Errorf("error filepath.Glob: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return 0, fmt.Errorf("tenant DB snapshot not found: dir=%s", tenantDBSnapshotDir())
+	}
+
+	var restored int64
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(initializeConcurrency())
+	for _, src := range snapshots {
+		src := src
+		eg.Go(func() error {
+			dst := filepath.Join(dir, filepath.Base(src))
+			if err := copyTenantDBFile(src, dst); err != nil {
+				return err
+			}
+			if err := migrateTenantDBFile(ctx, dst); err != nil {
+				return err
+			}
+			if n := atomic.AddInt64(&restored, 1); n%initializeProgressInterval == 0 {
+				log.Printf("initialize: tenant DB restored %d/%d", n, len(snapshots))
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return int(atomic.LoadInt64(&restored)), err
+	}
+	return len(snapshots), nil
+}
+
+func copyTenantDBFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error os.Open: %w", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error os.Create: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error io.Copy: src=%s, dst=%s, %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error close %s: %w", dst, err)
+	}
+	return nil
+}
+
+func migrateTenantDBFile(ctx context.Context, p string) error {
+	db, err := sqlx.Open(sqliteDriverName, tenantDBDSN(p))
+	if err != nil {
+		return fmt.Errorf("failed to open tenant DB: %w", err)
+	}
+	defer db.Close()
+	if _, err := migrateTenantDB(ctx, db); err != nil {
+		return fmt.Errorf("error migrateTenantDB: path=%s, %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+-- 初期化(POST /initialize)で管理用DBに実行するSQL go/initialize.go を参照
+-- sql/init.sql も合わせて変更すること
+
+DELETE FROM tenant WHERE id > 100;
+DELETE FROM visit_history WHERE created_at >= '1654041600';
+DELETE FROM billing_plan;
+DELETE FROM impersonation;
+DELETE FROM credential WHERE tenant_id > 100;
+DELETE FROM revoked_session;
+DELETE FROM ip_allowlist;
+DELETE FROM billing_receipt;
+DELETE FROM billing_report;
+DELETE FROM competition WHERE tenant_id > 100;
+DELETE FROM player WHERE tenant_id > 100;
+DELETE FROM player_score WHERE tenant_id > 100;
+DELETE FROM player_score_history WHERE tenant_id > 100;
+DELETE FROM score_upload WHERE tenant_id > 100;
+DELETE FROM score_upload_diff WHERE tenant_id > 100;
+DELETE FROM score_dispute WHERE tenant_id > 100;
+DELETE FROM id_sequence WHERE tenant_id > 100;
+DELETE FROM notification WHERE tenant_id > 100;
+DELETE FROM ranking_snapshot WHERE tenant_id > 100;
+UPDATE id_generator SET id=2678400000 WHERE stub='a';
+ALTER TABLE id_generator AUTO_INCREMENT=2678400000;
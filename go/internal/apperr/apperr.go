@@ -0,0 +1,154 @@
+// Package apperr はAPIが返すエラーの種類を表す
+// ハンドラはこのパッケージのエラーを返し、errorResponseHandlerでステータスコードとレスポンスに変換する
+// それ以外のエラーは全て500として扱う
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// エラーの種類 レスポンスのcodeとしてそのまま返す
+type Kind string
+
+const (
+	KindValidation Kind = "validation"
+	// リクエストがAPIの定義(OpenAPI)に合わない
+	KindUnprocessable Kind = "unprocessable"
+	KindUnauthorized  Kind = "unauthorized"
+	KindForbidden     Kind = "forbidden"
+	KindNotFound      Kind = "not_found"
+	KindConflict      Kind = "conflict"
+	KindUnavailable   Kind = "unavailable"
+)
+
+// errors.Isで種類を判定するためのエラー
+var (
+	ErrValidation    = errors.New("validation")
+	ErrUnprocessable = errors.New("unprocessable")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrForbidden     = errors.New("forbidden")
+	ErrNotFound      = errors.New("not found")
+	ErrConflict      = errors.New("conflict")
+	ErrUnavailable   = errors.New("unavailable")
+)
+
+var kinds = map[Kind]struct {
+	status   int
+	sentinel error
+}{
+	KindValidation:    {http.StatusBadRequest, ErrValidation},
+	KindUnprocessable: {http.StatusUnprocessableEntity, ErrUnprocessable},
+	KindUnauthorized:  {http.StatusUnauthorized, ErrUnauthorized},
+	KindForbidden:     {http.StatusForbidden, ErrForbidden},
+	KindNotFound:      {http.StatusNotFound, ErrNotFound},
+	KindConflict:      {http.StatusConflict, ErrConflict},
+	KindUnavailable:   {http.StatusServiceUnavailable, ErrUnavailable},
+}
+
+// InvalidFieldのCode
+const CodeInvalidField = "invalid_field"
+
+type Error struct {
+	Kind    Kind
+	Message string
+	// クライアントが判定に使うエラーの識別子 レスポンスのerror_codeとして返す
+	// 空ならKindを返す
+	Code string
+	// 不正な入力のフィールド名と理由
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Codeが設定されたErrorはCodeが一致するかで判定する
+func (e *Error) Is(target error) bool {
+	if t, ok := target.(*Error); ok {
+		return t.Code != "" && t.Code == e.Code
+	}
+	return kinds[e.Kind].sentinel == target
+}
+
+// Codeを設定したコピーを返す
+func (e *Error) WithCode(code string) *Error {
+	c := *e
+	c.Code = code
+	return &c
+}
+
+// レスポンスのerror_codeを返す
+func (e *Error) ErrorCode() string {
+	if e.Code != "" {
+		return e.Code
+	}
+	return string(e.Kind)
+}
+
+// HTTPのステータスコードを返す
+func (e *Error) Status() int {
+	if k, ok := kinds[e.Kind]; ok {
+		return k.status
+	}
+	return http.StatusInternalServerError
+}
+
+func newError(kind Kind, format string, args ...any) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// リクエストの内容が不正
+func Validation(format string, args ...any) *Error {
+	return newError(KindValidation, format, args...)
+}
+
+// リクエストのフィールドの値が不正
+func InvalidField(field string, format string, args ...any) *Error {
+	e := newError(KindValidation, format, args...)
+	e.Code = CodeInvalidField
+	e.Fields = map[string]string{field: e.Message}
+	return e
+}
+
+// リクエストがAPIの定義に合わない fieldsにフィールド名と理由を入れる
+func Unprocessable(fields map[string]string) *Error {
+	e := newError(KindUnprocessable, "request does not match the api definition")
+	e.Fields = fields
+	return e
+}
+
+// 認証されていない
+func Unauthorized(format string, args ...any) *Error {
+	return newError(KindUnauthorized, format, args...)
+}
+
+// 権限がない
+func Forbidden(format string, args ...any) *Error {
+	return newError(KindForbidden, format, args...)
+}
+
+// 対象が存在しない
+func NotFound(format string, args ...any) *Error {
+	return newError(KindNotFound, format, args...)
+}
+
+// 既存のデータと競合する
+func Conflict(format string, args ...any) *Error {
+	return newError(KindConflict, format, args...)
+}
+
+// 一時的に処理できない 時間をおいて再試行すれば成功する
+func Unavailable(format string, args ...any) *Error {
+	return newError(KindUnavailable, format, args...)
+}
+
+// errに含まれるErrorを返す
+func As(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
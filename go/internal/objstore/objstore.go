@@ -0,0 +1,75 @@
+// Package objstore はバックアップ、エクスポート、アップロード、結果の公開などで扱う大きなファイルの保存先を表す
+// 保存先はデプロイごとに1つ決めて、各機能はこのパッケージのStoreを通してファイルを読み書きする
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// 指定したキーのオブジェクトがない
+var ErrNotFound = errors.New("object not found")
+
+// オブジェクトの情報
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// オブジェクトの保存先
+// キーは/区切りの相対パスで、..や先頭の/は使えない
+type Store interface {
+	// sizeが分からない場合は-1を渡す
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (Object, error)
+	// 存在しないキーを削除してもエラーにしない
+	Delete(ctx context.Context, key string) error
+	// prefixで始まるキーのオブジェクトをキーの順に返す
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// キーが使えるものか確認する
+func ValidateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return fmt.Errorf("invalid object key: %q", key)
+	}
+	if path.Clean(key) != key {
+		return fmt.Errorf("invalid object key: %q", key)
+	}
+	for _, s := range strings.Split(key, "/") {
+		if s == ".." || s == "." {
+			return fmt.Errorf("invalid object key: %q", key)
+		}
+	}
+	return nil
+}
+
+// URLから保存先を作る
+// file:///path/to/dir か /path/to/dir ならローカルのディレクトリ、s3://bucket/prefix ならS3
+// S3の認証情報やエンドポイントはs3cfgで渡す BucketとPrefixはURLから設定する
+func Open(rawURL string, s3cfg S3Config) (Store, error) {
+	if !strings.Contains(rawURL, "://") {
+		return NewLocal(rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error url.Parse: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocal(u.Path)
+	case "s3":
+		s3cfg.Bucket = u.Host
+		s3cfg.Prefix = strings.Trim(u.Path, "/")
+		return NewS3(s3cfg)
+	}
+	return nil, fmt.Errorf("unsupported object storage scheme: %s", u.Scheme)
+}
@@ -0,0 +1,311 @@
+// テナント管理者向けAPIのgRPC版
+// RESTのAPI(/api/organizer/)と同じ処理を呼ぶ grpc.go を参照
+// 認証はRESTと同じJWTをメタデータの authorization: Bearer <token> で渡し、テナントは :authority (Hostヘッダ相当) で判定する
+// 生成したコードは internal/organizerpb に置く make proto で生成し直す
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: isuports/organizer/v1/organizer.proto
+
+package organizerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	OrganizerService_AddPlayers_FullMethodName        = "/isuports.organizer.v1.OrganizerService/AddPlayers"
+	OrganizerService_ListCompetitions_FullMethodName  = "/isuports.organizer.v1.OrganizerService/ListCompetitions"
+	OrganizerService_AddCompetition_FullMethodName    = "/isuports.organizer.v1.OrganizerService/AddCompetition"
+	OrganizerService_FinishCompetition_FullMethodName = "/isuports.organizer.v1.OrganizerService/FinishCompetition"
+	OrganizerService_UploadScores_FullMethodName      = "/isuports.organizer.v1.OrganizerService/UploadScores"
+)
+
+// OrganizerServiceClient is the client API for OrganizerService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OrganizerServiceClient interface {
+	// 参加者を追加する POST /api/organizer/players/add
+	AddPlayers(ctx context.Context, in *AddPlayersRequest, opts ...grpc.CallOption) (*AddPlayersResponse, error)
+	// 大会の一覧を取得する GET /api/organizer/competitions
+	ListCompetitions(ctx context.Context, in *ListCompetitionsRequest, opts ...grpc.CallOption) (*ListCompetitionsResponse, error)
+	// 大会を追加する POST /api/organizer/competitions/add
+	AddCompetition(ctx context.Context, in *AddCompetitionRequest, opts ...grpc.CallOption) (*AddCompetitionResponse, error)
+	// 大会を終了する POST /api/organizer/competition/:competition_id/finish
+	FinishCompetition(ctx context.Context, in *FinishCompetitionRequest, opts ...grpc.CallOption) (*FinishCompetitionResponse, error)
+	// 大会のスコアを置き換える POST /api/organizer/competition/:competition_id/score
+	// 最初のメッセージでcompetition_idを指定し、スコアは何回かに分けて送ってよい
+	// ストリームを閉じたところでまとめて置き換える
+	UploadScores(ctx context.Context, opts ...grpc.CallOption) (OrganizerService_UploadScoresClient, error)
+}
+
+type organizerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOrganizerServiceClient(cc grpc.ClientConnInterface) OrganizerServiceClient {
+	return &organizerServiceClient{cc}
+}
+
+func (c *organizerServiceClient) AddPlayers(ctx context.Context, in *AddPlayersRequest, opts ...grpc.CallOption) (*AddPlayersResponse, error) {
+	out := new(AddPlayersResponse)
+	err := c.cc.Invoke(ctx, OrganizerService_AddPlayers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organizerServiceClient) ListCompetitions(ctx context.Context, in *ListCompetitionsRequest, opts ...grpc.CallOption) (*ListCompetitionsResponse, error) {
+	out := new(ListCompetitionsResponse)
+	err := c.cc.Invoke(ctx, OrganizerService_ListCompetitions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organizerServiceClient) AddCompetition(ctx context.Context, in *AddCompetitionRequest, opts ...grpc.CallOption) (*AddCompetitionResponse, error) {
+	out := new(AddCompetitionResponse)
+	err := c.cc.Invoke(ctx, OrganizerService_AddCompetition_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organizerServiceClient) FinishCompetition(ctx context.Context, in *FinishCompetitionRequest, opts ...grpc.CallOption) (*FinishCompetitionResponse, error) {
+	out := new(FinishCompetitionResponse)
+	err := c.cc.Invoke(ctx, OrganizerService_FinishCompetition_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organizerServiceClient) UploadScores(ctx context.Context, opts ...grpc.CallOption) (OrganizerService_UploadScoresClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OrganizerService_ServiceDesc.Streams[0], OrganizerService_UploadScores_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &organizerServiceUploadScoresClient{stream}
+	return x, nil
+}
+
+type OrganizerService_UploadScoresClient interface {
+	Send(*UploadScoresRequest) error
+	CloseAndRecv() (*UploadScoresResponse, error)
+	grpc.ClientStream
+}
+
+type organizerServiceUploadScoresClient struct {
+	grpc.ClientStream
+}
+
+func (x *organizerServiceUploadScoresClient) Send(m *UploadScoresRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *organizerServiceUploadScoresClient) CloseAndRecv() (*UploadScoresResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadScoresResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OrganizerServiceServer is the server API for OrganizerService service.
+// All implementations must embed UnimplementedOrganizerServiceServer
+// for forward compatibility
+type OrganizerServiceServer interface {
+	// 参加者を追加する POST /api/organizer/players/add
+	AddPlayers(context.Context, *AddPlayersRequest) (*AddPlayersResponse, error)
+	// 大会の一覧を取得する GET /api/organizer/competitions
+	ListCompetitions(context.Context, *ListCompetitionsRequest) (*ListCompetitionsResponse, error)
+	// 大会を追加する POST /api/organizer/competitions/add
+	AddCompetition(context.Context, *AddCompetitionRequest) (*AddCompetitionResponse, error)
+	// 大会を終了する POST /api/organizer/competition/:competition_id/finish
+	FinishCompetition(context.Context, *FinishCompetitionRequest) (*FinishCompetitionResponse, error)
+	// 大会のスコアを置き換える POST /api/organizer/competition/:competition_id/score
+	// 最初のメッセージでcompetition_idを指定し、スコアは何回かに分けて送ってよい
+	// ストリームを閉じたところでまとめて置き換える
+	UploadScores(OrganizerService_UploadScoresServer) error
+	mustEmbedUnimplementedOrganizerServiceServer()
+}
+
+// UnimplementedOrganizerServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedOrganizerServiceServer struct {
+}
+
+func (UnimplementedOrganizerServiceServer) AddPlayers(context.Context, *AddPlayersRequest) (*AddPlayersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddPlayers not implemented")
+}
+func (UnimplementedOrganizerServiceServer) ListCompetitions(context.Context, *ListCompetitionsRequest) (*ListCompetitionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCompetitions not implemented")
+}
+func (UnimplementedOrganizerServiceServer) AddCompetition(context.Context, *AddCompetitionRequest) (*AddCompetitionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddCompetition not implemented")
+}
+func (UnimplementedOrganizerServiceServer) FinishCompetition(context.Context, *FinishCompetitionRequest) (*FinishCompetitionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FinishCompetition not implemented")
+}
+func (UnimplementedOrganizerServiceServer) UploadScores(OrganizerService_UploadScoresServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadScores not implemented")
+}
+func (UnimplementedOrganizerServiceServer) mustEmbedUnimplementedOrganizerServiceServer() {}
+
+// UnsafeOrganizerServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OrganizerServiceServer will
+// result in compilation errors.
+type UnsafeOrganizerServiceServer interface {
+	mustEmbedUnimplementedOrganizerServiceServer()
+}
+
+func RegisterOrganizerServiceServer(s grpc.ServiceRegistrar, srv OrganizerServiceServer) {
+	s.RegisterService(&OrganizerService_ServiceDesc, srv)
+}
+
+func _OrganizerService_AddPlayers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddPlayersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganizerServiceServer).AddPlayers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganizerService_AddPlayers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganizerServiceServer).AddPlayers(ctx, req.(*AddPlayersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganizerService_ListCompetitions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCompetitionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganizerServiceServer).ListCompetitions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganizerService_ListCompetitions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganizerServiceServer).ListCompetitions(ctx, req.(*ListCompetitionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganizerService_AddCompetition_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddCompetitionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganizerServiceServer).AddCompetition(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganizerService_AddCompetition_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganizerServiceServer).AddCompetition(ctx, req.(*AddCompetitionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganizerService_FinishCompetition_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FinishCompetitionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganizerServiceServer).FinishCompetition(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganizerService_FinishCompetition_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganizerServiceServer).FinishCompetition(ctx, req.(*FinishCompetitionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganizerService_UploadScores_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(OrganizerServiceServer).UploadScores(&organizerServiceUploadScoresServer{stream})
+}
+
+type OrganizerService_UploadScoresServer interface {
+	SendAndClose(*UploadScoresResponse) error
+	Recv() (*UploadScoresRequest, error)
+	grpc.ServerStream
+}
+
+type organizerServiceUploadScoresServer struct {
+	grpc.ServerStream
+}
+
+func (x *organizerServiceUploadScoresServer) SendAndClose(m *UploadScoresResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *organizerServiceUploadScoresServer) Recv() (*UploadScoresRequest, error) {
+	m := new(UploadScoresRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OrganizerService_ServiceDesc is the grpc.ServiceDesc for OrganizerService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OrganizerService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "isuports.organizer.v1.OrganizerService",
+	HandlerType: (*OrganizerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddPlayers",
+			Handler:    _OrganizerService_AddPlayers_Handler,
+		},
+		{
+			MethodName: "ListCompetitions",
+			Handler:    _OrganizerService_ListCompetitions_Handler,
+		},
+		{
+			MethodName: "AddCompetition",
+			Handler:    _OrganizerService_AddCompetition_Handler,
+		},
+		{
+			MethodName: "FinishCompetition",
+			Handler:    _OrganizerService_FinishCompetition_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "UploadScores",
+			Handler:       _OrganizerService_UploadScores_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "isuports/organizer/v1/organizer.proto",
+}
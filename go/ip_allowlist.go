@@ -0,0 +1,335 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// SaaS管理者向けAPIの許可リストのtenant_id
+const adminIPAllowlistTenantID = 0
+
+// 接続元IPアドレスの許可リストを使うか
+// 環境変数 ISUCON_IP_ALLOWLIST=0 で無効になる 許可リストを誤って設定して締め出されたときに使う
+// 許可リストが空なら全て許可する
+func ipAllowlistEnabled() bool {
+	return getEnv("ISUCON_IP_ALLOWLIST", "1") != "0"
+}
+
+type IPAllowlistRow struct {
+	ID        int64  `db:"id"`
+	TenantID  int64  `db:"tenant_id"`
+	CIDR      string `db:"cidr"`
+	Note      string `db:"note"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// Hostヘッダのテナント名ごとの許可リスト
+var ipAllowlistCache = helpisu.NewCache[string, []*net.IPNet]()
+
+// Hostヘッダのテナント名に対する許可リストを返す
+// adminの場合はSaaS管理者向けAPIの許可リスト
+func retrieveIPAllowlist(ctx context.Context, tenantName string) ([]*net.IPNet, error) {
+	if nets, ok := ipAllowlistCache.Get(tenantName); ok {
+		return nets, nil
+	}
+	cidrs := []string{}
+	var err error
+	if tenantName == "admin" {
+		err = adminDB.SelectContext(
+			ctx,
+			&cidrs,
+			"SELECT cidr FROM ip_allowlist WHERE tenant_id = ?",
+			adminIPAllowlistTenantID,
+		)
+	} else {
+		err = adminDB.SelectContext(
+			ctx,
+			&cidrs,
+			"SELECT ip_allowlist.cidr FROM ip_allowlist JOIN tenant ON tenant.id = ip_allowlist.tenant_id WHERE tenant.name = ?",
+			tenantName,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error Select ip_allowlist: tenantName=%s, %w", tenantName, err)
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("error net.ParseCIDR: cidr=%s, %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	ipAllowlistCache.Set(tenantName, nets)
+	return nets, nil
+}
+
+// 許可リストに含まれているか 空のリストは全て許可する
+func ipAllowed(nets []*net.IPNet, ip net.IP) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 単一のIPアドレスは/32か/128のCIDRとして扱う
+func normalizeCIDR(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP address: %s", s)
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", err
+	}
+	return n.String(), nil
+}
+
+// /api/organizer/ をテナントごとの許可リストで、/api/admin/ をSaaS管理者向けの許可リストで制限する
+// 接続元IPアドレスはecho.Context.RealIPで取得する newEcho の IPExtractor を参照
+func IPAllowlist(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !ipAllowlistEnabled() {
+			return next(c)
+		}
+		path := c.Request().URL.Path
+		if !strings.HasPrefix(path, "/api/organizer/") && !strings.HasPrefix(path, "/api/admin/") {
+			return next(c)
+		}
+		baseHost := appConfig.Hostname.Base
+		tenantName := strings.TrimSuffix(c.Request().Host, baseHost)
+		// SaaS管理者向けAPIはテナントのドメインでは404になるので、許可リストはadminのドメインでだけ見る
+		if strings.HasPrefix(path, "/api/admin/") && tenantName != "admin" {
+			return next(c)
+		}
+		nets, err := retrieveIPAllowlist(c.Request().Context(), tenantName)
+		if err != nil {
+			return err
+		}
+		if !ipAllowed(nets, net.ParseIP(c.RealIP())) {
+			return ErrIPNotAllowed
+		}
+		return next(c)
+	}
+}
+
+type IPAllowlistDetail struct {
+	ID        string `json:"id"`
+	TenantID  string `json:"tenant_id"`
+	CIDR      string `json:"cidr"`
+	Note      string `json:"note"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func toIPAllowlistDetail(r IPAllowlistRow) IPAllowlistDetail {
+	return IPAllowlistDetail{
+		ID:        strconv.FormatInt(r.ID, 10),
+		TenantID:  strconv.FormatInt(r.TenantID, 10),
+		CIDR:      r.CIDR,
+		Note:      r.Note,
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+// tenant_idを読む 省略した場合と0はSaaS管理者向けAPIの許可リスト
+func ipAllowlistTenantID(ctx context.Context, s string) (int64, error) {
+	if s == "" {
+		return adminIPAllowlistTenantID, nil
+	}
+	tenantID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, apperr.InvalidField("tenant_id", "invalid tenant_id: %s", s)
+	}
+	if tenantID == adminIPAllowlistTenantID {
+		return tenantID, nil
+	}
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return 0, err
+	}
+	return tenantID, nil
+}
+
+type IPAllowlistHandlerResult struct {
+	Entries []IPAllowlistDetail `json:"entries"`
+}
+
+// SasS管理者用API
+// GET /api/admin/ip_allowlist
+// 接続元IPアドレスの許可リストを取得する
+// tenant_idを指定するとそのテナントの/api/organizer/の許可リスト、省略すると/api/admin/の許可リスト
+func ipAllowlistHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tenantID, err := ipAllowlistTenantID(ctx, c.QueryParam("tenant_id"))
+	if err != nil {
+		return err
+	}
+
+	rows := []IPAllowlistRow{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&rows,
+		"SELECT * FROM ip_allowlist WHERE tenant_id = ? ORDER BY id ASC",
+		tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select ip_allowlist: tenantID=%d, %w", tenantID, err)
+	}
+	res := IPAllowlistHandlerResult{Entries: make([]IPAllowlistDetail, 0, len(rows))}
+	for _, r := range rows {
+		res.Entries = append(res.Entries, toIPAllowlistDetail(r))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type IPAllowlistEntryHandlerResult struct {
+	Entry IPAllowlistDetail `json:"entry"`
+}
+
+// SasS管理者用API
+// POST /api/admin/ip_allowlist/add
+// 接続元IPアドレスの許可リストにCIDRを追加する
+// フォームのtenant_idは ipAllowlistHandler と同じ cidrには単一のIPアドレスも指定できる
+// /api/admin/の許可リストに最初に追加するCIDRは、リクエストの接続元を含んでいなければならない
+func ipAllowlistAddHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tenantID, err := ipAllowlistTenantID(ctx, c.FormValue("tenant_id"))
+	if err != nil {
+		return err
+	}
+	cidr, err := normalizeCIDR(c.FormValue("cidr"))
+	if err != nil {
+		return apperr.InvalidField("cidr", "invalid cidr: %s", err)
+	}
+	note := c.FormValue("note")
+	if len(note) > 255 {
+		return apperr.InvalidField("note", "note must be at most 255 bytes")
+	}
+
+	// 空の許可リストは全て許可するので、最初の1件で自分を締め出さないようにする
+	if tenantID == adminIPAllowlistTenantID {
+		nets, err := retrieveIPAllowlist(ctx, "admin")
+		if err != nil {
+			return err
+		}
+		if len(nets) == 0 {
+			_, n, _ := net.ParseCIDR(cidr)
+			if !n.Contains(net.ParseIP(c.RealIP())) {
+				return apperr.InvalidField("cidr", "cidr must contain your address %s", c.RealIP())
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	insertRes, err := adminDB.ExecContext(
+		ctx,
+		"INSERT INTO ip_allowlist (tenant_id, cidr, note, created_at) VALUES (?, ?, ?, ?)",
+		tenantID, cidr, note, now,
+	)
+	if err != nil {
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // duplicate entry
+			return ErrIPAllowlistDuplicate
+		}
+		return fmt.Errorf("error Insert ip_allowlist: tenantID=%d, cidr=%s, %w", tenantID, cidr, err)
+	}
+	id, err := insertRes.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+	ipAllowlistCache.Reset()
+
+	res := IPAllowlistEntryHandlerResult{
+		Entry: toIPAllowlistDetail(IPAllowlistRow{
+			ID:        id,
+			TenantID:  tenantID,
+			CIDR:      cidr,
+			Note:      note,
+			CreatedAt: now,
+		}),
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// SasS管理者用API
+// POST /api/admin/ip_allowlist/:entry_id/delete
+// 接続元IPアドレスの許可リストからCIDRを削除する
+// 最後の1件を削除すると全て許可する
+func ipAllowlistDeleteHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	id, err := strconv.ParseInt(c.Param("entry_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("entry_id", "invalid entry_id")
+	}
+
+	var row IPAllowlistRow
+	if err := adminDB.GetContext(ctx, &row, "SELECT * FROM ip_allowlist WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrIPAllowlistEntryNotFound
+		}
+		return fmt.Errorf("error Select ip_allowlist: id=%d, %w", id, err)
+	}
+	// 残りの許可リストで自分を締め出さないようにする
+	if row.TenantID == adminIPAllowlistTenantID {
+		rest := []string{}
+		if err := adminDB.SelectContext(
+			ctx,
+			&rest,
+			"SELECT cidr FROM ip_allowlist WHERE tenant_id = ? AND id != ?",
+			adminIPAllowlistTenantID, id,
+		); err != nil {
+			return fmt.Errorf("error Select ip_allowlist: %w", err)
+		}
+		nets := make([]*net.IPNet, 0, len(rest))
+		for _, cidr := range rest {
+			if _, n, err := net.ParseCIDR(cidr); err == nil {
+				nets = append(nets, n)
+			}
+		}
+		if !ipAllowed(nets, net.ParseIP(c.RealIP())) {
+			return apperr.Validation("deleting this entry would block your address %s", c.RealIP()).WithCode(ErrIPAllowlistSelfLockout.Code)
+		}
+	}
+	if _, err := adminDB.ExecContext(ctx, "DELETE FROM ip_allowlist WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error Delete ip_allowlist: id=%d, %w", id, err)
+	}
+	ipAllowlistCache.Reset()
+
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   IPAllowlistEntryHandlerResult{Entry: toIPAllowlistDetail(row)},
+	})
+}
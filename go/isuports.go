@@ -6,32 +6,27 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/gofrs/flock"
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/labstack/gommon/log"
-	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jwk"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/logica0419/helpisu"
 )
 
 const (
-	tenantDBSchemaFilePath = "../sql/tenant/10_schema.sql"
-	initializeScript       = "../sql/init.sh"
-	cookieName             = "isuports_session"
+	cookieName = "isuports_session"
 
 	RoleAdmin     = "admin"
 	RoleOrganizer = "organizer"
@@ -47,26 +42,35 @@ var (
 
 	sqliteDriverName = "sqlite3"
 	tenantDBCache    = helpisu.NewCache[int64, *sqlx.DB]()
-	dispenseMu       = sync.Mutex{}
-	curId            = int64(-1)
 )
 
-// 環境変数を取得する、なければデフォルト値を返す
+// 環境変数を取得する、なければ設定ファイルのenvの値、それもなければデフォルト値を返す
 func getEnv(key string, defaultValue string) string {
 	if val, ok := os.LookupEnv(key); ok {
+		recordEnvLookup(key, val, false)
 		return val
 	}
+	if val, ok := appConfig.Env[key]; ok {
+		recordEnvLookup(key, val, false)
+		return val
+	}
+	recordEnvLookup(key, defaultValue, true)
 	return defaultValue
 }
 
 // 管理用DBに接続する
 func connectAdminDB() (*sqlx.DB, error) {
+	return connectAdminDBAt(appConfig.AdminDB.Host + ":" + appConfig.AdminDB.Port)
+}
+
+// 管理用DBと同じユーザーとデータベース名で、指定したホストのMySQLに接続する
+func connectAdminDBAt(addr string) (*sqlx.DB, error) {
 	config := mysql.NewConfig()
 	config.Net = "tcp"
-	config.Addr = getEnv("ISUCON_DB_HOST", "127.0.0.1") + ":" + getEnv("ISUCON_DB_PORT", "3306")
-	config.User = getEnv("ISUCON_DB_USER", "isucon")
-	config.Passwd = getEnv("ISUCON_DB_PASSWORD", "isucon")
-	config.DBName = getEnv("ISUCON_DB_NAME", "isuports")
+	config.Addr = addr
+	config.User = appConfig.AdminDB.User
+	config.Passwd = appConfig.AdminDB.Password
+	config.DBName = appConfig.AdminDB.Name
 	config.ParseTime = true
 	config.InterpolateParams = true
 	dsn := config.FormatDSN()
@@ -75,56 +79,69 @@ func connectAdminDB() (*sqlx.DB, error) {
 
 // テナントDBのパスを返す
 func tenantDBPath(id int64) string {
+	// スタンバイにフェイルオーバーしたテナント tenant_db_standby.go を参照
+	if isTenantDBFailedOver(id) {
+		return standbyTenantDBPath(id)
+	}
 	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
 	return filepath.Join(tenantDBDir, fmt.Sprintf("%d.db", id))
 }
 
 // テナントDBに接続する
+// MySQLに置いたテナントの場合は全テナントで共有する接続を返すので、Closeしてはいけない
 func connectToTenantDB(id int64) (*sqlx.DB, error) {
 	tenantDB, ok := tenantDBCache.Get(id)
+	tenantDBCacheStats.record(ok)
 	if ok {
+		touchTenantDB(id)
 		return tenantDB, nil
 	}
+	storage, err := retrieveTenantStorage(context.Background(), id)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieveTenantStorage: %w", err)
+	}
+	if storage == TenantStorageMySQL {
+		return connectTenantMySQLDB()
+	}
+	if tenantDBMemoryEnabled() {
+		return connectToMemoryTenantDB(id)
+	}
 	p := tenantDBPath(id)
-	db, err := sqlx.Open(sqliteDriverName, fmt.Sprintf("file:%s?mode=rw", p))
+	db, err := sqlx.Open(sqliteDriverName, tenantDBDSN(p))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open tenant DB: %w", err)
 	}
+	// tenant_db_pool.go を参照
+	configureTenantDBPool(db)
+	// tenant_migration.go, tenant_schema.go を参照
+	migrateTenantDBOrLog(context.Background(), id, db)
+	verifyTenantSchema(context.Background(), id, db)
 	tenantDBCache.Set(id, db)
+	touchTenantDB(id)
 	return db, nil
 }
 
 // テナントDBを新規に作成する
-func createTenantDB(id int64) error {
+// MySQLに置くテナントはテーブルを共有するので作成するものはない
+func createTenantDB(id int64, storage string) error {
 	if _, ok := tenantDBCache.Get(id); ok {
 		return nil
 	}
+	if storage == TenantStorageMySQL {
+		return nil
+	}
 
+	// 埋め込んだマイグレーションを全て適用して作る tenant_migration.go を参照
 	p := tenantDBPath(id)
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("sqlite3 %s < %s", p, tenantDBSchemaFilePath))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to exec sqlite3 %s < %s, out=%s: %w", p, tenantDBSchemaFilePath, string(out), err)
+	db, err := sqlx.Open(sqliteDriverName, fmt.Sprintf("file:%s?mode=rwc", p))
+	if err != nil {
+		return fmt.Errorf("failed to open tenant DB: %w", err)
 	}
-	return nil
-}
-
-// システム全体で一意なIDを生成する
-// これMutexと加算で置き換えられる
-func dispenseID(ctx context.Context) (string, error) {
-	if curId == -1 {
-		adminDB.Get(curId, "SELECT id FROM id_generator WHERE stub='a';")
+	defer db.Close()
+	if _, err := migrateTenantDB(context.Background(), db); err != nil {
+		return fmt.Errorf("error migrateTenantDB: path=%s, %w", p, err)
 	}
-	dispenseMu.Lock()
-	curId += 1
-	dispenseMu.Unlock()
-	return fmt.Sprintf("%x", curId), nil
-}
-
-func dispenseUpdate() {
-	t := time.NewTicker(90 * time.Second)
-	defer t.Stop()
-	<-t.C
-	adminDB.Exec("UPDATE id_generator SET id = ?, stub=?;", curId, "a")
+	return nil
 }
 
 // 全APIにCache-Control: privateを設定する
@@ -137,11 +154,82 @@ func SetCacheControlPrivate(next echo.HandlerFunc) echo.HandlerFunc {
 
 var d *helpisu.DBDisconnectDetector
 
+// Server はisuportsのサーバー
+// 埋め込んで使う場合はHooksを設定してからRunを呼ぶ
+type Server struct {
+	Hooks Hooks
+	// nilの場合は環境変数だけを反映した設定を使う config.go を参照
+	Config *Config
+}
+
+func NewServer() *Server {
+	return &Server{}
+}
+
 // Run は cmd/isuports/main.go から呼ばれるエントリーポイントです
-func Run() {
-	e := echo.New()
-	e.Debug = true
-	e.Logger.SetLevel(log.DEBUG)
+func Run(cfg *Config) {
+	s := NewServer()
+	s.Config = cfg
+	s.Run()
+}
+
+// 設定を反映する ログのレベルも設定ファイルで変えられるようにロガーを作り直す
+// Configがnilの場合は、起動後に設定された環境変数も反映するようにここで読み直す
+func (s *Server) applyConfig() {
+	if s.Config != nil {
+		appConfig = s.Config
+	} else {
+		appConfig = defaultConfigFromEnv()
+	}
+	appLogger = newAppLogger(getEnv("ISUCON_LOG_LEVEL", "info"))
+}
+
+// Handler はリッスンせずにリクエストを処理するhttp.Handlerを返す
+// テストから使うためのもので、Runと違いバックグラウンドのジョブは起動しない
+// 使い終わったらCloseを呼ぶこと
+func (s *Server) Handler() (http.Handler, error) {
+	hooks = s.Hooks
+	s.applyConfig()
+	resetCaches()
+
+	var err error
+	adminDB, err = connectAdminDB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect db: %w", err)
+	}
+	return newEcho(), nil
+}
+
+// Close はHandlerで開いたDBへの接続を閉じる
+func (s *Server) Close() error {
+	if adminDB == nil {
+		return nil
+	}
+	closeMemoryTenantDBs()
+	closeTenantDBs()
+	closeTenantMySQLDB()
+	return adminDB.Close()
+}
+
+// Run はサーバーを起動する
+func (s *Server) Run() {
+	hooks = s.Hooks
+	s.applyConfig()
+
+	// log.Printfで書いたログもJSONで出力する
+	defer redirectStdLog()()
+	defer appLogger.Sync()
+
+	e := newEcho()
+
+	// SO_REUSEPORTで同じポートをlistenする子プロセスを起動する
+	// listener.go を参照
+	if isListenerSupervisor() {
+		if err := superviseListenerProcesses(); err != nil {
+			e.Logger.Fatalf("error superviseListenerProcesses: %s", err)
+		}
+		return
+	}
 
 	var (
 		sqlLogger io.Closer
@@ -157,84 +245,312 @@ func Run() {
 	}
 	defer sqlLogger.Close()
 
-	e.Use(middleware.Logger())
+	adminDB, err = connectAdminDB()
+	if err != nil {
+		e.Logger.Fatalf("failed to connect db: %v", err)
+		return
+	}
+	adminDB.SetMaxOpenConns(appConfig.AdminDB.MaxOpenConns)
+	defer adminDB.Close()
+
+	// リードレプリカ admin_db_replica.go を参照
+	if err := connectAdminDBReplicas(); err != nil {
+		e.Logger.Fatalf("failed to connect replica: %v", err)
+		return
+	}
+	defer closeAdminDBReplicas()
+	if len(adminDBReplicas) > 0 {
+		startTicker("admin_db_replica_health", adminDBReplicaHealthCheckIntervalMs(), adminDBReplicaHealthCheckJob)
+	}
+
+	helpisu.WaitDBStartUp(adminDB.DB)
+
+	// テナントDBのスキーマが期待するものと一致しているかを確認する
+	if err := verifyAllTenantSchemas(context.Background()); err != nil {
+		e.Logger.Errorf("error verifyAllTenantSchemas: %s", err)
+	}
+
+	d = helpisu.NewDBDisconnectDetector(5, 90, adminDB.DB)
+	go d.Start()
+
+	// 閲覧履歴のジャーナルを開き、前のプロセスが書き込めなかった閲覧履歴をvisit_historyに書き込む
+	// visit_history_journal.go を参照
+	if dir := visitHistoryJournalDir(); dir != "" {
+		if err := openVisitHistoryJournal(dir); err != nil {
+			e.Logger.Fatalf("error openVisitHistoryJournal: %s", err)
+		}
+		delayedInsertVisitHistory()
+	}
+
+	// visit_historyの月ごとのパーティションを1時間ごとに保守する
+	go visitHistoryPartitionJob()
+	startTicker("visit_history_partition", 60*60*1000, visitHistoryPartitionJob)
+	// 保持期間を過ぎた終了した大会のvisit_historyを削除する
+	startTicker("visit_history_purge", visitHistoryPurgeIntervalMs(), visitHistoryPurgeJob)
+
+	// WALモードの場合は大きくなったWALファイルを定期的に切り詰める
+	if tenantDBWALEnabled() {
+		startTicker("wal_checkpoint", walCheckpointIntervalMs(), walCheckpointJob)
+	}
+	// 使われていないテナントDBの接続を閉じる tenant_db_pool.go を参照
+	if tenantDBEvictionEnabled() {
+		startTicker("tenant_db_evict", tenantDBEvictIntervalMs(), tenantDBEvictJob)
+	}
+
+	// テナントDBをメモリ上に置く場合は定期的にファイルに書き戻す
+	if tenantDBMemoryEnabled() {
+		startTicker("memory_write_back", tenantDBMemoryWriteBackIntervalMs(), memoryTenantDBWriteBackJob)
+	}
+
+	// アクセスのないテナントのDBへの接続とキャッシュを定期的に捨てる
+	if tenantTieringEnabled() {
+		startTicker("tenant_tier", tenantTierConfig().IntervalMs, tenantTierJob)
+	}
+
+	// テナントDBをスタンバイに定期的にコピーする
+	if tenantDBStandbyDir() != "" && !tenantDBMemoryEnabled() {
+		if err := loadTenantDBFailovers(); err != nil {
+			e.Logger.Errorf("error loadTenantDBFailovers: %s", err)
+		}
+		startTicker("standby", tenantDBStandbyIntervalMs(), tenantDBStandbyJob)
+	}
+
+	// 終了した大会の参加者ごとの最終順位の通知を作る
+	startTicker("notification_digest", 2000, notificationDigestJob)
+
+	// ヒープが上限に近づいたら大きなキャッシュを捨てる memory_governor.go を参照
+	if memoryLimitBytes() > 0 {
+		startTicker("memory_governor", memoryGovernorIntervalMs(), memoryGovernorJob)
+	}
+
+	// 同じホストの他のプロセスとランキングのキャッシュを共有する
+	if p := rankingShareSocketPath(); p != "" {
+		if err := startRankingShare(p); err != nil {
+			e.Logger.Fatalf("failed to start ranking share: %v", err)
+			return
+		}
+	}
+
+	// プール内に保持できるアイドル接続数の制限を設定 (default: 2)
+	adminDB.SetMaxIdleConns(appConfig.AdminDB.MaxIdleConns)
+	// 接続してから再利用できる最大期間
+	adminDB.SetConnMaxLifetime(time.Duration(appConfig.AdminDB.ConnMaxLifetimeMs) * time.Millisecond)
+	// アイドル接続してから再利用できる最大期間
+	adminDB.SetConnMaxIdleTime(time.Duration(appConfig.AdminDB.ConnMaxIdleTimeMs) * time.Millisecond)
+
+	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0           // default: 100
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1024 // default: 2
+	http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2 = true
+	http.DefaultClient.Timeout = 5 * time.Second // 問題の切り分け用
+
+	// debug_listener.go を参照
+	startDebugListener()
+
+	port := appConfig.Server.Port
+	e.Logger.Infof("starting isuports server on : %s ...", port)
+	serverPort := fmt.Sprintf(":%s", port)
+	// HTTPSで直接受け付ける設定 tls.go を参照
+	tlsCfg, redirect, err := newTLSConfig()
+	if err != nil {
+		e.Logger.Fatalf("failed to configure tls: %v", err)
+		return
+	}
+	l, err := reusePortListener(serverPort, e, tlsCfg)
+	if err != nil {
+		e.Logger.Fatalf("failed to listen: %v", err)
+		return
+	}
+	if l == nil && tlsCfg != nil {
+		if l, err = listenTLS(serverPort, tlsCfg); err != nil {
+			e.Logger.Fatalf("failed to listen: %v", err)
+			return
+		}
+	}
+	if redirect != nil {
+		if err := startHTTPRedirect(redirect); err != nil {
+			e.Logger.Fatalf("failed to listen: %v", err)
+			return
+		}
+	}
+	// テナント管理者向けAPIのgRPC版 grpc.go を参照
+	if grpcAddr() != "" {
+		if err := startGRPCServer(tlsCfg); err != nil {
+			e.Logger.Fatalf("failed to start grpc server: %v", err)
+			return
+		}
+	}
+	if l != nil {
+		e.Listener = l
+	}
+	go func() {
+		if err := e.Start(serverPort); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	// SIGTERMを受けたら処理中のリクエストと溜めているデータを書き出してから終了する shutdown.go を参照
+	sig := waitForShutdownSignal()
+	e.Logger.Infof("received %s, shutting down", sig)
+	gracefulShutdown(e)
+}
+
+// ミドルウェアとルーティングを設定したechoを作る
+func newEcho() *echo.Echo {
+	e := echo.New()
+	e.Debug = true
+	// ログはJSONで出力する logging.go を参照
+	e.Logger = newZapEchoLogger(appLogger)
+
+	// 信頼できるプロキシ(ループバックとプライベートアドレス)からのX-Forwarded-Forだけを使って接続元を判定する
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+
+	e.Use(RequestLogger)
 	e.Use(middleware.Recover())
 	e.Use(SetCacheControlPrivate)
+	// 接続元IPアドレスの許可リスト ip_allowlist.go を参照
+	e.Use(IPAllowlist)
+	// クッキー認証のPOSTのCSRF対策 csrf.go を参照
+	e.Use(CSRFProtection())
+	// APIの定義に合わないリクエストを422で拒否する openapi.go を参照
+	e.Use(ValidateRequest)
 
 	// SaaS管理者向けAPI
+	e.GET("/api/admin/tenants", tenantsListHandler)
 	e.POST("/api/admin/tenants/add", tenantsAddHandler)
+	e.POST("/api/admin/tenants/bulk_add", tenantsBulkAddHandler)
 	e.GET("/api/admin/tenants/billing", tenantsBillingHandler)
+	e.GET("/api/admin/tenants/billing/export", tenantsBillingExportHandler)
+	e.GET("/api/admin/tenants/:tenant_id/billing/monthly", tenantMonthlyBillingHandler)
+	e.POST("/api/admin/tenant/:tenant_id/delete", tenantDeleteHandler)
+	e.POST("/api/admin/tenant/:tenant_id/suspend", tenantSuspendHandler)
+	e.POST("/api/admin/tenant/:tenant_id/reactivate", tenantReactivateHandler)
+	e.GET("/api/admin/tenant/:tenant_id/stats", tenantStatsHandler)
+	e.GET("/api/admin/tenants/tiers", tenantTiersHandler)
+	e.GET("/api/admin/tenant/:tenant_id/billing_plan", billingPlanHandler)
+	e.POST("/api/admin/tenant/:tenant_id/impersonate", impersonateHandler)
+	e.GET("/api/admin/tenant/:tenant_id/impersonations", impersonationsHandler)
+	e.POST("/api/admin/tenant/:tenant_id/organizer_credential", organizerCredentialHandler)
+	e.POST("/api/admin/tenant/:tenant_id/sandbox", tenantSandboxHandler)
+	e.GET("/api/admin/search", searchHandler)
+	e.GET("/api/admin/tenant/:tenant_id/competition/:competition_id/billing_receipt", adminBillingReceiptHandler)
+	e.GET("/api/admin/ip_allowlist", ipAllowlistHandler)
+	e.POST("/api/admin/ip_allowlist/add", ipAllowlistAddHandler)
+	e.POST("/api/admin/ip_allowlist/:entry_id/delete", ipAllowlistDeleteHandler)
+	e.POST("/api/admin/tenants/:tenant_id/db/reopen", tenantDBReopenHandler)
+	e.GET("/api/admin/tenants/:tenant_id/db/standby", tenantDBStandbyHandler)
+	e.POST("/api/admin/tenants/:tenant_id/db/failover", tenantDBFailoverHandler)
+	e.POST("/api/admin/tenants/:tenant_id/indexes/build", indexBuildHandler)
+	e.GET("/api/admin/tenants/:tenant_id/indexes/build", indexBuildProgressHandler)
+	e.POST("/api/admin/visit_history/purge", visitHistoryPurgeHandler)
+	e.GET("/api/admin/visit_history/purge", visitHistoryPurgeProgressHandler)
+	e.POST("/api/admin/tenant/:tenant_id/billing_plan", billingPlanUpdateHandler)
+	e.POST("/api/admin/tenant/:tenant_id/billing_plan/tier", billingPlanTierUpdateHandler)
+	e.GET("/api/admin/tenant/:tenant_id/billing/recompute", billingRecomputeHandler)
+	e.GET("/api/admin/sql/slow_query_log", slowQueryLogHandler)
+	e.POST("/api/admin/sql/slow_query_log", slowQueryLogUpdateHandler)
 
 	// テナント管理者向けAPI - 参加者追加、一覧、失格
 	e.GET("/api/organizer/players", playersListHandler)
 	e.POST("/api/organizer/players/add", playersAddHandler)
 	e.POST("/api/organizer/player/:player_id/disqualified", playerDisqualifiedHandler)
+	e.POST("/api/organizer/player/:player_id/reinstate", playerReinstateHandler)
+	e.POST("/api/organizer/player/:player_id/delete", playerDeleteHandler)
+	e.POST("/api/organizer/player/:player_id/restore", playerRestoreHandler)
+	e.POST("/api/organizer/player/:src_id/merge/:dst_id", playerMergeHandler)
+	e.POST("/api/organizer/player/:player_id/credential", playerCredentialHandler)
 
 	// テナント管理者向けAPI - 大会管理
 	e.POST("/api/organizer/competitions/add", competitionsAddHandler)
 	e.POST("/api/organizer/competition/:competition_id/finish", competitionFinishHandler)
+	e.POST("/api/organizer/competition/:competition_id/tie_break", competitionTieBreakHandler)
 	e.POST("/api/organizer/competition/:competition_id/score", competitionScoreHandler)
+	e.POST("/api/organizer/competition/:competition_id/score/:player_id", competitionPlayerScoreHandler)
+	e.POST("/api/organizer/competition/:competition_id/score/:player_id/delete", competitionPlayerScoreDeleteHandler)
+	e.POST("/api/organizer/competition/:competition_id/import", competitionScoreImportHandler)
+	e.GET("/api/organizer/competition/:competition_id/uploads", competitionScoreUploadsHandler)
+	e.GET("/api/organizer/competition/:competition_id/export/scores.csv", competitionScoresExportHandler)
+	e.GET("/api/organizer/competition/:competition_id/export/ranking.csv", competitionRankingExportHandler)
+	e.GET("/api/organizer/competition/:competition_id/ranking/export", competitionFinalRankingExportHandler)
+	e.GET("/api/organizer/competition/:competition_id/upload/:upload_id", competitionScoreUploadHandler)
 	e.GET("/api/organizer/billing", billingHandler)
+	e.GET("/api/organizer/billing/export", billingExportHandler)
+	e.GET("/api/organizer/competition/:competition_id/billing_receipt", competitionBillingReceiptHandler)
 	e.GET("/api/organizer/competitions", organizerCompetitionsHandler)
+	e.GET("/api/organizer/competition/:competition_id/visitors", competitionVisitorsHandler)
+	e.GET("/api/organizer/competition/:competition_id/visits", competitionVisitsHandler)
+	e.GET("/api/organizer/competition/:competition_id/analytics", competitionAnalyticsHandler)
+	e.GET("/api/organizer/competition/:competition_id/stats", organizerCompetitionStatsHandler)
+	e.GET("/api/organizer/competition/:competition_id/disputes", competitionDisputesHandler)
+	e.POST("/api/organizer/dispute/:dispute_id/resolve", disputeResolveHandler)
 
 	// 参加者向けAPI
 	e.GET("/api/player/player/:player_id", playerHandler)
+	e.GET("/api/player/player/:player_id/history", playerScoreHistoryHandler)
+	e.GET("/api/player/player/:player_id/stats", playerStatsHandler)
 	e.GET("/api/player/competition/:competition_id/ranking", competitionRankingHandler)
+	e.GET("/api/player/competition/:competition_id/ranking/changes", competitionRankingChangesHandler)
+	e.GET("/api/player/competition/:competition_id/ranking/me", competitionMyRankHandler)
+	e.GET("/api/player/competition/:competition_id/stats", playerCompetitionStatsHandler)
 	e.GET("/api/player/competitions", playerCompetitionsHandler)
+	e.POST("/api/player/competition/:competition_id/dispute", playerDisputeHandler)
+	e.GET("/api/player/notifications", playerNotificationsHandler)
+	e.GET("/api/graphql", graphqlHandler)
+	e.POST("/api/graphql", graphqlHandler)
 
 	// 全ロール及び未認証でも使えるhandler
 	e.GET("/api/me", meHandler)
+	e.POST("/api/auth/login", loginHandler)
+	e.POST("/api/auth/logout", logoutHandler)
+	e.GET("/api/openapi.json", openAPIHandler)
 
 	// ベンチマーカー向けAPI
 	e.POST("/initialize", initializeHandler)
 
-	e.HTTPErrorHandler = errorResponseHandler
-
-	adminDB, err = connectAdminDB()
-	if err != nil {
-		e.Logger.Fatalf("failed to connect db: %v", err)
-		return
-	}
-	adminDB.SetMaxOpenConns(10)
-	defer adminDB.Close()
-
-	helpisu.WaitDBStartUp(adminDB.DB)
-
-	d = helpisu.NewDBDisconnectDetector(5, 90, adminDB.DB)
-	go d.Start()
-
-	// プール内に保持できるアイドル接続数の制限を設定 (default: 2)
-	adminDB.SetMaxIdleConns(1024)
-	// 接続してから再利用できる最大期間
-	adminDB.SetConnMaxLifetime(0)
-	// アイドル接続してから再利用できる最大期間
-	adminDB.SetConnMaxIdleTime(0)
-
-	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0           // default: 100
-	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1024 // default: 2
-	http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2 = true
-	http.DefaultClient.Timeout = 5 * time.Second // 問題の切り分け用
+	// 運用向けAPI debug_state.go, debug_caches.go を参照
+	e.GET("/debug/state", debugStateHandler)
+	e.GET("/debug/caches", debugCachesHandler)
+	e.POST("/debug/caches/:name/flush", debugCacheFlushHandler)
 
-	go http.ListenAndServe(":6060", nil)
+	e.HTTPErrorHandler = errorResponseHandler
+	checkAPIOperations(e)
 
-	port := getEnv("SERVER_APP_PORT", "3000")
-	e.Logger.Infof("starting isuports server on : %s ...", port)
-	serverPort := fmt.Sprintf(":%s", port)
-	e.Logger.Fatal(e.Start(serverPort))
+	return e
 }
 
 // エラー処理関数
 func errorResponseHandler(err error, c echo.Context) {
-	c.Logger().Errorf("error at %s: %s", c.Path(), err.Error())
+	// エラーの内容はRequestLoggerがリクエストのログに入れる
+	// CSVのエクスポートなどでレスポンスを書き始めた後のエラーは返しようがない
+	if c.Response().Committed {
+		return
+	}
+	// ハンドラが返したエラーはinternal/apperrの種類に応じたステータスコードにする
+	if ae, ok := apperr.As(err); ok {
+		// 時間をおいて再試行すれば成功する
+		if ae.Kind == apperr.KindUnavailable {
+			c.Response().Header().Set("Retry-After", retryAfterSeconds)
+		}
+		c.JSON(ae.Status(), FailureResult{
+			Status:    false,
+			Message:   ae.Message,
+			Code:      string(ae.Kind),
+			ErrorCode: ae.ErrorCode(),
+			Fields:    ae.Fields,
+		})
+		return
+	}
+	// ルーティングできなかった場合などはechoのエラーになる
 	var he *echo.HTTPError
 	if errors.As(err, &he) {
 		c.JSON(he.Code, FailureResult{
-			Status: false,
+			Status:    false,
+			ErrorCode: httpErrorCode(he),
 		})
 		return
 	}
 	c.JSON(http.StatusInternalServerError, FailureResult{
-		Status: false,
+		Status:    false,
+		ErrorCode: errorCodeInternal,
 	})
 }
 
@@ -246,6 +562,11 @@ type SuccessResult struct {
 type FailureResult struct {
 	Status  bool   `json:"status"`
 	Message string `json:"message"`
+	// apperr.Kind
+	Code string `json:"code,omitempty"`
+	// エラーの識別子 error_codes.go を参照
+	ErrorCode string            `json:"error_code,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
 }
 
 // アクセスしてきた人の情報
@@ -254,114 +575,137 @@ type Viewer struct {
 	playerID   string
 	tenantName string
 	tenantID   int64
+	// SaaS管理者がテナント管理者として他のテナントにアクセスしている
+	crossTenantAdmin bool
+	// なりすましセッションを発行したSaaS管理者
+	impersonatedBy string
 }
 
-var jwtKeyCache = helpisu.NewCache[bool, any]()
+// adminロールのJWTのaudで全テナントを表す
+const audienceWildcard = "*"
+
+var jwtKeyCache = helpisu.NewCache[bool, jwtFileKeySet]()
 
 type TokenData struct {
 	subject string
 	role    string
 	aud     []string
+	// ログインAPIで発行したセッションのID
+	jti string
+	// 有効期限 0なら期限なし
+	expiresAt int64
 }
 
-var jwtTokenCache = helpisu.NewCache[string, TokenData]()
+var jwtTokenCache = newLRUCache[string, TokenData](func() CacheLimitConfig { return appConfig.Cache.JWTToken })
 
 // リクエストヘッダをパースしてViewerを返す
 // JWTのキーキャッシュできる
 func parseViewer(c echo.Context) (*Viewer, error) {
 	cookie, err := c.Request().Cookie(cookieName)
 	if err != nil {
-		return nil, echo.NewHTTPError(
-			http.StatusUnauthorized,
-			fmt.Sprintf("cookie %s is not found", cookieName),
-		)
+		return nil, ErrSessionNotFound
 	}
 	tokenStr := cookie.Value
+	// SaaS管理者がテナント管理者になりすましている
+	if strings.HasPrefix(tokenStr, impersonationTokenPrefix) {
+		v, err := parseImpersonationViewer(c, tokenStr)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(logViewerKey, v)
+		return v, nil
+	}
 
 	var subject, role string
 	aud := []string{}
 	tokenData, ok := jwtTokenCache.Get(tokenStr)
 	if !ok {
-		jwtTokenCache.Get(tokenStr)
-		key, ok := jwtKeyCache.Get(true)
-		if !ok {
-			keyFilename := getEnv("ISUCON_JWT_KEY_FILE", "../public.pem")
-			keysrc, err := os.ReadFile(keyFilename)
-			if err != nil {
-				return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", keyFilename, err)
-			}
-			key, _, err = jwk.DecodePEM(keysrc)
-			if err != nil {
-				return nil, fmt.Errorf("error jwk.DecodePEM: %w", err)
-			}
-
-			jwtKeyCache.Set(true, key)
-		}
-
-		token, err := jwt.Parse(
-			[]byte(tokenStr),
-			jwt.WithKey(jwa.RS256, key),
-		)
+		token, err := parseJWT(tokenStr)
 		if err != nil {
-			return nil, echo.NewHTTPError(http.StatusUnauthorized, fmt.Errorf("error jwt.Parse: %s", err.Error()))
+			return nil, err
 		}
 		if subject = token.Subject(); subject == "" {
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: subject is not found in token: %s", tokenStr),
-			)
+			return nil, apperr.Unauthorized(
+				"invalid token: subject is not found in token: %s", tokenStr,
+			).WithCode(ErrInvalidToken.Code)
 		}
 
 		tr, ok := token.Get("role")
 		if !ok {
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: role is not found: %s", tokenStr),
-			)
+			return nil, apperr.Unauthorized(
+				"invalid token: role is not found: %s", tokenStr,
+			).WithCode(ErrInvalidToken.Code)
 		}
 		switch tr {
 		case RoleAdmin, RoleOrganizer, RolePlayer:
 			role = tr.(string)
 		default:
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: invalid role: %s", tokenStr),
-			)
+			return nil, apperr.Unauthorized(
+				"invalid token: invalid role: %s", tokenStr,
+			).WithCode(ErrInvalidToken.Code)
 		}
 		// aud は1要素でテナント名がはいっている
+		// adminロールのみ複数のテナント名、またはワイルドカードを持てる
 		aud = token.Audience()
-		if len(aud) != 1 {
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: aud field is few or too much: %s", tokenStr),
-			)
+		if len(aud) == 0 || (role != RoleAdmin && len(aud) != 1) {
+			return nil, apperr.Unauthorized(
+				"invalid token: aud field is few or too much: %s", tokenStr,
+			).WithCode(ErrInvalidToken.Code)
 		}
 
-		jwtTokenCache.Set(tokenStr, TokenData{
+		tokenData = TokenData{
 			subject: subject,
 			role:    role,
 			aud:     aud,
-		})
+			jti:     token.JwtID(),
+		}
+		if exp := token.Expiration(); !exp.IsZero() {
+			tokenData.expiresAt = exp.Unix()
+		}
+		jwtTokenCache.Set(tokenStr, tokenData)
 	} else {
 		subject, role, aud = tokenData.subject, tokenData.role, tokenData.aud
 	}
+	// キャッシュしたトークンの期限切れとログアウトを確認する
+	if tokenData.expiresAt != 0 && time.Now().Unix() >= tokenData.expiresAt {
+		jwtTokenCache.Delete(tokenStr)
+		return nil, ErrTokenExpired
+	}
+	if tokenData.jti != "" {
+		revoked, err := isSessionRevoked(context.Background(), tokenData.jti)
+		if err != nil {
+			return nil, fmt.Errorf("error isSessionRevoked: %w", err)
+		}
+		if revoked {
+			return nil, ErrSessionRevoked
+		}
+	}
 
 	tenant, err := retrieveTenantRowFromHeader(c)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, echo.NewHTTPError(http.StatusUnauthorized, "tenant not found")
+			return nil, apperr.Unauthorized("tenant not found").WithCode(ErrTenantNotFound.Code)
 		}
 		return nil, fmt.Errorf("error retrieveTenantRowFromHeader at parseViewer: %w", err)
 	}
 	if tenant.Name == "admin" && role != RoleAdmin {
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "tenant not found")
+		return nil, apperr.Unauthorized("tenant not found").WithCode(ErrTenantNotFound.Code)
 	}
 
-	if tenant.Name != aud[0] {
-		return nil, echo.NewHTTPError(
-			http.StatusUnauthorized,
-			fmt.Sprintf("invalid token: tenant name is not match with %s: %s", c.Request().Host, tokenStr),
-		)
+	if tenant.IsSuspended() {
+		if _, ok := suspendedTenantAllowedPaths[c.Path()]; !ok {
+			return nil, ErrTenantSuspended
+		}
+	}
+
+	if !audienceAllows(role, aud, tenant.Name) {
+		return nil, apperr.Unauthorized(
+			"invalid token: tenant name is not match with %s: %s", c.Request().Host, tokenStr,
+		).WithCode(ErrInvalidToken.Code)
+	}
+
+	if tenant.Name != "admin" {
+		recordTenantAccess(tenant.ID)
 	}
 
 	v := &Viewer{
@@ -370,12 +714,37 @@ func parseViewer(c echo.Context) (*Viewer, error) {
 		tenantName: tenant.Name,
 		tenantID:   tenant.ID,
 	}
+	// SaaS管理者が他のテナントにアクセスした場合はテナント管理者として扱い、監査ログを残す
+	if role == RoleAdmin && tenant.Name != "admin" {
+		v.role = RoleOrganizer
+		v.crossTenantAdmin = true
+		c.Logger().Infof(
+			"audit: cross-tenant admin access: subject=%s tenant=%s method=%s path=%s",
+			subject, tenant.Name, c.Request().Method, c.Request().URL.Path,
+		)
+	}
+	// リクエストのログに入れる logging.go を参照
+	c.Set(logViewerKey, v)
 	return v, nil
 }
 
+// JWTのaudでテナントへのアクセスが許可されているか
+// adminロールはaudに含まれるテナントとワイルドカード(*)が使える
+func audienceAllows(role string, aud []string, tenantName string) bool {
+	if role != RoleAdmin {
+		return len(aud) == 1 && aud[0] == tenantName
+	}
+	for _, a := range aud {
+		if a == tenantName || a == audienceWildcard {
+			return true
+		}
+	}
+	return false
+}
+
 func retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
 	// JWTに入っているテナント名とHostヘッダのテナント名が一致しているか確認
-	baseHost := getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")
+	baseHost := appConfig.Hostname.Base
 	tenantName := strings.TrimSuffix(c.Request().Host, baseHost)
 
 	// SaaS管理者用ドメイン
@@ -387,24 +756,44 @@ func retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
 	}
 
 	// テナントの存在確認
+	// 停止したテナントを遅れたレプリカから読んで使わせないように、認可に使うテナントはプライマリから読む
 	var tenant TenantRow
-	if err := adminDB.GetContext(
-		context.Background(),
-		&tenant,
-		"SELECT * FROM tenant WHERE name = ?",
-		tenantName,
-	); err != nil {
+	if err := adminDB.GetContext(context.Background(), &tenant, "SELECT * FROM tenant WHERE name = ?", tenantName); err != nil {
 		return nil, fmt.Errorf("failed to Select tenant: name=%s, %w", tenantName, err)
 	}
 	return &tenant, nil
 }
 
 type TenantRow struct {
-	ID          int64  `db:"id"`
-	Name        string `db:"name"`
-	DisplayName string `db:"display_name"`
-	CreatedAt   int64  `db:"created_at"`
-	UpdatedAt   int64  `db:"updated_at"`
+	ID          int64         `db:"id"`
+	Name        string        `db:"name"`
+	DisplayName string        `db:"display_name"`
+	Status      string        `db:"status"`
+	Storage     string        `db:"storage"`
+	SandboxOf   sql.NullInt64 `db:"sandbox_of"`
+	CreatedAt   int64         `db:"created_at"`
+	UpdatedAt   int64         `db:"updated_at"`
+}
+
+const (
+	TenantStatusActive    = "active"
+	TenantStatusSuspended = "suspended"
+)
+
+// 停止中のテナントか
+// statusカラムがない古いスキーマでは空文字になるので有効なテナントとして扱う
+func (t *TenantRow) IsSuspended() bool {
+	return t.Status == TenantStatusSuspended
+}
+
+// 停止中のテナントでも使えるAPI
+// 課金の確認はテナントを停止していてもできるようにする
+var suspendedTenantAllowedPaths = map[string]struct{}{
+	"/api/me": {},
+	// 課金レポート、そのCSVと大会ごとの領収書
+	"/api/organizer/billing":                                     {},
+	"/api/organizer/billing/export":                              {},
+	"/api/organizer/competition/:competition_id/billing_receipt": {},
 }
 
 type dbOrTx interface {
@@ -414,19 +803,21 @@ type dbOrTx interface {
 }
 
 type PlayerRow struct {
-	TenantID       int64  `db:"tenant_id"`
-	ID             string `db:"id"`
-	DisplayName    string `db:"display_name"`
-	IsDisqualified bool   `db:"is_disqualified"`
-	CreatedAt      int64  `db:"created_at"`
-	UpdatedAt      int64  `db:"updated_at"`
+	TenantID       int64         `db:"tenant_id"`
+	ID             string        `db:"id"`
+	DisplayName    string        `db:"display_name"`
+	IsDisqualified bool          `db:"is_disqualified"`
+	DeletedAt      sql.NullInt64 `db:"deleted_at"`
+	CreatedAt      int64         `db:"created_at"`
+	UpdatedAt      int64         `db:"updated_at"`
 }
 
-var playerCache = helpisu.NewCache[string, PlayerRow]()
+var playerCache = newLRUCache[string, PlayerRow](func() CacheLimitConfig { return appConfig.Cache.Player })
 
 // 参加者を取得する
 func retrievePlayer(ctx context.Context, tenantDB dbOrTx, id string) (*PlayerRow, error) {
 	p, ok := playerCache.Get(id)
+	playerCacheStats.record(ok)
 	if !ok {
 		if err := tenantDB.GetContext(ctx, &p, "SELECT * FROM player WHERE id = ?", id); err != nil {
 			return nil, fmt.Errorf("error Select player: id=%s, %w", id, err)
@@ -442,12 +833,16 @@ func authorizePlayer(ctx context.Context, tenantDB dbOrTx, id string) error {
 	player, err := retrievePlayer(ctx, tenantDB, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusUnauthorized, "player not found")
+			return apperr.Unauthorized("player not found").WithCode(ErrPlayerNotFound.Code)
 		}
 		return fmt.Errorf("error retrievePlayer from viewer: %w", err)
 	}
+	// 削除済みの参加者は存在しないものとして扱う
+	if player.DeletedAt.Valid {
+		return apperr.Unauthorized("player not found").WithCode(ErrPlayerNotFound.Code)
+	}
 	if player.IsDisqualified {
-		return echo.NewHTTPError(http.StatusForbidden, "player is disqualified")
+		return ErrPlayerDisqualified
 	}
 	return nil
 }
@@ -457,6 +852,7 @@ type CompetitionRow struct {
 	ID         string        `db:"id"`
 	Title      string        `db:"title"`
 	FinishedAt sql.NullInt64 `db:"finished_at"`
+	TieBreak   string        `db:"tie_break"`
 	CreatedAt  int64         `db:"created_at"`
 	UpdatedAt  int64         `db:"updated_at"`
 }
@@ -466,6 +862,7 @@ var competitionCache = helpisu.NewCache[string, CompetitionRow]()
 // 大会を取得する
 func retrieveCompetition(ctx context.Context, tenantDB dbOrTx, id string) (*CompetitionRow, error) {
 	c, ok := competitionCache.Get(id)
+	competitionCacheStats.record(ok)
 	if !ok {
 		if err := tenantDB.GetContext(ctx, &c, "SELECT * FROM competition WHERE id = ?", id); err != nil {
 			return nil, fmt.Errorf("error Select competition: id=%s, %w", id, err)
@@ -493,19 +890,90 @@ func lockFilePath(id int64) string {
 	return filepath.Join(tenantDBDir, fmt.Sprintf("%d.lock", id))
 }
 
+// ロックを待つ最大の時間(ms)
+// 環境変数 ISUCON_LOCK_WAIT_TIMEOUT_MS で設定する 0なら制限しない
+// リクエストのcontextがキャンセルされた場合もロックを待つのをやめる
+func lockWaitTimeout() time.Duration {
+	n, err := strconv.Atoi(getEnv("ISUCON_LOCK_WAIT_TIMEOUT_MS", "0"))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Millisecond
+}
+
+// 503を返すときのRetry-After(秒)
+const retryAfterSeconds = "1"
+
+// ロックが取れるまで試す間隔
+const lockRetryDelay = 5 * time.Millisecond
+
 // 排他ロックする
-func flockByTenantID(tenantID int64) (io.Closer, error) {
+// ロックの方式は tenant_lock.go を参照 MySQLに置いたテナントの場合はMySQLのロックを使う
+// ハンドラからはリクエストのcontextを渡す ロックを取る前にcontextが終わった場合はErrLockUnavailableを返す
+func flockByTenantID(ctx context.Context, tenantID int64) (io.Closer, error) {
+	return lockByTenantID(ctx, tenantID, false)
+}
+
+// 共有ロックする player_scoreを読むだけの処理で使う
+// 共有ロック同士は待たないが、排他ロック(スコアの登録など)とは待ち合わせる
+// MySQLに置いたテナントの場合は共有ロックを区別せず排他ロックになる
+func rlockByTenantID(ctx context.Context, tenantID int64) (io.Closer, error) {
+	return lockByTenantID(ctx, tenantID, true)
+}
+
+func lockByTenantID(ctx context.Context, tenantID int64, shared bool) (closer io.Closer, err error) {
+	// ロックの統計 debug_state.go を参照
+	start := time.Now()
+	defer func() { recordLockWait(time.Since(start), err) }()
+
+	storage, err := retrieveTenantStorage(context.Background(), tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieveTenantStorage: %w", err)
+	}
+	if t := lockWaitTimeout(); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	if storage == TenantStorageMySQL {
+		return lockTenantMySQL(ctx, tenantID)
+	}
+	if tenantLockMode() == TenantLockProcess {
+		return lockTenantInProcess(ctx, tenantID, shared)
+	}
+
 	p := lockFilePath(tenantID)
 
 	fl := flock.New(p)
-	if err := fl.Lock(); err != nil {
-		return nil, fmt.Errorf("error flock.Lock: path=%s, %w", p, err)
+	lock, tryLock := fl.Lock, fl.TryLockContext
+	if shared {
+		lock, tryLock = fl.RLock, fl.TryRLockContext
+	}
+	// 終わらないcontextなら待ち続けるのでブロックするロックを使う
+	if ctx.Done() == nil {
+		if err := lock(); err != nil {
+			return nil, fmt.Errorf("error flock.Lock: path=%s, %w", p, err)
+		}
+		return fl, nil
+	}
+	locked, err := tryLock(ctx, lockRetryDelay)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrLockUnavailable
+		}
+		return nil, fmt.Errorf("error flock.TryLockContext: path=%s, %w", p, err)
+	}
+	if !locked {
+		return nil, ErrLockUnavailable
 	}
 	return fl, nil
 }
 
 type InitializeHandlerResult struct {
-	Lang string `json:"lang"`
+	Lang         string           `json:"lang"`
+	Steps        []InitializeStep `json:"steps"`
+	ElapsedMs    int64            `json:"elapsed_ms"`
+	TenantsReset int              `json:"tenants_reset"` // 初期データで置き換えたテナントDBの数
 }
 
 // ベンチマーカー向けAPI
@@ -513,43 +981,107 @@ type InitializeHandlerResult struct {
 // ベンチマーカーが起動したときに最初に呼ぶ
 // データベースの初期化などが実行されるため、スキーマを変更した場合などは適宜改変すること
 func initializeHandler(c echo.Context) error {
-	var tenantNum int
-	adminDB.GetContext(c.Request().Context(), &tenantNum, "SELECT count(*) FROM tenant")
-
-	out, err := exec.Command(initializeScript).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error exec.Command: %s %e", string(out), err)
+	ctx := c.Request().Context()
+	start := time.Now()
+	steps := initializeSteps{}
+	tenantsReset := 0
+
+	// テナントDBのファイルを置き換えるので、先に接続を閉じておく
+	// メモリ上のテナントDBは初期化後のファイルから読み込み直す
+	if err := steps.run("close_tenant_db", func() error {
+		closeMemoryTenantDBs()
+		closeTenantDBs()
+		return nil
+	}); err != nil {
+		return err
 	}
-
-	for i := 1; i < tenantNum; i++ {
-		tenantDB, ok := tenantDBCache.Get(int64(i))
-		if ok {
-			tenantDB.Close()
+	if err := steps.run("admin_db", func() error {
+		return initializeAdminDB(ctx)
+	}); err != nil {
+		return err
+	}
+	if err := steps.run("tenant_db", func() error {
+		n, err := restoreTenantDBs(ctx)
+		tenantsReset = n
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := steps.run("cache", func() error {
+		// 初期化したファイルを使うので、スタンバイへのフェイルオーバーを解除する
+		if err := clearTenantDBFailovers(); err != nil {
+			return fmt.Errorf("error clearTenantDBFailovers: %w", err)
 		}
+		resetCaches()
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := steps.run("visit_history", func() error {
+		if err := resetVisitHistories(); err != nil {
+			return fmt.Errorf("error resetVisitHistories: %w", err)
+		}
+		startTicker("insert_visit_history", 2000, delayedInsertVisitHistory)
+		return nil
+	}); err != nil {
+		return err
 	}
 
+	d.Pause()
+
+	res := InitializeHandlerResult{
+		Lang:         "go",
+		Steps:        steps,
+		ElapsedMs:    time.Since(start).Milliseconds(),
+		TenantsReset: tenantsReset,
+	}
+	log.Printf("initialize: done, elapsed=%dms, tenants_reset=%d", res.ElapsedMs, res.TenantsReset)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// インメモリのキャッシュを全て捨てる
+func resetCaches() {
 	tenantDBCache.Reset()
+	tenantDBLastUsedCache.Reset()
 	jwtKeyCache.Reset()
 	jwtTokenCache.Reset()
 	playerCache.Reset()
 	competitionCache.Reset()
 	tenantCache.Reset()
-	compFinishCache.Reset()
 	billingReportCache.Reset()
+	billingPlanCache.Reset()
+	tenantStorageCache.Reset()
+	impersonationCache.Reset()
+	jwtSigningKeyCache.Reset()
+	revokedSessionCache.Reset()
+	rankingVersionCache.Reset()
+	rankingPageCache.Reset()
+	materializedRankingCache.Reset()
+	resetRankingShare()
+	walStatsCache.Reset()
+	latestScoresCache.Reset()
+	resetTenantTiers()
+	tenantSchemaDriftVar.Init()
+	ipAllowlistCache.Reset()
+	resetTenantIDBlocks()
+	resetIDBlock()
+	resetCacheStats()
+	searchIndexCache.Reset()
+	resetIndexBuildJobs()
+	resetVisitHistoryPurge()
+	resetPendingDigests()
+	standbyStatusCache.Reset()
+}
 
-	go dispenseUpdate()
-
-	visitHistories.Set(0, make([]VisitHistoryRow, 0, 100))
-	insertVisitHistory := helpisu.NewTicker(2000, delayedInsertVisitHistory)
-	go insertVisitHistory.Start()
-
-	updateCompetitionFinish := helpisu.NewTicker(2000, updateCompetitionFinish)
-	go updateCompetitionFinish.Start()
-
-	d.Pause()
-
-	res := InitializeHandlerResult{
-		Lang: "go",
+// キャッシュしているテナントDBへの接続を全て閉じる
+func closeTenantDBs() {
+	var ids []int64
+	if err := adminDB.Select(&ids, "SELECT id FROM tenant"); err != nil {
+		return
+	}
+	for _, id := range ids {
+		if db, ok := tenantDBCache.GetAndDelete(id); ok {
+			db.Close()
+		}
 	}
-	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
@@ -0,0 +1,131 @@
+package isuportstest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	isuports "github.com/isucon/isucon12-qualify/webapp/go"
+)
+
+// MySQLを使わずに確認できるフィクスチャの部品のテスト
+// サーバーを立ち上げる TestServerSmoke はMySQLがないとスキップするので、こちらでJWTとテナントDBの準備を確認する
+
+// 発行したJWTが、ISUCON_JWT_KEY_FILE に書き出した公開鍵で検証できて、isuportsが読むクレームを持つこと
+func TestTokenVerifiesWithKeyFile(t *testing.T) {
+	key, keyFile := writeJWTKey(t, t.TempDir())
+	s := &Server{t: t, key: key}
+
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("error os.ReadFile: %s", err)
+	}
+	pub, err := jwk.ParseKey(b, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatalf("error jwk.ParseKey: %s", err)
+	}
+
+	tests := []struct {
+		token    string
+		role     string
+		audience string
+		subject  string
+	}{
+		{s.AdminToken(), isuports.RoleAdmin, AdminTenantName, "admin"},
+		{s.OrganizerToken("tenant1"), isuports.RoleOrganizer, "tenant1", "organizer"},
+		{s.PlayerToken("tenant1", "player1"), isuports.RolePlayer, "tenant1", "player1"},
+	}
+	for _, tt := range tests {
+		tok, err := jwt.Parse([]byte(tt.token), jwt.WithKey(jwa.RS256, pub), jwt.WithValidate(true))
+		if err != nil {
+			t.Fatalf("error jwt.Parse: role=%s, %s", tt.role, err)
+		}
+		if tok.Subject() != tt.subject {
+			t.Errorf("unexpected subject: got=%s, want=%s", tok.Subject(), tt.subject)
+		}
+		if aud := tok.Audience(); len(aud) != 1 || aud[0] != tt.audience {
+			t.Errorf("unexpected audience: got=%v, want=%s", aud, tt.audience)
+		}
+		if role, _ := tok.Get("role"); role != tt.role {
+			t.Errorf("unexpected role: got=%v, want=%s", role, tt.role)
+		}
+		if !tok.Expiration().After(time.Now()) {
+			t.Errorf("token is already expired: exp=%s", tok.Expiration())
+		}
+	}
+}
+
+// 別の鍵で署名したJWTは検証できないこと
+func TestTokenRejectedWithOtherKey(t *testing.T) {
+	key, _ := writeJWTKey(t, t.TempDir())
+	_, otherKeyFile := writeJWTKey(t, t.TempDir())
+	s := &Server{t: t, key: key}
+
+	b, err := os.ReadFile(otherKeyFile)
+	if err != nil {
+		t.Fatalf("error os.ReadFile: %s", err)
+	}
+	pub, err := jwk.ParseKey(b, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatalf("error jwk.ParseKey: %s", err)
+	}
+	if _, err := jwt.Parse([]byte(s.AdminToken()), jwt.WithKey(jwa.RS256, pub)); err == nil {
+		t.Fatalf("token signed with another key is verified")
+	}
+}
+
+// テナントDBのディレクトリが空で、スナップショットには空のテナントDBが1つだけあること
+func TestPrepareTenantDBDirs(t *testing.T) {
+	tenantDBDir, snapshotDir := prepareTenantDBDirs(t, t.TempDir())
+
+	entries, err := os.ReadDir(tenantDBDir)
+	if err != nil {
+		t.Fatalf("error os.ReadDir: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("tenant DB directory is not empty: %d entries", len(entries))
+	}
+
+	entries, err = os.ReadDir(snapshotDir)
+	if err != nil {
+		t.Fatalf("error os.ReadDir: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "1.db" {
+		t.Fatalf("unexpected snapshot entries: %v", entries)
+	}
+	fi, err := os.Stat(filepath.Join(snapshotDir, "1.db"))
+	if err != nil {
+		t.Fatalf("error os.Stat: %s", err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("snapshot tenant DB is not empty: size=%d", fi.Size())
+	}
+}
+
+// 管理用DBのスキーマのUSE文を取り除き、テスト用のデータベースに適用できること
+func TestStripUseStatements(t *testing.T) {
+	got := stripUseStatements("USE `isuports`;\n\nDROP TABLE IF EXISTS `tenant`;\n  use other;\nCREATE TABLE `user` (id BIGINT);\n")
+	want := "\nDROP TABLE IF EXISTS `tenant`;\nCREATE TABLE `user` (id BIGINT);\n"
+	if got != want {
+		t.Fatalf("unexpected schema: got=%q, want=%q", got, want)
+	}
+
+	root := repositoryRoot(t)
+	for _, name := range []string{"10_schema.sql", "20_tenant_schema.sql"} {
+		b, err := os.ReadFile(filepath.Join(root, "sql", "admin", name))
+		if err != nil {
+			t.Fatalf("error os.ReadFile: %s", err)
+		}
+		for _, l := range strings.Split(stripUseStatements(string(b)), "\n") {
+			if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(l)), "USE ") {
+				t.Errorf("USE statement is not stripped: %s, %q", name, l)
+			}
+		}
+	}
+}
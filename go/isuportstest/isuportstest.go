@@ -0,0 +1,487 @@
+// Package isuportstest は isuports の結合テストのためのフィクスチャを提供する
+//
+// 一時ディレクトリのテナントDBと、使い捨てのMySQLデータベースでサーバーを立ち上げ、
+// テナント・参加者・大会の作成や、テスト用の署名済みJWTの発行を行う
+//
+// MySQLは以下のいずれかを使う
+//   - 環境変数 ISUPORTSTEST_MYSQL_HOST (と _PORT, _USER, _PASSWORD) で指定したサーバー
+//     テストごとにデータベースを作り、終了時に削除する
+//   - dockerコマンドが使える場合は mysql コンテナを起動する
+//
+// どちらも使えない場合はテストをスキップする
+// isuports はパッケージ変数に状態を持つので、NewServer を並行して呼んではいけない
+package isuportstest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	isuports "github.com/isucon/isucon12-qualify/webapp/go"
+)
+
+const (
+	// isuports のデフォルトの ISUCON_BASE_HOSTNAME
+	BaseHostname = ".t.isucon.dev"
+	// SaaS管理者用のテナント名
+	AdminTenantName = "admin"
+
+	mysqlImage = "mysql:8.0"
+)
+
+// Server はテスト用に立ち上げた isuports
+type Server struct {
+	Handler     http.Handler
+	TenantDBDir string
+
+	t      testing.TB
+	key    *rsa.PrivateKey
+	server *isuports.Server
+}
+
+type Tenant struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// テナントIDを数値で返す
+func (t Tenant) IntID() int64 {
+	id, _ := strconv.ParseInt(t.ID, 10, 64)
+	return id
+}
+
+// NewServer はテスト用のサーバーを立ち上げる
+// 後片付けは t.Cleanup で行われる
+func NewServer(t testing.TB, hooks isuports.Hooks) *Server {
+	t.Helper()
+
+	root := repositoryRoot(t)
+	mc := startMySQL(t)
+	applyAdminSchema(
+		t, mc,
+		filepath.Join(root, "sql", "admin", "10_schema.sql"),
+		filepath.Join(root, "sql", "admin", "20_tenant_schema.sql"),
+	)
+
+	dir := t.TempDir()
+	key, keyFile := writeJWTKey(t, dir)
+	tenantDBDir, snapshotDir := prepareTenantDBDirs(t, dir)
+
+	t.Setenv("ISUCON_DB_HOST", mc.host)
+	t.Setenv("ISUCON_DB_PORT", mc.port)
+	t.Setenv("ISUCON_DB_USER", mc.user)
+	t.Setenv("ISUCON_DB_PASSWORD", mc.password)
+	t.Setenv("ISUCON_DB_NAME", mc.dbName)
+	t.Setenv("ISUCON_JWT_KEY_FILE", keyFile)
+	t.Setenv("ISUCON_TENANT_DB_DIR", tenantDBDir)
+	t.Setenv("ISUCON_TENANT_DB_SNAPSHOT_DIR", snapshotDir)
+	t.Setenv("ISUCON_BASE_HOSTNAME", BaseHostname)
+	t.Setenv("ISUCON_ADMIN_HOSTNAME", AdminTenantName+BaseHostname)
+
+	srv := isuports.NewServer()
+	srv.Hooks = hooks
+	h, err := srv.Handler()
+	if err != nil {
+		t.Fatalf("error isuports.Server.Handler: %s", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return &Server{
+		Handler:     h,
+		TenantDBDir: tenantDBDir,
+		t:           t,
+		key:         key,
+		server:      srv,
+	}
+}
+
+// テスト用の鍵を作り、公開鍵をdirに書き出す
+// 秘密鍵と、ISUCON_JWT_KEY_FILE に指定する公開鍵のファイルのパスを返す
+func writeJWTKey(t testing.TB, dir string) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error rsa.GenerateKey: %s", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error x509.MarshalPKIXPublicKey: %s", err)
+	}
+	keyFile := filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600); err != nil {
+		t.Fatalf("error os.WriteFile: %s", err)
+	}
+	return key, keyFile
+}
+
+// テナントDBのディレクトリと、初期化(POST /initialize)で置き換えるテナントDBのスナップショットのディレクトリをdirに作る
+// 空のファイルは空のSQLiteのDBとして開けるので、初期化でマイグレーションだけが適用される
+func prepareTenantDBDirs(t testing.TB, dir string) (string, string) {
+	t.Helper()
+	tenantDBDir := filepath.Join(dir, "tenant_db")
+	if err := os.Mkdir(tenantDBDir, 0700); err != nil {
+		t.Fatalf("error os.Mkdir: %s", err)
+	}
+	snapshotDir := filepath.Join(dir, "initial_data")
+	if err := os.Mkdir(snapshotDir, 0700); err != nil {
+		t.Fatalf("error os.Mkdir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshotDir, "1.db"), nil, 0600); err != nil {
+		t.Fatalf("error os.WriteFile: %s", err)
+	}
+	return tenantDBDir, snapshotDir
+}
+
+// Token はテスト用の鍵で署名したJWTを発行する
+func (s *Server) Token(role, tenantName, subject string) string {
+	s.t.Helper()
+	tok, err := jwt.NewBuilder().
+		Issuer("isuports").
+		Subject(subject).
+		Audience([]string{tenantName}).
+		Expiration(time.Now().Add(time.Hour)).
+		Claim("role", role).
+		Build()
+	if err != nil {
+		s.t.Fatalf("error jwt.Build: %s", err)
+	}
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256, s.key))
+	if err != nil {
+		s.t.Fatalf("error jwt.Sign: %s", err)
+	}
+	return string(signed)
+}
+
+func (s *Server) AdminToken() string {
+	return s.Token(isuports.RoleAdmin, AdminTenantName, "admin")
+}
+
+func (s *Server) OrganizerToken(tenantName string) string {
+	return s.Token(isuports.RoleOrganizer, tenantName, "organizer")
+}
+
+func (s *Server) PlayerToken(tenantName, playerID string) string {
+	return s.Token(isuports.RolePlayer, tenantName, playerID)
+}
+
+// Do はテナントのHostヘッダとJWTのクッキーを付けてリクエストを送る
+func (s *Server) Do(method, tenantName, path, token, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest(method, path, body)
+	req.Host = tenantName + BaseHostname
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: "isuports_session", Value: token})
+	}
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *Server) Get(tenantName, path, token string) *httptest.ResponseRecorder {
+	return s.Do(http.MethodGet, tenantName, path, token, "", nil)
+}
+
+func (s *Server) PostForm(tenantName, path, token string, form url.Values) *httptest.ResponseRecorder {
+	return s.Do(http.MethodPost, tenantName, path, token, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
+
+// DecodeSuccess はSuccessResultのdataをdestにデコードする
+// ステータスコードが200でない場合はテストを失敗させる
+func (s *Server) DecodeSuccess(rec *httptest.ResponseRecorder, dest any) {
+	s.t.Helper()
+	if rec.Code != http.StatusOK {
+		s.t.Fatalf("unexpected status: code=%d body=%s", rec.Code, rec.Body.String())
+	}
+	res := struct {
+		Status bool            `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		s.t.Fatalf("error json.Unmarshal: %s, body=%s", err, rec.Body.String())
+	}
+	if !res.Status {
+		s.t.Fatalf("status is false: body=%s", rec.Body.String())
+	}
+	if dest == nil {
+		return
+	}
+	if err := json.Unmarshal(res.Data, dest); err != nil {
+		s.t.Fatalf("error json.Unmarshal data: %s, body=%s", err, rec.Body.String())
+	}
+}
+
+// Initialize はベンチマーカーと同じように初期化する
+func (s *Server) Initialize() {
+	s.t.Helper()
+	rec := s.Do(http.MethodPost, AdminTenantName, "/initialize", "", "", nil)
+	s.DecodeSuccess(rec, nil)
+}
+
+// CreateTenant はテナントを作成する
+func (s *Server) CreateTenant(name, displayName string) Tenant {
+	s.t.Helper()
+	rec := s.PostForm(AdminTenantName, "/api/admin/tenants/add", s.AdminToken(), url.Values{
+		"name":         {name},
+		"display_name": {displayName},
+	})
+	res := struct {
+		Tenant Tenant `json:"tenant"`
+	}{}
+	s.DecodeSuccess(rec, &res)
+	return res.Tenant
+}
+
+// AddPlayers はテナントに参加者を追加して、参加者IDを返す
+func (s *Server) AddPlayers(tenantName string, displayNames ...string) []string {
+	s.t.Helper()
+	rec := s.PostForm(tenantName, "/api/organizer/players/add", s.OrganizerToken(tenantName), url.Values{
+		"display_name[]": displayNames,
+	})
+	res := struct {
+		Players []struct {
+			ID string `json:"id"`
+		} `json:"players"`
+	}{}
+	s.DecodeSuccess(rec, &res)
+	ids := make([]string, 0, len(res.Players))
+	for _, p := range res.Players {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// AddCompetition はテナントに大会を追加して、大会IDを返す
+func (s *Server) AddCompetition(tenantName, title string) string {
+	s.t.Helper()
+	rec := s.PostForm(tenantName, "/api/organizer/competitions/add", s.OrganizerToken(tenantName), url.Values{
+		"title": {title},
+	})
+	res := struct {
+		Competition struct {
+			ID string `json:"id"`
+		} `json:"competition"`
+	}{}
+	s.DecodeSuccess(rec, &res)
+	return res.Competition.ID
+}
+
+// UploadScores は参加者IDとスコアの組をCSVにして大会のスコアとして登録する
+func (s *Server) UploadScores(tenantName, competitionID string, scores [][2]string) {
+	s.t.Helper()
+	var csv strings.Builder
+	csv.WriteString("player_id,score\n")
+	for _, sc := range scores {
+		csv.WriteString(sc[0] + "," + sc[1] + "\n")
+	}
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("scores", "scores.csv")
+	if err != nil {
+		s.t.Fatalf("error CreateFormFile: %s", err)
+	}
+	io.WriteString(fw, csv.String())
+	mw.Close()
+
+	rec := s.Do(
+		http.MethodPost,
+		tenantName,
+		"/api/organizer/competition/"+competitionID+"/score",
+		s.OrganizerToken(tenantName),
+		mw.FormDataContentType(),
+		strings.NewReader(body.String()),
+	)
+	s.DecodeSuccess(rec, nil)
+}
+
+// FinishCompetition は大会を終了する
+func (s *Server) FinishCompetition(tenantName, competitionID string) {
+	s.t.Helper()
+	rec := s.PostForm(tenantName, "/api/organizer/competition/"+competitionID+"/finish", s.OrganizerToken(tenantName), nil)
+	s.DecodeSuccess(rec, nil)
+}
+
+// リポジトリのルート(sqlディレクトリがあるところ)を探す
+func repositoryRoot(t testing.TB) string {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error os.Getwd: %s", err)
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "sql", "admin", "10_schema.sql")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatalf("repository root is not found")
+		}
+		dir = parent
+	}
+}
+
+type mysqlConfig struct {
+	host     string
+	port     string
+	user     string
+	password string
+	dbName   string
+}
+
+func (mc mysqlConfig) dsn(dbName string) string {
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = mc.host + ":" + mc.port
+	config.User = mc.user
+	config.Passwd = mc.password
+	config.DBName = dbName
+	config.MultiStatements = true
+	return config.FormatDSN()
+}
+
+// テスト用のMySQLを用意する
+func startMySQL(t testing.TB) mysqlConfig {
+	t.Helper()
+	if host := os.Getenv("ISUPORTSTEST_MYSQL_HOST"); host != "" {
+		mc := mysqlConfig{
+			host:     host,
+			port:     getEnv("ISUPORTSTEST_MYSQL_PORT", "3306"),
+			user:     getEnv("ISUPORTSTEST_MYSQL_USER", "root"),
+			password: os.Getenv("ISUPORTSTEST_MYSQL_PASSWORD"),
+			dbName:   fmt.Sprintf("isuports_test_%d", time.Now().UnixNano()),
+		}
+		db := openMySQL(t, mc, "")
+		defer db.Close()
+		if _, err := db.Exec("CREATE DATABASE " + mc.dbName); err != nil {
+			t.Fatalf("error CREATE DATABASE: %s", err)
+		}
+		t.Cleanup(func() {
+			db := openMySQL(t, mc, "")
+			defer db.Close()
+			db.Exec("DROP DATABASE " + mc.dbName)
+		})
+		return mc
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("MySQL is not available: set ISUPORTSTEST_MYSQL_HOST or install docker")
+	}
+	out, err := exec.Command(
+		"docker", "run", "-d", "--rm", "-p", "127.0.0.1::3306",
+		"-e", "MYSQL_ROOT_PASSWORD=isucon",
+		"-e", "MYSQL_DATABASE=isuports",
+		mysqlImage,
+	).Output()
+	if err != nil {
+		t.Skipf("failed to start MySQL container: %s", err)
+	}
+	containerID := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		exec.Command("docker", "rm", "-f", containerID).Run()
+	})
+	out, err = exec.Command("docker", "port", containerID, "3306/tcp").Output()
+	if err != nil {
+		t.Fatalf("error docker port: %s", err)
+	}
+	// 127.0.0.1:49153 の形式
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		t.Fatalf("unexpected docker port output: %s", out)
+	}
+	mc := mysqlConfig{
+		host:     addr[:i],
+		port:     addr[i+1:],
+		user:     "root",
+		password: "isucon",
+		dbName:   "isuports",
+	}
+	db := openMySQL(t, mc, mc.dbName)
+	db.Close()
+	return mc
+}
+
+// MySQLが接続を受け付けるまで待って接続する
+func openMySQL(t testing.TB, mc mysqlConfig, dbName string) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("mysql", mc.dsn(dbName))
+	if err != nil {
+		t.Fatalf("error sqlx.Open: %s", err)
+	}
+	deadline := time.Now().Add(60 * time.Second)
+	for {
+		err := db.Ping()
+		if err == nil {
+			return db
+		}
+		if time.Now().After(deadline) {
+			db.Close()
+			t.Fatalf("MySQL did not become ready: %s", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// 管理用DBのスキーマを適用する
+// スキーマファイルのUSE文はテスト用のデータベースを使うために取り除く
+func applyAdminSchema(t testing.TB, mc mysqlConfig, paths ...string) {
+	t.Helper()
+	db := openMySQL(t, mc, mc.dbName)
+	defer db.Close()
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("error os.ReadFile: %s", err)
+		}
+		if _, err := db.Exec(stripUseStatements(string(b))); err != nil {
+			t.Fatalf("error apply admin schema: path=%s, %s", path, err)
+		}
+	}
+	// IDの払い出しに使う行
+	if _, err := db.Exec("INSERT INTO id_generator (id, stub) VALUES (1, 'a')"); err != nil {
+		t.Fatalf("error Insert id_generator: %s", err)
+	}
+}
+
+// USE文の行を取り除く
+func stripUseStatements(schema string) string {
+	lines := strings.Split(schema, "\n")
+	filtered := lines[:0]
+	for _, l := range lines {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(l)), "USE ") {
+			continue
+		}
+		filtered = append(filtered, l)
+	}
+	return strings.Join(filtered, "\n")
+}
+
+func getEnv(key, defaultValue string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return defaultValue
+}
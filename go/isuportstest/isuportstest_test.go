@@ -0,0 +1,35 @@
+package isuportstest_test
+
+import (
+	"testing"
+
+	isuports "github.com/isucon/isucon12-qualify/webapp/go"
+	"github.com/isucon/isucon12-qualify/webapp/go/isuportstest"
+)
+
+// 初期化からテナントの作成、/api/me までを通して、フィクスチャとサーバーの設定が噛み合っているかを確認する
+func TestServerSmoke(t *testing.T) {
+	s := isuportstest.NewServer(t, isuports.Hooks{})
+	s.Initialize()
+
+	tenant := s.CreateTenant("smoke", "スモークテスト")
+	if tenant.Name != "smoke" {
+		t.Fatalf("unexpected tenant name: %s", tenant.Name)
+	}
+
+	me := isuports.MeHandlerResult{}
+	s.DecodeSuccess(s.Get(tenant.Name, "/api/me", s.OrganizerToken(tenant.Name)), &me)
+	if !me.LoggedIn || me.Role != isuports.RoleOrganizer {
+		t.Fatalf("unexpected /api/me: logged_in=%t, role=%s", me.LoggedIn, me.Role)
+	}
+	if me.Tenant == nil || me.Tenant.Name != tenant.Name {
+		t.Fatalf("unexpected /api/me tenant: %+v", me.Tenant)
+	}
+
+	ids := s.AddPlayers(tenant.Name, "player1")
+	me = isuports.MeHandlerResult{}
+	s.DecodeSuccess(s.Get(tenant.Name, "/api/me", s.PlayerToken(tenant.Name, ids[0])), &me)
+	if me.Me == nil || me.Me.ID != ids[0] || me.Role != isuports.RolePlayer {
+		t.Fatalf("unexpected /api/me player: %+v", me.Me)
+	}
+}
@@ -0,0 +1,77 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// JWTの検証に使う鍵を取得するJWKSのURL
+// 環境変数 ISUCON_JWT_JWKS_URL を設定すると、ISUCON_JWT_KEY_FILE の代わりに使う
+// 鍵は定期的に取得し直し、JWTのヘッダのkidで選ぶので、アプリを再起動せずに鍵を入れ替えられる
+func jwtJWKSURL() string {
+	return getEnv("ISUCON_JWT_JWKS_URL", "")
+}
+
+// JWKSを取得し直す間隔(秒)
+func jwtJWKSRefreshSeconds() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_JWT_JWKS_REFRESH_SECONDS", "900"))
+	if err != nil || n <= 0 {
+		return 900
+	}
+	return n
+}
+
+// 知らないkidのJWTが来たときにJWKSを取得し直す最短の間隔
+// 不正なJWTを送られてもIdPに大量にリクエストしないようにする
+const jwksForceRefreshInterval = 10 * time.Second
+
+var (
+	jwksCache            *jwk.Cache
+	jwksMu               sync.Mutex
+	jwksLastForceRefresh time.Time
+)
+
+// JWKSの鍵のセットを返す
+// 初めて呼ばれたときに取得し、以降はバックグラウンドで定期的に取得し直す
+func retrieveJWKS(ctx context.Context, url string) (jwk.Set, error) {
+	jwksMu.Lock()
+	if jwksCache == nil {
+		c := jwk.NewCache(context.Background())
+		if err := c.Register(url, jwk.WithRefreshInterval(time.Duration(jwtJWKSRefreshSeconds())*time.Second)); err != nil {
+			jwksMu.Unlock()
+			return nil, fmt.Errorf("error jwk.Cache.Register: url=%s, %w", url, err)
+		}
+		jwksCache = c
+	}
+	c := jwksCache
+	jwksMu.Unlock()
+
+	set, err := c.Get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("error jwk.Cache.Get: url=%s, %w", url, err)
+	}
+	return set, nil
+}
+
+// 鍵が入れ替わった直後のために、間隔を空けてJWKSを取得し直す
+// 取得し直した場合はtrueを返す
+func forceRefreshJWKS(ctx context.Context, url string) bool {
+	jwksMu.Lock()
+	c := jwksCache
+	if c == nil || time.Since(jwksLastForceRefresh) < jwksForceRefreshInterval {
+		jwksMu.Unlock()
+		return false
+	}
+	jwksLastForceRefresh = time.Now()
+	jwksMu.Unlock()
+
+	if _, err := c.Refresh(ctx, url); err != nil {
+		return false
+	}
+	return true
+}
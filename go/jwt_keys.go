@@ -0,0 +1,220 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// 鍵のファイルが変わったかを確認する間隔
+const jwtKeyFileCheckInterval = time.Second
+
+// PEMファイルから読み込んだ鍵のセット
+type jwtFileKeySet struct {
+	set jwk.Set
+	// 読み込んだときのファイルのパス、更新日時、サイズ
+	signature string
+	checkedAt time.Time
+}
+
+// 鍵のファイルのパスを返す
+// 環境変数 ISUCON_JWT_KEY_FILE にはカンマ区切りで複数のファイルやディレクトリを指定できる
+// ディレクトリの場合はその中の*.pemを全て使う
+// 鍵を入れ替えるときは新旧の鍵を両方置いておく
+func jwtKeyFilePaths() ([]string, error) {
+	paths := []string{}
+	for _, p := range strings.Split(getEnv("ISUCON_JWT_KEY_FILE", "../public.pem"), ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("error os.Stat: keyFilename=%s: %w", p, err)
+		}
+		if !fi.IsDir() {
+			paths = append(paths, p)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("error filepath.Glob: dir=%s: %w", p, err)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no JWT key file found: ISUCON_JWT_KEY_FILE=%s", getEnv("ISUCON_JWT_KEY_FILE", "../public.pem"))
+	}
+	return paths, nil
+}
+
+// 鍵のファイルが変わったかを判定するための文字列を返す
+func jwtKeyFilesSignature(paths []string) (string, error) {
+	var sb strings.Builder
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", fmt.Errorf("error os.Stat: keyFilename=%s: %w", p, err)
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", p, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return sb.String(), nil
+}
+
+// JWTの署名アルゴリズム
+// 環境変数 ISUCON_JWT_ALGORITHM に RS256, ES256, EdDSA のいずれかを設定すると、そのアルゴリズムだけを受け付ける
+// 未設定なら鍵の種類から決める
+func jwtAlgorithm() string {
+	return getEnv("ISUCON_JWT_ALGORITHM", "")
+}
+
+// 鍵で検証するアルゴリズムを返す
+// RSAならRS256、P-256のECDSAならES256、Ed25519ならEdDSA
+func jwtAlgorithmForKey(k jwk.Key) (jwa.SignatureAlgorithm, error) {
+	var alg jwa.SignatureAlgorithm
+	switch k := k.(type) {
+	case jwk.RSAPublicKey:
+		alg = jwa.RS256
+	case jwk.ECDSAPublicKey:
+		if k.Crv() != jwa.P256 {
+			return "", fmt.Errorf("unsupported ECDSA curve: %s", k.Crv())
+		}
+		alg = jwa.ES256
+	case jwk.OKPPublicKey:
+		if k.Crv() != jwa.Ed25519 {
+			return "", fmt.Errorf("unsupported OKP curve: %s", k.Crv())
+		}
+		alg = jwa.EdDSA
+	default:
+		return "", fmt.Errorf("unsupported key type: %s", k.KeyType())
+	}
+	if want := jwtAlgorithm(); want != "" && want != alg.String() {
+		return "", fmt.Errorf("key algorithm %s does not match ISUCON_JWT_ALGORITHM=%s", alg, want)
+	}
+	return alg, nil
+}
+
+// PEMファイルの公開鍵のセットを返す
+// ファイルが変わっていたら読み込み直す
+func retrieveJWTKeysFromFiles() (jwk.Set, error) {
+	cached, ok := jwtKeyCache.Get(true)
+	if ok && time.Since(cached.checkedAt) < jwtKeyFileCheckInterval {
+		return cached.set, nil
+	}
+
+	paths, err := jwtKeyFilePaths()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := jwtKeyFilesSignature(paths)
+	if err != nil {
+		return nil, err
+	}
+	if ok && cached.signature == signature {
+		cached.checkedAt = time.Now()
+		jwtKeyCache.Set(true, cached)
+		return cached.set, nil
+	}
+
+	set := jwk.NewSet()
+	for _, p := range paths {
+		keysrc, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", p, err)
+		}
+		key, _, err := jwk.DecodePEM(keysrc)
+		if err != nil {
+			return nil, fmt.Errorf("error jwk.DecodePEM: keyFilename=%s: %w", p, err)
+		}
+		k, err := jwk.FromRaw(key)
+		if err != nil {
+			return nil, fmt.Errorf("error jwk.FromRaw: keyFilename=%s: %w", p, err)
+		}
+		// PEMにはkidがないので、拡張子を除いたファイル名をkidにする
+		if err := k.Set(jwk.KeyIDKey, strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))); err != nil {
+			return nil, fmt.Errorf("error set kid: %w", err)
+		}
+		alg, err := jwtAlgorithmForKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("error jwtAlgorithmForKey: keyFilename=%s: %w", p, err)
+		}
+		if err := k.Set(jwk.AlgorithmKey, alg); err != nil {
+			return nil, fmt.Errorf("error set alg: %w", err)
+		}
+		if err := set.AddKey(k); err != nil {
+			return nil, fmt.Errorf("error AddKey: keyFilename=%s: %w", p, err)
+		}
+	}
+	// 外した鍵で署名されたJWTを使えなくする
+	if ok {
+		jwtTokenCache.Reset()
+	}
+	jwtKeyCache.Set(true, jwtFileKeySet{set: set, signature: signature, checkedAt: time.Now()})
+	return set, nil
+}
+
+// JWTを検証してパースする
+// 検証に失敗した場合は401のエラーを返す
+func parseJWT(tokenStr string) (jwt.Token, error) {
+	url := jwtJWKSURL()
+	if url == "" {
+		set, err := retrieveJWTKeysFromFiles()
+		if err != nil {
+			return nil, err
+		}
+		// kidが鍵のファイル名と一致すればその鍵を使い、そうでなければ全ての鍵を試す
+		opt := jwt.WithKeySet(set, jws.WithRequireKid(false))
+		if msg, err := jws.Parse([]byte(tokenStr)); err == nil && len(msg.Signatures()) > 0 {
+			if kid := msg.Signatures()[0].ProtectedHeaders().KeyID(); kid != "" {
+				if _, ok := set.LookupKeyID(kid); ok {
+					opt = jwt.WithKeySet(set)
+				}
+			}
+		}
+		token, err := jwt.Parse([]byte(tokenStr), opt)
+		if err != nil {
+			return nil, apperr.Unauthorized("error jwt.Parse: %s", err).WithCode(ErrInvalidToken.Code)
+		}
+		return token, nil
+	}
+
+	// JWKSの鍵はalgがあればそれを、なければ鍵の種類から推測したアルゴリズムを使うので、
+	// ISUCON_JWT_ALGORITHMを設定している場合はJWTのヘッダのalgで制限する
+	if want := jwtAlgorithm(); want != "" {
+		msg, err := jws.Parse([]byte(tokenStr))
+		if err != nil || len(msg.Signatures()) == 0 {
+			return nil, ErrInvalidToken
+		}
+		if alg := msg.Signatures()[0].ProtectedHeaders().Algorithm(); alg.String() != want {
+			return nil, apperr.Unauthorized("invalid token: algorithm %s is not allowed", alg).WithCode(ErrInvalidToken.Code)
+		}
+	}
+
+	ctx := context.Background()
+	set, err := retrieveJWKS(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse([]byte(tokenStr), jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true)))
+	// 知らないkidの場合は鍵が入れ替わったばかりかもしれないので取得し直す
+	if err != nil && forceRefreshJWKS(ctx, url) {
+		if set, rerr := retrieveJWKS(ctx, url); rerr == nil {
+			token, err = jwt.Parse([]byte(tokenStr), jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true)))
+		}
+	}
+	if err != nil {
+		return nil, apperr.Unauthorized("error jwt.Parse: %s", err).WithCode(ErrInvalidToken.Code)
+	}
+	return token, nil
+}
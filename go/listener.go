@@ -0,0 +1,184 @@
+package isuports
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// 同じポートをlistenする方法
+const (
+	// プロセスを複数起動する GOMAXPROCSをプロセスごとに設定できる
+	ListenerModeProcess = "process"
+	// 1つのプロセスでリスナーを複数作る
+	ListenerModeGoroutine = "goroutine"
+)
+
+// 同じポートをSO_REUSEPORTでlistenするリスナーの数
+// 環境変数 ISUCON_LISTENERS で設定する 1ならSO_REUSEPORTを使わない
+// コア数の多いホストでacceptのキューの競合を減らすためのもの
+// 既定では1つのプロセスでリスナーを複数作るので、メモリ上のキャッシュは全てのリスナーで共有する
+func listenerCount() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_LISTENERS", "1"))
+	if err != nil || n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// 環境変数 ISUCON_LISTENER_MODE で process か goroutine を指定する 未設定なら goroutine
+// process の場合、大会やテナント、課金レポートなどのキャッシュはプロセスごとに持ち、他のプロセスでの更新や初期化(POST /initialize)で捨てられない
+// 大会の終了やテナントの停止が他のプロセスに反映されないので、キャッシュを使わない検証用の構成以外では使わないこと
+func listenerMode() string {
+	if getEnv("ISUCON_LISTENER_MODE", ListenerModeGoroutine) == ListenerModeProcess {
+		return ListenerModeProcess
+	}
+	return ListenerModeGoroutine
+}
+
+// 子プロセスのGOMAXPROCS
+// 環境変数 ISUCON_LISTENER_GOMAXPROCS が未設定ならコア数をプロセス数で割った値にする
+func listenerGOMAXPROCS(n int) int {
+	if v, err := strconv.Atoi(getEnv("ISUCON_LISTENER_GOMAXPROCS", "")); err == nil && v > 0 {
+		return v
+	}
+	if procs := runtime.NumCPU() / n; procs > 0 {
+		return procs
+	}
+	return 1
+}
+
+// 親プロセスが子プロセスに渡すリスナーの番号
+const listenerIndexEnv = "ISUCON_LISTENER_INDEX"
+
+// 子プロセスを起動して待つ親プロセスか
+func isListenerSupervisor() bool {
+	if listenerCount() <= 1 || listenerMode() != ListenerModeProcess {
+		return false
+	}
+	_, ok := os.LookupEnv(listenerIndexEnv)
+	return !ok
+}
+
+// SO_REUSEPORTを設定してlistenする
+func listenReusePort(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	l, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error Listen with SO_REUSEPORT: address=%s, %w", address, err)
+	}
+	return l, nil
+}
+
+// 同じ引数で子プロセスをリスナーの数だけ起動して待つ
+// どれかの子プロセスが終了したら他の子プロセスも止めて終了する
+func superviseListenerProcesses() error {
+	n := listenerCount()
+	procs := listenerGOMAXPROCS(n)
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error os.Executable: %w", err)
+	}
+
+	cmds := make([]*exec.Cmd, 0, n)
+	exited := make(chan error, n)
+	for i := 0; i < n; i++ {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(
+			os.Environ(),
+			fmt.Sprintf("%s=%d", listenerIndexEnv, i),
+			fmt.Sprintf("GOMAXPROCS=%d", procs),
+		)
+		if err := cmd.Start(); err != nil {
+			for _, c := range cmds {
+				c.Process.Signal(syscall.SIGTERM)
+			}
+			return fmt.Errorf("error start listener process: index=%d, %w", i, err)
+		}
+		cmds = append(cmds, cmd)
+		go func(i int, cmd *exec.Cmd) {
+			err := cmd.Wait()
+			exited <- fmt.Errorf("listener process exited: index=%d, err=%v", i, err)
+		}(i, cmd)
+	}
+	log.Printf("started %d listener processes with GOMAXPROCS=%d", n, procs)
+	log.Printf("warning: listener processes do not share caches, updates in one process are not visible to the others")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	var result error
+	select {
+	case s := <-sig:
+		log.Printf("received %s, stopping listener processes", s)
+	case result = <-exited:
+	}
+	for _, c := range cmds {
+		c.Process.Signal(syscall.SIGTERM)
+	}
+	// 子プロセスは処理中のリクエストと溜めているデータを書き出してから終了するので待つ
+	remaining := n
+	if result != nil {
+		remaining--
+	}
+	timeout := time.After(shutdownTimeout() + 5*time.Second)
+	for ; remaining > 0; remaining-- {
+		select {
+		case err := <-exited:
+			log.Print(err)
+		case <-timeout:
+			log.Printf("%d listener processes did not exit in time", remaining)
+			return result
+		}
+	}
+	return result
+}
+
+// SO_REUSEPORTを設定したリスナーを返す
+// goroutineモードの場合は残りのリスナーもここで作ってhandlerで受け付ける
+// ISUCON_LISTENERSが1ならnilを返すので、echoにlistenさせる
+// tlsCfgがnilでなければ全てのリスナーでHTTPSを受け付ける
+func reusePortListener(address string, handler http.Handler, tlsCfg *tls.Config) (net.Listener, error) {
+	n := listenerCount()
+	if n <= 1 {
+		return nil, nil
+	}
+	count := 1
+	if listenerMode() == ListenerModeGoroutine {
+		count = n
+	}
+	ls := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		l, err := listenReusePort(address)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		if tlsCfg != nil {
+			l = tls.NewListener(l, tlsCfg)
+		}
+		ls = append(ls, l)
+	}
+	for _, l := range ls[1:] {
+		// 終了するときに処理中のリクエストを待てるようにhttp.Serverを残しておく shutdown.go を参照
+		srv := &http.Server{Handler: handler}
+		extraServersMu.Lock()
+		extraServers = append(extraServers, srv)
+		extraServersMu.Unlock()
+		go srv.Serve(l)
+	}
+	return ls[0], nil
+}
@@ -0,0 +1,141 @@
+package isuports
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ログは1行1つのJSONで標準エラー出力に書く
+// テナント名やロールで絞り込めるように、リクエストのログにはViewerの情報を入れる
+// 出力するレベルは環境変数 ISUCON_LOG_LEVEL (debug, info, warn, error) で変更できる
+var appLogger = newAppLogger(getEnv("ISUCON_LOG_LEVEL", "info"))
+
+// parseViewerが成功したときにViewerを入れておくecho.Contextのキー
+const logViewerKey = "isuports.viewer"
+
+func newAppLogger(level string) *zap.Logger {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+		lvl = zapcore.InfoLevel
+	}
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.TimeKey = "time"
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encCfg), zapcore.Lock(os.Stderr), lvl)
+	return zap.New(core, zap.AddCaller())
+}
+
+// リクエストごとに1行のログを書くミドルウェア
+// ハンドラがエラーを返した場合は先にエラーレスポンスを書いて、実際のステータスコードを記録する
+func RequestLogger(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		req := c.Request()
+		res := c.Response()
+		fields := []zap.Field{
+			zap.String("method", req.Method),
+			zap.String("uri", req.RequestURI),
+			zap.String("route", c.Path()),
+			zap.Int("status", res.Status),
+			zap.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			zap.String("remote_ip", c.RealIP()),
+			zap.Int64("bytes_out", res.Size),
+		}
+		if v, ok := c.Get(logViewerKey).(*Viewer); ok {
+			fields = append(fields,
+				zap.String("tenant_name", v.tenantName),
+				zap.String("role", v.role),
+				zap.String("player_id", v.playerID),
+			)
+		}
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		}
+
+		switch {
+		case res.Status >= 500:
+			appLogger.Error("request", fields...)
+		case res.Status >= 400:
+			appLogger.Warn("request", fields...)
+		default:
+			appLogger.Info("request", fields...)
+		}
+		return nil
+	}
+}
+
+// echo.Loggerをzapで実装したもの
+// e.Loggerとc.Logger()に書いたログもJSONで出力する
+type zapEchoLogger struct {
+	l *zap.SugaredLogger
+}
+
+func newZapEchoLogger(l *zap.Logger) *zapEchoLogger {
+	// ラッパーのメソッドではなく呼び出し元を記録する
+	return &zapEchoLogger{l: l.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+func (z *zapEchoLogger) Output() io.Writer     { return os.Stderr }
+func (z *zapEchoLogger) SetOutput(w io.Writer) {}
+func (z *zapEchoLogger) Prefix() string        { return "" }
+func (z *zapEchoLogger) SetPrefix(p string)    {}
+func (z *zapEchoLogger) SetHeader(h string)    {}
+
+// レベルは ISUCON_LOG_LEVEL で決めるので、echo側からは変更しない
+func (z *zapEchoLogger) Level() log.Lvl {
+	if z.l.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		return log.DEBUG
+	}
+	return log.INFO
+}
+func (z *zapEchoLogger) SetLevel(v log.Lvl) {}
+
+func (z *zapEchoLogger) Print(i ...interface{})                    { z.l.Info(i...) }
+func (z *zapEchoLogger) Printf(format string, args ...interface{}) { z.l.Infof(format, args...) }
+func (z *zapEchoLogger) Printj(j log.JSON)                         { z.l.Infow("", jsonFields(j)...) }
+func (z *zapEchoLogger) Debug(i ...interface{})                    { z.l.Debug(i...) }
+func (z *zapEchoLogger) Debugf(format string, args ...interface{}) { z.l.Debugf(format, args...) }
+func (z *zapEchoLogger) Debugj(j log.JSON)                         { z.l.Debugw("", jsonFields(j)...) }
+func (z *zapEchoLogger) Info(i ...interface{})                     { z.l.Info(i...) }
+func (z *zapEchoLogger) Infof(format string, args ...interface{})  { z.l.Infof(format, args...) }
+func (z *zapEchoLogger) Infoj(j log.JSON)                          { z.l.Infow("", jsonFields(j)...) }
+func (z *zapEchoLogger) Warn(i ...interface{})                     { z.l.Warn(i...) }
+func (z *zapEchoLogger) Warnf(format string, args ...interface{})  { z.l.Warnf(format, args...) }
+func (z *zapEchoLogger) Warnj(j log.JSON)                          { z.l.Warnw("", jsonFields(j)...) }
+func (z *zapEchoLogger) Error(i ...interface{})                    { z.l.Error(i...) }
+func (z *zapEchoLogger) Errorf(format string, args ...interface{}) { z.l.Errorf(format, args...) }
+func (z *zapEchoLogger) Errorj(j log.JSON)                         { z.l.Errorw("", jsonFields(j)...) }
+func (z *zapEchoLogger) Fatal(i ...interface{})                    { z.l.Fatal(i...) }
+func (z *zapEchoLogger) Fatalf(format string, args ...interface{}) { z.l.Fatalf(format, args...) }
+func (z *zapEchoLogger) Fatalj(j log.JSON)                         { z.l.Fatalw("", jsonFields(j)...) }
+func (z *zapEchoLogger) Panic(i ...interface{})                    { z.l.Panic(i...) }
+func (z *zapEchoLogger) Panicf(format string, args ...interface{}) { z.l.Panicf(format, args...) }
+func (z *zapEchoLogger) Panicj(j log.JSON)                         { z.l.Panicw("", jsonFields(j)...) }
+
+func jsonFields(j log.JSON) []interface{} {
+	kvs := make([]interface{}, 0, len(j)*2)
+	for k, v := range j {
+		kvs = append(kvs, k, v)
+	}
+	return kvs
+}
+
+// 標準のlogパッケージに書いたログもJSONにする
+// バックグラウンドの処理は log.Printf でログを書いている
+func redirectStdLog() func() {
+	return zap.RedirectStdLog(appLogger)
+}
+
+var _ echo.Logger = (*zapEchoLogger)(nil)
@@ -0,0 +1,117 @@
+package isuports
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// 要素の数と有効期間に上限のあるキャッシュ
+// helpisu.Cacheと同じメソッドを持ち、上限を超えたら最後に使われたのが古い要素から捨てる
+// 上限は設定(config.go の CacheConfig)から読むので、設定を読み込む前に作ったキャッシュにも反映される
+type lruCache[K comparable, V any] struct {
+	mu     sync.Mutex
+	limits func() CacheLimitConfig
+	items  map[K]*list.Element
+	// 先頭が最後に使われた要素
+	order *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time // 有効期間がなければゼロ値
+}
+
+func newLRUCache[K comparable, V any](limits func() CacheLimitConfig) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		limits: limits,
+		items:  map[K]*list.Element{},
+		order:  list.New(),
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*lruEntry[K, V])
+	if !e.expiresAt.IsZero() && time.Now().After(e.expiresAt) {
+		c.remove(el)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *lruCache[K, V]) Set(key K, value V) {
+	l := c.limits()
+	var expiresAt time.Time
+	if l.TTLMs > 0 {
+		expiresAt = time.Now().Add(time.Duration(l.TTLMs) * time.Millisecond)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[K, V])
+		e.value, e.expiresAt = value, expiresAt
+		c.order.MoveToFront(el)
+	} else {
+		c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	}
+	if l.MaxEntries > 0 {
+		for c.order.Len() > l.MaxEntries {
+			c.remove(c.order.Back())
+		}
+	}
+}
+
+func (c *lruCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *lruCache[K, V]) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = map[K]*list.Element{}
+	c.order.Init()
+}
+
+// 要素の数 有効期間が過ぎてまだ捨てていない要素も含む
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// 有効期間内の要素を最後に使われたのが新しい順に読む
+// fの中でこのキャッシュのメソッドを呼んではいけない
+func (c *lruCache[K, V]) Range(f func(K, V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*lruEntry[K, V])
+		if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			continue
+		}
+		if !f(e.key, e.value) {
+			return
+		}
+	}
+}
+
+func (c *lruCache[K, V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[K, V]).key)
+}
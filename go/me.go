@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
 	"github.com/labstack/echo/v4"
 )
 
@@ -24,8 +25,7 @@ func meHandler(c echo.Context) error {
 	}
 	v, err := parseViewer(c)
 	if err != nil {
-		var he *echo.HTTPError
-		if ok := errors.As(err, &he); ok && he.Code == http.StatusUnauthorized {
+		if errors.Is(err, apperr.ErrUnauthorized) {
 			return c.JSON(http.StatusOK, SuccessResult{
 				Status: true,
 				Data: MeHandlerResult{
@@ -38,6 +38,7 @@ func meHandler(c echo.Context) error {
 		}
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
+
 	if v.role == RoleAdmin || v.role == RoleOrganizer {
 		return c.JSON(http.StatusOK, SuccessResult{
 			Status: true,
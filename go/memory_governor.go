@@ -0,0 +1,77 @@
+package isuports
+
+import (
+	"expvar"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// ヒープの上限(MB)
+// 環境変数 ISUCON_MEMORY_LIMIT_MB に設定すると、ヒープが上限に近づいたときに大きなキャッシュを捨てる
+// 0なら何もしない
+func memoryLimitBytes() uint64 {
+	n, err := strconv.ParseUint(getEnv("ISUCON_MEMORY_LIMIT_MB", "0"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n * 1024 * 1024
+}
+
+// ヒープを確認する間隔(ms)
+func memoryGovernorIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_MEMORY_GOVERNOR_INTERVAL_MS", "1000"))
+	if err != nil || n <= 0 {
+		return 1000
+	}
+	return n
+}
+
+// 上限に対してこの割合を超えたらキャッシュを捨て始める
+const memoryGovernorHighWatermark = 0.9
+
+// ヒープが多いときに捨てるキャッシュ
+// 大きくなりやすいものから順に捨て、上限を下回ったらそれ以降は捨てない
+var memoryGovernorCaches = []struct {
+	name  string
+	reset func()
+}{
+	{"ranking_page", rankingPageCache.Reset},
+	{"materialized_ranking", materializedRankingCache.Reset},
+	{"player", playerCache.Reset},
+	{"jwt_token", jwtTokenCache.Reset},
+	// 捨てても同じ閲覧を記録し直すだけ
+	{"visited_competition", visitedCompetitionCache.Reset},
+}
+
+// キャッシュごとの捨てた回数
+// デバッグ用のlistenerの /debug/vars で見られる debug_listener.go を参照
+var memoryGovernorShrinkVar = expvar.NewMap("memory_governor_shrink")
+
+// ヒープが上限に近づいていたらキャッシュを捨てる
+// キャッシュを捨てた後にGCしてからヒープを測り直す
+func memoryGovernorJob() {
+	limit := memoryLimitBytes()
+	if limit == 0 {
+		return
+	}
+	threshold := uint64(float64(limit) * memoryGovernorHighWatermark)
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.HeapAlloc < threshold {
+		return
+	}
+	before := ms.HeapAlloc
+	for _, c := range memoryGovernorCaches {
+		c.reset()
+		memoryGovernorShrinkVar.Add(c.name, 1)
+		debug.FreeOSMemory()
+		runtime.ReadMemStats(&ms)
+		log.Printf("memory governor: reset %s cache, heap=%dMB->%dMB, limit=%dMB", c.name, before>>20, ms.HeapAlloc>>20, limit>>20)
+		if ms.HeapAlloc < threshold {
+			return
+		}
+	}
+}
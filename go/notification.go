@@ -0,0 +1,219 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 通知の種類
+const (
+	// 大会の終了時の最終順位
+	NotificationKindCompetitionResult = "competition_result"
+)
+
+type NotificationRow struct {
+	TenantID      int64   `db:"tenant_id"`
+	PlayerID      string  `db:"player_id"`
+	CompetitionID string  `db:"competition_id"`
+	Kind          string  `db:"kind"`
+	Rank          int64   `db:"rank"`
+	Score         int64   `db:"score"`
+	Percentile    float64 `db:"percentile"`
+	PlayerCount   int64   `db:"player_count"`
+	CreatedAt     int64   `db:"created_at"`
+}
+
+// 最終順位の通知を作る大会
+// 大会を終了したときに追加し、notificationDigestJobでまとめて処理する
+// プロセスのメモリ上にだけ持つので、処理する前に再起動すると通知は作られない
+type pendingDigest struct {
+	tenantID      int64
+	competitionID string
+}
+
+var (
+	pendingDigests   = []pendingDigest{}
+	pendingDigestsMu sync.Mutex
+)
+
+func enqueueNotificationDigest(tenantID int64, competitionID string) {
+	pendingDigestsMu.Lock()
+	defer pendingDigestsMu.Unlock()
+	pendingDigests = append(pendingDigests, pendingDigest{tenantID: tenantID, competitionID: competitionID})
+}
+
+func resetPendingDigests() {
+	pendingDigestsMu.Lock()
+	defer pendingDigestsMu.Unlock()
+	pendingDigests = []pendingDigest{}
+}
+
+// 終了した大会の参加者ごとの最終順位の通知を作る
+// 失敗した大会は次回にやり直す
+func notificationDigestJob() {
+	pendingDigestsMu.Lock()
+	ds := pendingDigests
+	pendingDigests = []pendingDigest{}
+	pendingDigestsMu.Unlock()
+
+	ctx := context.Background()
+	for _, d := range ds {
+		if err := createCompetitionResultNotifications(ctx, d.tenantID, d.competitionID); err != nil {
+			log.Printf("error createCompetitionResultNotifications: tenantID=%d, competitionID=%s, %s", d.tenantID, d.competitionID, err)
+			enqueueNotificationDigest(d.tenantID, d.competitionID)
+		}
+	}
+}
+
+// 大会の最終的なランキングから参加者ごとの通知を作る
+// 大会ごとに一度だけ作り、その後にスコアが訂正されても作り直さない
+func createCompetitionResultNotifications(ctx context.Context, tenantID int64, competitionID string) error {
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+
+	var exists int
+	if err := tenantDB.GetContext(
+		ctx,
+		&exists,
+		"SELECT COUNT(*) FROM notification WHERE tenant_id = ? AND competition_id = ? AND kind = ?",
+		tenantID, competitionID, NotificationKindCompetitionResult,
+	); err != nil {
+		return fmt.Errorf("error Select notification: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	// 終了した大会のスコアはアップロードできないので、ロックを取って読んだ時点のランキングが最終結果になる
+	fl, err := rlockByTenantID(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	pss := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
+		tenantID,
+		competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	tieBreak, err := competitionTieBreak(ctx, tenantDB, competitionID)
+	if err != nil {
+		return err
+	}
+	ranks, err := buildCompetitionRanks(ctx, tenantDB, pss, tieBreak, make([]CompetitionRank, 0, len(pss)), make(map[string]struct{}, len(pss)))
+	if err != nil {
+		return err
+	}
+	if len(ranks) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	n := int64(len(ranks))
+	rows := make([]NotificationRow, 0, len(ranks))
+	for _, r := range ranks {
+		rank := r.Rank
+		rows = append(rows, NotificationRow{
+			TenantID:      tenantID,
+			PlayerID:      r.PlayerID,
+			CompetitionID: competitionID,
+			Kind:          NotificationKindCompetitionResult,
+			Rank:          rank,
+			Score:         r.Score,
+			// 自分以下の順位の参加者の割合 1位は100
+			Percentile:  float64(n-rank+1) / float64(n) * 100,
+			PlayerCount: n,
+			CreatedAt:   now,
+		})
+	}
+	if _, err := tenantDB.NamedExecContext(
+		ctx,
+		"INSERT INTO notification (tenant_id, player_id, competition_id, kind, `rank`, score, percentile, player_count, created_at) VALUES (:tenant_id, :player_id, :competition_id, :kind, :rank, :score, :percentile, :player_count, :created_at)",
+		rows,
+	); err != nil {
+		return fmt.Errorf("error Insert notification: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	return nil
+}
+
+type NotificationDetail struct {
+	Kind        string            `json:"kind"`
+	Competition CompetitionDetail `json:"competition"`
+	Rank        int64             `json:"rank"`
+	Score       int64             `json:"score"`
+	Percentile  float64           `json:"percentile"`
+	PlayerCount int64             `json:"player_count"`
+	CreatedAt   int64             `json:"created_at"`
+}
+
+type NotificationsHandlerResult struct {
+	Notifications []NotificationDetail `json:"notifications"`
+}
+
+// 参加者向けAPI
+// GET /api/player/notifications
+// 自分宛ての通知を新しい順に取得する
+func playerNotificationsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	ns := []NotificationRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&ns,
+		"SELECT * FROM notification WHERE tenant_id = ? AND player_id = ? ORDER BY created_at DESC",
+		v.tenantID, v.playerID,
+	); err != nil {
+		return fmt.Errorf("error Select notification: tenantID=%d, playerID=%s, %w", v.tenantID, v.playerID, err)
+	}
+
+	res := NotificationsHandlerResult{Notifications: make([]NotificationDetail, 0, len(ns))}
+	for _, n := range ns {
+		comp, err := retrieveCompetition(ctx, tenantDB, n.CompetitionID)
+		if err != nil {
+			return fmt.Errorf("error retrieveCompetition: %w", err)
+		}
+		res.Notifications = append(res.Notifications, NotificationDetail{
+			Kind: n.Kind,
+			Competition: CompetitionDetail{
+				ID:         comp.ID,
+				Title:      comp.Title,
+				IsFinished: comp.FinishedAt.Valid,
+			},
+			Rank:        n.Rank,
+			Score:       n.Score,
+			Percentile:  n.Percentile,
+			PlayerCount: n.PlayerCount,
+			CreatedAt:   n.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,45 @@
+package isuports
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/objstore"
+)
+
+// バックアップ、エクスポート、アップロード、結果の公開などの大きなファイルの保存先
+// 環境変数 ISUCON_OBJECT_STORAGE に file:///path/to/dir か s3://bucket/prefix を設定する
+// 未設定なら ../object_storage ディレクトリ
+// S3の場合は ISUCON_S3_ENDPOINT, ISUCON_S3_REGION と AWS_ACCESS_KEY_ID などの環境変数を使う
+// 各機能は独自にファイルを扱わず、connectObjectStore で取得したものを使うこと
+func objectStorageURL() string {
+	return getEnv("ISUCON_OBJECT_STORAGE", "../object_storage")
+}
+
+var (
+	objectStore   objstore.Store
+	objectStoreMu sync.Mutex
+)
+
+// 大きなファイルの保存先を返す
+// 全ての機能で共有するので、最初に呼ばれたときに作る
+func connectObjectStore() (objstore.Store, error) {
+	objectStoreMu.Lock()
+	defer objectStoreMu.Unlock()
+	if objectStore != nil {
+		return objectStore, nil
+	}
+
+	s, err := objstore.Open(objectStorageURL(), objstore.S3Config{
+		Endpoint:        getEnv("ISUCON_S3_ENDPOINT", ""),
+		Region:          getEnv("ISUCON_S3_REGION", getEnv("AWS_REGION", "")),
+		AccessKeyID:     getEnv("AWS_ACCESS_KEY_ID", ""),
+		SecretAccessKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		SessionToken:    getEnv("AWS_SESSION_TOKEN", ""),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error objstore.Open: url=%s, %w", objectStorageURL(), err)
+	}
+	objectStore = s
+	return s, nil
+}
@@ -0,0 +1,794 @@
+package isuports
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// APIの定義
+// apiOperationsからOpenAPIのスキーマを作って /api/openapi.json で返し、
+// ValidateRequestミドルウェアで定義に合わないリクエストをハンドラの前に422で拒否する
+// レスポンスのスキーマはResultに指定した型からreflectで作る
+// newEchoにルートを追加したらここにも追加すること 定義のないルートは起動時にログに出す
+
+// パラメータの場所
+const (
+	apiParamInPath  = "path"
+	apiParamInQuery = "query"
+	apiParamInForm  = "form"
+)
+
+// パラメータの型
+const (
+	apiTypeString  = "string"
+	apiTypeInteger = "integer"
+	apiTypeArray   = "array" // 同じ名前の文字列を複数 display_name[] など
+	apiTypeFile    = "file"
+)
+
+type apiParam struct {
+	Name     string
+	In       string
+	Type     string
+	Required bool
+	Enum     []string
+	Minimum  *int64
+}
+
+func (p apiParam) withMinimum(n int64) apiParam {
+	p.Minimum = &n
+	return p
+}
+
+func pathParam(name, typ string) apiParam {
+	return apiParam{Name: name, In: apiParamInPath, Type: typ, Required: true}
+}
+
+func queryParam(name, typ string) apiParam {
+	return apiParam{Name: name, In: apiParamInQuery, Type: typ}
+}
+
+func queryEnum(name string, values ...string) apiParam {
+	return apiParam{Name: name, In: apiParamInQuery, Type: apiTypeString, Enum: values}
+}
+
+func formParam(name, typ string, required bool) apiParam {
+	return apiParam{Name: name, In: apiParamInForm, Type: typ, Required: required}
+}
+
+func formEnum(name string, required bool, values ...string) apiParam {
+	return apiParam{Name: name, In: apiParamInForm, Type: apiTypeString, Required: required, Enum: values}
+}
+
+type apiOperation struct {
+	Method  string
+	Path    string // echoのルーティングと同じ :name の形式
+	Tag     string
+	Summary string
+	Params  []apiParam
+	// JSONのリクエストボディの型 nilならフォームかボディなし
+	Body any
+	// SuccessResultのdataの型 nilならdataを返さない
+	Result any
+	// SuccessResultで包まずに返すJSONの型
+	RawResult any
+	// JSON以外を返す場合のContent-Type
+	ContentType string
+}
+
+const (
+	apiTagAdmin     = "admin"
+	apiTagOrganizer = "organizer"
+	apiTagPlayer    = "player"
+	apiTagCommon    = "common"
+)
+
+var (
+	tenantIDParam      = pathParam("tenant_id", apiTypeInteger)
+	competitionIDParam = pathParam("competition_id", apiTypeString)
+	playerIDParam      = pathParam("player_id", apiTypeString)
+	billingFromParam   = queryParam("from", apiTypeInteger).withMinimum(0)
+	billingToParam     = queryParam("to", apiTypeInteger).withMinimum(0)
+)
+
+var apiOperations = []apiOperation{
+	// SaaS管理者向けAPI
+	{Method: http.MethodGet, Path: "/api/admin/tenants", Tag: apiTagAdmin, Summary: "テナントの一覧をidの降順で取得する",
+		Params: []apiParam{
+			queryParam("name", apiTypeString),
+			queryParam("created_from", apiTypeInteger),
+			queryParam("created_to", apiTypeInteger),
+			queryParam("before", apiTypeInteger),
+			queryParam("limit", apiTypeInteger),
+		},
+		Result: TenantsListHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenants/add", Tag: apiTagAdmin, Summary: "テナントを追加する",
+		Params: []apiParam{
+			formParam("name", apiTypeString, true),
+			formParam("display_name", apiTypeString, false),
+			formEnum("storage", false, TenantStorageSQLite, TenantStorageMySQL),
+		},
+		Result: TenantsAddHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenants/bulk_add", Tag: apiTagAdmin, Summary: "テナントを一括で追加する",
+		Body: TenantsBulkAddRequest{}, Result: TenantsBulkAddHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenants/billing", Tag: apiTagAdmin, Summary: "テナントごとの課金レポートをテナントのid降順で取得する",
+		Params: []apiParam{
+			queryParam("before", apiTypeInteger),
+			queryParam("limit", apiTypeInteger).withMinimum(1),
+			billingFromParam,
+			billingToParam,
+		},
+		Result: TenantsBillingHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenants/billing/export", Tag: apiTagAdmin, Summary: "テナントごとの課金レポートをテナントのid降順でCSVで取得する",
+		Params:      []apiParam{queryParam("before", apiTypeInteger), billingFromParam, billingToParam},
+		ContentType: "text/csv"},
+	{Method: http.MethodGet, Path: "/api/admin/tenants/:tenant_id/billing/monthly", Tag: apiTagAdmin, Summary: "テナントの課金を大会の終了日時の月(日本時間)ごとに合計する",
+		Params: []apiParam{
+			tenantIDParam,
+			{Name: "year", In: apiParamInQuery, Type: apiTypeInteger, Required: true},
+			{Name: "month", In: apiParamInQuery, Type: apiTypeInteger, Required: true},
+		},
+		Result: TenantMonthlyBillingHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/delete", Tag: apiTagAdmin, Summary: "テナントを削除する",
+		Params: []apiParam{tenantIDParam}, Result: TenantDeleteHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/suspend", Tag: apiTagAdmin, Summary: "テナントを停止する",
+		Params: []apiParam{tenantIDParam}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/reactivate", Tag: apiTagAdmin, Summary: "停止したテナントを再開する",
+		Params: []apiParam{tenantIDParam}},
+	{Method: http.MethodGet, Path: "/api/admin/tenant/:tenant_id/stats", Tag: apiTagAdmin, Summary: "テナントの利用状況を取得する",
+		Params: []apiParam{tenantIDParam}, Result: TenantStatsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenants/tiers", Tag: apiTagAdmin, Summary: "テナントの温度の判定結果と閾値を取得する",
+		Result: TenantTiersHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenant/:tenant_id/billing_plan", Tag: apiTagAdmin, Summary: "テナントの課金単価を取得する",
+		Params: []apiParam{tenantIDParam}, Result: BillingPlanHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/billing_plan", Tag: apiTagAdmin, Summary: "テナントの課金単価を設定する",
+		Params: []apiParam{
+			tenantIDParam,
+			formParam("player_yen", apiTypeInteger, true).withMinimum(0),
+			formParam("visitor_yen", apiTypeInteger, true).withMinimum(0),
+		},
+		Result: BillingPlanHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/billing_plan/tier", Tag: apiTagAdmin, Summary: "テナントの課金プランを設定する",
+		Params: []apiParam{
+			tenantIDParam,
+			formEnum("tier", true, BillingTierFree, BillingTierStandard, BillingTierEnterprise),
+		},
+		Result: BillingPlanHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenant/:tenant_id/billing/recompute", Tag: apiTagAdmin, Summary: "キャッシュを使わずに課金レポートを計算し直し、キャッシュと保存した値との差分を取得する",
+		Params: []apiParam{tenantIDParam}, Result: BillingRecomputeHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/impersonate", Tag: apiTagAdmin, Summary: "テナント管理者になりすますための短時間のセッションを発行する",
+		Params: []apiParam{tenantIDParam, formParam("reason", apiTypeString, true)},
+		Result: ImpersonateHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenant/:tenant_id/impersonations", Tag: apiTagAdmin, Summary: "テナントに対するなりすましの記録を新しい順に取得する",
+		Params: []apiParam{tenantIDParam}, Result: ImpersonationsHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/organizer_credential", Tag: apiTagAdmin, Summary: "テナント管理者がログインAPIで使うlogin_idとパスワードを設定する",
+		Params: []apiParam{
+			tenantIDParam,
+			formParam("login_id", apiTypeString, true),
+			formParam("password", apiTypeString, true),
+		}},
+	{Method: http.MethodPost, Path: "/api/admin/tenant/:tenant_id/sandbox", Tag: apiTagAdmin, Summary: "テナントを複製してサンドボックスのテナントを作る",
+		Params: []apiParam{tenantIDParam, formParam("name", apiTypeString, false)},
+		Result: TenantSandboxHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/search", Tag: apiTagAdmin, Summary: "テナント名と表示名から部分一致で検索する",
+		Params: []apiParam{
+			{Name: "q", In: apiParamInQuery, Type: apiTypeString, Required: true},
+			queryParam("limit", apiTypeInteger).withMinimum(1),
+			queryParam("competitions", apiTypeString),
+		},
+		Result: SearchHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenant/:tenant_id/competition/:competition_id/billing_receipt", Tag: apiTagAdmin, Summary: "大会の終了時に確定した請求の記録を返す",
+		Params: []apiParam{tenantIDParam, competitionIDParam}, Result: BillingReceiptHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/ip_allowlist", Tag: apiTagAdmin, Summary: "接続元IPアドレスの許可リストを取得する",
+		Params: []apiParam{queryParam("tenant_id", apiTypeInteger)}, Result: IPAllowlistHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/ip_allowlist/add", Tag: apiTagAdmin, Summary: "接続元IPアドレスの許可リストにCIDRを追加する",
+		Params: []apiParam{
+			formParam("tenant_id", apiTypeInteger, false),
+			formParam("cidr", apiTypeString, true),
+			formParam("note", apiTypeString, false),
+		},
+		Result: IPAllowlistEntryHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/ip_allowlist/:entry_id/delete", Tag: apiTagAdmin, Summary: "接続元IPアドレスの許可リストからCIDRを削除する",
+		Params: []apiParam{pathParam("entry_id", apiTypeInteger)}, Result: IPAllowlistEntryHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenants/:tenant_id/db/reopen", Tag: apiTagAdmin, Summary: "テナントDBへの接続を閉じて開き直す",
+		Params: []apiParam{tenantIDParam}, Result: TenantDBReopenHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenants/:tenant_id/db/standby", Tag: apiTagAdmin, Summary: "テナントDBのスタンバイの状態を返す",
+		Params: []apiParam{tenantIDParam}, Result: TenantDBStandbyDetail{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenants/:tenant_id/db/failover", Tag: apiTagAdmin, Summary: "テナントDBをスタンバイのコピーに切り替える",
+		Params: []apiParam{tenantIDParam}, Result: TenantDBStandbyDetail{}},
+	{Method: http.MethodPost, Path: "/api/admin/tenants/:tenant_id/indexes/build", Tag: apiTagAdmin, Summary: "テナントDBに足りないインデックスをバックグラウンドで追加する",
+		Params: []apiParam{tenantIDParam}, Result: IndexBuildDetail{}},
+	{Method: http.MethodGet, Path: "/api/admin/tenants/:tenant_id/indexes/build", Tag: apiTagAdmin, Summary: "テナントDBへのインデックスの追加の進捗を返す",
+		Params: []apiParam{tenantIDParam}, Result: IndexBuildDetail{}},
+	{Method: http.MethodPost, Path: "/api/admin/visit_history/purge", Tag: apiTagAdmin, Summary: "終了した大会のvisit_historyの削除をバックグラウンドで始める",
+		Params: []apiParam{formParam("retention_days", apiTypeInteger, false).withMinimum(0)}, Result: VisitHistoryPurgeDetail{}},
+	{Method: http.MethodGet, Path: "/api/admin/visit_history/purge", Tag: apiTagAdmin, Summary: "最後に実行したvisit_historyの削除の進捗を返す",
+		Result: VisitHistoryPurgeDetail{}},
+	{Method: http.MethodGet, Path: "/api/admin/sql/slow_query_log", Tag: apiTagAdmin, Summary: "テナントDBのスロークエリログの設定を返す",
+		Result: SlowQueryLogDetail{}},
+	{Method: http.MethodPost, Path: "/api/admin/sql/slow_query_log", Tag: apiTagAdmin, Summary: "テナントDBのスロークエリログの閾値を変更する",
+		Params: []apiParam{formParam("threshold_ms", apiTypeInteger, true).withMinimum(0)},
+		Result: SlowQueryLogDetail{}},
+
+	// テナント管理者向けAPI
+	{Method: http.MethodGet, Path: "/api/organizer/players", Tag: apiTagOrganizer, Summary: "参加者一覧を返す",
+		Result: PlayersListHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/players/add", Tag: apiTagOrganizer, Summary: "テナントに参加者を追加する",
+		Params: []apiParam{formParam("display_name[]", apiTypeArray, false)},
+		Result: PlayersAddHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/player/:player_id/disqualified", Tag: apiTagOrganizer, Summary: "参加者を失格にする",
+		Params: []apiParam{playerIDParam, formParam("reason", apiTypeString, false)},
+		Result: PlayerDisqualifiedHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/player/:player_id/reinstate", Tag: apiTagOrganizer, Summary: "失格にした参加者を復帰させる",
+		Params: []apiParam{playerIDParam}, Result: PlayerReinstateHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/player/:player_id/delete", Tag: apiTagOrganizer, Summary: "参加者を論理削除する",
+		Params: []apiParam{playerIDParam}, Result: PlayerDeleteHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/player/:player_id/restore", Tag: apiTagOrganizer, Summary: "論理削除した参加者を元に戻す",
+		Params: []apiParam{playerIDParam}, Result: PlayerDeleteHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/player/:src_id/merge/:dst_id", Tag: apiTagOrganizer, Summary: "二重登録された参加者をまとめる",
+		Params: []apiParam{pathParam("src_id", apiTypeString), pathParam("dst_id", apiTypeString)},
+		Result: PlayerMergeHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/player/:player_id/credential", Tag: apiTagOrganizer, Summary: "参加者がログインAPIで使うパスワードを設定する",
+		Params: []apiParam{playerIDParam, formParam("password", apiTypeString, true)}},
+	{Method: http.MethodPost, Path: "/api/organizer/competitions/add", Tag: apiTagOrganizer, Summary: "大会を追加する",
+		Params: []apiParam{formParam("title", apiTypeString, false)},
+		Result: CompetitionsAddHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/competition/:competition_id/finish", Tag: apiTagOrganizer, Summary: "大会を終了する",
+		Params: []apiParam{competitionIDParam}},
+	{Method: http.MethodPost, Path: "/api/organizer/competition/:competition_id/tie_break", Tag: apiTagOrganizer, Summary: "大会のランキングの同点の扱いを設定する",
+		Params: []apiParam{competitionIDParam, formEnum("tie_break", true, TieBreakEarliest, TieBreakLatest, TieBreakShared)},
+		Result: CompetitionTieBreakHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/competition/:competition_id/score", Tag: apiTagOrganizer, Summary: "大会のスコアをCSVでアップロードする",
+		Params: []apiParam{competitionIDParam, queryEnum("mode", ScoreUploadModeReplace, ScoreUploadModeAppend), formParam("scores", apiTypeFile, true)},
+		Result: ScoreHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/competition/:competition_id/score/:player_id", Tag: apiTagOrganizer, Summary: "開催中の大会の参加者1人のスコアを登録または訂正する",
+		Params: []apiParam{competitionIDParam, playerIDParam, formParam("score", apiTypeInteger, true)},
+		Result: ScoreCorrectionHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/competition/:competition_id/score/:player_id/delete", Tag: apiTagOrganizer, Summary: "大会から参加者1人のスコアを全て削除する",
+		Params: []apiParam{competitionIDParam, playerIDParam},
+		Result: ScoreDeletionHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/competition/:competition_id/import", Tag: apiTagOrganizer, Summary: "外部の計測システムなどの形式のファイルからスコアを取り込む",
+		Params: []apiParam{
+			competitionIDParam,
+			formEnum("format", true, ScoreImportFormatResultsJSON, ScoreImportFormatTimingCSV),
+			formParam("mapping", apiTypeString, false),
+			formParam("file", apiTypeFile, true),
+		},
+		Result: ScoreImportHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/uploads", Tag: apiTagOrganizer, Summary: "大会のスコアのアップロードの一覧を新しい順に取得する",
+		Params: []apiParam{competitionIDParam}, Result: ScoreUploadsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/export/scores.csv", Tag: apiTagOrganizer, Summary: "大会のスコアをアップロードしたCSVと同じ順でCSVにする",
+		Params:      []apiParam{competitionIDParam, queryParam("offset", apiTypeInteger).withMinimum(0)},
+		ContentType: "text/csv"},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/export/ranking.csv", Tag: apiTagOrganizer, Summary: "大会のランキングを順位の順でCSVにする",
+		Params: []apiParam{competitionIDParam}, ContentType: "text/csv"},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/ranking/export", Tag: apiTagOrganizer, Summary: "終了した大会の最終順位を全参加者分CSVで返す",
+		Params:      []apiParam{competitionIDParam, queryParam("offset", apiTypeInteger).withMinimum(0)},
+		ContentType: "text/csv"},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/upload/:upload_id", Tag: apiTagOrganizer, Summary: "スコアのアップロードで、直前の有効なスコアから何が変わったかを取得する",
+		Params: []apiParam{competitionIDParam, pathParam("upload_id", apiTypeString)},
+		Result: ScoreUploadHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/billing", Tag: apiTagOrganizer, Summary: "テナント内の課金レポートを取得する",
+		Params: []apiParam{
+			queryEnum("fields", BillingFieldsAll, BillingFieldsCounts, BillingFieldsYen),
+			queryParam("locale", apiTypeString),
+			billingFromParam,
+			billingToParam,
+		},
+		Result: BillingHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/billing/export", Tag: apiTagOrganizer, Summary: "テナント内の課金レポートをCSVで取得する",
+		Params: []apiParam{
+			queryEnum("fields", BillingFieldsAll, BillingFieldsCounts, BillingFieldsYen),
+			queryParam("locale", apiTypeString),
+			billingFromParam,
+			billingToParam,
+		},
+		ContentType: "text/csv"},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/billing_receipt", Tag: apiTagOrganizer, Summary: "大会の終了時に確定した請求の記録を返す",
+		Params: []apiParam{competitionIDParam}, Result: BillingReceiptHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competitions", Tag: apiTagOrganizer, Summary: "大会の一覧を取得する",
+		Result: CompetitionsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/visitors", Tag: apiTagOrganizer, Summary: "大会のランキングを閲覧したユニークな参加者数の推移を取得する",
+		Params: []apiParam{competitionIDParam, queryParam("interval", apiTypeInteger).withMinimum(minVisitorsInterval)},
+		Result: CompetitionVisitorsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/visits", Tag: apiTagOrganizer, Summary: "大会のランキングを閲覧した参加者と、最初と最後に閲覧した日時を取得する",
+		Params: []apiParam{competitionIDParam}, Result: CompetitionVisitsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/analytics", Tag: apiTagOrganizer, Summary: "大会のランキングの閲覧者数、閲覧数の推移、閲覧した参加者のうちスコアを登録した割合を取得する",
+		Params: []apiParam{competitionIDParam, queryParam("interval", apiTypeInteger).withMinimum(minVisitorsInterval)},
+		Result: CompetitionAnalyticsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/stats", Tag: apiTagOrganizer, Summary: "大会の参加者ごとの最新のスコアの統計量とヒストグラムを取得する",
+		Params: []apiParam{competitionIDParam, queryParam("bins", apiTypeInteger).withMinimum(1)},
+		Result: OrganizerCompetitionStatsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/organizer/competition/:competition_id/disputes", Tag: apiTagOrganizer, Summary: "大会への異議申し立ての一覧を古い順に取得する",
+		Params: []apiParam{competitionIDParam, queryEnum("status", DisputeStatusOpen, DisputeStatusAccepted, DisputeStatusRejected)},
+		Result: ScoreDisputesHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/organizer/dispute/:dispute_id/resolve", Tag: apiTagOrganizer, Summary: "異議申し立てを認めるか却下する",
+		Params: []apiParam{
+			pathParam("dispute_id", apiTypeString),
+			formEnum("status", true, DisputeStatusAccepted, DisputeStatusRejected),
+			formParam("resolution", apiTypeString, false),
+			formParam("corrected_score", apiTypeInteger, false),
+		},
+		Result: ScoreDisputeHandlerResult{}},
+
+	// 参加者向けAPI
+	{Method: http.MethodGet, Path: "/api/player/player/:player_id", Tag: apiTagPlayer, Summary: "参加者の詳細情報を取得する",
+		Params: []apiParam{playerIDParam}, Result: PlayerHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/player/:player_id/history", Tag: apiTagPlayer, Summary: "参加者がこれまでに登録されたスコアを全て取得する",
+		Params: []apiParam{playerIDParam}, Result: PlayerScoreHistoryHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/player/:player_id/stats", Tag: apiTagPlayer, Summary: "終了した大会ごとの参加者の順位、パーセンタイル、スコアを取得する",
+		Params: []apiParam{playerIDParam}, Result: PlayerStatsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/competition/:competition_id/ranking", Tag: apiTagPlayer, Summary: "大会ごとのランキングを取得する",
+		Params: []apiParam{competitionIDParam, queryParam("rank_after", apiTypeInteger), queryParam("limit", apiTypeInteger).withMinimum(1)},
+		Result: CompetitionRankingHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/competition/:competition_id/ranking/changes", Tag: apiTagPlayer, Summary: "最新のスコアのアップロードで参加者ごとの順位がいくつ変わったかを取得する",
+		Params: []apiParam{competitionIDParam}, Result: CompetitionRankingChangesHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/competition/:competition_id/ranking/me", Tag: apiTagPlayer, Summary: "大会のランキングでの自分の順位と前後5人ずつを取得する",
+		Params: []apiParam{competitionIDParam}, Result: CompetitionMyRankHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/competition/:competition_id/stats", Tag: apiTagPlayer, Summary: "大会の参加者ごとの最新のスコアの統計量を取得する",
+		Params: []apiParam{competitionIDParam}, Result: CompetitionScoreStatsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/competitions", Tag: apiTagPlayer, Summary: "大会の一覧を取得する",
+		Result: CompetitionsHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/player/competition/:competition_id/dispute", Tag: apiTagPlayer, Summary: "終了した大会の自分のスコアに異議を申し立てる",
+		Params: []apiParam{
+			competitionIDParam,
+			formParam("reason", apiTypeString, true),
+			formParam("claimed_score", apiTypeInteger, false),
+		},
+		Result: ScoreDisputeHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/player/notifications", Tag: apiTagPlayer, Summary: "自分宛ての通知を新しい順に取得する",
+		Result: NotificationsHandlerResult{}},
+	{Method: http.MethodGet, Path: "/api/graphql", Tag: apiTagPlayer, Summary: "大会の一覧、ランキング、自分のスコアをGraphQLで取得する",
+		Params: []apiParam{
+			{Name: "query", In: apiParamInQuery, Type: apiTypeString, Required: true},
+			queryParam("operationName", apiTypeString),
+			queryParam("variables", apiTypeString),
+		},
+		RawResult: graphqlResponse{}},
+	{Method: http.MethodPost, Path: "/api/graphql", Tag: apiTagPlayer, Summary: "大会の一覧、ランキング、自分のスコアをGraphQLで取得する",
+		Body: graphqlRequest{}, RawResult: graphqlResponse{}},
+
+	// 共通API
+	{Method: http.MethodGet, Path: "/api/me", Tag: apiTagCommon, Summary: "JWTで認証した結果、テナントやユーザ情報を返す",
+		Result: MeHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/auth/login", Tag: apiTagCommon, Summary: "login_idとpasswordで認証し、署名したJWTをisuports_sessionクッキーに設定する",
+		Params: []apiParam{
+			formParam("login_id", apiTypeString, true),
+			formParam("password", apiTypeString, false),
+		},
+		Result: LoginHandlerResult{}},
+	{Method: http.MethodPost, Path: "/api/auth/logout", Tag: apiTagCommon, Summary: "isuports_sessionクッキーを消し、ログインAPIで発行したセッションを無効にする"},
+	{Method: http.MethodGet, Path: "/api/openapi.json", Tag: apiTagCommon, Summary: "このAPIの定義をOpenAPIの形式で返す",
+		RawResult: map[string]any{}},
+	{Method: http.MethodPost, Path: "/initialize", Tag: apiTagCommon, Summary: "ベンチマーカーが起動したときに最初に呼ぶ",
+		Result: InitializeHandlerResult{}},
+	{Method: http.MethodGet, Path: "/debug/state", Tag: apiTagAdmin, Summary: "実際に使っている設定や実行時の状態をまとめて返す",
+		Result: DebugStateHandlerResult{}},
+	{Method: http.MethodGet, Path: "/debug/caches", Tag: apiTagAdmin, Summary: "キャッシュごとの要素数、ヒット率、メモリの見積もりを返す",
+		Result: DebugCachesHandlerResult{}},
+	{Method: http.MethodPost, Path: "/debug/caches/:name/flush", Tag: apiTagAdmin, Summary: "キャッシュの要素を全て捨てる",
+		Params: []apiParam{pathParam("name", apiTypeString)}, Result: DebugCacheFlushHandlerResult{}},
+}
+
+// GraphQLのレスポンス graphql.Responseと同じ形
+type graphqlResponse struct {
+	Data   any `json:"data"`
+	Errors []struct {
+		Message    string            `json:"message"`
+		Path       []any             `json:"path,omitempty"`
+		Extensions map[string]string `json:"extensions,omitempty"`
+	} `json:"errors,omitempty"`
+}
+
+// メソッドとパスからapiOperationを引く
+var apiOperationIndex = func() map[string]*apiOperation {
+	m := make(map[string]*apiOperation, len(apiOperations))
+	for i := range apiOperations {
+		op := &apiOperations[i]
+		m[op.Method+" "+op.Path] = op
+	}
+	return m
+}()
+
+// リクエストの検証を行うか
+// 環境変数 ISUCON_REQUEST_VALIDATION=0 で無効にできる
+func requestValidationEnabled() bool {
+	return getEnv("ISUCON_REQUEST_VALIDATION", "1") != "0"
+}
+
+// apiOperationsの定義に合わないリクエストを422で拒否するミドルウェア
+// 不正なパラメータはレスポンスのfieldsにパラメータ名と理由を入れて返す
+// 認証や存在確認などの値の中身に依存する確認はハンドラで行う
+func ValidateRequest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !requestValidationEnabled() {
+			return next(c)
+		}
+		op, ok := apiOperationIndex[c.Request().Method+" "+c.Path()]
+		if !ok {
+			return next(c)
+		}
+		fields := map[string]string{}
+		for _, p := range op.Params {
+			if msg := validateAPIParam(c, p); msg != "" {
+				fields[p.Name] = msg
+			}
+		}
+		if op.Body != nil {
+			if msg := validateAPIBody(c, op.Body); msg != "" {
+				fields["body"] = msg
+			}
+		}
+		if len(fields) > 0 {
+			return apperr.Unprocessable(fields).WithCode(ErrRequestValidation.Code)
+		}
+		return next(c)
+	}
+}
+
+// パラメータが定義に合わなければ理由を返す
+func validateAPIParam(c echo.Context, p apiParam) string {
+	var values []string
+	switch p.In {
+	case apiParamInPath:
+		values = []string{c.Param(p.Name)}
+	case apiParamInQuery:
+		values = c.QueryParams()[p.Name]
+	case apiParamInForm:
+		if p.Type == apiTypeFile {
+			if _, err := c.FormFile(p.Name); err != nil && p.Required {
+				return "required"
+			}
+			return ""
+		}
+		params, err := c.FormParams()
+		if err != nil {
+			return "invalid form"
+		}
+		values = params[p.Name]
+	}
+	if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+		if p.Required {
+			return "required"
+		}
+		return ""
+	}
+	if p.Type == apiTypeArray {
+		return ""
+	}
+	v := values[0]
+	switch p.Type {
+	case apiTypeInteger:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "must be an integer"
+		}
+		if p.Minimum != nil && n < *p.Minimum {
+			return fmt.Sprintf("must be >= %d", *p.Minimum)
+		}
+	case apiTypeString:
+		if len(p.Enum) > 0 {
+			for _, e := range p.Enum {
+				if v == e {
+					return ""
+				}
+			}
+			return "must be one of " + strings.Join(p.Enum, ", ")
+		}
+	}
+	return ""
+}
+
+// JSONのボディが定義の型に合わなければ理由を返す
+// ハンドラでも読めるようにボディは読み直せるようにしておく
+func validateAPIBody(c echo.Context, body any) string {
+	req := c.Request()
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "cannot read body"
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	if len(b) == 0 {
+		return "required"
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(reflect.New(reflect.TypeOf(body)).Interface()); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// 定義のないルートと、ルートのない定義をログに出す
+func checkAPIOperations(e *echo.Echo) {
+	routes := map[string]struct{}{}
+	for _, r := range e.Routes() {
+		key := r.Method + " " + r.Path
+		routes[key] = struct{}{}
+		if _, ok := apiOperationIndex[key]; !ok {
+			log.Printf("openapi: route has no api definition: %s", key)
+		}
+	}
+	for key := range apiOperationIndex {
+		if _, ok := routes[key]; !ok {
+			log.Printf("openapi: api definition has no route: %s", key)
+		}
+	}
+}
+
+var openAPIDocument = buildOpenAPIDocument()
+
+// 共通API
+// GET /api/openapi.json
+// このAPIの定義をOpenAPI 3.0の形式で返す 認証は不要
+func openAPIHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, openAPIDocument)
+}
+
+func buildOpenAPIDocument() map[string]any {
+	sb := &openAPISchemaBuilder{components: map[string]any{}}
+	sb.components["FailureResult"] = sb.schemaOf(reflect.TypeOf(FailureResult{}))
+
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		path := openAPIPath(op.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(op.Method)] = sb.operation(op)
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "isuports",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": sb.components,
+		},
+	}
+}
+
+// /api/admin/tenant/:tenant_id を /api/admin/tenant/{tenant_id} にする
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+type openAPISchemaBuilder struct {
+	components map[string]any
+}
+
+func (sb *openAPISchemaBuilder) operation(op apiOperation) map[string]any {
+	o := map[string]any{
+		"tags":        []string{op.Tag},
+		"summary":     op.Summary,
+		"operationId": op.Method + " " + op.Path,
+	}
+
+	params := []any{}
+	formProps := map[string]any{}
+	formRequired := []string{}
+	multipart := false
+	for _, p := range op.Params {
+		schema := openAPIParamSchema(p)
+		if p.In == apiParamInForm {
+			if p.Type == apiTypeFile {
+				multipart = true
+			}
+			formProps[p.Name] = schema
+			if p.Required {
+				formRequired = append(formRequired, p.Name)
+			}
+			continue
+		}
+		params = append(params, map[string]any{
+			"name":     p.Name,
+			"in":       p.In,
+			"required": p.Required,
+			"schema":   schema,
+		})
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+	if len(formProps) > 0 {
+		contentType := "application/x-www-form-urlencoded"
+		if multipart {
+			contentType = "multipart/form-data"
+		}
+		schema := map[string]any{"type": "object", "properties": formProps}
+		if len(formRequired) > 0 {
+			sort.Strings(formRequired)
+			schema["required"] = formRequired
+		}
+		o["requestBody"] = map[string]any{
+			"required": len(formRequired) > 0,
+			"content":  map[string]any{contentType: map[string]any{"schema": schema}},
+		}
+	} else if op.Body != nil {
+		o["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{"application/json": map[string]any{
+				"schema": sb.schemaOf(reflect.TypeOf(op.Body)),
+			}},
+		}
+	}
+
+	var ok map[string]any
+	switch {
+	case op.ContentType != "":
+		ok = map[string]any{op.ContentType: map[string]any{"schema": map[string]any{"type": "string"}}}
+	case op.RawResult != nil:
+		ok = map[string]any{"application/json": map[string]any{"schema": sb.schemaOf(reflect.TypeOf(op.RawResult))}}
+	default:
+		props := map[string]any{"status": map[string]any{"type": "boolean"}}
+		if op.Result != nil {
+			props["data"] = sb.schemaOf(reflect.TypeOf(op.Result))
+		}
+		ok = map[string]any{"application/json": map[string]any{"schema": map[string]any{
+			"type":       "object",
+			"properties": props,
+			"required":   []string{"status"},
+		}}}
+	}
+	failure := map[string]any{"application/json": map[string]any{
+		"schema": map[string]any{"$ref": "#/components/schemas/FailureResult"},
+	}}
+	responses := map[string]any{
+		"200":     map[string]any{"description": "OK", "content": ok},
+		"default": map[string]any{"description": "エラー", "content": failure},
+	}
+	if len(op.Params) > 0 || op.Body != nil {
+		responses["422"] = map[string]any{"description": "リクエストがAPIの定義に合わない fieldsに理由を入れる", "content": failure}
+	}
+	o["responses"] = responses
+	return o
+}
+
+func openAPIParamSchema(p apiParam) map[string]any {
+	switch p.Type {
+	case apiTypeInteger:
+		s := map[string]any{"type": "integer", "format": "int64"}
+		if p.Minimum != nil {
+			s["minimum"] = *p.Minimum
+		}
+		return s
+	case apiTypeArray:
+		return map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+	case apiTypeFile:
+		return map[string]any{"type": "string", "format": "binary"}
+	}
+	s := map[string]any{"type": "string"}
+	if len(p.Enum) > 0 {
+		s["enum"] = p.Enum
+	}
+	return s
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	jsonRawMessageType  = reflect.TypeOf(json.RawMessage{})
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	openAPIAnySchema    = map[string]any{}
+	openAPIStringSchema = map[string]any{"type": "string"}
+)
+
+// Goの型からJSONのスキーマを作る 名前のある構造体はcomponentsに入れて参照する
+func (sb *openAPISchemaBuilder) schemaOf(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == jsonRawMessageType:
+		return openAPIAnySchema
+	case t.Kind() != reflect.Pointer && t.Implements(jsonMarshalerType):
+		return openAPIAnySchema
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := sb.schemaOf(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		n := make(map[string]any, len(s)+1)
+		for k, v := range s {
+			n[k] = v
+		}
+		n["nullable"] = true
+		return n
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return openAPIStringSchema
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": sb.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sb.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := sb.components[name]; !ok {
+			// 再帰している型のために先に場所を取っておく
+			sb.components[name] = openAPIAnySchema
+			sb.components[name] = sb.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return openAPIAnySchema
+}
+
+func (sb *openAPISchemaBuilder) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	sb.addStructFields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// encoding/jsonと同じ規則でフィールドを並べる 埋め込んだ構造体のフィールドは展開する
+func (sb *openAPISchemaBuilder) addStructFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				sb.addStructFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := sb.schemaOf(f.Type)
+		if strings.Contains(opts, "string") {
+			s = openAPIStringSchema
+		}
+		props[name] = s
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
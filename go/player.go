@@ -1,21 +1,33 @@
 package isuports
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
 	"github.com/labstack/echo/v4"
 	"github.com/logica0419/helpisu"
 )
 
 var (
 	visitHistories = helpisu.NewCache[int, []VisitHistoryRow]()
+	// visitHistoriesとジャーナルへの追記と、書き込む分の切り出しを直列にする
+	visitHistoriesMu sync.Mutex
+	// delayedInsertVisitHistoryを同時に実行しない
+	visitHistoryFlushMu sync.Mutex
+	// このプロセスで閲覧履歴を記録した参加者と大会 キーはvisitedCompetitionKey
+	visitedCompetitionCache = helpisu.NewCache[string, struct{}]()
 )
 
 type PlayerScoreDetail struct {
@@ -39,7 +51,7 @@ func playerHandler(c echo.Context) error {
 		return err
 	}
 	if v.role != RolePlayer {
-		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+		return ErrRolePlayerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -53,15 +65,18 @@ func playerHandler(c echo.Context) error {
 
 	playerID := c.Param("player_id")
 	if playerID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "player_id is required")
+		return apperr.InvalidField("player_id", "player_id is required")
 	}
 	p, err := retrievePlayer(ctx, tenantDB, playerID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+			return ErrPlayerNotFound
 		}
 		return fmt.Errorf("error retrievePlayer: %w", err)
 	}
+	if p.DeletedAt.Valid {
+		return ErrPlayerNotFound
+	}
 	// cs := []CompetitionRow{}
 	// if err := tenantDB.SelectContext(
 	// 	ctx,
@@ -72,6 +87,31 @@ func playerHandler(c echo.Context) error {
 	// 	return fmt.Errorf("error Select competition: %w", err)
 	// }
 
+	psds, err := retrievePlayerScores(c.Request().Context(), tenantDB, v.tenantID, p.ID)
+	if err != nil {
+		return err
+	}
+
+	res := SuccessResult{
+		Status: true,
+		Data: PlayerHandlerResult{
+			Player: PlayerDetail{
+				ID:             p.ID,
+				DisplayName:    p.DisplayName,
+				IsDisqualified: p.IsDisqualified,
+			},
+			Scores: psds,
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// 参加者の大会ごとの最新のスコアを大会の作成順に返す
+// RESTのAPIとGraphQL(graphql.go)で共通の処理
+// lockCtxはロックを待つ間だけ使う flockByTenantID を参照
+func retrievePlayerScores(lockCtx context.Context, tenantDB dbOrTx, tenantID int64, playerID string) ([]PlayerScoreDetail, error) {
+	ctx := context.Background()
+
 	type Row struct {
 		Score  int64  `db:"score"`
 		Title  string `db:"title"`
@@ -79,9 +119,9 @@ func playerHandler(c echo.Context) error {
 	}
 
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(v.tenantID)
+	fl, err := rlockByTenantID(lockCtx, tenantID)
 	if err != nil {
-		return fmt.Errorf("error flockByTenantID: %w", err)
+		return nil, fmt.Errorf("error rlockByTenantID: %w", err)
 	}
 	defer fl.Close()
 	pss := make([]Row, 0, 10000)
@@ -95,14 +135,14 @@ func playerHandler(c echo.Context) error {
 			"FROM player_score JOIN competition ON competition.id = player_score.competition_id "+
 			"WHERE player_score.tenant_id = ? AND player_score.player_id = ? "+
 			"ORDER BY competition.created_at ASC, player_score.competition_id ASC, player_score.row_num DESC",
-		v.tenantID,
-		p.ID,
+		tenantID,
+		playerID,
 	); err != nil {
 		// // 行がない = スコアが記録されてない
 		// if errors.Is(err, sql.ErrNoRows) {
 		// 	continue
 		// }
-		return fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", v.tenantID, p.ID, err)
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
 	}
 	// pss = append(pss, ps)
 	// }
@@ -124,15 +164,221 @@ func playerHandler(c echo.Context) error {
 		}
 	}
 
+	return psds, nil
+}
+
+type PlayerScoreHistoryDetail struct {
+	CompetitionID    string `json:"competition_id"`
+	CompetitionTitle string `json:"competition_title"`
+	Score            int64  `json:"score"`
+	RowNum           int64  `json:"row_num"`
+	CreatedAt        int64  `json:"created_at"`
+}
+
+type PlayerScoreHistoryHandlerResult struct {
+	Player  PlayerDetail               `json:"player"`
+	History []PlayerScoreHistoryDetail `json:"history"`
+}
+
+// 参加者向けAPI
+// GET /api/player/player/:player_id/history
+// 参加者がこれまでに登録されたスコアを全て取得する
+// CSVの再アップロードで消えたスコアも含む
+func playerScoreHistoryHandler(c echo.Context) error {
+	ctx := context.Background()
+
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	playerID := c.Param("player_id")
+	if playerID == "" {
+		return apperr.InvalidField("player_id", "player_id is required")
+	}
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPlayerNotFound
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	if p.DeletedAt.Valid {
+		return ErrPlayerNotFound
+	}
+
+	type Row struct {
+		CompID    string `db:"comp_id"`
+		Title     string `db:"title"`
+		Score     int64  `db:"score"`
+		RowNum    int64  `db:"row_num"`
+		CreatedAt int64  `db:"created_at"`
+	}
+	rows := []Row{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&rows,
+		"SELECT competition.id AS comp_id, competition.title AS title, h.score AS score, h.row_num AS row_num, h.created_at AS created_at "+
+			"FROM player_score_history h JOIN competition ON competition.id = h.competition_id "+
+			"WHERE h.tenant_id = ? AND h.player_id = ? "+
+			"ORDER BY competition.created_at ASC, h.competition_id ASC, h.created_at ASC, h.row_num ASC",
+		v.tenantID,
+		p.ID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score_history: tenantID=%d, playerID=%s, %w", v.tenantID, p.ID, err)
+	}
+
+	history := make([]PlayerScoreHistoryDetail, 0, len(rows))
+	for _, r := range rows {
+		history = append(history, PlayerScoreHistoryDetail{
+			CompetitionID:    r.CompID,
+			CompetitionTitle: r.Title,
+			Score:            r.Score,
+			RowNum:           r.RowNum,
+			CreatedAt:        r.CreatedAt,
+		})
+	}
+
 	res := SuccessResult{
 		Status: true,
-		Data: PlayerHandlerResult{
+		Data: PlayerScoreHistoryHandlerResult{
 			Player: PlayerDetail{
 				ID:             p.ID,
 				DisplayName:    p.DisplayName,
 				IsDisqualified: p.IsDisqualified,
 			},
-			Scores: psds,
+			History: history,
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+type PlayerCompetitionStat struct {
+	CompetitionID    string  `json:"competition_id"`
+	CompetitionTitle string  `json:"competition_title"`
+	Rank             int64   `json:"rank"`
+	Score            int64   `json:"score"`
+	PlayerCount      int64   `json:"player_count"`
+	Percentile       float64 `json:"percentile"` // 自分以下の順位の参加者の割合(%) 1位なら100
+}
+
+type PlayerStatsHandlerResult struct {
+	Player PlayerDetail            `json:"player"`
+	Stats  []PlayerCompetitionStat `json:"stats"`
+}
+
+// 参加者向けAPI
+// GET /api/player/player/:player_id/stats
+// 終了した大会ごとの参加者の順位、パーセンタイル、スコアを取得する
+func playerStatsHandler(c echo.Context) error {
+	ctx := context.Background()
+
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	playerID := c.Param("player_id")
+	if playerID == "" {
+		return apperr.InvalidField("player_id", "player_id is required")
+	}
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPlayerNotFound
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	if p.DeletedAt.Valid {
+		return ErrPlayerNotFound
+	}
+
+	// 参加者がスコアを登録している終了済みの大会
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id = ? AND finished_at IS NOT NULL AND id IN "+
+			"(SELECT DISTINCT(competition_id) FROM player_score WHERE tenant_id = ? AND player_id = ?) "+
+			"ORDER BY created_at ASC",
+		v.tenantID, v.tenantID, p.ID,
+	); err != nil {
+		return fmt.Errorf("error Select competition: %w", err)
+	}
+
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := rlockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	stats := make([]PlayerCompetitionStat, 0, len(cs))
+	for _, comp := range cs {
+		pss := []PlayerScoreRow{}
+		if err := tenantDB.SelectContext(
+			ctx,
+			&pss,
+			"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
+			v.tenantID,
+			comp.ID,
+		); err != nil {
+			return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", v.tenantID, comp.ID, err)
+		}
+		ranks, err := buildCompetitionRanks(ctx, tenantDB, pss, normalizeTieBreak(comp.TieBreak), make([]CompetitionRank, 0, len(pss)), make(map[string]struct{}, len(pss)))
+		if err != nil {
+			return err
+		}
+		for _, r := range ranks {
+			if r.PlayerID != p.ID {
+				continue
+			}
+			n := int64(len(ranks))
+			stats = append(stats, PlayerCompetitionStat{
+				CompetitionID:    comp.ID,
+				CompetitionTitle: comp.Title,
+				Rank:             r.Rank,
+				Score:            r.Score,
+				PlayerCount:      n,
+				Percentile:       float64(n-r.Rank+1) / float64(n) * 100,
+			})
+			break
+		}
+	}
+
+	res := SuccessResult{
+		Status: true,
+		Data: PlayerStatsHandlerResult{
+			Player: PlayerDetail{
+				ID:             p.ID,
+				DisplayName:    p.DisplayName,
+				IsDisqualified: p.IsDisqualified,
+			},
+			Stats: stats,
 		},
 	}
 	return c.JSON(http.StatusOK, res)
@@ -153,9 +399,89 @@ type CompetitionRankingHandlerResult struct {
 
 var tenantCache = helpisu.NewCache[int64, struct{}]()
 
+// ランキングのシリアライズで使うバッファはリクエストごとに確保せず使い回す
+var jsonBufferPool = sync.Pool{New: func() any {
+	return new(bytes.Buffer)
+}}
+
+// row_numの降順に並んだ大会のスコアから、参加者ごとの最新のスコアを順位順に並べてRankを設定する
+// 同点の並びと順位はtieBreak(ranking_tie_break.go)に従う
+// ranksとseenは呼び出し元で使い回せるように引数で受け取る
+func buildCompetitionRanks(ctx context.Context, tenantDB dbOrTx, pss []PlayerScoreRow, tieBreak string, ranks []CompetitionRank, seen map[string]struct{}) ([]CompetitionRank, error) {
+	for i := range pss {
+		ps := &pss[i]
+		// player_scoreが同一player_id内ではrow_numの降順でソートされているので
+		// 現れたのが2回目以降のplayer_idはより大きいrow_numでスコアが出ているとみなせる
+		if _, ok := seen[ps.PlayerID]; ok {
+			continue
+		}
+		seen[ps.PlayerID] = struct{}{}
+		p, err := retrievePlayer(ctx, tenantDB, ps.PlayerID)
+		if err != nil {
+			return ranks, fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		// 削除済みの参加者はランキングに載せない
+		if p.DeletedAt.Valid {
+			continue
+		}
+		ranks = append(ranks, CompetitionRank{
+			Score:             ps.Score,
+			PlayerID:          p.ID,
+			PlayerDisplayName: p.DisplayName,
+			RowNum:            ps.RowNum,
+		})
+	}
+	if tieBreak == TieBreakLatest {
+		sort.Sort(latestCompetitionRanks(ranks))
+	} else {
+		sort.Sort(competitionRanks(ranks))
+	}
+	assignCompetitionRanks(ranks, tieBreak)
+	return ranks, nil
+}
+
+// スコアの降順、同点ならrow_numの昇順に並べる
+// sort.Sliceと違いreflectを使わないので速い
+type competitionRanks []CompetitionRank
+
+func (r competitionRanks) Len() int      { return len(r) }
+func (r competitionRanks) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r competitionRanks) Less(i, j int) bool {
+	if r[i].Score == r[j].Score {
+		return r[i].RowNum < r[j].RowNum
+	}
+	return r[i].Score > r[j].Score
+}
+
+// スコアの降順、同点ならrow_numの降順に並べる
+type latestCompetitionRanks []CompetitionRank
+
+func (r latestCompetitionRanks) Len() int      { return len(r) }
+func (r latestCompetitionRanks) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r latestCompetitionRanks) Less(i, j int) bool {
+	if r[i].Score == r[j].Score {
+		return r[i].RowNum > r[j].RowNum
+	}
+	return r[i].Score > r[j].Score
+}
+
+// ランキングのAPIで1回に返す件数 limitで変えられる
+const defaultRankingPageLimit = 100
+
+// ランキングのAPIのlimitの上限
+// 環境変数 ISUCON_RANKING_PAGE_MAX_LIMIT で変更できる 省略した場合の件数(100)より小さくはできない
+func rankingPageMaxLimit() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_RANKING_PAGE_MAX_LIMIT", "1000"), 10, 64)
+	if err != nil || n < defaultRankingPageLimit {
+		return 1000
+	}
+	return n
+}
+
 // 参加者向けAPI
 // GET /api/player/competition/:competition_id/ranking
 // 大会ごとのランキングを取得する
+// rank_after位より後のlimit人分を返す limitを省略した場合は100人分
 func competitionRankingHandler(c echo.Context) error {
 	ctx := context.Background()
 	v, err := parseViewer(c)
@@ -163,7 +489,7 @@ func competitionRankingHandler(c echo.Context) error {
 		return err
 	}
 	if v.role != RolePlayer {
-		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+		return ErrRolePlayerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -177,33 +503,22 @@ func competitionRankingHandler(c echo.Context) error {
 
 	competitionID := c.Param("competition_id")
 	if competitionID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "competition_id is required")
+		return apperr.InvalidField("competition_id", "competition_id is required")
 	}
 
 	// 大会の存在確認
 	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+			return ErrCompetitionNotFound
 		}
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
 
-	now := time.Now().Unix()
-	var tenant TenantRow
-	_, ok := tenantCache.Get(v.tenantID)
-	if !ok {
-		if err := adminDB.GetContext(ctx, &tenant, "SELECT id FROM tenant WHERE id = ?", v.tenantID); err != nil {
-			return fmt.Errorf("error Select tenant: id=%d, %w", v.tenantID, err)
-		}
-	} else {
-		tenant.ID = v.tenantID
+	if err := recordCompetitionVisit(ctx, v.tenantID, v.playerID, competitionID); err != nil {
+		return err
 	}
 
-	visitHistory, _ := visitHistories.Get(0)
-	visitHistory = append(visitHistory, VisitHistoryRow{v.playerID, tenant.ID, competitionID, now, now})
-	visitHistories.Set(0, visitHistory)
-
 	var rankAfter int64
 	rankAfterStr := c.QueryParam("rank_after")
 	if rankAfterStr != "" {
@@ -211,63 +526,49 @@ func competitionRankingHandler(c echo.Context) error {
 			return fmt.Errorf("error strconv.ParseUint: rankAfterStr=%s, %w", rankAfterStr, err)
 		}
 	}
+	limit := int64(defaultRankingPageLimit)
+	if s := c.QueryParam("limit"); s != "" {
+		maxLimit := rankingPageMaxLimit()
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil || limit < 1 || limit > maxLimit {
+			return apperr.Validation(
+				"query parameter 'limit' must be between 1 and %d", maxLimit,
+			).WithCode(ErrInvalidQuery.Code)
+		}
+	}
 
-	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(v.tenantID)
+	// 同じ内容のランキングはシリアライズ済みのものをそのまま返す
+	version := rankingVersion(competitionID)
+	if b, ok := getRankingPage(competitionID, version, rankAfter, limit); ok {
+		return writeRankingPage(c, competition, b)
+	}
+
+	ranks, err := competitionRanking(c.Request().Context(), tenantDB, v.tenantID, competitionID, version)
 	if err != nil {
-		return fmt.Errorf("error flockByTenantID: %w", err)
+		return err
 	}
-	defer fl.Close()
-	pss := []PlayerScoreRow{}
-	if err := tenantDB.SelectContext(
-		ctx,
-		&pss,
-		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
-		tenant.ID,
-		competitionID,
-	); err != nil {
-		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenant.ID, competitionID, err)
+	b, err := serializeRankingPage(competition, ranks, rankAfter, limit)
+	if err != nil {
+		return err
 	}
-	ranks := make([]CompetitionRank, 0, len(pss))
-	scoredPlayerSet := make(map[string]struct{}, len(pss))
-	for _, ps := range pss {
-		// player_scoreが同一player_id内ではrow_numの降順でソートされているので
-		// 現れたのが2回目以降のplayer_idはより大きいrow_numでスコアが出ているとみなせる
-		if _, ok := scoredPlayerSet[ps.PlayerID]; ok {
-			continue
-		}
-		scoredPlayerSet[ps.PlayerID] = struct{}{}
-		p, err := retrievePlayer(ctx, tenantDB, ps.PlayerID)
-		if err != nil {
-			return fmt.Errorf("error retrievePlayer: %w", err)
-		}
-		ranks = append(ranks, CompetitionRank{
-			Score:             ps.Score,
-			PlayerID:          p.ID,
-			PlayerDisplayName: p.DisplayName,
-			RowNum:            ps.RowNum,
-		})
+	storeRankingPage(competitionID, version, rankAfter, limit, b)
+	return writeRankingPage(c, competition, b)
+}
+
+// ランキングのページをJSONにする
+// ランキングのAPIと終了した大会のランキングの作り置き(ranking_frozen.go)で共通の処理
+func serializeRankingPage(competition *CompetitionRow, ranks []CompetitionRank, rankAfter, limit int64) ([]byte, error) {
+	// ページ分をコピーせずにそのまま切り出す ranksは共有しているので書き換えない
+	// RowNumはJSONに含まれないので残っていても問題ない
+	pageStart := int(rankAfter)
+	if pageStart < 0 {
+		pageStart = 0
 	}
-	sort.Slice(ranks, func(i, j int) bool {
-		if ranks[i].Score == ranks[j].Score {
-			return ranks[i].RowNum < ranks[j].RowNum
-		}
-		return ranks[i].Score > ranks[j].Score
-	})
-	pagedRanks := make([]CompetitionRank, 0, 100)
-	for i, rank := range ranks {
-		if int64(i) < rankAfter {
-			continue
-		}
-		pagedRanks = append(pagedRanks, CompetitionRank{
-			Rank:              int64(i + 1),
-			Score:             rank.Score,
-			PlayerID:          rank.PlayerID,
-			PlayerDisplayName: rank.PlayerDisplayName,
-		})
-		if len(pagedRanks) >= 100 {
-			break
-		}
+	if pageStart > len(ranks) {
+		pageStart = len(ranks)
+	}
+	pageEnd := pageStart + int(limit)
+	if pageEnd > len(ranks) {
+		pageEnd = len(ranks)
 	}
 
 	res := SuccessResult{
@@ -278,20 +579,315 @@ func competitionRankingHandler(c echo.Context) error {
 				Title:      competition.Title,
 				IsFinished: competition.FinishedAt.Valid,
 			},
-			Ranks: pagedRanks,
+			Ranks: ranks[pageStart:pageEnd],
 		},
 	}
-	return c.JSON(http.StatusOK, res)
+	buf := jsonBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer jsonBufferPool.Put(buf)
+	if err := json.NewEncoder(buf).Encode(res); err != nil {
+		return nil, fmt.Errorf("error json.Encode: %w", err)
+	}
+	// バッファはプールに返すので、キャッシュに残す分だけコピーする
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+	return b, nil
+}
+
+// 自分の順位の前後に返す人数
+const myRankNeighbors = 5
+
+type CompetitionMyRankHandlerResult struct {
+	Competition CompetitionDetail `json:"competition"`
+	Me          *CompetitionRank  `json:"me"`    // ランキングに載っていなければnull
+	Ranks       []CompetitionRank `json:"ranks"` // 自分と前後5人ずつ 自分が載っていなければ空
+}
+
+// 参加者向けAPI
+// GET /api/player/competition/:competition_id/ranking/me
+// 大会のランキングでの自分の順位とスコア、前後5人ずつを取得する
+// ランキングを見たことになるので、閲覧履歴を記録する
+func competitionMyRankHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id is required")
+	}
+	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	if err := recordCompetitionVisit(ctx, v.tenantID, v.playerID, competitionID); err != nil {
+		return err
+	}
+
+	ranks, err := competitionRanking(c.Request().Context(), tenantDB, v.tenantID, competitionID, rankingVersion(competitionID))
+	if err != nil {
+		return err
+	}
+
+	res := CompetitionMyRankHandlerResult{
+		Competition: CompetitionDetail{
+			ID:         competition.ID,
+			Title:      competition.Title,
+			IsFinished: competition.FinishedAt.Valid,
+		},
+		Ranks: []CompetitionRank{},
+	}
+	for i := range ranks {
+		if ranks[i].PlayerID != v.playerID {
+			continue
+		}
+		me := ranks[i]
+		res.Me = &me
+		start, end := i-myRankNeighbors, i+myRankNeighbors+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(ranks) {
+			end = len(ranks)
+		}
+		// ranksは共有しているので書き換えない
+		res.Ranks = ranks[start:end]
+		break
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 参加者が大会のランキングを見たことを記録する 請求の計算に使う
+// RESTのAPIとGraphQL(graphql.go)で共通の処理
+func recordCompetitionVisit(ctx context.Context, tenantID int64, playerID, competitionID string) error {
+	now := time.Now().Unix()
+	var tenant TenantRow
+	_, ok := tenantCache.Get(tenantID)
+	if !ok {
+		if err := adminDB.GetContext(ctx, &tenant, "SELECT id FROM tenant WHERE id = ?", tenantID); err != nil {
+			return fmt.Errorf("error Select tenant: id=%d, %w", tenantID, err)
+		}
+	} else {
+		tenant.ID = tenantID
+	}
+
+	vh := VisitHistoryRow{playerID, tenant.ID, competitionID, now, now}
+	visitHistoriesMu.Lock()
+	if visitHistoryDedupEnabled() {
+		// 課金の計算は最初に閲覧した日時しか使わないので、2回目以降の閲覧は記録しない
+		key := visitedCompetitionKey(tenant.ID, competitionID, playerID)
+		if _, ok := visitedCompetitionCache.Get(key); ok {
+			visitHistoriesMu.Unlock()
+			return nil
+		}
+		visitedCompetitionCache.Set(key, struct{}{})
+	}
+	var pending int
+	if visitHistoryJournalEnabled() {
+		if err := appendVisitHistoryJournal(vh); err != nil {
+			visitHistoriesMu.Unlock()
+			return err
+		}
+		pending = visitHistoryJournal.rows
+	} else {
+		visitHistory, _ := visitHistories.Get(0)
+		visitHistory = append(visitHistory, vh)
+		visitHistories.Set(0, visitHistory)
+		pending = len(visitHistory)
+	}
+	visitHistoriesMu.Unlock()
+
+	// 溜まりすぎたらtickerを待たずに書き込む
+	if pending >= visitHistoryFlushRows() {
+		requestVisitHistoryFlush()
+	}
+	return nil
+}
+
+// 同じ参加者が同じ大会のランキングを閲覧しても、プロセスの中では最初の1回だけ記録するか
+// 環境変数 ISUCON_VISIT_HISTORY_DEDUP=1 で有効になる 既定では無効
+// 有効な場合、閲覧回数と最後に閲覧した日時(visits, visitors, analyticsのAPI)は、プロセスごとに最初の閲覧だけを数えた値になるので、
+// それらのAPIを使わない場合だけ有効にすること
+func visitHistoryDedupEnabled() bool {
+	return getEnv("ISUCON_VISIT_HISTORY_DEDUP", "0") == "1"
+}
+
+func visitedCompetitionKey(tenantID int64, competitionID, playerID string) string {
+	return strconv.FormatInt(tenantID, 10) + "/" + competitionID + "/" + playerID
+}
+
+// 大会のランキングを順位順に返す Rankは設定済み
+// スコアのアップロードで作り直したランキング(ranking_cache.go)がversionと一致すればそれを返し、なければplayer_scoreから作る
+// 返したスライスは共有しているので書き換えない
+// RESTのAPIとGraphQL(graphql.go)で共通の処理 lockCtxはロックを待つ間だけ使う
+func competitionRanking(lockCtx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, version int64) ([]CompetitionRank, error) {
+	if ranks, ok := getMaterializedRanking(competitionID, version); ok {
+		return ranks, nil
+	}
+	pss := []PlayerScoreRow{}
+	ranks, err := loadCompetitionRanks(lockCtx, tenantDB, tenantID, competitionID, &pss, []CompetitionRank{}, map[string]struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	storeMaterializedRanking(competitionID, version, ranks)
+	return ranks, nil
 }
 
+// 大会のスコアを読んで順位順に並べる
+// RESTのAPIとGraphQL(graphql.go)で共通の処理
+// pss, ranks, seenは呼び出し元で使い回せるように引数で受け取る lockCtxはロックを待つ間だけ使う
+func loadCompetitionRanks(lockCtx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, pss *[]PlayerScoreRow, ranks []CompetitionRank, seen map[string]struct{}) ([]CompetitionRank, error) {
+	ctx := context.Background()
+
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := rlockByTenantID(lockCtx, tenantID)
+	if err != nil {
+		return ranks, fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	defer fl.Close()
+	if err := tenantDB.SelectContext(
+		ctx,
+		pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
+		tenantID,
+		competitionID,
+	); err != nil {
+		return ranks, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	tieBreak, err := competitionTieBreak(ctx, tenantDB, competitionID)
+	if err != nil {
+		return ranks, err
+	}
+	return buildCompetitionRanks(ctx, tenantDB, *pss, tieBreak, ranks, seen)
+}
+
+// 溜めている閲覧履歴がこの件数になったら、tickerを待たずに書き込む
+// 環境変数 ISUCON_VISIT_HISTORY_FLUSH_ROWS で変更できる
+func visitHistoryFlushRows() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_VISIT_HISTORY_FLUSH_ROWS", "5000"))
+	if err != nil || n <= 0 {
+		return 5000
+	}
+	return n
+}
+
+// 1回のINSERTで書き込む閲覧履歴の件数の上限 max_allowed_packetを超えないようにする
+// 環境変数 ISUCON_VISIT_HISTORY_INSERT_BATCH で変更できる
+func visitHistoryInsertBatch() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_VISIT_HISTORY_INSERT_BATCH", "1000"))
+	if err != nil || n <= 0 {
+		return 1000
+	}
+	return n
+}
+
+// 1なら件数による書き込みを実行中
+var visitHistoryFlushRequested int32
+
+// バックグラウンドでdelayedInsertVisitHistoryを実行する 既に実行を頼んでいれば何もしない
+func requestVisitHistoryFlush() {
+	if !atomic.CompareAndSwapInt32(&visitHistoryFlushRequested, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&visitHistoryFlushRequested, 0)
+		delayedInsertVisitHistory()
+	}()
+}
+
+// 溜めている閲覧履歴をvisit_historyに書き込む
+// ジャーナルが有効な場合は、書き込めなかった閲覧履歴はジャーナルに残して次に呼んだときに書き込む
 func delayedInsertVisitHistory() {
-	visitHistory, _ := visitHistories.Get(0)
-	_, _ = adminDB.NamedExec(
-		"INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES (:player_id, :tenant_id, :competition_id, :created_at, :updated_at)",
-		visitHistory,
-	)
-	visitHistory = make([]VisitHistoryRow, 0, 100)
-	visitHistories.Set(0, visitHistory)
+	visitHistoryFlushMu.Lock()
+	defer visitHistoryFlushMu.Unlock()
+
+	var visitHistory []VisitHistoryRow
+	if visitHistoryJournalEnabled() {
+		var err error
+		visitHistory, err = drainVisitHistoryJournal(insertVisitHistories)
+		if err != nil {
+			log.Printf("error drainVisitHistoryJournal: %s", err)
+		}
+	} else {
+		visitHistoriesMu.Lock()
+		visitHistory, _ = visitHistories.Get(0)
+		visitHistories.Set(0, make([]VisitHistoryRow, 0, 100))
+		visitHistoriesMu.Unlock()
+		_ = insertVisitHistories(visitHistory)
+	}
+
+	// 書き込んだ閲覧履歴の大会の課金レポートを計算し直す
+	type key struct {
+		tenantID      int64
+		competitionID string
+	}
+	// 大会ごとの最も古い閲覧日時
+	earliest := map[key]int64{}
+	for _, vh := range visitHistory {
+		k := key{vh.TenantID, vh.CompetitionID}
+		if t, ok := earliest[k]; ok && t <= vh.CreatedAt {
+			continue
+		}
+		earliest[k] = vh.CreatedAt
+	}
+	for k, t := range earliest {
+		invalidateBillingInputs(k.tenantID, k.competitionID)
+		resaveBillingReportForLateVisits(context.Background(), k.tenantID, k.competitionID, t)
+	}
+}
+
+// 溜めている閲覧履歴を書き込まずに捨てる 初期化のときに呼ぶ
+func resetVisitHistories() error {
+	visitHistoryFlushMu.Lock()
+	defer visitHistoryFlushMu.Unlock()
+	if visitHistoryJournalEnabled() {
+		if err := discardVisitHistoryJournal(); err != nil {
+			return err
+		}
+	}
+	visitHistoriesMu.Lock()
+	defer visitHistoriesMu.Unlock()
+	visitHistories.Set(0, make([]VisitHistoryRow, 0, 100))
+	visitedCompetitionCache.Reset()
+	return nil
+}
+
+// visitHistoryInsertBatch件ずつに分けてINSERTする
+// 途中で失敗した場合、それより前のINSERTは書き込まれたまま
+func insertVisitHistories(visitHistory []VisitHistoryRow) error {
+	batch := visitHistoryInsertBatch()
+	for start := 0; start < len(visitHistory); start += batch {
+		end := start + batch
+		if end > len(visitHistory) {
+			end = len(visitHistory)
+		}
+		if _, err := adminDB.NamedExec(
+			"INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES (:player_id, :tenant_id, :competition_id, :created_at, :updated_at)",
+			visitHistory[start:end],
+		); err != nil {
+			return fmt.Errorf("error Insert visit_history: rows=%d-%d, %w", start, end, err)
+		}
+	}
+	return nil
 }
 
 type CompetitionsHandlerResult struct {
@@ -309,7 +905,7 @@ func playerCompetitionsHandler(c echo.Context) error {
 		return err
 	}
 	if v.role != RolePlayer {
-		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+		return ErrRolePlayerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -332,7 +928,7 @@ func organizerCompetitionsHandler(c echo.Context) error {
 		return err
 	}
 	if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -346,14 +942,31 @@ func organizerCompetitionsHandler(c echo.Context) error {
 func competitionsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
 	ctx := context.Background()
 
+	cds, err := listCompetitions(ctx, tenantDB, v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	res := SuccessResult{
+		Status: true,
+		Data: CompetitionsHandlerResult{
+			Competitions: cds,
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// 大会の一覧を新しい順に返す
+// RESTのAPIとgRPCのAPI(grpc.go)で共通の処理
+func listCompetitions(ctx context.Context, tenantDB dbOrTx, tenantID int64) ([]CompetitionDetail, error) {
 	cs := []CompetitionRow{}
 	if err := tenantDB.SelectContext(
 		ctx,
 		&cs,
 		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
-		v.tenantID,
+		tenantID,
 	); err != nil {
-		return fmt.Errorf("error Select competition: %w", err)
+		return nil, fmt.Errorf("error Select competition: %w", err)
 	}
 	cds := make([]CompetitionDetail, 0, len(cs))
 	for _, comp := range cs {
@@ -363,14 +976,7 @@ func competitionsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
 			IsFinished: comp.FinishedAt.Valid,
 		})
 	}
-
-	res := SuccessResult{
-		Status: true,
-		Data: CompetitionsHandlerResult{
-			Competitions: cds,
-		},
-	}
-	return c.JSON(http.StatusOK, res)
+	return cds, nil
 }
 
 type TenantDetail struct {
@@ -0,0 +1,129 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/logica0419/helpisu"
+)
+
+// 大会ごとのランキングのバージョン
+// スコアの登録や大会の終了などランキングの内容が変わるたびに更新する
+var rankingVersionCache = helpisu.NewCache[string, int64]()
+
+// 大会ごとに、シリアライズ済みのランキングのページをrank_afterとlimitをキーにして保持する
+var rankingPageCache = helpisu.NewCache[string, *rankingPageSet]()
+
+type rankingPageSet struct {
+	version int64
+	pages   *helpisu.Cache[rankingPageKey, []byte]
+}
+
+type rankingPageKey struct {
+	rankAfter int64
+	limit     int64
+}
+
+// 大会ごとの順位順に並べたランキング
+// スコアのアップロード(uploadScores)でロックを取ったまま作り直し、ランキングのAPIはページを切り出すだけにする
+// プロセスごとに持ち、バージョンが変わったものは使わずに次に読んだときに作り直す
+var materializedRankingCache = helpisu.NewCache[string, *materializedRanking]()
+
+type materializedRanking struct {
+	version int64
+	ranks   []CompetitionRank // Rankは設定済み 共有するので書き換えない
+}
+
+// ローカルのキャッシュの操作
+// 他のプロセスとキャッシュを共有する場合は ranking_share.go を経由して呼ばれる
+
+// 大会のランキングの現在のバージョンを返す
+func localRankingVersion(competitionID string) int64 {
+	v, _ := rankingVersionCache.Get(competitionID)
+	return v
+}
+
+// キャッシュ済みのランキングのページを返す
+// バージョンが一致しない場合は古いページなので使わない
+func localGetRankingPage(competitionID string, version int64, rankAfter, limit int64) ([]byte, bool) {
+	set, ok := rankingPageCache.Get(competitionID)
+	if !ok || set.version != version {
+		return nil, false
+	}
+	return set.pages.Get(rankingPageKey{rankAfter: rankAfter, limit: limit})
+}
+
+// シリアライズ済みのランキングのページをキャッシュする
+func localStoreRankingPage(competitionID string, version int64, rankAfter, limit int64, b []byte) {
+	// 計算中にランキングが更新されていたら捨てる
+	if localRankingVersion(competitionID) != version {
+		return
+	}
+	set, ok := rankingPageCache.Get(competitionID)
+	if !ok || set.version != version {
+		set = &rankingPageSet{
+			version: version,
+			pages:   helpisu.NewCache[rankingPageKey, []byte](),
+		}
+		rankingPageCache.Set(competitionID, set)
+	}
+	set.pages.Set(rankingPageKey{rankAfter: rankAfter, limit: limit}, b)
+}
+
+// 作り直したランキングを返す バージョンが一致しない場合は古いので使わない
+func getMaterializedRanking(competitionID string, version int64) ([]CompetitionRank, bool) {
+	m, ok := materializedRankingCache.Get(competitionID)
+	if !ok || m.version != version {
+		return nil, false
+	}
+	return m.ranks, true
+}
+
+// Rankを設定したランキングを保持する ranksはこれ以降書き換えない
+func storeMaterializedRanking(competitionID string, version int64, ranks []CompetitionRank) {
+	materializedRankingCache.Set(competitionID, &materializedRanking{version: version, ranks: ranks})
+}
+
+// アップロードしたスコアからランキングを作り直して返す 返したスライスは共有しているので書き換えない
+// player_scoreを読み直さないように、書き込んだ行(row_numの昇順)から作る
+func rebuildMaterializedRanking(ctx context.Context, tenantDB dbOrTx, competitionID string, playerScoreRows []PlayerScoreRow) ([]CompetitionRank, error) {
+	pss := make([]PlayerScoreRow, len(playerScoreRows))
+	for i := range playerScoreRows {
+		pss[len(pss)-1-i] = playerScoreRows[i]
+	}
+	tieBreak, err := competitionTieBreak(ctx, tenantDB, competitionID)
+	if err != nil {
+		return nil, err
+	}
+	ranks, err := buildCompetitionRanks(ctx, tenantDB, pss, tieBreak, make([]CompetitionRank, 0, len(pss)), make(map[string]struct{}, len(pss)))
+	if err != nil {
+		return nil, err
+	}
+	storeMaterializedRanking(competitionID, rankingVersion(competitionID), ranks)
+	return ranks, nil
+}
+
+// 大会のランキングのキャッシュを無効にする
+func localInvalidateRanking(competitionID string) {
+	rankingVersionCache.Set(competitionID, time.Now().UnixNano())
+	rankingPageCache.Delete(competitionID)
+	materializedRankingCache.Delete(competitionID)
+}
+
+// 参加者がスコアを登録している大会のランキングのキャッシュを無効にする
+func invalidateRankingByPlayer(ctx context.Context, tenantDB dbOrTx, tenantID int64, playerID string) error {
+	competitionIDs := []string{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&competitionIDs,
+		"SELECT DISTINCT(competition_id) FROM player_score WHERE tenant_id = ? AND player_id = ?",
+		tenantID, playerID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	for _, id := range competitionIDs {
+		invalidateRanking(id)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package isuports
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 終了した大会のランキング
+// 終了した大会にはスコアをアップロードできないので、大会の終了時に最初のページを作り置きし、
+// ランキングのAPIではETagを付けて返し、変わっていなければ本文を返さない
+// 終了した大会でも異議申し立てによるスコアの訂正(dispute.go)やスコアの削除(score_edit.go)でランキングが変わるので、
+// デフォルトでは毎回ETagで確認させる(no-cache) max-ageを指定した場合は、過ぎるまでクライアントに反映されない
+
+// 終了した大会のランキングを確認せずにクライアントがキャッシュしてよい秒数
+// 環境変数 ISUCON_FINISHED_RANKING_MAX_AGE で変更できる 0の場合は毎回ETagで確認させる
+func finishedRankingMaxAge() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_FINISHED_RANKING_MAX_AGE", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// シリアライズ済みのランキングのページを返す
+// 終了した大会の場合はキャッシュのヘッダとETagを付け、If-None-Matchが一致すれば本文を返さない
+func writeRankingPage(c echo.Context, competition *CompetitionRow, b []byte) error {
+	if !competition.FinishedAt.Valid {
+		return c.JSONBlob(http.StatusOK, b)
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	h := c.Response().Header()
+	// 認証が必要なAPIなので共有のキャッシュには置かせない
+	if maxAge := finishedRankingMaxAge(); maxAge > 0 {
+		h.Set(echo.HeaderCacheControl, "private, max-age="+strconv.Itoa(maxAge))
+	} else {
+		h.Set(echo.HeaderCacheControl, "private, no-cache")
+	}
+	h.Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, b)
+}
+
+// 終了した大会のランキングの最初のページを作ってキャッシュしておく
+// 大会の終了のレスポンスを遅らせないように、失敗してもログに残すだけにする
+func freezeCompetitionRanking(ctx context.Context, tenantDB dbOrTx, tenantID int64, comp *CompetitionRow) {
+	version := rankingVersion(comp.ID)
+	ranks, err := competitionRanking(ctx, tenantDB, tenantID, comp.ID, version)
+	if err != nil {
+		log.Printf("error freezeCompetitionRanking: tenantID=%d, competitionID=%s, %s", tenantID, comp.ID, err)
+		return
+	}
+	b, err := serializeRankingPage(comp, ranks, 0, defaultRankingPageLimit)
+	if err != nil {
+		log.Printf("error freezeCompetitionRanking: tenantID=%d, competitionID=%s, %s", tenantID, comp.ID, err)
+		return
+	}
+	storeRankingPage(comp.ID, version, 0, defaultRankingPageLimit, b)
+}
@@ -0,0 +1,260 @@
+package isuports
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// 同じホストで複数のプロセスを動かす場合に、ランキングのキャッシュをunixソケット経由で共有する
+// 環境変数 ISUCON_RANKING_SHARE_SOCKET にソケットのパスを設定すると有効になる
+// 最初にソケットをlistenできたプロセスがキャッシュを持ち、他のプロセスはそこに問い合わせる
+// キャッシュを持つプロセスが落ちた場合は、次に問い合わせたプロセスが引き継ぐ
+func rankingShareSocketPath() string {
+	return getEnv("ISUCON_RANKING_SHARE_SOCKET", "")
+}
+
+// ランキングのキャッシュを共有するRPCのサービス
+// キャッシュを持つプロセスのローカルのキャッシュを操作する
+type RankingShare struct{}
+
+type RankingPageArgs struct {
+	CompetitionID string
+	Version       int64
+	RankAfter     int64
+	Limit         int64
+	Page          []byte
+}
+
+type RankingPageReply struct {
+	Page  []byte
+	Found bool
+}
+
+func (RankingShare) Version(competitionID string, reply *int64) error {
+	*reply = localRankingVersion(competitionID)
+	return nil
+}
+
+func (RankingShare) GetPage(args RankingPageArgs, reply *RankingPageReply) error {
+	reply.Page, reply.Found = localGetRankingPage(args.CompetitionID, args.Version, args.RankAfter, args.Limit)
+	return nil
+}
+
+func (RankingShare) StorePage(args RankingPageArgs, _ *struct{}) error {
+	localStoreRankingPage(args.CompetitionID, args.Version, args.RankAfter, args.Limit, args.Page)
+	return nil
+}
+
+func (RankingShare) Invalidate(competitionID string, _ *struct{}) error {
+	localInvalidateRanking(competitionID)
+	return nil
+}
+
+func (RankingShare) Reset(_ struct{}, _ *struct{}) error {
+	rankingVersionCache.Reset()
+	rankingPageCache.Reset()
+	return nil
+}
+
+// ランキングのキャッシュを持つプロセスへの接続
+type rankingShareClient struct {
+	path   string
+	mu     sync.Mutex
+	client *rpc.Client
+	// 自分がキャッシュを持っている
+	serving bool
+}
+
+var rankingShare *rankingShareClient
+
+// ランキングのキャッシュの共有を始める
+func startRankingShare(path string) error {
+	s := &rankingShareClient{path: path}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	rankingShare = s
+	return nil
+}
+
+// キャッシュを持つプロセスに接続する
+// 接続できなければ自分がキャッシュを持つ
+// 呼び出し側でmuを取ること
+func (s *rankingShareClient) connectLocked() error {
+	if s.serving || s.client != nil {
+		return nil
+	}
+	if client, err := rpc.Dial("unix", s.path); err == nil {
+		s.client = client
+		return nil
+	}
+
+	// 複数のプロセスが同時に引き継がないようにロックを取る
+	fl := flock.New(s.path + ".lock")
+	if err := fl.Lock(); err != nil {
+		return fmt.Errorf("error flock.Lock: path=%s.lock, %w", s.path, err)
+	}
+	defer fl.Close()
+
+	// ロックを待っている間に他のプロセスが引き継いでいるかもしれない
+	if client, err := rpc.Dial("unix", s.path); err == nil {
+		s.client = client
+		return nil
+	}
+	// 落ちたプロセスのソケットが残っている
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error os.Remove: path=%s, %w", s.path, err)
+	}
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("error net.Listen: path=%s, %w", s.path, err)
+	}
+	server := rpc.NewServer()
+	if err := server.Register(RankingShare{}); err != nil {
+		l.Close()
+		return fmt.Errorf("error rpc.Register: %w", err)
+	}
+	go server.Accept(l)
+	s.serving = true
+	log.Printf("serving shared ranking cache on %s", s.path)
+	return nil
+}
+
+func (s *rankingShareClient) connect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connectLocked()
+}
+
+// キャッシュを持つプロセスのメソッドを呼ぶ
+// 自分がキャッシュを持っている場合はfalseを返すので、ローカルのキャッシュを使う
+func (s *rankingShareClient) call(method string, args any, reply any) (bool, error) {
+	// キャッシュを持つプロセスが落ちていた場合は一度だけやり直す
+	remote, err := s.callOnce(method, args, reply)
+	if err != nil {
+		return s.callOnce(method, args, reply)
+	}
+	return remote, nil
+}
+
+func (s *rankingShareClient) callOnce(method string, args any, reply any) (bool, error) {
+	s.mu.Lock()
+	if err := s.connectLocked(); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	if s.serving {
+		s.mu.Unlock()
+		return false, nil
+	}
+	client := s.client
+	s.mu.Unlock()
+
+	if err := client.Call("RankingShare."+method, args, reply); err != nil {
+		// 接続し直すか、キャッシュを引き継ぐ
+		s.mu.Lock()
+		if s.client == client {
+			s.client.Close()
+			s.client = nil
+		}
+		s.mu.Unlock()
+		return false, fmt.Errorf("error RankingShare.%s: %w", method, err)
+	}
+	return true, nil
+}
+
+// 大会のランキングの現在のバージョンを返す
+func rankingVersion(competitionID string) int64 {
+	if rankingShare == nil {
+		return localRankingVersion(competitionID)
+	}
+	var v int64
+	remote, err := rankingShare.call("Version", competitionID, &v)
+	if err != nil {
+		// どのキャッシュとも一致しないバージョンを返して、キャッシュを使わせない
+		log.Printf("error rankingShare Version: %s", err)
+		return -time.Now().UnixNano()
+	}
+	if !remote {
+		return localRankingVersion(competitionID)
+	}
+	return v
+}
+
+// キャッシュ済みのランキングのページを返す
+func getRankingPage(competitionID string, version int64, rankAfter, limit int64) ([]byte, bool) {
+	if rankingShare == nil {
+		return localGetRankingPage(competitionID, version, rankAfter, limit)
+	}
+	var reply RankingPageReply
+	remote, err := rankingShare.call("GetPage", RankingPageArgs{
+		CompetitionID: competitionID,
+		Version:       version,
+		RankAfter:     rankAfter,
+		Limit:         limit,
+	}, &reply)
+	if err != nil {
+		log.Printf("error rankingShare GetPage: %s", err)
+		return nil, false
+	}
+	if !remote {
+		return localGetRankingPage(competitionID, version, rankAfter, limit)
+	}
+	return reply.Page, reply.Found
+}
+
+// シリアライズ済みのランキングのページをキャッシュする
+func storeRankingPage(competitionID string, version int64, rankAfter, limit int64, b []byte) {
+	if rankingShare == nil {
+		localStoreRankingPage(competitionID, version, rankAfter, limit, b)
+		return
+	}
+	remote, err := rankingShare.call("StorePage", RankingPageArgs{
+		CompetitionID: competitionID,
+		Version:       version,
+		RankAfter:     rankAfter,
+		Limit:         limit,
+		Page:          b,
+	}, &struct{}{})
+	if err != nil {
+		log.Printf("error rankingShare StorePage: %s", err)
+		return
+	}
+	if !remote {
+		localStoreRankingPage(competitionID, version, rankAfter, limit, b)
+	}
+}
+
+// 大会のランキングのキャッシュを無効にする
+func invalidateRanking(competitionID string) {
+	if rankingShare == nil {
+		localInvalidateRanking(competitionID)
+		return
+	}
+	remote, err := rankingShare.call("Invalidate", competitionID, &struct{}{})
+	if err != nil {
+		log.Printf("error rankingShare Invalidate: %s", err)
+		return
+	}
+	if !remote {
+		localInvalidateRanking(competitionID)
+	}
+}
+
+// 共有しているランキングのキャッシュを全て捨てる
+func resetRankingShare() {
+	if rankingShare == nil {
+		return
+	}
+	if _, err := rankingShare.call("Reset", struct{}{}, &struct{}{}); err != nil {
+		log.Printf("error rankingShare Reset: %s", err)
+	}
+}
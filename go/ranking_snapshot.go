@@ -0,0 +1,191 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ランキングのスナップショット
+// スコアのアップロードごとに、作り直したランキングの順位をranking_snapshotに保存する
+// 大会ごとに最新のアップロードの分だけを残し、その前のアップロードの直後の順位をprevious_rankに持つ
+// 1人分のスコアの訂正(dispute.go, score_edit.go)ではスナップショットを更新しない
+
+type RankingSnapshotRow struct {
+	TenantID      int64         `db:"tenant_id"`
+	CompetitionID string        `db:"competition_id"`
+	PlayerID      string        `db:"player_id"`
+	UploadID      string        `db:"upload_id"`
+	Rank          int64         `db:"rank"`
+	Score         int64         `db:"score"`
+	PreviousRank  sql.NullInt64 `db:"previous_rank"`
+	PreviousScore sql.NullInt64 `db:"previous_score"`
+	CreatedAt     int64         `db:"created_at"`
+}
+
+// アップロードで作り直したランキングをスナップショットとして保存する
+// 呼び出し元でテナントのロックを取得しておくこと
+func saveRankingSnapshot(ctx context.Context, tenantDB *sqlx.DB, tenantID int64, competitionID, uploadID string, ranks []CompetitionRank, now int64) error {
+	prevRows := []RankingSnapshotRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&prevRows,
+		"SELECT * FROM ranking_snapshot WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select ranking_snapshot: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	prev := make(map[string]RankingSnapshotRow, len(prevRows))
+	for _, r := range prevRows {
+		prev[r.PlayerID] = r
+	}
+
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"DELETE FROM ranking_snapshot WHERE tenant_id = ? AND competition_id = ?",
+		tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Delete ranking_snapshot: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	if len(ranks) == 0 {
+		return nil
+	}
+
+	rows := make([]RankingSnapshotRow, 0, len(ranks))
+	for _, r := range ranks {
+		row := RankingSnapshotRow{
+			TenantID:      tenantID,
+			CompetitionID: competitionID,
+			PlayerID:      r.PlayerID,
+			UploadID:      uploadID,
+			Rank:          r.Rank,
+			Score:         r.Score,
+			CreatedAt:     now,
+		}
+		if p, ok := prev[r.PlayerID]; ok {
+			row.PreviousRank = sql.NullInt64{Int64: p.Rank, Valid: true}
+			row.PreviousScore = sql.NullInt64{Int64: p.Score, Valid: true}
+		}
+		rows = append(rows, row)
+	}
+	if _, err := tenantDB.NamedExecContext(
+		ctx,
+		"INSERT INTO ranking_snapshot (tenant_id, competition_id, player_id, upload_id, `rank`, score, previous_rank, previous_score, created_at) VALUES (:tenant_id, :competition_id, :player_id, :upload_id, :rank, :score, :previous_rank, :previous_score, :created_at)",
+		rows,
+	); err != nil {
+		return fmt.Errorf("error Insert ranking_snapshot: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	return nil
+}
+
+type RankingChange struct {
+	Rank              int64  `json:"rank"`
+	Score             int64  `json:"score"`
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	PreviousRank      *int64 `json:"previous_rank"`  // 前のアップロードでランキングに載っていなければnull
+	PreviousScore     *int64 `json:"previous_score"` // 同上
+	RankDelta         *int64 `json:"rank_delta"`     // 順位が上がった数 下がった場合は負 同上
+}
+
+type CompetitionRankingChangesHandlerResult struct {
+	Competition CompetitionDetail `json:"competition"`
+	UploadID    string            `json:"upload_id"`   // スナップショットを作ったアップロード まだアップロードがなければ空
+	UploadedAt  int64             `json:"uploaded_at"` // 同上 0
+	Changes     []RankingChange   `json:"changes"`
+}
+
+// 参加者向けAPI
+// GET /api/player/competition/:competition_id/ranking/changes
+// 最新のスコアのアップロードで、参加者ごとの順位がその前のアップロードからいくつ変わったかを順位順に取得する
+func competitionRankingChangesHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id is required")
+	}
+	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	// アップロードがスナップショットを置き換えている途中を読まないようにロックを取得する
+	fl, err := rlockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	rows := []RankingSnapshotRow{}
+	err = tenantDB.SelectContext(
+		ctx,
+		&rows,
+		"SELECT * FROM ranking_snapshot WHERE tenant_id = ? AND competition_id = ? ORDER BY `rank` ASC, player_id ASC",
+		v.tenantID, competitionID,
+	)
+	fl.Close()
+	if err != nil {
+		return fmt.Errorf("error Select ranking_snapshot: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+
+	res := CompetitionRankingChangesHandlerResult{
+		Competition: CompetitionDetail{
+			ID:         competition.ID,
+			Title:      competition.Title,
+			IsFinished: competition.FinishedAt.Valid,
+		},
+		Changes: make([]RankingChange, 0, len(rows)),
+	}
+	for _, r := range rows {
+		res.UploadID = r.UploadID
+		res.UploadedAt = r.CreatedAt
+		p, err := retrievePlayer(ctx, tenantDB, r.PlayerID)
+		if err != nil {
+			return fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		// 削除済みの参加者はランキングと同じく載せない
+		if p.DeletedAt.Valid {
+			continue
+		}
+		rc := RankingChange{
+			Rank:              r.Rank,
+			Score:             r.Score,
+			PlayerID:          p.ID,
+			PlayerDisplayName: p.DisplayName,
+		}
+		if r.PreviousRank.Valid {
+			previousRank, previousScore := r.PreviousRank.Int64, r.PreviousScore.Int64
+			delta := previousRank - r.Rank
+			rc.PreviousRank = &previousRank
+			rc.PreviousScore = &previousScore
+			rc.RankDelta = &delta
+		}
+		res.Changes = append(res.Changes, rc)
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,110 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// ランキングの同点の扱い 大会ごとにcompetition.tie_breakに保存する
+const (
+	// CSVで先に登場したスコアを上の順位にする 元からの挙動
+	TieBreakEarliest = "earliest"
+	// CSVで後に登場したスコアを上の順位にする
+	TieBreakLatest = "latest"
+	// 同点は同じ順位にし、次の順位は人数分飛ばす(1, 1, 3) 並びはearliestと同じ
+	TieBreakShared = "shared"
+)
+
+// 同点の扱いを返す 未設定や知らない値はearliestとして扱う
+func normalizeTieBreak(tieBreak string) string {
+	switch tieBreak {
+	case TieBreakLatest, TieBreakShared:
+		return tieBreak
+	}
+	return TieBreakEarliest
+}
+
+// 大会の同点の扱いを返す
+func competitionTieBreak(ctx context.Context, tenantDB dbOrTx, competitionID string) (string, error) {
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		return "", fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	return normalizeTieBreak(comp.TieBreak), nil
+}
+
+// 順位順に並べたランキングにRankを設定する
+// sharedの場合は同点の参加者に最初の参加者と同じ順位を付ける
+func assignCompetitionRanks(ranks []CompetitionRank, tieBreak string) {
+	for i := range ranks {
+		if tieBreak == TieBreakShared && i > 0 && ranks[i].Score == ranks[i-1].Score {
+			ranks[i].Rank = ranks[i-1].Rank
+			continue
+		}
+		ranks[i].Rank = int64(i + 1)
+	}
+}
+
+type CompetitionTieBreakHandlerResult struct {
+	CompetitionID string `json:"competition_id"`
+	TieBreak      string `json:"tie_break"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/tie_break
+// 大会のランキングの同点の扱いを設定する
+// フォームで tie_break (earliest, latest, shared) を受け取る 終了した大会は最終順位が変わるので変更できない
+func competitionTieBreakHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tieBreak := c.FormValue("tie_break")
+	switch tieBreak {
+	case TieBreakEarliest, TieBreakLatest, TieBreakShared:
+	default:
+		return apperr.InvalidField("tie_break", "tie_break must be one of earliest, latest, shared")
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+	competitionID := c.Param("competition_id")
+	if err := checkCompetitionOpen(ctx, tenantDB, competitionID); err != nil {
+		return err
+	}
+
+	// アップロードでランキングを作り直している間に変わらないようにロックする
+	fl, err := flockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	now := time.Now().Unix()
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE competition SET tie_break = ?, updated_at = ? WHERE id = ?",
+		tieBreak, now, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Update competition: tieBreak=%s, id=%s, %w", tieBreak, competitionID, err)
+	}
+	competitionCache.Delete(competitionID)
+	invalidateRanking(competitionID)
+
+	res := CompetitionTieBreakHandlerResult{
+		CompetitionID: competitionID,
+		TieBreak:      tieBreak,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,18 @@
+package isuports
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ソケットにSO_REUSEPORTを設定する
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package isuports
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SO_REUSEPORTはLinuxでのみ使う
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on linux")
+}
@@ -0,0 +1,155 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// サンドボックスのテナントか
+// テナント管理者がスコアの登録や大会の終了を試すために、既存のテナントを複製したもの
+// 課金の対象にはしない
+func (t *TenantRow) IsSandbox() bool {
+	return t.SandboxOf.Valid
+}
+
+type SandboxIDMapping struct {
+	SourceID string `json:"source_id"`
+	ID       string `json:"id"`
+}
+
+type TenantSandboxHandlerResult struct {
+	Tenant       TenantWithBilling  `json:"tenant"`
+	SandboxOf    string             `json:"sandbox_of"`
+	Players      []SandboxIDMapping `json:"players"`
+	Competitions []SandboxIDMapping `json:"competitions"`
+}
+
+// SasS管理者用API
+// テナントを複製してサンドボックスのテナントを作る
+// POST /api/admin/tenant/:tenant_id/sandbox
+// フォームのnameでテナント名を指定できる 省略した場合は{元のテナント名}-sandbox-{作成日時}
+// 参加者と大会を複製する IDは振り直すので、元のIDとの対応を返す
+// 大会は全て開催中の状態で複製し、スコアは複製しない
+func tenantSandboxHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	ctx := context.Background()
+	source, err := retrieveTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if source.IsSandbox() {
+		return ErrSandboxOfSandbox
+	}
+
+	now := time.Now().Unix()
+	name := c.FormValue("name")
+	if name == "" {
+		name = fmt.Sprintf("%s-sandbox-%d", source.Name, now)
+	}
+	tenant, err := addTenant(ctx, name, source.DisplayName+" (sandbox)", source.Storage)
+	if err != nil {
+		return err
+	}
+	sandboxID, err := strconv.ParseInt(tenant.ID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("error strconv.ParseInt: id=%s, %w", tenant.ID, err)
+	}
+	if _, err := adminDB.ExecContext(
+		ctx,
+		"UPDATE tenant SET sandbox_of = ?, updated_at = ? WHERE id = ?",
+		source.ID, now, sandboxID,
+	); err != nil {
+		return fmt.Errorf("error Update tenant: id=%d, sandboxOf=%d, %w", sandboxID, source.ID, err)
+	}
+
+	res := TenantSandboxHandlerResult{
+		Tenant:       *tenant,
+		SandboxOf:    strconv.FormatInt(source.ID, 10),
+		Players:      []SandboxIDMapping{},
+		Competitions: []SandboxIDMapping{},
+	}
+	if err := copyTenantToSandbox(ctx, source.ID, sandboxID, &res); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 参加者と大会をサンドボックスのテナントに複製する
+func copyTenantToSandbox(ctx context.Context, sourceID, sandboxID int64, res *TenantSandboxHandlerResult) error {
+	sourceDB, err := connectToTenantDB(sourceID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: id=%d, %w", sourceID, err)
+	}
+	players := []PlayerRow{}
+	if err := sourceDB.SelectContext(
+		ctx,
+		&players,
+		"SELECT * FROM player WHERE tenant_id = ? AND deleted_at IS NULL ORDER BY created_at ASC",
+		sourceID,
+	); err != nil {
+		return fmt.Errorf("error Select player: tenantID=%d, %w", sourceID, err)
+	}
+	competitions := []CompetitionRow{}
+	if err := sourceDB.SelectContext(
+		ctx,
+		&competitions,
+		"SELECT * FROM competition WHERE tenant_id = ? ORDER BY created_at ASC",
+		sourceID,
+	); err != nil {
+		return fmt.Errorf("error Select competition: tenantID=%d, %w", sourceID, err)
+	}
+
+	sandboxDB, err := connectToTenantDB(sandboxID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: id=%d, %w", sandboxID, err)
+	}
+	fl, err := flockByTenantID(ctx, sandboxID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	now := time.Now().Unix()
+	for _, p := range players {
+		id, err := dispenseTenantID(ctx, sandboxID)
+		if err != nil {
+			return fmt.Errorf("error dispenseTenantID: %w", err)
+		}
+		if _, err := sandboxDB.ExecContext(
+			ctx,
+			"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			id, sandboxID, p.DisplayName, p.IsDisqualified, now, now,
+		); err != nil {
+			return fmt.Errorf("error Insert player: id=%s, tenantID=%d, %w", id, sandboxID, err)
+		}
+		res.Players = append(res.Players, SandboxIDMapping{SourceID: p.ID, ID: id})
+	}
+	for _, comp := range competitions {
+		id, err := dispenseTenantID(ctx, sandboxID)
+		if err != nil {
+			return fmt.Errorf("error dispenseTenantID: %w", err)
+		}
+		if _, err := sandboxDB.ExecContext(
+			ctx,
+			"INSERT INTO competition (id, tenant_id, title, finished_at, tie_break, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			id, sandboxID, comp.Title, nil, normalizeTieBreak(comp.TieBreak), now, now,
+		); err != nil {
+			return fmt.Errorf("error Insert competition: id=%s, tenantID=%d, %w", id, sandboxID, err)
+		}
+		res.Competitions = append(res.Competitions, SandboxIDMapping{SourceID: comp.ID, ID: id})
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// 参加者1人分のスコアの編集
+// CSVを全てアップロードし直さずに、1人分のスコアを訂正または削除する
+
+type ScoreCorrectionHandlerResult struct {
+	PlayerID string `json:"player_id"`
+	Score    int64  `json:"score"`
+	UploadID string `json:"upload_id"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/score/:player_id
+// 開催中の大会の参加者1人のスコアを登録または訂正する
+// フォームで score を受け取る row_numが最大の行として追加するので、その参加者の有効なスコアになる
+func competitionPlayerScoreHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if err := checkCompetitionOpen(ctx, tenantDB, competitionID); err != nil {
+		return err
+	}
+	playerID := c.Param("player_id")
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPlayerNotFound
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	if p.DeletedAt.Valid {
+		return ErrPlayerNotFound
+	}
+	score, err := parseOptionalIntForm(c, "score")
+	if err != nil {
+		return err
+	}
+	if !score.Valid {
+		return apperr.InvalidField("score", "score is required")
+	}
+
+	// アップロードと同じくplayer_scoreを書き換えるのでロックする
+	fl, err := flockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	uploadID, err := correctPlayerScore(ctx, tenantDB, v.tenantID, competitionID, p.ID, score.Int64, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error correctPlayerScore: %w", err)
+	}
+	hooks.scoreUploaded(ctx, ScoreUploadedEvent{
+		TenantID:      v.tenantID,
+		CompetitionID: competitionID,
+		Rows:          1,
+	})
+
+	res := ScoreCorrectionHandlerResult{
+		PlayerID: p.ID,
+		Score:    score.Int64,
+		UploadID: uploadID,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type ScoreDeletionHandlerResult struct {
+	PlayerID    string `json:"player_id"`
+	DeletedRows int64  `json:"deleted_rows"`
+	UploadID    string `json:"upload_id"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/score/:player_id/delete
+// 大会から参加者1人のスコアを全て削除する 失格にした参加者をランキングから外すときなどに使う
+// 終了した大会でも削除でき、保存した課金レポートの参加者数は計算し直す
+// 削除もアップロードとして記録する player_score_historyの行は残す
+func competitionPlayerScoreDeleteHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	playerID := c.Param("player_id")
+
+	fl, err := flockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	pss := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		v.tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+	next := make([]PlayerScoreRow, 0, len(pss))
+	for _, ps := range pss {
+		if ps.PlayerID != playerID {
+			next = append(next, ps)
+		}
+	}
+	deleted := int64(len(pss) - len(next))
+	if deleted == 0 {
+		return ErrPlayerScoreNotFound
+	}
+
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"DELETE FROM player_score WHERE tenant_id = ? AND competition_id = ? AND player_id = ?",
+		v.tenantID, competitionID, playerID,
+	); err != nil {
+		return fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, playerID=%s, %w", v.tenantID, competitionID, playerID, err)
+	}
+	uploadID, err := dispenseTenantID(ctx, v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error dispenseTenantID: %w", err)
+	}
+	if err := insertScoreUpload(
+		ctx,
+		tenantDB,
+		ScoreUploadRow{
+			ID:            uploadID,
+			TenantID:      v.tenantID,
+			CompetitionID: competitionID,
+			RowCount:      0,
+			CreatedAt:     time.Now().Unix(),
+		},
+		diffEffectiveScores(uploadID, v.tenantID, effectiveScores(pss), effectiveScores(next)),
+	); err != nil {
+		return fmt.Errorf("error insertScoreUpload: %w", err)
+	}
+
+	invalidateRanking(competitionID)
+	// アップロードと同じくランキングを作り直し、順位の変化を返せるようにスナップショットを残す
+	sort.Slice(next, func(i, j int) bool { return next[i].RowNum < next[j].RowNum })
+	ranks, err := rebuildMaterializedRanking(ctx, tenantDB, competitionID, next)
+	if err != nil {
+		return fmt.Errorf("error rebuildMaterializedRanking: %w", err)
+	}
+	if err := saveRankingSnapshot(ctx, tenantDB, v.tenantID, competitionID, uploadID, ranks, time.Now().Unix()); err != nil {
+		return fmt.Errorf("error saveRankingSnapshot: %w", err)
+	}
+	invalidateBillingInputs(v.tenantID, competitionID)
+	if err := recalculateBillingReportPlayers(ctx, tenantDB, v.tenantID, competitionID); err != nil {
+		return fmt.Errorf("error recalculateBillingReportPlayers: %w", err)
+	}
+	hooks.scoreUploaded(ctx, ScoreUploadedEvent{
+		TenantID:      v.tenantID,
+		CompetitionID: competitionID,
+		Rows:          0,
+	})
+
+	res := ScoreDeletionHandlerResult{
+		PlayerID:    playerID,
+		DeletedRows: deleted,
+		UploadID:    uploadID,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
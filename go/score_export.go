@@ -0,0 +1,161 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/export/scores.csv
+// 大会のスコアをアップロードしたCSVと同じ順(row_numの昇順)でCSVにする
+// 中断したダウンロードを再開できるように、Rangeヘッダとoffset(読み飛ばすデータ行の数)に対応する
+func competitionScoresExportHandler(c echo.Context) error {
+	return exportCompetitionCSV(c, "scores", false, func(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, w *csv.Writer, offset int64) error {
+		pss := []PlayerScoreRow{}
+		if err := tenantDB.SelectContext(
+			ctx,
+			&pss,
+			"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num ASC, id ASC",
+			tenantID, competitionID,
+		); err != nil {
+			return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+		}
+		if offset == 0 {
+			w.Write([]string{"player_id", "score", "row_num"})
+		}
+		for i := offset; i < int64(len(pss)); i++ {
+			ps := pss[i]
+			w.Write([]string{ps.PlayerID, strconv.FormatInt(ps.Score, 10), strconv.FormatInt(ps.RowNum, 10)})
+		}
+		return nil
+	})
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/export/ranking.csv
+// 大会のランキングを順位の順でCSVにする
+// 同点の場合はランキングAPIと同じく大会の同点の扱い(ranking_tie_break.go)に従うので、データが変わらなければ順番も変わらない
+func competitionRankingExportHandler(c echo.Context) error {
+	return exportCompetitionCSV(c, "ranking", false, writeCompetitionRankingCSV)
+}
+
+// 大会のランキングをCSVに書く
+func writeCompetitionRankingCSV(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, w *csv.Writer, offset int64) error {
+	pss := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
+		tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	tieBreak, err := competitionTieBreak(ctx, tenantDB, competitionID)
+	if err != nil {
+		return err
+	}
+	ranks, err := buildCompetitionRanks(ctx, tenantDB, pss, tieBreak, make([]CompetitionRank, 0, len(pss)), make(map[string]struct{}, len(pss)))
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		w.Write([]string{"rank", "player_id", "player_display_name", "score"})
+	}
+	for i := offset; i < int64(len(ranks)); i++ {
+		r := ranks[i]
+		w.Write([]string{strconv.FormatInt(r.Rank, 10), r.PlayerID, r.PlayerDisplayName, strconv.FormatInt(r.Score, 10)})
+	}
+	return nil
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/ranking/export
+// 終了した大会の最終順位をCSVにする 内容とRange、offsetの扱いはexport/ranking.csvと同じ
+func competitionFinalRankingExportHandler(c echo.Context) error {
+	return exportCompetitionCSV(c, "final_ranking", true, writeCompetitionRankingCSV)
+}
+
+// CSVのエクスポートの共通処理
+// CSVを全てメモリ上に作ってからhttp.ServeContentで返すので、Range、If-Range、ETagはnet/httpが処理する
+// ETagは内容のハッシュなので、再開したときに内容が変わっていれば全体を返し直す
+// offsetを指定した場合はヘッダ行を付けない
+// finishedOnlyの場合は終了していない大会をエラーにする
+func exportCompetitionCSV(
+	c echo.Context,
+	name string,
+	finishedOnly bool,
+	write func(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, w *csv.Writer, offset int64) error,
+) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if finishedOnly && !comp.FinishedAt.Valid {
+		return ErrCompetitionNotFinished
+	}
+
+	var offset int64
+	if s := c.QueryParam("offset"); s != "" {
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+			return apperr.InvalidField("offset", "offset must be a non-negative integer")
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := rlockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error rlockByTenantID: %w", err)
+	}
+	err = write(ctx, tenantDB, v.tenantID, competitionID, w, offset)
+	fl.Close()
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("error csv.Writer: %w", err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	h.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s_%s.csv", competitionID, name)))
+	h.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	return nil
+}
@@ -0,0 +1,391 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 外部の形式
+const (
+	// 結果の配列を持つJSON
+	ScoreImportFormatResultsJSON = "results_json"
+	// 計測システムなどが出力するヘッダ付きのCSV 区切り文字や列名はマッピングで指定する
+	ScoreImportFormatTimingCSV = "timing_csv"
+)
+
+// スコアの種類
+const (
+	// 点数 大きいほど上位
+	ScoreImportTypePoints = "points"
+	// タイム(h:mm:ss.fff など) 短いほど上位
+	// ランキングはスコアの降順なので、ミリ秒を負の数にしてスコアにする
+	ScoreImportTypeTime = "time"
+)
+
+// 参加者の特定に使う値
+const (
+	ScoreImportPlayerKeyID          = "id"
+	ScoreImportPlayerKeyDisplayName = "display_name"
+)
+
+// 外部の形式からスコアへの変換の設定
+type ScoreImportMapping struct {
+	// 参加者の列名 JSONの場合はドット区切りのフィールドのパス
+	Player string `json:"player"`
+	// 参加者の列の値が参加者IDか表示名か 未指定なら参加者ID
+	PlayerKey string `json:"player_key"`
+	// スコアの列名 JSONの場合はドット区切りのフィールドのパス
+	Score string `json:"score"`
+	// points か time 未指定なら points
+	ScoreType string `json:"score_type"`
+	// points の場合にかける数 小数の点数を整数にするために使う 未指定なら1
+	ScoreScale float64 `json:"score_scale"`
+	// CSVの区切り文字 未指定なら,
+	Delimiter string `json:"delimiter"`
+	// CSVのヘッダ行の前に読み飛ばす行数
+	SkipRows int `json:"skip_rows"`
+	// JSONで結果の配列があるフィールドのパス 未指定ならトップレベルが配列
+	ResultsPath string `json:"results_path"`
+	// スコアが空の行(棄権など)を読み飛ばすか 未指定ならエラーにする
+	SkipEmptyScore bool `json:"skip_empty_score"`
+}
+
+func (m *ScoreImportMapping) validate(format string) error {
+	if m.Player == "" {
+		return apperr.InvalidField("mapping", "mapping.player is required")
+	}
+	if m.Score == "" {
+		return apperr.InvalidField("mapping", "mapping.score is required")
+	}
+	switch m.PlayerKey {
+	case "":
+		m.PlayerKey = ScoreImportPlayerKeyID
+	case ScoreImportPlayerKeyID, ScoreImportPlayerKeyDisplayName:
+	default:
+		return apperr.InvalidField("mapping", "mapping.player_key must be %s or %s", ScoreImportPlayerKeyID, ScoreImportPlayerKeyDisplayName)
+	}
+	switch m.ScoreType {
+	case "":
+		m.ScoreType = ScoreImportTypePoints
+	case ScoreImportTypePoints, ScoreImportTypeTime:
+	default:
+		return apperr.InvalidField("mapping", "mapping.score_type must be %s or %s", ScoreImportTypePoints, ScoreImportTypeTime)
+	}
+	if m.ScoreScale == 0 {
+		m.ScoreScale = 1
+	}
+	if format == ScoreImportFormatTimingCSV {
+		if m.Delimiter == "" {
+			m.Delimiter = ","
+		}
+		if m.Delimiter == "\\t" {
+			m.Delimiter = "\t"
+		}
+		if len([]rune(m.Delimiter)) != 1 {
+			return apperr.InvalidField("mapping", "mapping.delimiter must be a single character")
+		}
+		if m.SkipRows < 0 {
+			return apperr.InvalidField("mapping", "mapping.skip_rows must be >= 0")
+		}
+	}
+	return nil
+}
+
+// 外部の形式から読み込んだ1行分の参加者とスコア 変換前の文字列
+type importedScore struct {
+	Player string
+	Score  string
+}
+
+// ヘッダ付きのCSVを読み込む
+func readTimingCSV(r io.Reader, m *ScoreImportMapping) ([]importedScore, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = []rune(m.Delimiter)[0]
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	for i := 0; i < m.SkipRows; i++ {
+		if _, err := cr.Read(); err != nil {
+			return nil, apperr.Validation("cannot skip %d rows: %s", m.SkipRows, err).WithCode(ErrInvalidCSVRow.Code)
+		}
+	}
+	headers, err := cr.Read()
+	if err != nil {
+		return nil, ErrInvalidCSVHeader
+	}
+	playerCol, scoreCol := -1, -1
+	for i, h := range headers {
+		// 先頭のBOMと前後の空白は無視する
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		if strings.EqualFold(h, m.Player) {
+			playerCol = i
+		}
+		if strings.EqualFold(h, m.Score) {
+			scoreCol = i
+		}
+	}
+	if playerCol < 0 || scoreCol < 0 {
+		return nil, apperr.Validation("column %s or %s is not found in CSV headers", m.Player, m.Score).WithCode(ErrInvalidCSVHeader.Code)
+	}
+
+	res := []importedScore{}
+	for line := m.SkipRows + 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, apperr.Validation("error reading CSV: %s", err).WithCode(ErrInvalidCSVRow.Code)
+		}
+		// 空行
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		if playerCol >= len(row) || scoreCol >= len(row) {
+			return nil, apperr.Validation("line %d has too few columns", line).WithCode(ErrInvalidCSVRow.Code)
+		}
+		res = append(res, importedScore{Player: strings.TrimSpace(row[playerCol]), Score: strings.TrimSpace(row[scoreCol])})
+	}
+	return res, nil
+}
+
+// ドット区切りのパスでJSONのフィールドを取り出す
+func lookupJSONPath(v any, path string) (any, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// JSONの値を文字列にする 数値は元の表記のまま
+func jsonValueString(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(x)
+	case json.Number:
+		return x.String()
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// 結果の配列を持つJSONを読み込む
+func readResultsJSON(r io.Reader, m *ScoreImportMapping) ([]importedScore, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, apperr.Validation("invalid JSON: %s", err).WithCode(ErrInvalidRequestBody.Code)
+	}
+	v, ok := lookupJSONPath(doc, m.ResultsPath)
+	if !ok {
+		return nil, apperr.Validation("results_path %s is not found", m.ResultsPath).WithCode(ErrInvalidRequestBody.Code)
+	}
+	items, ok := v.([]any)
+	if !ok {
+		return nil, apperr.Validation("results is not an array").WithCode(ErrInvalidRequestBody.Code)
+	}
+	res := make([]importedScore, 0, len(items))
+	for i, item := range items {
+		player, ok := lookupJSONPath(item, m.Player)
+		if !ok {
+			return nil, apperr.Validation("results[%d].%s is not found", i, m.Player).WithCode(ErrInvalidRequestBody.Code)
+		}
+		score, _ := lookupJSONPath(item, m.Score)
+		res = append(res, importedScore{Player: jsonValueString(player), Score: jsonValueString(score)})
+	}
+	return res, nil
+}
+
+// h:mm:ss.fff、mm:ss.fff、ss.fff の形式のタイムをミリ秒にする
+func parseRaceTime(s string) (int64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	var ms float64
+	for i, p := range parts {
+		n, err := strconv.ParseFloat(p, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time: %s", s)
+		}
+		// 秒以外は整数
+		if i < len(parts)-1 && n != math.Trunc(n) {
+			return 0, fmt.Errorf("invalid time: %s", s)
+		}
+		ms = ms*60 + n
+	}
+	return int64(math.Round(ms * 1000)), nil
+}
+
+// 読み込んだ値をスコアのアップロードと同じ形式にする
+func convertImportedScores(ctx context.Context, tenantDB *sqlx.DB, tenantID int64, rows []importedScore, m *ScoreImportMapping) ([]scoreRecord, error) {
+	// 表示名で参加者を特定する場合は表示名から参加者IDを引く
+	var idByName map[string]string
+	if m.PlayerKey == ScoreImportPlayerKeyDisplayName {
+		ps := []PlayerRow{}
+		if err := tenantDB.SelectContext(
+			ctx,
+			&ps,
+			"SELECT * FROM player WHERE tenant_id = ? AND deleted_at IS NULL",
+			tenantID,
+		); err != nil {
+			return nil, fmt.Errorf("error Select player: tenantID=%d, %w", tenantID, err)
+		}
+		idByName = make(map[string]string, len(ps))
+		for _, p := range ps {
+			// 同じ表示名の参加者が複数いる場合は特定できない
+			if _, ok := idByName[p.DisplayName]; ok {
+				idByName[p.DisplayName] = ""
+				continue
+			}
+			idByName[p.DisplayName] = p.ID
+		}
+	}
+
+	records := make([]scoreRecord, 0, len(rows))
+	for i, row := range rows {
+		playerID := row.Player
+		if idByName != nil {
+			id, ok := idByName[row.Player]
+			if !ok {
+				return nil, apperr.Validation("row %d: player not found: %s", i+1, row.Player).WithCode(ErrPlayerNotFound.Code)
+			}
+			if id == "" {
+				return nil, apperr.Validation("row %d: display name is ambiguous: %s", i+1, row.Player).WithCode(ErrInvalidCSVRow.Code)
+			}
+			playerID = id
+		}
+		if row.Score == "" {
+			if m.SkipEmptyScore {
+				continue
+			}
+			return nil, apperr.Validation("row %d: score is empty", i+1).WithCode(ErrInvalidCSVRow.Code)
+		}
+
+		var score int64
+		switch m.ScoreType {
+		case ScoreImportTypeTime:
+			ms, err := parseRaceTime(row.Score)
+			if err != nil {
+				return nil, apperr.Validation("row %d: %s", i+1, err).WithCode(ErrInvalidCSVRow.Code)
+			}
+			score = -ms
+		default:
+			f, err := strconv.ParseFloat(row.Score, 64)
+			if err != nil {
+				return nil, apperr.Validation("row %d: invalid score: %s", i+1, row.Score).WithCode(ErrInvalidCSVRow.Code)
+			}
+			score = int64(math.Round(f * m.ScoreScale))
+		}
+		records = append(records, scoreRecord{PlayerID: playerID, Score: strconv.FormatInt(score, 10)})
+	}
+	return records, nil
+}
+
+type ScoreImportHandlerResult struct {
+	Format string `json:"format"`
+	ScoreHandlerResult
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/import
+// 外部の計測システムなどの形式のファイルからスコアを取り込む
+// format に results_json か timing_csv、mapping に ScoreImportMapping のJSON、file にファイルを指定する
+// 変換した後はスコアのCSVのアップロードと同じく大会のスコアを置き換える
+func competitionScoreImportHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if comp.FinishedAt.Valid {
+		return ErrCompetitionFinished
+	}
+
+	format := c.FormValue("format")
+	if format != ScoreImportFormatResultsJSON && format != ScoreImportFormatTimingCSV {
+		return apperr.InvalidField("format", "format must be %s or %s", ScoreImportFormatResultsJSON, ScoreImportFormatTimingCSV)
+	}
+	var m ScoreImportMapping
+	if err := json.Unmarshal([]byte(c.FormValue("mapping")), &m); err != nil {
+		return apperr.InvalidField("mapping", "invalid mapping: %s", err)
+	}
+	if err := m.validate(format); err != nil {
+		return err
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return apperr.InvalidField("file", "file required")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("error fh.Open FormFile(file): %w", err)
+	}
+	defer f.Close()
+
+	var rows []importedScore
+	switch format {
+	case ScoreImportFormatResultsJSON:
+		rows, err = readResultsJSON(f, &m)
+	case ScoreImportFormatTimingCSV:
+		rows, err = readTimingCSV(f, &m)
+	}
+	if err != nil {
+		return err
+	}
+	records, err := convertImportedScores(ctx, tenantDB, v.tenantID, rows, &m)
+	if err != nil {
+		return err
+	}
+
+	res, err := uploadScores(c.Request().Context(), tenantDB, v.tenantID, competitionID, records, ScoreUploadModeReplace)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: ScoreImportHandlerResult{Format: format, ScoreHandlerResult: *res}})
+}
@@ -0,0 +1,259 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+type ScorePercentiles struct {
+	P10 int64 `json:"p10"`
+	P25 int64 `json:"p25"`
+	P50 int64 `json:"p50"`
+	P75 int64 `json:"p75"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+}
+
+type ScoreStats struct {
+	Count       int64            `json:"count"`
+	Min         int64            `json:"min"`
+	Max         int64            `json:"max"`
+	Mean        float64          `json:"mean"`
+	Median      float64          `json:"median"`
+	Percentiles ScorePercentiles `json:"percentiles"`
+}
+
+// 昇順に並んだスコアの統計量を計算する
+func computeScoreStats(sorted []int64) ScoreStats {
+	n := len(sorted)
+	if n == 0 {
+		return ScoreStats{}
+	}
+	var sum float64
+	for _, s := range sorted {
+		sum += float64(s)
+	}
+	median := float64(sorted[n/2])
+	if n%2 == 0 {
+		median = (float64(sorted[n/2-1]) + float64(sorted[n/2])) / 2
+	}
+	// nearest-rank法
+	percentile := func(p float64) int64 {
+		i := int(math.Ceil(p/100*float64(n))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return ScoreStats{
+		Count:  int64(n),
+		Min:    sorted[0],
+		Max:    sorted[n-1],
+		Mean:   sum / float64(n),
+		Median: median,
+		Percentiles: ScorePercentiles{
+			P10: percentile(10),
+			P25: percentile(25),
+			P50: percentile(50),
+			P75: percentile(75),
+			P90: percentile(90),
+			P99: percentile(99),
+		},
+	}
+}
+
+// 大会の参加者ごとの最新のスコアを昇順で返す
+// player_scoreを読み直さずに、ランキングのAPIと同じ作り直したランキング(ranking_cache.go)から作るので、ランキングと同じスコアになる
+// 結果はランキングのバージョンごとにキャッシュする
+type latestScores struct {
+	version int64
+	scores  []int64
+}
+
+var latestScoresCache = helpisu.NewCache[string, latestScores]()
+
+func retrieveLatestScores(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) ([]int64, error) {
+	version := rankingVersion(competitionID)
+	if ls, ok := latestScoresCache.Get(competitionID); ok && ls.version == version {
+		return ls.scores, nil
+	}
+
+	ranks, err := competitionRanking(ctx, tenantDB, tenantID, competitionID, version)
+	if err != nil {
+		return nil, fmt.Errorf("error competitionRanking: %w", err)
+	}
+	scores := make([]int64, 0, len(ranks))
+	for _, r := range ranks {
+		scores = append(scores, r.Score)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i] < scores[j] })
+
+	latestScoresCache.Set(competitionID, latestScores{version: version, scores: scores})
+	return scores, nil
+}
+
+type CompetitionScoreStatsHandlerResult struct {
+	Competition CompetitionDetail `json:"competition"`
+	Stats       ScoreStats        `json:"stats"`
+}
+
+// 参加者向けAPI
+// GET /api/player/competition/:competition_id/stats
+// 大会の参加者ごとの最新のスコアの統計量を取得する
+func playerCompetitionStatsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return ErrRolePlayerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id is required")
+	}
+	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	scores, err := retrieveLatestScores(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveLatestScores: %w", err)
+	}
+
+	res := SuccessResult{
+		Status: true,
+		Data: CompetitionScoreStatsHandlerResult{
+			Competition: CompetitionDetail{
+				ID:         competition.ID,
+				Title:      competition.Title,
+				IsFinished: competition.FinishedAt.Valid,
+			},
+			Stats: computeScoreStats(scores),
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// ヒストグラムの1区間 LowerとUpperを含む
+type ScoreHistogramBin struct {
+	Lower int64 `json:"lower"`
+	Upper int64 `json:"upper"`
+	Count int64 `json:"count"`
+}
+
+const (
+	defaultScoreHistogramBins = 10
+	maxScoreHistogramBins     = 100
+)
+
+// 昇順に並んだスコアを最小値から最大値までの等幅の区間に分けて数える
+// 区間の幅は整数に切り上げるので、区間の数がbinsより少なくなることがある
+func computeScoreHistogram(sorted []int64, bins int64) []ScoreHistogramBin {
+	n := len(sorted)
+	if n == 0 {
+		return []ScoreHistogramBin{}
+	}
+	min, max := sorted[0], sorted[n-1]
+	width := (max - min + bins) / bins
+	if width < 1 {
+		width = 1
+	}
+	hist := make([]ScoreHistogramBin, (max-min)/width+1)
+	for i := range hist {
+		hist[i].Lower = min + int64(i)*width
+		hist[i].Upper = hist[i].Lower + width - 1
+	}
+	for _, s := range sorted {
+		hist[(s-min)/width].Count++
+	}
+	return hist
+}
+
+type OrganizerCompetitionStatsHandlerResult struct {
+	Competition CompetitionDetail   `json:"competition"`
+	Stats       ScoreStats          `json:"stats"`
+	Histogram   []ScoreHistogramBin `json:"histogram"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/stats
+// 大会の参加者ごとの最新のスコアの統計量とヒストグラムを取得する
+// クエリパラメータ bins でヒストグラムの区間の数を指定する 省略した場合は10
+func organizerCompetitionStatsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	bins := int64(defaultScoreHistogramBins)
+	if s := c.QueryParam("bins"); s != "" {
+		if bins, err = strconv.ParseInt(s, 10, 64); err != nil || bins < 1 || bins > maxScoreHistogramBins {
+			return apperr.Validation(
+				"query parameter 'bins' must be between 1 and %d", maxScoreHistogramBins,
+			).WithCode(ErrInvalidQuery.Code)
+		}
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id is required")
+	}
+	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	scores, err := retrieveLatestScores(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveLatestScores: %w", err)
+	}
+
+	res := OrganizerCompetitionStatsHandlerResult{
+		Competition: CompetitionDetail{
+			ID:         competition.ID,
+			Title:      competition.Title,
+			IsFinished: competition.FinishedAt.Valid,
+		},
+		Stats:     computeScoreStats(scores),
+		Histogram: computeScoreHistogram(scores, bins),
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,280 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// スコアの差分の種類
+const (
+	ScoreChangeAdded   = "added"   // 前回のアップロードにいなかった参加者
+	ScoreChangeRemoved = "removed" // 今回のアップロードからいなくなった参加者
+	ScoreChangeChanged = "changed" // 有効なスコアが変わった参加者
+)
+
+type ScoreUploadRow struct {
+	ID            string `db:"id"`
+	TenantID      int64  `db:"tenant_id"`
+	CompetitionID string `db:"competition_id"`
+	RowCount      int64  `db:"row_count"`
+	AddedCount    int64  `db:"added_count"`
+	RemovedCount  int64  `db:"removed_count"`
+	ChangedCount  int64  `db:"changed_count"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type ScoreUploadDiffRow struct {
+	UploadID      string        `db:"upload_id"`
+	TenantID      int64         `db:"tenant_id"`
+	PlayerID      string        `db:"player_id"`
+	ChangeType    string        `db:"change_type"`
+	PreviousScore sql.NullInt64 `db:"previous_score"`
+	Score         sql.NullInt64 `db:"score"`
+}
+
+// 参加者ごとの有効なスコア(row_numが最大の行のスコア)を返す
+func effectiveScores(pss []PlayerScoreRow) map[string]PlayerScoreRow {
+	scores := make(map[string]PlayerScoreRow, len(pss))
+	for _, ps := range pss {
+		if cur, ok := scores[ps.PlayerID]; ok && cur.RowNum >= ps.RowNum {
+			continue
+		}
+		scores[ps.PlayerID] = ps
+	}
+	return scores
+}
+
+// 前回と今回のアップロードの有効なスコアの差分を計算する
+// 参加者IDの順に並べて返す
+func diffEffectiveScores(uploadID string, tenantID int64, prev, next map[string]PlayerScoreRow) []ScoreUploadDiffRow {
+	diffs := []ScoreUploadDiffRow{}
+	for pid, n := range next {
+		p, ok := prev[pid]
+		switch {
+		case !ok:
+			diffs = append(diffs, ScoreUploadDiffRow{
+				UploadID:   uploadID,
+				TenantID:   tenantID,
+				PlayerID:   pid,
+				ChangeType: ScoreChangeAdded,
+				Score:      sql.NullInt64{Int64: n.Score, Valid: true},
+			})
+		case p.Score != n.Score:
+			diffs = append(diffs, ScoreUploadDiffRow{
+				UploadID:      uploadID,
+				TenantID:      tenantID,
+				PlayerID:      pid,
+				ChangeType:    ScoreChangeChanged,
+				PreviousScore: sql.NullInt64{Int64: p.Score, Valid: true},
+				Score:         sql.NullInt64{Int64: n.Score, Valid: true},
+			})
+		}
+	}
+	for pid, p := range prev {
+		if _, ok := next[pid]; ok {
+			continue
+		}
+		diffs = append(diffs, ScoreUploadDiffRow{
+			UploadID:      uploadID,
+			TenantID:      tenantID,
+			PlayerID:      pid,
+			ChangeType:    ScoreChangeRemoved,
+			PreviousScore: sql.NullInt64{Int64: p.Score, Valid: true},
+		})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].PlayerID < diffs[j].PlayerID })
+	return diffs
+}
+
+// アップロードの記録と差分を保存する
+func insertScoreUpload(ctx context.Context, tenantDB dbOrTx, upload ScoreUploadRow, diffs []ScoreUploadDiffRow) error {
+	for _, d := range diffs {
+		switch d.ChangeType {
+		case ScoreChangeAdded:
+			upload.AddedCount++
+		case ScoreChangeRemoved:
+			upload.RemovedCount++
+		case ScoreChangeChanged:
+			upload.ChangedCount++
+		}
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"INSERT INTO score_upload (id, tenant_id, competition_id, row_count, added_count, removed_count, changed_count, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		upload.ID, upload.TenantID, upload.CompetitionID, upload.RowCount, upload.AddedCount, upload.RemovedCount, upload.ChangedCount, upload.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("error Insert score_upload: id=%s, %w", upload.ID, err)
+	}
+	for _, d := range diffs {
+		if _, err := tenantDB.ExecContext(
+			ctx,
+			"INSERT INTO score_upload_diff (upload_id, tenant_id, player_id, change_type, previous_score, score) VALUES (?, ?, ?, ?, ?, ?)",
+			d.UploadID, d.TenantID, d.PlayerID, d.ChangeType, d.PreviousScore, d.Score,
+		); err != nil {
+			return fmt.Errorf("error Insert score_upload_diff: uploadID=%s, playerID=%s, %w", d.UploadID, d.PlayerID, err)
+		}
+	}
+	return nil
+}
+
+type ScoreUploadDetail struct {
+	ID           string `json:"id"`
+	RowCount     int64  `json:"row_count"`
+	AddedCount   int64  `json:"added_count"`
+	RemovedCount int64  `json:"removed_count"`
+	ChangedCount int64  `json:"changed_count"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+func toScoreUploadDetail(u ScoreUploadRow) ScoreUploadDetail {
+	return ScoreUploadDetail{
+		ID:           u.ID,
+		RowCount:     u.RowCount,
+		AddedCount:   u.AddedCount,
+		RemovedCount: u.RemovedCount,
+		ChangedCount: u.ChangedCount,
+		CreatedAt:    u.CreatedAt,
+	}
+}
+
+type ScoreUploadsHandlerResult struct {
+	Uploads []ScoreUploadDetail `json:"uploads"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/uploads
+// 大会のスコアのアップロードの一覧を新しい順に取得する
+func competitionScoreUploadsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	uploads := []ScoreUploadRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&uploads,
+		"SELECT * FROM score_upload WHERE tenant_id = ? AND competition_id = ? ORDER BY created_at DESC, id DESC",
+		v.tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select score_upload: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+
+	res := ScoreUploadsHandlerResult{Uploads: make([]ScoreUploadDetail, 0, len(uploads))}
+	for _, u := range uploads {
+		res.Uploads = append(res.Uploads, toScoreUploadDetail(u))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type ScoreUploadDiffDetail struct {
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	ChangeType        string `json:"change_type"`
+	PreviousScore     *int64 `json:"previous_score"`
+	Score             *int64 `json:"score"`
+}
+
+type ScoreUploadHandlerResult struct {
+	Upload ScoreUploadDetail       `json:"upload"`
+	Diffs  []ScoreUploadDiffDetail `json:"diffs"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/upload/:upload_id
+// スコアのアップロードで、直前の有効なスコアから何が変わったかを取得する
+func competitionScoreUploadHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	uploadID := c.Param("upload_id")
+	var upload ScoreUploadRow
+	if err := tenantDB.GetContext(
+		ctx,
+		&upload,
+		"SELECT * FROM score_upload WHERE tenant_id = ? AND competition_id = ? AND id = ?",
+		v.tenantID, competitionID, uploadID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUploadNotFound
+		}
+		return fmt.Errorf("error Select score_upload: id=%s, %w", uploadID, err)
+	}
+
+	diffs := []ScoreUploadDiffRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&diffs,
+		"SELECT * FROM score_upload_diff WHERE tenant_id = ? AND upload_id = ? ORDER BY player_id",
+		v.tenantID, uploadID,
+	); err != nil {
+		return fmt.Errorf("error Select score_upload_diff: uploadID=%s, %w", uploadID, err)
+	}
+
+	res := ScoreUploadHandlerResult{
+		Upload: toScoreUploadDetail(upload),
+		Diffs:  make([]ScoreUploadDiffDetail, 0, len(diffs)),
+	}
+	for _, d := range diffs {
+		dd := ScoreUploadDiffDetail{
+			PlayerID:   d.PlayerID,
+			ChangeType: d.ChangeType,
+		}
+		if d.PreviousScore.Valid {
+			previous := d.PreviousScore.Int64
+			dd.PreviousScore = &previous
+		}
+		if d.Score.Valid {
+			score := d.Score.Int64
+			dd.Score = &score
+		}
+		// 削除された参加者も差分には残す
+		if p, err := retrievePlayer(ctx, tenantDB, d.PlayerID); err == nil {
+			dd.PlayerDisplayName = p.DisplayName
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		res.Diffs = append(res.Diffs, dd)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
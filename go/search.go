@@ -0,0 +1,188 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+// 大会名を検索するときに同時に読むテナントDBの数
+// 環境変数 ISUCON_SEARCH_CONCURRENCY で変更できる
+func searchConcurrency() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_SEARCH_CONCURRENCY", "8"))
+	if err != nil || n <= 0 {
+		return 8
+	}
+	return n
+}
+
+// 検索用の大会の索引
+type searchCompetition struct {
+	ID    string `db:"id"`
+	Title string `db:"title"`
+	// 大文字小文字を区別せずに検索するため小文字にしたもの
+	lowerTitle string
+}
+
+// テナントごとの大会の索引
+// 大会名は変わらないので、大会を追加したときとテナントを削除したときだけ捨てる
+var searchIndexCache = helpisu.NewCache[int64, []searchCompetition]()
+
+func retrieveSearchIndex(ctx context.Context, tenantID int64) ([]searchCompetition, error) {
+	if idx, ok := searchIndexCache.Get(tenantID); ok {
+		return idx, nil
+	}
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error connectToTenantDB: id=%d, %w", tenantID, err)
+	}
+	idx := []searchCompetition{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&idx,
+		"SELECT id, title FROM competition WHERE tenant_id = ? ORDER BY created_at DESC",
+		tenantID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	for i := range idx {
+		idx[i].lowerTitle = strings.ToLower(idx[i].Title)
+	}
+	searchIndexCache.Set(tenantID, idx)
+	return idx, nil
+}
+
+type SearchTenantDetail struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type SearchCompetitionDetail struct {
+	TenantID          string `json:"tenant_id"`
+	TenantName        string `json:"tenant_name"`
+	TenantDisplayName string `json:"tenant_display_name"`
+	ID                string `json:"id"`
+	Title             string `json:"title"`
+}
+
+type SearchHandlerResult struct {
+	Tenants      []SearchTenantDetail      `json:"tenants"`
+	Competitions []SearchCompetitionDetail `json:"competitions"`
+}
+
+// SasS管理者用API
+// GET /api/admin/search?q=
+// テナント名と表示名から部分一致で検索する
+// competitions=1 を指定すると全テナントの大会名も検索する
+// limitで種類ごとの最大件数を指定する
+func searchHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return apperr.InvalidField("q", "q is required")
+	}
+	limit := defaultSearchLimit
+	if s := c.QueryParam("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			return apperr.InvalidField("limit", "limit must be between 1 and %d", maxSearchLimit)
+		}
+		limit = n
+	}
+
+	ctx := context.Background()
+	lowerQ := strings.ToLower(q)
+	ts := []TenantRow{}
+	if err := adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id DESC"); err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+
+	res := SearchHandlerResult{
+		Tenants:      []SearchTenantDetail{},
+		Competitions: []SearchCompetitionDetail{},
+	}
+	for _, t := range ts {
+		if len(res.Tenants) >= limit {
+			break
+		}
+		if strings.Contains(strings.ToLower(t.Name), lowerQ) || strings.Contains(strings.ToLower(t.DisplayName), lowerQ) {
+			res.Tenants = append(res.Tenants, SearchTenantDetail{
+				ID:          strconv.FormatInt(t.ID, 10),
+				Name:        t.Name,
+				DisplayName: t.DisplayName,
+			})
+		}
+	}
+
+	if c.QueryParam("competitions") == "1" {
+		comps, err := searchCompetitions(ctx, ts, lowerQ)
+		if err != nil {
+			return err
+		}
+		if len(comps) > limit {
+			comps = comps[:limit]
+		}
+		res.Competitions = comps
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 全テナントの大会名を検索する
+// テナントDBは searchConcurrency 個ずつ並行して読む
+// 結果はテナントIDの降順、同じテナントの中では新しい大会から並べる
+func searchCompetitions(ctx context.Context, ts []TenantRow, lowerQ string) ([]SearchCompetitionDetail, error) {
+	found := make([][]SearchCompetitionDetail, len(ts))
+	errs := make([]error, len(ts))
+	sem := make(chan struct{}, searchConcurrency())
+	var wg sync.WaitGroup
+	for i, t := range ts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t TenantRow) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			idx, err := retrieveSearchIndex(ctx, t.ID)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, comp := range idx {
+				if strings.Contains(comp.lowerTitle, lowerQ) {
+					found[i] = append(found[i], SearchCompetitionDetail{
+						TenantID:          strconv.FormatInt(t.ID, 10),
+						TenantName:        t.Name,
+						TenantDisplayName: t.DisplayName,
+						ID:                comp.ID,
+						Title:             comp.Title,
+					})
+				}
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	comps := []SearchCompetitionDetail{}
+	for i := range ts {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("error retrieveSearchIndex: %w", errs[i])
+		}
+		comps = append(comps, found[i]...)
+	}
+	return comps, nil
+}
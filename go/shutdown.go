@@ -0,0 +1,71 @@
+package isuports
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SIGTERMを受けてから処理中のリクエストを待つ最大の時間(ミリ秒)
+// 環境変数 ISUCON_SHUTDOWN_TIMEOUT_MS で変更できる
+func shutdownTimeout() time.Duration {
+	n, err := strconv.Atoi(getEnv("ISUCON_SHUTDOWN_TIMEOUT_MS", "10000"))
+	if err != nil || n <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(n) * time.Millisecond
+}
+
+// echo以外で受け付けているサーバー goroutineモードのリスナー listener.go を参照
+var (
+	extraServers   = []*http.Server{}
+	extraServersMu sync.Mutex
+)
+
+// SIGINTかSIGTERMを受けるまで待つ
+func waitForShutdownSignal() os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	return <-sig
+}
+
+// 新しい接続の受け付けをやめ、処理中のリクエストが終わるのを待ってから、メモリ上に溜めているデータを書き出す
+// 書き出すもの
+// - visitHistoriesや閲覧履歴のジャーナルに溜めている閲覧履歴
+// - dispenseIDで予約したIDのうち使わなかった分(id_generator) id_dispenser.go を参照
+// - メモリ上に置いたテナントDB
+func gracefulShutdown(e *echo.Echo) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("error e.Shutdown: %s", err)
+	}
+	extraServersMu.Lock()
+	for _, srv := range extraServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("error http.Server.Shutdown: %s", err)
+		}
+	}
+	extraServersMu.Unlock()
+	stopGRPCServer(ctx)
+
+	delayedInsertVisitHistory()
+	closeVisitHistoryJournal()
+	releaseIDBlock()
+	if tenantDBMemoryEnabled() {
+		memoryTenantDBWriteBackJob()
+		closeMemoryTenantDBs()
+	}
+	closeTenantDBs()
+	closeTenantMySQLDB()
+	log.Printf("shutdown completed")
+}
@@ -0,0 +1,130 @@
+package isuports
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/mattn/go-sqlite3"
+	proxy "github.com/shogo82148/go-sql-proxy"
+	"go.uber.org/zap"
+)
+
+// テナントDBのスロークエリログ
+// ISUCON_SQLITE_SLOW_QUERY_LOG=1 のときだけ有効で、実行時間が閾値以上のクエリだけをログに書く
+// 全てのクエリを書くトレースファイル(ISUCON_SQLITE_TRACE_FILE)と違って常に有効にしておける
+// 閾値と有効無効は /api/admin/sql/slow_query_log で実行中に変更できる
+var (
+	// ドライバを差し替えたか 起動後には変えられない
+	slowQueryLogAvailable bool
+	// 閾値 0以下なら無効
+	slowQueryThresholdMs int64
+)
+
+func initializeSlowQueryLog() {
+	slowQueryLogAvailable = true
+	n, err := strconv.ParseInt(getEnv("ISUCON_SQLITE_SLOW_QUERY_MS", "100"), 10, 64)
+	if err != nil {
+		n = 100
+	}
+	atomic.StoreInt64(&slowQueryThresholdMs, n)
+}
+
+func logSlowQuery(stmt *proxy.Stmt, queryTime time.Duration) {
+	threshold := atomic.LoadInt64(&slowQueryThresholdMs)
+	if threshold <= 0 || queryTime < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+	appLogger.Warn("slow query",
+		zap.Int64("tenant_id", tenantIDOfStmt(stmt)),
+		zap.String("statement", normalizeSQL(stmt.QueryString)),
+		zap.Float64("query_time_ms", float64(queryTime.Microseconds())/1000),
+	)
+}
+
+// クエリを実行したテナントDBのファイル名からテナントIDを返す
+// ファイルに置いていないテナントDBなどでわからない場合は0
+func tenantIDOfStmt(stmt *proxy.Stmt) int64 {
+	if stmt.Conn == nil {
+		return 0
+	}
+	conn, ok := stmt.Conn.Conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return 0
+	}
+	name := strings.TrimSuffix(filepath.Base(conn.GetFilename("main")), ".db")
+	id, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+var (
+	sqlStringLiteralRe = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumberLiteralRe = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlInListRe        = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlValuesListRe    = regexp.MustCompile(`(?i)\bVALUES\s*\([^()]*\)(?:\s*,\s*\([^()]*\))*`)
+	sqlSpaceRe         = regexp.MustCompile(`\s+`)
+)
+
+// 同じ種類のクエリをまとめて見られるように、リテラルを?にして、INやVALUESの要素の数の違いをなくす
+func normalizeSQL(q string) string {
+	q = sqlStringLiteralRe.ReplaceAllString(q, "?")
+	q = sqlNumberLiteralRe.ReplaceAllString(q, "?")
+	q = sqlInListRe.ReplaceAllString(q, "IN (...)")
+	q = sqlValuesListRe.ReplaceAllString(q, "VALUES (...)")
+	q = sqlSpaceRe.ReplaceAllString(q, " ")
+	return strings.TrimSpace(q)
+}
+
+type SlowQueryLogDetail struct {
+	Available   bool  `json:"available"`
+	Enabled     bool  `json:"enabled"`
+	ThresholdMs int64 `json:"threshold_ms"`
+}
+
+func slowQueryLogDetail() SlowQueryLogDetail {
+	threshold := atomic.LoadInt64(&slowQueryThresholdMs)
+	return SlowQueryLogDetail{
+		Available:   slowQueryLogAvailable,
+		Enabled:     slowQueryLogAvailable && threshold > 0,
+		ThresholdMs: threshold,
+	}
+}
+
+// SasS管理者用API
+// GET /api/admin/sql/slow_query_log
+// テナントDBのスロークエリログの設定を返す
+func slowQueryLogHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: slowQueryLogDetail()})
+}
+
+// SasS管理者用API
+// POST /api/admin/sql/slow_query_log
+// テナントDBのスロークエリログの閾値を変更する threshold_ms に0を指定すると無効にする
+// プロセスのメモリ上にだけ持つので、再起動すると ISUCON_SQLITE_SLOW_QUERY_MS に戻る
+func slowQueryLogUpdateHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+	if !slowQueryLogAvailable {
+		// 起動時にドライバを差し替えていないとクエリの実行時間を測れない
+		return ErrSlowQueryLogUnavailable
+	}
+	threshold, err := strconv.ParseInt(c.FormValue("threshold_ms"), 10, 64)
+	if err != nil || threshold < 0 {
+		return apperr.InvalidField("threshold_ms", "invalid threshold_ms")
+	}
+	atomic.StoreInt64(&slowQueryThresholdMs, threshold)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: slowQueryLogDetail()})
+}
@@ -18,17 +18,25 @@ var traceLogEncoder *json.Encoder
 
 func initializeSQLLogger() (string, io.Closer, error) {
 	traceFilePath := getEnv("ISUCON_SQLITE_TRACE_FILE", "")
-	if traceFilePath == "" {
+	slowQueryLog := getEnv("ISUCON_SQLITE_SLOW_QUERY_LOG", "") == "1"
+	if traceFilePath == "" && !slowQueryLog {
 		return "sqlite3", io.NopCloser(nil), nil
 	}
 
-	traceLogFile, err := os.OpenFile(traceFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return "", nil, fmt.Errorf("cannot open ISUCON_SQLITE_TRACE_FILE: %w", err)
+	var closer io.Closer = io.NopCloser(nil)
+	if traceFilePath != "" {
+		traceLogFile, err := os.OpenFile(traceFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot open ISUCON_SQLITE_TRACE_FILE: %w", err)
+		}
+		traceLogEncoder = json.NewEncoder(traceLogFile)
+		traceLogEncoder.SetEscapeHTML(false)
+		closer = traceLogFile
+	}
+	if slowQueryLog {
+		initializeSlowQueryLog()
 	}
 
-	traceLogEncoder = json.NewEncoder(traceLogFile)
-	traceLogEncoder.SetEscapeHTML(false)
 	driverName := "sqlite3-with-trace"
 	sql.Register(driverName, proxy.NewProxyContext(&sqlite3.SQLiteDriver{}, &proxy.HooksContext{
 		PreExec:   traceLogPre,
@@ -36,7 +44,7 @@ func initializeSQLLogger() (string, io.Closer, error) {
 		PreQuery:  traceLogPre,
 		PostQuery: traceLogPostQuery,
 	}))
-	return driverName, traceLogFile, nil
+	return driverName, closer, nil
 }
 
 func traceLogPre(_ context.Context, _ *proxy.Stmt, _ []driver.NamedValue) (interface{}, error) {
@@ -52,11 +60,12 @@ type sqlTraceLog struct {
 }
 
 func traceLogPostExec(_ context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, result driver.Result, _ error) error {
+	starts := ctx.(time.Time)
+	queryTime := time.Since(starts)
 	if traceLogEncoder == nil {
+		logSlowQuery(stmt, queryTime)
 		return nil
 	}
-	starts := ctx.(time.Time)
-	queryTime := time.Since(starts)
 
 	argsValues := make([]any, 0, len(args))
 	for _, arg := range args {
@@ -81,15 +90,17 @@ func traceLogPostExec(_ context.Context, ctx interface{}, stmt *proxy.Stmt, args
 	if err := traceLogEncoder.Encode(log); err != nil {
 		return fmt.Errorf("error encode.Encode at traceLogPostExec: %w", err)
 	}
+	logSlowQuery(stmt, queryTime)
 	return nil
 }
 
 func traceLogPostQuery(_ context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, result driver.Rows, _ error) error {
+	starts := ctx.(time.Time)
+	queryTime := time.Since(starts)
 	if traceLogEncoder == nil {
+		logSlowQuery(stmt, queryTime)
 		return nil
 	}
-	starts := ctx.(time.Time)
-	queryTime := time.Since(starts)
 
 	argsValues := make([]any, 0, len(args))
 	for _, arg := range args {
@@ -105,5 +116,6 @@ func traceLogPostQuery(_ context.Context, ctx interface{}, stmt *proxy.Stmt, arg
 	if err := traceLogEncoder.Encode(log); err != nil {
 		return fmt.Errorf("error encode.Encode at traceLogPostQuery: %w", err)
 	}
+	logSlowQuery(stmt, queryTime)
 	return nil
 }
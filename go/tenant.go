@@ -12,8 +12,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	"github.com/logica0419/helpisu"
 )
 
 type CompetitionDetail struct {
@@ -35,7 +36,7 @@ func competitionsAddHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -43,35 +44,44 @@ func competitionsAddHandler(c echo.Context) error {
 		return err
 	}
 
-	title := c.FormValue("title")
+	cd, err := addCompetition(ctx, tenantDB, v.tenantID, c.FormValue("title"))
+	if err != nil {
+		return err
+	}
 
+	res := CompetitionsAddHandlerResult{
+		Competition: *cd,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 大会を追加する
+// RESTのAPIとgRPCのAPI(grpc.go)で共通の処理
+func addCompetition(ctx context.Context, tenantDB *sqlx.DB, tenantID int64, title string) (*CompetitionDetail, error) {
 	now := time.Now().Unix()
-	id, err := dispenseID(ctx)
+	id, err := dispenseTenantID(ctx, tenantID)
 	if err != nil {
-		return fmt.Errorf("error dispenseID: %w", err)
+		return nil, fmt.Errorf("error dispenseTenantID: %w", err)
 	}
 	if _, err := tenantDB.ExecContext(
 		ctx,
 		"INSERT INTO competition (id, tenant_id, title, finished_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-		id, v.tenantID, title, sql.NullInt64{}, now, now,
+		id, tenantID, title, sql.NullInt64{}, now, now,
 	); err != nil {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"error Insert competition: id=%s, tenant_id=%d, title=%s, finishedAt=null, createdAt=%d, updatedAt=%d, %w",
-			id, v.tenantID, title, now, now, err,
+			id, tenantID, title, now, now, err,
 		)
 	}
 
-	res := CompetitionsAddHandlerResult{
-		Competition: CompetitionDetail{
-			ID:         id,
-			Title:      title,
-			IsFinished: false,
-		},
-	}
-	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
-}
+	searchIndexCache.Delete(tenantID)
 
-var compFinishCache = helpisu.NewCache[int, []string]()
+	return &CompetitionDetail{
+		ID:         id,
+		Title:      title,
+		IsFinished: false,
+	}, nil
+}
 
 /// テナント管理者向けAPI
 // POST /api/organizer/competition/:competition_id/finish
@@ -82,7 +92,7 @@ func competitionFinishHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -90,15 +100,23 @@ func competitionFinishHandler(c echo.Context) error {
 		return err
 	}
 
-	id := c.Param("competition_id")
+	if err := finishCompetition(ctx, tenantDB, v.tenantID, c.Param("competition_id")); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// 大会を終了する
+// RESTのAPIとgRPCのAPI(grpc.go)で共通の処理
+func finishCompetition(ctx context.Context, tenantDB *sqlx.DB, tenantID int64, id string) error {
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+		return apperr.InvalidField("competition_id", "competition_id required")
 	}
-	_, err = retrieveCompetition(ctx, tenantDB, id)
+	comp, err := retrieveCompetition(ctx, tenantDB, id)
 	if err != nil {
 		// 存在しない大会
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+			return ErrCompetitionNotFound
 		}
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
@@ -114,31 +132,52 @@ func competitionFinishHandler(c echo.Context) error {
 			now, now, id, err,
 		)
 	}
+	competitionCache.Delete(id)
+	comp.FinishedAt = sql.NullInt64{Int64: now, Valid: true}
 
-	finish, ok := compFinishCache.Get(0)
-	if !ok {
-		finish = []string{}
+	// 終了までの閲覧履歴を請求に含めるため、溜めている閲覧履歴を書き込んでから集計する
+	delayedInsertVisitHistory()
+
+	// 請求を確定して記録する billing_receipt.go を参照
+	if err := createBillingReceipt(ctx, tenantDB, tenantID, id, now); err != nil {
+		return fmt.Errorf("error createBillingReceipt: %w", err)
+	}
+	// 課金レポートを計算して保存する 課金レポートのAPIはこれを読む billing.go を参照
+	if _, err := saveBillingReport(ctx, tenantDB, tenantID, comp); err != nil {
+		return fmt.Errorf("error saveBillingReport: %w", err)
 	}
-	compFinishCache.Set(0, append(finish, strconv.Itoa(int(v.tenantID))+id))
 
-	competitionCache.Delete(id)
-	return c.JSON(http.StatusOK, SuccessResult{Status: true})
-}
+	// 参加者ごとの最終順位の通知を作る notification.go を参照
+	enqueueNotificationDigest(tenantID, id)
 
-func updateCompetitionFinish() {
-	finish, _ := compFinishCache.GetAndDelete(0)
-	for j := range finish {
-		billingReportCache.Delete(finish[j])
-	}
+	invalidateRanking(id)
+	// 終了した大会のランキングは変わらないので、最初のページを作り置きする ranking_frozen.go を参照
+	freezeCompetitionRanking(ctx, tenantDB, tenantID, comp)
+	hooks.competitionFinished(ctx, CompetitionFinishedEvent{
+		TenantID:      tenantID,
+		CompetitionID: id,
+		FinishedAt:    now,
+	})
+	return nil
 }
 
 type ScoreHandlerResult struct {
-	Rows int64 `json:"rows"`
+	Rows     int64  `json:"rows"`
+	UploadID string `json:"upload_id"`
 }
 
+// スコアのアップロードの方式
+const (
+	// 大会のスコアを全て置き換える
+	ScoreUploadModeReplace = "replace"
+	// 今あるスコアを残し、row_numを続きから振って追加する 参加者ごとに最後の行が有効なスコアになるのは置き換えと同じ
+	ScoreUploadModeAppend = "append"
+)
+
 // テナント管理者向けAPI
 // POST /api/organizer/competition/:competition_id/score
 // 大会のスコアをCSVでアップロードする
+// クエリパラメータ mode=append で今あるスコアに追加する 省略した場合は置き換える
 func competitionScoreHandler(c echo.Context) error {
 	ctx := context.Background()
 	v, err := parseViewer(c)
@@ -146,7 +185,7 @@ func competitionScoreHandler(c echo.Context) error {
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
 	if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -155,23 +194,18 @@ func competitionScoreHandler(c echo.Context) error {
 	}
 
 	competitionID := c.Param("competition_id")
-	if competitionID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
-	}
-	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
-	if err != nil {
-		// 存在しない大会
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
-		}
-		return fmt.Errorf("error retrieveCompetition: %w", err)
+	if err := checkCompetitionOpen(ctx, tenantDB, competitionID); err != nil {
+		return err
 	}
-	if comp.FinishedAt.Valid {
-		res := FailureResult{
-			Status:  false,
-			Message: "competition is finished",
-		}
-		return c.JSON(http.StatusBadRequest, res)
+	mode := c.QueryParam("mode")
+	switch mode {
+	case "":
+		mode = ScoreUploadModeReplace
+	case ScoreUploadModeReplace, ScoreUploadModeAppend:
+	default:
+		return apperr.Validation(
+			"query parameter 'mode' must be replace or append",
+		).WithCode(ErrInvalidQuery.Code)
 	}
 
 	fh, err := c.FormFile("scores")
@@ -190,19 +224,11 @@ func competitionScoreHandler(c echo.Context) error {
 		return fmt.Errorf("error r.Read at header: %w", err)
 	}
 	if !reflect.DeepEqual(headers, []string{"player_id", "score"}) {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid CSV headers")
+		return ErrInvalidCSVHeader
 	}
 
-	// / DELETEしたタイミングで参照が来ると空っぽのランキングになるのでロックする
-	fl, err := flockByTenantID(v.tenantID)
-	if err != nil {
-		return fmt.Errorf("error flockByTenantID: %w", err)
-	}
-	defer fl.Close()
-	var rowNum int64
-	playerScoreRows := []PlayerScoreRow{}
+	records := []scoreRecord{}
 	for {
-		rowNum++
 		row, err := r.Read()
 		if err != nil {
 			if err == io.EOF {
@@ -213,32 +239,97 @@ func competitionScoreHandler(c echo.Context) error {
 		if len(row) != 2 {
 			return fmt.Errorf("row must have two columns: %#v", row)
 		}
-		playerID, scoreStr := row[0], row[1]
+		records = append(records, scoreRecord{PlayerID: row[0], Score: row[1]})
+	}
+
+	res, err := uploadScores(c.Request().Context(), tenantDB, v.tenantID, competitionID, records, mode)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// スコアを受け付けられる大会か 存在しない大会と終了した大会はエラーにする
+func checkCompetitionOpen(ctx context.Context, tenantDB dbOrTx, competitionID string) error {
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if comp.FinishedAt.Valid {
+		return ErrCompetitionFinished
+	}
+	return nil
+}
+
+// CSVの1行分のスコア
+type scoreRecord struct {
+	PlayerID string
+	Score    string
+}
+
+// 大会のスコアを置き換える modeがappendの場合は今あるスコアに追加する
+// CSVのアップロードと外部の形式からの取り込み(score_import.go)で共通の処理
+// lockCtxはロックを待つ間だけ使う flockByTenantID を参照
+func uploadScores(lockCtx context.Context, tenantDB *sqlx.DB, tenantID int64, competitionID string, records []scoreRecord, mode string) (*ScoreHandlerResult, error) {
+	ctx := context.Background()
+
+	// / DELETEしたタイミングで参照が来ると空っぽのランキングになるのでロックする
+	fl, err := flockByTenantID(lockCtx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	// 差分を残すために置き換える前のスコアを読んでおく
+	prevScoreRows := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&prevScoreRows,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num ASC",
+		tenantID,
+		competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+
+	var rowNum int64
+	if mode == ScoreUploadModeAppend && len(prevScoreRows) > 0 {
+		rowNum = prevScoreRows[len(prevScoreRows)-1].RowNum
+	}
+	playerScoreRows := []PlayerScoreRow{}
+	for _, rec := range records {
+		rowNum++
+		playerID, scoreStr := rec.PlayerID, rec.Score
 		if _, err := retrievePlayer(ctx, tenantDB, playerID); err != nil {
 			// 存在しない参加者が含まれている
 			if errors.Is(err, sql.ErrNoRows) {
-				return echo.NewHTTPError(
-					http.StatusBadRequest,
-					fmt.Sprintf("player not found: %s", playerID),
-				)
+				return nil, apperr.Validation(
+					"player not found: %s", playerID,
+				).WithCode(ErrPlayerNotFound.Code)
 			}
-			return fmt.Errorf("error retrievePlayer: %w", err)
+			return nil, fmt.Errorf("error retrievePlayer: %w", err)
 		}
 		var score int64
 		if score, err = strconv.ParseInt(scoreStr, 10, 64); err != nil {
-			return echo.NewHTTPError(
-				http.StatusBadRequest,
-				fmt.Sprintf("error strconv.ParseUint: scoreStr=%s, %s", scoreStr, err),
-			)
+			return nil, apperr.Validation(
+				"error strconv.ParseUint: scoreStr=%s, %s", scoreStr, err,
+			).WithCode(ErrInvalidCSVRow.Code)
 		}
-		id, err := dispenseID(ctx)
+		id, err := dispenseTenantID(ctx, tenantID)
 		if err != nil {
-			return fmt.Errorf("error dispenseID: %w", err)
+			return nil, fmt.Errorf("error dispenseTenantID: %w", err)
 		}
 		now := time.Now().Unix()
 		playerScoreRows = append(playerScoreRows, PlayerScoreRow{
 			ID:            id,
-			TenantID:      v.tenantID,
+			TenantID:      tenantID,
 			PlayerID:      playerID,
 			CompetitionID: competitionID,
 			Score:         score,
@@ -248,13 +339,17 @@ func competitionScoreHandler(c echo.Context) error {
 		})
 	}
 
-	if _, err := tenantDB.ExecContext(
+	// アップロードの後の大会の全てのスコア row_numの昇順
+	scoreRows := playerScoreRows
+	if mode == ScoreUploadModeAppend {
+		scoreRows = append(append(make([]PlayerScoreRow, 0, len(prevScoreRows)+len(playerScoreRows)), prevScoreRows...), playerScoreRows...)
+	} else if _, err := tenantDB.ExecContext(
 		ctx,
 		"DELETE FROM player_score WHERE tenant_id = ? AND competition_id = ?",
-		v.tenantID,
+		tenantID,
 		competitionID,
 	); err != nil {
-		return fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+		return nil, fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
 	}
 
 	_, err = tenantDB.NamedExecContext(
@@ -263,26 +358,68 @@ func competitionScoreHandler(c echo.Context) error {
 		playerScoreRows,
 	)
 	if err != nil {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"error Insert player_score: %w",
 			err,
 		)
 
 	}
-
-	return c.JSON(http.StatusOK, SuccessResult{
-		Status: true,
-		Data:   ScoreHandlerResult{Rows: int64(len(playerScoreRows))},
+	// 再アップロードで消えないように履歴にも残す
+	if _, err := tenantDB.NamedExecContext(
+		ctx,
+		"INSERT INTO player_score_history (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at) VALUES (:id, :tenant_id, :player_id, :competition_id, :score, :row_num, :created_at, :updated_at)",
+		playerScoreRows,
+	); err != nil {
+		return nil, fmt.Errorf("error Insert player_score_history: %w", err)
+	}
+	uploadID, err := dispenseTenantID(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error dispenseTenantID: %w", err)
+	}
+	if err := insertScoreUpload(
+		ctx,
+		tenantDB,
+		ScoreUploadRow{
+			ID:            uploadID,
+			TenantID:      tenantID,
+			CompetitionID: competitionID,
+			RowCount:      int64(len(playerScoreRows)),
+			CreatedAt:     time.Now().Unix(),
+		},
+		diffEffectiveScores(uploadID, tenantID, effectiveScores(prevScoreRows), effectiveScores(scoreRows)),
+	); err != nil {
+		return nil, fmt.Errorf("error insertScoreUpload: %w", err)
+	}
+	invalidateRanking(competitionID)
+	// ロックを取っている間にランキングを作り直し、ランキングのAPIではplayer_scoreを読まないようにする
+	ranks, err := rebuildMaterializedRanking(ctx, tenantDB, competitionID, scoreRows)
+	if err != nil {
+		return nil, fmt.Errorf("error rebuildMaterializedRanking: %w", err)
+	}
+	// 順位の変化を返せるようにスナップショットを残す ranking_snapshot.go を参照
+	if err := saveRankingSnapshot(ctx, tenantDB, tenantID, competitionID, uploadID, ranks, time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("error saveRankingSnapshot: %w", err)
+	}
+	invalidateBillingInputs(tenantID, competitionID)
+	hooks.scoreUploaded(ctx, ScoreUploadedEvent{
+		TenantID:      tenantID,
+		CompetitionID: competitionID,
+		Rows:          int64(len(playerScoreRows)),
 	})
+
+	return &ScoreHandlerResult{Rows: int64(len(playerScoreRows)), UploadID: uploadID}, nil
 }
 
 type BillingHandlerResult struct {
-	Reports []BillingReport `json:"reports"`
+	Reports []BillingReportDetail `json:"reports"`
 }
 
 // テナント管理者向けAPI
 // GET /api/organizer/billing
 // テナント内の課金レポートを取得する
+// fields=counts で参加者数だけ、fields=yen で請求金額だけを返す
+// locale=ja-JP などを指定すると請求金額を整形した文字列も返す
+// from, to(unix秒)を指定すると終了日時がその範囲の大会だけを返す
 func billingHandler(c echo.Context) error {
 	ctx := context.Background()
 	v, err := parseViewer(c)
@@ -290,7 +427,15 @@ func billingHandler(c echo.Context) error {
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
 	if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
+	}
+	opts, err := parseBillingReportOptions(c.QueryParam("fields"), c.QueryParam("locale"))
+	if err != nil {
+		return err
+	}
+	period, err := parseBillingPeriod(c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return err
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -298,29 +443,367 @@ func billingHandler(c echo.Context) error {
 		return err
 	}
 
+	reports, err := tenantBillingReports(ctx, tenantDB, v.tenantID, period)
+	if err != nil {
+		return err
+	}
+	tbrs := make([]BillingReportDetail, 0, len(reports))
+	for _, report := range reports {
+		tbrs = append(tbrs, report.Detail(opts))
+	}
+
+	res := SuccessResult{
+		Status: true,
+		Data: BillingHandlerResult{
+			Reports: tbrs,
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// テナントの大会ごとの課金レポートを大会の作成日時の降順で返す
+// RESTのAPIとCSVのエクスポート(billing_export.go)で共通の処理
+func tenantBillingReports(ctx context.Context, tenantDB dbOrTx, tenantID int64, period BillingPeriod) ([]*BillingReport, error) {
+	cond, args := period.condition()
 	cs := []CompetitionRow{}
 	if err := tenantDB.SelectContext(
 		ctx,
 		&cs,
-		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
-		v.tenantID,
+		"SELECT * FROM competition WHERE tenant_id=?"+cond+" ORDER BY created_at DESC",
+		append([]any{tenantID}, args...)...,
 	); err != nil {
-		return fmt.Errorf("error Select competition: %w", err)
+		return nil, fmt.Errorf("error Select competition: %w", err)
 	}
-	tbrs := make([]BillingReport, 0, len(cs))
+	reports := make([]*BillingReport, 0, len(cs))
 	for _, comp := range cs {
-		report, err := billingReportByCompetition(ctx, tenantDB, v.tenantID, comp.ID)
+		report, err := billingReportByCompetition(ctx, tenantDB, tenantID, comp.ID)
 		if err != nil {
-			return fmt.Errorf("error billingReportByCompetition: %w", err)
+			return nil, fmt.Errorf("error billingReportByCompetition: %w", err)
 		}
-		tbrs = append(tbrs, *report)
+		reports = append(reports, report)
 	}
+	return reports, nil
+}
 
-	res := SuccessResult{
-		Status: true,
-		Data: BillingHandlerResult{
-			Reports: tbrs,
-		},
+type VisitorBucket struct {
+	Start              int64 `json:"start"`               // バケットの開始時刻(unix秒)
+	Visits             int64 `json:"visits"`              // バケット内でランキングを閲覧した回数
+	UniqueVisitors     int64 `json:"unique_visitors"`     // バケット内でランキングを閲覧した参加者数
+	NewVisitors        int64 `json:"new_visitors"`        // バケット内で初めてランキングを閲覧した参加者数
+	CumulativeVisitors int64 `json:"cumulative_visitors"` // バケットの終わりまでにランキングを閲覧した参加者数
+}
+
+type CompetitionVisitorsHandlerResult struct {
+	CompetitionID  string          `json:"competition_id"`
+	Interval       int64           `json:"interval"`
+	UniqueVisitors int64           `json:"unique_visitors"`
+	Buckets        []VisitorBucket `json:"buckets"`
+}
+
+// 閲覧数を集計する時間の幅(秒)
+const (
+	defaultVisitorsInterval = 60 * 60
+	minVisitorsInterval     = 60
+)
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/visitors
+// 大会のランキングを閲覧したユニークな参加者数の推移を取得する
+// URL引数intervalで集計する時間の幅を秒で指定できる
+func competitionVisitorsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
 	}
-	return c.JSON(http.StatusOK, res)
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	interval, err := parseVisitorsInterval(c)
+	if err != nil {
+		return err
+	}
+	buckets, err := selectVisitorBuckets(ctx, v.tenantID, competitionID, interval)
+	if err != nil {
+		return err
+	}
+
+	res := CompetitionVisitorsHandlerResult{
+		CompetitionID: competitionID,
+		Interval:      interval,
+		Buckets:       buckets,
+	}
+	if len(buckets) > 0 {
+		res.UniqueVisitors = buckets[len(buckets)-1].CumulativeVisitors
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// URL引数intervalを読む 省略した場合はdefaultVisitorsInterval
+func parseVisitorsInterval(c echo.Context) (int64, error) {
+	s := c.QueryParam("interval")
+	if s == "" {
+		return defaultVisitorsInterval, nil
+	}
+	interval, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || interval < minVisitorsInterval {
+		return 0, apperr.Validation(
+			"query parameter 'interval' must be an integer >= %d", minVisitorsInterval,
+		).WithCode(ErrInvalidQuery.Code)
+	}
+	return interval, nil
+}
+
+// 大会のランキングの閲覧をintervalごとに集計する 閲覧のあったバケットだけを開始時刻の昇順で返す
+// visitorsとanalyticsのAPIで共通の処理
+// 結果は保存もキャッシュもしない集計なので、レプリカに送る
+func selectVisitorBuckets(ctx context.Context, tenantID int64, competitionID string, interval int64) ([]VisitorBucket, error) {
+	type uniqueRow struct {
+		Bucket int64 `db:"bucket"`
+		Count  int64 `db:"cnt"`
+		Visits int64 `db:"visits"`
+	}
+	db := adminReadDB()
+	uniques := []uniqueRow{}
+	if err := db.SelectContext(
+		ctx,
+		&uniques,
+		"SELECT FLOOR(created_at / ?) * ? AS bucket, COUNT(DISTINCT player_id) AS cnt, COUNT(*) AS visits FROM visit_history "+
+			"WHERE tenant_id = ? AND competition_id = ? GROUP BY bucket ORDER BY bucket",
+		interval, interval, tenantID, competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	firsts := []uniqueRow{}
+	if err := db.SelectContext(
+		ctx,
+		&firsts,
+		"SELECT FLOOR(min_created_at / ?) * ? AS bucket, COUNT(*) AS cnt FROM "+
+			"(SELECT MIN(created_at) AS min_created_at FROM visit_history WHERE tenant_id = ? AND competition_id = ? GROUP BY player_id) AS v "+
+			"GROUP BY bucket ORDER BY bucket",
+		interval, interval, tenantID, competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select visit_history summary: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	newVisitors := make(map[int64]int64, len(firsts))
+	for _, f := range firsts {
+		newVisitors[f.Bucket] = f.Count
+	}
+
+	buckets := make([]VisitorBucket, 0, len(uniques))
+	var cumulative int64
+	for _, u := range uniques {
+		cumulative += newVisitors[u.Bucket]
+		buckets = append(buckets, VisitorBucket{
+			Start:              u.Bucket,
+			Visits:             u.Visits,
+			UniqueVisitors:     u.Count,
+			NewVisitors:        newVisitors[u.Bucket],
+			CumulativeVisitors: cumulative,
+		})
+	}
+	return buckets, nil
+}
+
+type CompetitionAnalyticsHandlerResult struct {
+	CompetitionID  string          `json:"competition_id"`
+	Interval       int64           `json:"interval"`
+	UniqueVisitors int64           `json:"unique_visitors"` // ランキングを閲覧した参加者数
+	TotalVisits    int64           `json:"total_visits"`    // ランキングを閲覧した回数
+	Scorers        int64           `json:"scorers"`         // スコアを登録した参加者数
+	ScoredVisitors int64           `json:"scored_visitors"` // ランキングを閲覧した参加者のうちスコアを登録した参加者数
+	ConversionRate float64         `json:"conversion_rate"` // scored_visitors / unique_visitors 閲覧者がいなければ0
+	Buckets        []VisitorBucket `json:"buckets"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/analytics
+// 大会のランキングの閲覧者数、閲覧数の推移、閲覧した参加者のうちスコアを登録した割合を取得する
+// URL引数intervalはvisitorsと同じ
+func competitionAnalyticsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	interval, err := parseVisitorsInterval(c)
+	if err != nil {
+		return err
+	}
+	buckets, err := selectVisitorBuckets(ctx, v.tenantID, competitionID, interval)
+	if err != nil {
+		return err
+	}
+
+	visitors := []string{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&visitors,
+		"SELECT DISTINCT player_id FROM visit_history WHERE tenant_id = ? AND competition_id = ?",
+		v.tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+	scorers := []string{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&scorers,
+		"SELECT DISTINCT player_id FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		v.tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+	scored := make(map[string]struct{}, len(scorers))
+	for _, id := range scorers {
+		scored[id] = struct{}{}
+	}
+
+	res := CompetitionAnalyticsHandlerResult{
+		CompetitionID:  competitionID,
+		Interval:       interval,
+		UniqueVisitors: int64(len(visitors)),
+		Scorers:        int64(len(scorers)),
+		Buckets:        buckets,
+	}
+	for _, b := range buckets {
+		res.TotalVisits += b.Visits
+	}
+	for _, id := range visitors {
+		if _, ok := scored[id]; ok {
+			res.ScoredVisitors++
+		}
+	}
+	if res.UniqueVisitors > 0 {
+		res.ConversionRate = float64(res.ScoredVisitors) / float64(res.UniqueVisitors)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type CompetitionVisit struct {
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	FirstVisitedAt    int64  `json:"first_visited_at"`
+	LastVisitedAt     int64  `json:"last_visited_at"`
+	VisitCount        int64  `json:"visit_count"`
+}
+
+type CompetitionVisitsHandlerResult struct {
+	CompetitionID string             `json:"competition_id"`
+	Visits        []CompetitionVisit `json:"visits"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/visits
+// 大会のランキングを閲覧した参加者と、最初と最後に閲覧した日時を取得する
+// 最初に閲覧した日時の昇順
+func competitionVisitsHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return apperr.InvalidField("competition_id", "competition_id required")
+	}
+	if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCompetitionNotFound
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	type visitRow struct {
+		PlayerID       string `db:"player_id"`
+		FirstVisitedAt int64  `db:"first_visited_at"`
+		LastVisitedAt  int64  `db:"last_visited_at"`
+		VisitCount     int64  `db:"visit_count"`
+	}
+	rows := []visitRow{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&rows,
+		"SELECT player_id, MIN(created_at) AS first_visited_at, MAX(created_at) AS last_visited_at, COUNT(*) AS visit_count "+
+			"FROM visit_history WHERE tenant_id = ? AND competition_id = ? GROUP BY player_id ORDER BY first_visited_at ASC, player_id ASC",
+		v.tenantID, competitionID,
+	); err != nil {
+		return fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	}
+
+	visits := make([]CompetitionVisit, 0, len(rows))
+	for _, r := range rows {
+		p, err := retrievePlayer(ctx, tenantDB, r.PlayerID)
+		if err != nil {
+			// 削除された参加者は含めない
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		if p.DeletedAt.Valid {
+			continue
+		}
+		visits = append(visits, CompetitionVisit{
+			PlayerID:          r.PlayerID,
+			PlayerDisplayName: p.DisplayName,
+			FirstVisitedAt:    r.FirstVisitedAt,
+			LastVisitedAt:     r.LastVisitedAt,
+			VisitCount:        r.VisitCount,
+		})
+	}
+
+	res := CompetitionVisitsHandlerResult{
+		CompetitionID: competitionID,
+		Visits:        visits,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
@@ -0,0 +1,207 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// テナントDBをメモリ上に置くか
+// 環境変数 ISUCON_TENANT_DB_MEMORY=1 で有効になる
+// SQLiteのディスクI/Oがレイテンシにどれだけ影響しているかを測るためのモード
+// ファイルの内容は最初に接続したときにメモリに読み込み、定期的にファイルに書き戻す
+func tenantDBMemoryEnabled() bool {
+	return getEnv("ISUCON_TENANT_DB_MEMORY", "0") == "1"
+}
+
+// ファイルに書き戻す間隔(ミリ秒)
+func tenantDBMemoryWriteBackIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_MEMORY_WRITEBACK_MS", "10000"))
+	if err != nil || n <= 0 {
+		return 10000
+	}
+	return n
+}
+
+// テナントごとのメモリ上のDBの名前
+// file::memory:?cache=shared だと全テナントで同じDBになってしまうので名前を付ける
+func memoryTenantDBDSN(id int64) string {
+	return fmt.Sprintf("file:isuports_tenant_%d?mode=memory&cache=shared", id)
+}
+
+// メモリ上のDBは全ての接続が閉じると消えるので、テナントごとに接続を1つ保持しておく
+type memoryTenantDBAnchor struct {
+	db   *sqlx.DB
+	conn *sql.Conn
+}
+
+var (
+	memoryTenantDBs  = map[int64]memoryTenantDBAnchor{}
+	memoryTenantDBMu sync.Mutex
+)
+
+// メモリ上のテナントDBに接続する
+// まだメモリに読み込んでいない場合はファイルから読み込む
+func connectToMemoryTenantDB(id int64) (*sqlx.DB, error) {
+	memoryTenantDBMu.Lock()
+	defer memoryTenantDBMu.Unlock()
+
+	if db, ok := tenantDBCache.Get(id); ok {
+		return db, nil
+	}
+
+	ctx := context.Background()
+	if _, ok := memoryTenantDBs[id]; !ok {
+		anchorDB, err := sqlx.Open(sqliteDriverName, memoryTenantDBDSN(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open memory tenant DB: %w", err)
+		}
+		anchor, err := anchorDB.Conn(ctx)
+		if err != nil {
+			anchorDB.Close()
+			return nil, fmt.Errorf("error anchorDB.Conn: %w", err)
+		}
+		if err := loadMemoryTenantDB(ctx, anchor, tenantDBPath(id)); err != nil {
+			anchor.Close()
+			anchorDB.Close()
+			return nil, fmt.Errorf("error loadMemoryTenantDB: id=%d, %w", id, err)
+		}
+		memoryTenantDBs[id] = memoryTenantDBAnchor{db: anchorDB, conn: anchor}
+	}
+
+	db, err := sqlx.Open(sqliteDriverName, memoryTenantDBDSN(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open memory tenant DB: %w", err)
+	}
+	migrateTenantDBOrLog(ctx, id, db)
+	verifyTenantSchema(ctx, id, db)
+	tenantDBCache.Set(id, db)
+	return db, nil
+}
+
+// ファイルのテナントDBの内容をメモリ上のDBにコピーする
+func loadMemoryTenantDB(ctx context.Context, conn *sql.Conn, p string) error {
+	if _, err := os.Stat(p); err != nil {
+		return fmt.Errorf("error os.Stat: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS disk", p); err != nil {
+		return fmt.Errorf("error ATTACH DATABASE: %w", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE disk")
+
+	type schemaRow struct {
+		Type string
+		Name string
+		SQL  string
+	}
+	rows, err := conn.QueryContext(
+		ctx,
+		"SELECT type, name, sql FROM disk.sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY type = 'index'",
+	)
+	if err != nil {
+		return fmt.Errorf("error Select sqlite_master: %w", err)
+	}
+	schema := []schemaRow{}
+	for rows.Next() {
+		var r schemaRow
+		if err := rows.Scan(&r.Type, &r.Name, &r.SQL); err != nil {
+			rows.Close()
+			return fmt.Errorf("error Scan sqlite_master: %w", err)
+		}
+		schema = append(schema, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error rows.Err: %w", err)
+	}
+
+	// テーブルを作ってデータをコピーしてから、インデックスを作る
+	for _, r := range schema {
+		if _, err := conn.ExecContext(ctx, r.SQL); err != nil {
+			return fmt.Errorf("error create %s %s: %w", r.Type, r.Name, err)
+		}
+		if r.Type != "table" {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(`INSERT INTO main."%s" SELECT * FROM disk."%s"`, r.Name, r.Name)); err != nil {
+			return fmt.Errorf("error copy table %s: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// メモリ上のテナントDBの内容をファイルに書き戻す
+// 書き込みと重ならないようにテナントのロックを取り、一時ファイルに書き出してから置き換える
+func writeBackMemoryTenantDB(ctx context.Context, id int64, conn *sql.Conn) error {
+	fl, err := flockByTenantID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	p := tenantDBPath(id)
+	tmp := p + ".writeback"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error os.Remove: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		return fmt.Errorf("error VACUUM INTO: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("error os.Rename: %w", err)
+	}
+	return nil
+}
+
+// メモリ上の全てのテナントDBをファイルに書き戻す
+func memoryTenantDBWriteBackJob() {
+	ctx := context.Background()
+	// テナントのロックを取ってからconnectToTenantDBを呼ぶ処理があるので、
+	// memoryTenantDBMuを持ったままロックを取らない
+	memoryTenantDBMu.Lock()
+	anchors := make(map[int64]memoryTenantDBAnchor, len(memoryTenantDBs))
+	for id, a := range memoryTenantDBs {
+		anchors[id] = a
+	}
+	memoryTenantDBMu.Unlock()
+
+	for id, a := range anchors {
+		if err := writeBackMemoryTenantDB(ctx, id, a.conn); err != nil {
+			log.Printf("error writeBackMemoryTenantDB: id=%d, %s", id, err)
+		}
+	}
+}
+
+// メモリ上のテナントDBを捨てる
+// 書き戻しはしないので、必要な場合は先にmemoryTenantDBWriteBackJobを呼ぶ
+func closeMemoryTenantDB(id int64) {
+	memoryTenantDBMu.Lock()
+	defer memoryTenantDBMu.Unlock()
+	closeMemoryTenantDBLocked(id)
+}
+
+func closeMemoryTenantDBLocked(id int64) {
+	if db, ok := tenantDBCache.GetAndDelete(id); ok {
+		db.Close()
+	}
+	if a, ok := memoryTenantDBs[id]; ok {
+		a.conn.Close()
+		a.db.Close()
+		delete(memoryTenantDBs, id)
+	}
+}
+
+// メモリ上の全てのテナントDBを捨てる
+func closeMemoryTenantDBs() {
+	memoryTenantDBMu.Lock()
+	defer memoryTenantDBMu.Unlock()
+	for id := range memoryTenantDBs {
+		closeMemoryTenantDBLocked(id)
+	}
+}
@@ -0,0 +1,170 @@
+package isuports
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/logica0419/helpisu"
+)
+
+// テナントDBの接続の管理
+// テナントDBの接続はtenantDBCacheに置いたまま閉じないので、テナントが多いとファイルハンドルを使い切る
+// 接続ごとのコネクションプールの大きさを制限し、しばらく使われていないテナントの接続を古い順に閉じる
+// 閉じたテナントは次にconnectToTenantDBを呼んだときに開き直す
+// テナントの温度による管理(tenant_tier.go)と違い、キャッシュは捨てずに接続だけを閉じる
+
+// 1つのテナントDBで同時に開く接続の上限 0なら制限しない
+// 環境変数 ISUCON_TENANT_DB_MAX_OPEN_CONNS で変更できる
+func tenantDBMaxOpenConns() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_MAX_OPEN_CONNS", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// 1つのテナントDBで使わずに残しておく接続の数
+// 環境変数 ISUCON_TENANT_DB_MAX_IDLE_CONNS で変更できる database/sqlの既定と同じ2
+func tenantDBMaxIdleConns() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_MAX_IDLE_CONNS", "2"))
+	if err != nil || n < 0 {
+		return 2
+	}
+	return n
+}
+
+// 使っていない接続を閉じるまでの時間(ミリ秒) 0なら閉じない
+// 環境変数 ISUCON_TENANT_DB_CONN_MAX_IDLE_MS で変更できる
+func tenantDBConnMaxIdleMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_CONN_MAX_IDLE_MS", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// この秒数使われていないテナントDBを閉じる 0なら時間では閉じない
+// 環境変数 ISUCON_TENANT_DB_IDLE_EVICT_SECONDS で変更できる
+func tenantDBIdleEvictSeconds() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_TENANT_DB_IDLE_EVICT_SECONDS", "0"), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// 開いたままにしておくテナントDBの数の上限 超えた分は最後に使われたのが古い順に閉じる 0なら制限しない
+// 環境変数 ISUCON_TENANT_DB_MAX_CACHED で変更できる
+func tenantDBMaxCached() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_MAX_CACHED", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// テナントDBを閉じるかを判定する間隔(ミリ秒)
+// 環境変数 ISUCON_TENANT_DB_EVICT_INTERVAL_MS で変更できる
+func tenantDBEvictIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_EVICT_INTERVAL_MS", "60000"))
+	if err != nil || n <= 0 {
+		return 60000
+	}
+	return n
+}
+
+// キャッシュから外したテナントDBの接続を閉じるまでの時間(ミリ秒)
+// 環境変数 ISUCON_TENANT_DB_CLOSE_GRACE_MS で変更できる
+func tenantDBCloseGraceMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_CLOSE_GRACE_MS", "30000"))
+	if err != nil || n < 0 {
+		return 30000
+	}
+	return n
+}
+
+func tenantDBEvictionEnabled() bool {
+	return tenantDBIdleEvictSeconds() > 0 || tenantDBMaxCached() > 0
+}
+
+// 開いたテナントDBの接続にコネクションプールの設定をする
+func configureTenantDBPool(db *sqlx.DB) {
+	db.SetMaxOpenConns(tenantDBMaxOpenConns())
+	db.SetMaxIdleConns(tenantDBMaxIdleConns())
+	db.SetConnMaxIdleTime(time.Duration(tenantDBConnMaxIdleMs()) * time.Millisecond)
+}
+
+// テナントDBを最後に使った日時(unix秒)
+var tenantDBLastUsedCache = helpisu.NewCache[int64, *int64]()
+
+// テナントDBを使ったことを記録する connectToTenantDBから呼ぶ
+func touchTenantDB(id int64) {
+	now := time.Now().Unix()
+	if p, ok := tenantDBLastUsedCache.Get(id); ok {
+		if atomic.LoadInt64(p) != now {
+			atomic.StoreInt64(p, now)
+		}
+		return
+	}
+	tenantDBLastUsedCache.Set(id, &now)
+}
+
+// 使われていないテナントDBの接続を閉じる
+func tenantDBEvictJob() {
+	// インメモリのテナントDBは閉じるとデータが消えるので、書き戻しをするtenant_tier.goに任せる
+	if tenantDBMemoryEnabled() {
+		return
+	}
+	type entry struct {
+		id       int64
+		lastUsed int64
+	}
+	entries := []entry{}
+	cacheRange(tenantDBCache, func(id int64, _ *sqlx.DB) bool {
+		var lastUsed int64
+		if p, ok := tenantDBLastUsedCache.Get(id); ok {
+			lastUsed = atomic.LoadInt64(p)
+		}
+		entries = append(entries, entry{id: id, lastUsed: lastUsed})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed < entries[j].lastUsed })
+
+	idle, max := tenantDBIdleEvictSeconds(), tenantDBMaxCached()
+	now := time.Now().Unix()
+	remaining := len(entries)
+	for _, e := range entries {
+		overCapacity := max > 0 && remaining > max
+		expired := idle > 0 && now-e.lastUsed >= idle
+		if !overCapacity && !expired {
+			// 最後に使われたのが古い順に並んでいるので、これより後は閉じない
+			break
+		}
+		evictTenantDB(e.id)
+		remaining--
+	}
+}
+
+// テナントDBをキャッシュから外し、しばらくしてから接続を閉じる
+func evictTenantDB(id int64) {
+	if db, ok := tenantDBCache.GetAndDelete(id); ok {
+		retireTenantDB(id, db)
+	}
+}
+
+// キャッシュから外したテナントDBの接続を閉じる
+// connectToTenantDBで受け取った接続はテナントのロックを取らずに使われていることがあるので、すぐには閉じない
+// 使っているリクエストが終わるのを待つため、tenantDBCloseGraceMsだけ待ってから閉じる
+// 外した後にconnectToTenantDBが呼ばれた場合は新しく開いた接続を使うので、古い接続はそれ以上使われない
+func retireTenantDB(id int64, db *sqlx.DB) {
+	tenantDBLastUsedCache.Delete(id)
+	time.AfterFunc(time.Duration(tenantDBCloseGraceMs())*time.Millisecond, func() {
+		if err := db.Close(); err != nil {
+			log.Printf("error close tenant DB: tenantID=%d, %s", id, err)
+		}
+	})
+}
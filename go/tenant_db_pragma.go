@@ -0,0 +1,62 @@
+package isuports
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// テナントDBのSQLiteの設定
+// 接続ごとにPRAGMAを実行しなくて済むように、go-sqlite3のDSNのパラメータで指定する
+// テナントDBの接続は全てtenantDBDSNで開くので、キャッシュしている接続は全て同じ設定になる
+
+// ジャーナルモード
+// 環境変数 ISUCON_TENANT_DB_JOURNAL_MODE で DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF のどれかを指定する
+// 未設定の場合、ISUCON_TENANT_DB_WAL=1 ならWAL、そうでなければSQLiteの既定(DELETE)
+// WALにすると、スコアのアップロードで書き込んでいる間もランキングを読める
+func tenantDBJournalMode() string {
+	switch m := strings.ToUpper(getEnv("ISUCON_TENANT_DB_JOURNAL_MODE", "")); m {
+	case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+		return m
+	}
+	if getEnv("ISUCON_TENANT_DB_WAL", "0") == "1" {
+		return "WAL"
+	}
+	return ""
+}
+
+// ロックが取れないときに待つミリ秒
+// 環境変数 ISUCON_TENANT_DB_BUSY_TIMEOUT_MS で変更できる
+func tenantDBBusyTimeoutMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_BUSY_TIMEOUT_MS", "5000"))
+	if err != nil || n < 0 {
+		return 5000
+	}
+	return n
+}
+
+// 書き込みの同期のレベル
+// 環境変数 ISUCON_TENANT_DB_SYNCHRONOUS で OFF, NORMAL, FULL, EXTRA のどれかを指定する 未設定ならSQLiteの既定
+// WALの場合はNORMALにしてもDBは壊れないが、OSごと落ちると直前の書き込みが失われることがある
+func tenantDBSynchronous() string {
+	switch s := strings.ToUpper(getEnv("ISUCON_TENANT_DB_SYNCHRONOUS", "")); s {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+		return s
+	}
+	return ""
+}
+
+// テナントDBに接続するときのDSN
+func tenantDBDSN(p string) string {
+	q := url.Values{}
+	q.Set("mode", "rw")
+	if m := tenantDBJournalMode(); m != "" {
+		q.Set("_journal_mode", m)
+	}
+	q.Set("_busy_timeout", strconv.Itoa(tenantDBBusyTimeoutMs()))
+	if s := tenantDBSynchronous(); s != "" {
+		q.Set("_synchronous", s)
+	}
+	return fmt.Sprintf("file:%s?%s", p, q.Encode())
+}
@@ -0,0 +1,345 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// テナントDBのウォームスタンバイ
+// ISUCON_TENANT_DB_STANDBY_DIR を設定すると、テナントDBのファイルを定期的にオンラインバックアップ(VACUUM INTO)でコピーする
+// 別ホストに置く場合は、そのホストのディレクトリをマウントして指定する
+// コピーは整合性チェックと行数の照合をしてから置き換えるので、スタンバイには検証済みのコピーだけが残る
+// フェイルオーバーすると、そのテナントはスタンバイのファイルに接続するようになる
+func tenantDBStandbyDir() string {
+	return getEnv("ISUCON_TENANT_DB_STANDBY_DIR", "")
+}
+
+// コピーする間隔(ミリ秒)
+func tenantDBStandbyIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_STANDBY_INTERVAL_MS", "60000"))
+	if err != nil || n <= 0 {
+		return 60000
+	}
+	return n
+}
+
+func standbyTenantDBPath(id int64) string {
+	return filepath.Join(tenantDBStandbyDir(), fmt.Sprintf("%d.db", id))
+}
+
+// フェイルオーバーしたことを示すファイル
+// 再起動してもスタンバイに接続し続けるように、スタンバイのディレクトリに置く
+func standbyFailoverMarkerPath(id int64) string {
+	return filepath.Join(tenantDBStandbyDir(), fmt.Sprintf("%d.failover", id))
+}
+
+// フェイルオーバーしたテナント
+var (
+	failedOverTenants   = map[int64]struct{}{}
+	failedOverTenantsMu sync.RWMutex
+)
+
+func isTenantDBFailedOver(id int64) bool {
+	failedOverTenantsMu.RLock()
+	defer failedOverTenantsMu.RUnlock()
+	_, ok := failedOverTenants[id]
+	return ok
+}
+
+// 起動時にフェイルオーバーしたテナントを読み込む
+func loadTenantDBFailovers() error {
+	markers, err := filepath.Glob(filepath.Join(tenantDBStandbyDir(), "*.failover"))
+	if err != nil {
+		return fmt.Errorf("error filepath.Glob: %w", err)
+	}
+	failedOverTenantsMu.Lock()
+	defer failedOverTenantsMu.Unlock()
+	failedOverTenants = map[int64]struct{}{}
+	for _, m := range markers {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(m), ".failover"), 10, 64)
+		if err != nil {
+			continue
+		}
+		failedOverTenants[id] = struct{}{}
+		log.Printf("tenant DB is failed over to standby: tenantID=%d", id)
+	}
+	return nil
+}
+
+// フェイルオーバーを全て解除する
+func clearTenantDBFailovers() error {
+	failedOverTenantsMu.Lock()
+	defer failedOverTenantsMu.Unlock()
+	for id := range failedOverTenants {
+		if err := os.Remove(standbyFailoverMarkerPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error remove failover marker: %w", err)
+		}
+	}
+	failedOverTenants = map[int64]struct{}{}
+	return nil
+}
+
+// テナントごとのスタンバイの状態
+type TenantDBStandbyStatus struct {
+	LastCopiedAt   int64  `json:"last_copied_at"`   // 最後に検証済みのコピーを置いた日時(unix秒)
+	LastCopiedMod  int64  `json:"-"`                // コピーしたときの元のファイルの更新日時(unixナノ秒)
+	LastVerifiedAt int64  `json:"last_verified_at"` // 最後に検証した日時(unix秒)
+	Copies         int64  `json:"copies"`
+	Failures       int64  `json:"failures"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+var standbyStatusCache = helpisu.NewCache[int64, TenantDBStandbyStatus]()
+
+// 元のファイルの更新日時 WALモードの場合はWALファイルの更新も含める
+func tenantDBModTime(id int64) (int64, error) {
+	var mod int64
+	for _, p := range []string{tenantDBPath(id), tenantDBPath(id) + "-wal"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return 0, fmt.Errorf("error os.Stat: %w", err)
+		}
+		if t := fi.ModTime().UnixNano(); t > mod {
+			mod = t
+		}
+	}
+	return mod, nil
+}
+
+// テーブルごとの行数
+func tenantDBRowCounts(ctx context.Context, db sqlx.QueryerContext) (map[string]int64, error) {
+	tables := []string{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&tables,
+		"SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name",
+	); err != nil {
+		return nil, fmt.Errorf("error Select sqlite_master: %w", err)
+	}
+	counts := make(map[string]int64, len(tables))
+	for _, t := range tables {
+		var n int64
+		if err := sqlx.GetContext(ctx, db, &n, fmt.Sprintf("SELECT COUNT(*) FROM %q", t)); err != nil {
+			return nil, fmt.Errorf("error count %s: %w", t, err)
+		}
+		counts[t] = n
+	}
+	return counts, nil
+}
+
+// コピーしたファイルを検証する
+// 整合性チェックを通り、全てのテーブルの行数がコピー元と一致すること
+func verifyStandbyCopy(ctx context.Context, p string, want map[string]int64) error {
+	db, err := sqlx.Open(sqliteDriverName, fmt.Sprintf("file:%s?mode=ro", p))
+	if err != nil {
+		return fmt.Errorf("error open standby copy: %w", err)
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.GetContext(ctx, &result, "PRAGMA integrity_check"); err != nil {
+		return fmt.Errorf("error integrity_check: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity_check failed: %s", result)
+	}
+	got, err := tenantDBRowCounts(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("table count mismatch: got=%d, want=%d", len(got), len(want))
+	}
+	for t, n := range want {
+		if got[t] != n {
+			return fmt.Errorf("row count mismatch: table=%s, got=%d, want=%d", t, got[t], n)
+		}
+	}
+	return nil
+}
+
+// テナントDBをスタンバイにコピーする
+// 一時ファイルにコピーして検証してから置き換えるので、失敗しても前回のコピーは残る
+func copyTenantDBToStandby(ctx context.Context, id int64) error {
+	tenantDB, err := connectToTenantDB(id)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+	tmp := standbyTenantDBPath(id) + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error remove %s: %w", tmp, err)
+	}
+
+	// コピーと行数の取得の間に書き込まれないようにロックを取る
+	fl, err := flockByTenantID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	if _, err := tenantDB.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		fl.Close()
+		return fmt.Errorf("error VACUUM INTO: %w", err)
+	}
+	want, err := tenantDBRowCounts(ctx, tenantDB)
+	fl.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := verifyStandbyCopy(ctx, tmp, want); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error verifyStandbyCopy: %w", err)
+	}
+	if err := os.Rename(tmp, standbyTenantDBPath(id)); err != nil {
+		return fmt.Errorf("error rename standby copy: %w", err)
+	}
+	return nil
+}
+
+// 更新されたテナントDBをスタンバイにコピーする
+func tenantDBStandbyJob() {
+	ctx := context.Background()
+	dbs, err := filepath.Glob(filepath.Join(getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db"), "*.db"))
+	if err != nil {
+		log.Printf("error filepath.Glob: %s", err)
+		return
+	}
+	for _, p := range dbs {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(p), ".db"), 10, 64)
+		if err != nil {
+			continue
+		}
+		// フェイルオーバーしたテナントはスタンバイが本番なのでコピーしない
+		if isTenantDBFailedOver(id) {
+			continue
+		}
+		mod, err := tenantDBModTime(id)
+		if err != nil {
+			log.Printf("error tenantDBModTime: tenantID=%d, %s", id, err)
+			continue
+		}
+		status, _ := standbyStatusCache.Get(id)
+		if mod == status.LastCopiedMod {
+			continue
+		}
+
+		now := time.Now().Unix()
+		status.LastVerifiedAt = now
+		if err := copyTenantDBToStandby(ctx, id); err != nil {
+			log.Printf("error copyTenantDBToStandby: tenantID=%d, %s", id, err)
+			status.Failures++
+			status.LastError = err.Error()
+		} else {
+			status.Copies++
+			status.LastCopiedAt = now
+			status.LastCopiedMod = mod
+			status.LastError = ""
+		}
+		standbyStatusCache.Set(id, status)
+	}
+}
+
+type TenantDBStandbyDetail struct {
+	TenantID   string                `json:"tenant_id"`
+	FailedOver bool                  `json:"failed_over"`
+	Path       string                `json:"path"` // 現在接続しているファイル
+	Status     TenantDBStandbyStatus `json:"status"`
+}
+
+func tenantDBStandbyDetail(id int64) TenantDBStandbyDetail {
+	status, _ := standbyStatusCache.Get(id)
+	return TenantDBStandbyDetail{
+		TenantID:   strconv.FormatInt(id, 10),
+		FailedOver: isTenantDBFailedOver(id),
+		Path:       tenantDBPath(id),
+		Status:     status,
+	}
+}
+
+// スタンバイに対応しているテナントかを確認する
+func checkTenantDBStandby(ctx context.Context, c echo.Context) (int64, error) {
+	if _, err := authorizeAdmin(c); err != nil {
+		return 0, err
+	}
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return 0, apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return 0, err
+	}
+	if tenantDBStandbyDir() == "" || tenantDBMemoryEnabled() {
+		return 0, ErrTenantDBStandbyUnavailable
+	}
+	storage, err := retrieveTenantStorage(ctx, tenantID)
+	if err != nil {
+		return 0, fmt.Errorf("error retrieveTenantStorage: %w", err)
+	}
+	if storage == TenantStorageMySQL {
+		return 0, apperr.Validation("tenant storage is %s", storage).WithCode(ErrTenantStorageUnsupported.Code)
+	}
+	return tenantID, nil
+}
+
+// SasS管理者用API
+// GET /api/admin/tenants/:tenant_id/db/standby
+// テナントDBのスタンバイの状態を返す
+func tenantDBStandbyHandler(c echo.Context) error {
+	tenantID, err := checkTenantDBStandby(context.Background(), c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: tenantDBStandbyDetail(tenantID)})
+}
+
+// SasS管理者用API
+// POST /api/admin/tenants/:tenant_id/db/failover
+// テナントDBをスタンバイのコピーに切り替える
+// 最後に検証したコピー以降の書き込みは失われる 元のファイルには戻さないので、戻す場合はファイルを手で入れ替えてマーカーを消す
+func tenantDBFailoverHandler(c echo.Context) error {
+	ctx := context.Background()
+	tenantID, err := checkTenantDBStandby(ctx, c)
+	if err != nil {
+		return err
+	}
+	if isTenantDBFailedOver(tenantID) {
+		return ErrTenantDBAlreadyFailedOver
+	}
+	if _, err := os.Stat(standbyTenantDBPath(tenantID)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrTenantDBStandbyNotFound
+		}
+		return fmt.Errorf("error os.Stat: %w", err)
+	}
+
+	if err := os.WriteFile(standbyFailoverMarkerPath(tenantID), []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
+		return fmt.Errorf("error write failover marker: %w", err)
+	}
+	failedOverTenantsMu.Lock()
+	failedOverTenants[tenantID] = struct{}{}
+	failedOverTenantsMu.Unlock()
+	log.Printf("tenant DB failed over to standby: tenantID=%d", tenantID)
+
+	// キャッシュしている元のファイルへの接続を閉じて、スタンバイに接続し直す
+	if _, err := reopenTenantDB(ctx, tenantID); err != nil {
+		return fmt.Errorf("error reopenTenantDB: id=%d, %w", tenantID, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: tenantDBStandbyDetail(tenantID)})
+}
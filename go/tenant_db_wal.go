@@ -0,0 +1,133 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logica0419/helpisu"
+)
+
+// テナントDBをWALモードで開くか
+// 環境変数 ISUCON_TENANT_DB_WAL=1 または ISUCON_TENANT_DB_JOURNAL_MODE=WAL で有効になる tenant_db_pragma.go を参照
+func tenantDBWALEnabled() bool {
+	return tenantDBJournalMode() == "WAL"
+}
+
+// WALファイルがこのサイズ以上になったらチェックポイントを実行する
+func walCheckpointThresholdBytes() int64 {
+	n, err := strconv.ParseInt(getEnv("ISUCON_TENANT_DB_WAL_CHECKPOINT_BYTES", "4194304"), 10, 64)
+	if err != nil || n < 0 {
+		return 4194304
+	}
+	return n
+}
+
+// チェックポイントを実行する間隔(ミリ秒)
+func walCheckpointIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_DB_WAL_CHECKPOINT_INTERVAL_MS", "60000"))
+	if err != nil || n <= 0 {
+		return 60000
+	}
+	return n
+}
+
+// テナントごとのWALのチェックポイントの統計
+type WALStats struct {
+	Checkpoints            int64 `json:"checkpoints"`               // チェックポイントを実行した回数
+	LastCheckpointAt       int64 `json:"last_checkpoint_at"`        // 最後にチェックポイントを実行した日時(unix秒)
+	LastCheckpointWALBytes int64 `json:"last_checkpoint_wal_bytes"` // 最後のチェックポイントの直前のWALのサイズ
+	MaxWALBytes            int64 `json:"max_wal_bytes"`             // 観測したWALの最大サイズ
+}
+
+var walStatsCache = helpisu.NewCache[int64, WALStats]()
+
+// テナントDBのWALファイルのサイズを返す
+func tenantDBWALSize(tenantID int64) (int64, error) {
+	fi, err := os.Stat(tenantDBPath(tenantID) + "-wal")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error os.Stat: %w", err)
+	}
+	return fi.Size(), nil
+}
+
+// テナントDBのWALをチェックポイントしてWALファイルを切り詰める
+// スコアの登録などの書き込みと重ならないようにテナントのロックを取って実行する
+func checkpointTenantDB(ctx context.Context, tenantID int64) error {
+	fl, err := flockByTenantID(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	size, err := tenantDBWALSize(tenantID)
+	if err != nil {
+		return err
+	}
+
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+	var busy, logFrames, checkpointed int64
+	if err := tenantDB.QueryRowxContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return fmt.Errorf("error wal_checkpoint: tenantID=%d, %w", tenantID, err)
+	}
+	if busy != 0 {
+		// 読み込み中の接続があると最後までチェックポイントできないので次回に回す
+		return fmt.Errorf("wal_checkpoint is busy: tenantID=%d, log=%d, checkpointed=%d", tenantID, logFrames, checkpointed)
+	}
+
+	stats, _ := walStatsCache.Get(tenantID)
+	stats.Checkpoints++
+	stats.LastCheckpointAt = time.Now().Unix()
+	stats.LastCheckpointWALBytes = size
+	if size > stats.MaxWALBytes {
+		stats.MaxWALBytes = size
+	}
+	walStatsCache.Set(tenantID, stats)
+	log.Printf("checkpointed tenant DB: tenantID=%d, walBytes=%d", tenantID, size)
+	return nil
+}
+
+// WALファイルが大きくなったテナントDBのチェックポイントを定期的に実行する
+func walCheckpointJob() {
+	ctx := context.Background()
+	threshold := walCheckpointThresholdBytes()
+	wals, err := filepath.Glob(filepath.Join(getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db"), "*.db-wal"))
+	if err != nil {
+		log.Printf("error filepath.Glob: %s", err)
+		return
+	}
+	for _, w := range wals {
+		tenantID, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(w), ".db-wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		size, err := tenantDBWALSize(tenantID)
+		if err != nil {
+			log.Printf("error tenantDBWALSize: tenantID=%d, %s", tenantID, err)
+			continue
+		}
+		stats, _ := walStatsCache.Get(tenantID)
+		if size > stats.MaxWALBytes {
+			stats.MaxWALBytes = size
+			walStatsCache.Set(tenantID, stats)
+		}
+		if size < threshold {
+			continue
+		}
+		if err := checkpointTenantDB(ctx, tenantID); err != nil {
+			log.Printf("error checkpointTenantDB: %s", err)
+		}
+	}
+}
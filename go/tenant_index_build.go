@@ -0,0 +1,263 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	IndexBuildStateRunning = "running"
+	IndexBuildStateDone    = "done"
+	IndexBuildStateFailed  = "failed"
+)
+
+// インデックスを1つ作るごとにロックを解放して待つ時間
+// 待っているスコアの登録などに先にロックを取らせるためのもの
+// 環境変数 ISUCON_INDEX_BUILD_PAUSE_MS で変更できる
+func indexBuildPause() time.Duration {
+	n, err := strconv.Atoi(getEnv("ISUCON_INDEX_BUILD_PAUSE_MS", "100"))
+	if err != nil || n < 0 {
+		return 100 * time.Millisecond
+	}
+	return time.Duration(n) * time.Millisecond
+}
+
+// テナントDBにインデックスを追加する処理の進捗
+type indexBuildJob struct {
+	mu         sync.Mutex
+	tenantID   int64
+	state      string
+	indexes    []string
+	done       int
+	current    string
+	startedAt  int64
+	finishedAt int64
+	err        string
+}
+
+type IndexBuildDetail struct {
+	TenantID   string   `json:"tenant_id"`
+	State      string   `json:"state"`
+	Indexes    []string `json:"indexes"`
+	Total      int      `json:"total"`
+	Done       int      `json:"done"`
+	Current    string   `json:"current,omitempty"`
+	StartedAt  int64    `json:"started_at"`
+	FinishedAt *int64   `json:"finished_at"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func (j *indexBuildJob) Detail() IndexBuildDetail {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d := IndexBuildDetail{
+		TenantID:  strconv.FormatInt(j.tenantID, 10),
+		State:     j.state,
+		Indexes:   j.indexes,
+		Total:     len(j.indexes),
+		Done:      j.done,
+		Current:   j.current,
+		StartedAt: j.startedAt,
+		Error:     j.err,
+	}
+	if j.finishedAt != 0 {
+		finishedAt := j.finishedAt
+		d.FinishedAt = &finishedAt
+	}
+	return d
+}
+
+func (j *indexBuildJob) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == IndexBuildStateRunning
+}
+
+// テナントごとの最後に実行したインデックスの追加
+// プロセスのメモリ上にだけ持つので、再起動すると進捗は見られなくなる
+var (
+	indexBuildJobs   = map[int64]*indexBuildJob{}
+	indexBuildJobsMu sync.Mutex
+)
+
+func resetIndexBuildJobs() {
+	indexBuildJobsMu.Lock()
+	defer indexBuildJobsMu.Unlock()
+	indexBuildJobs = map[int64]*indexBuildJob{}
+}
+
+// テナントDBに足りないインデックスの名前を返す
+func retrieveMissingIndexes(ctx context.Context, db *sqlx.DB) ([]string, *tenantSchema, error) {
+	expected, err := retrieveExpectedTenantSchema(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieveExpectedTenantSchema: %w", err)
+	}
+	actual, err := readTenantSchema(ctx, db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error readTenantSchema: %w", err)
+	}
+	names := []string{}
+	for name := range expected.Indexes {
+		if _, ok := actual.Indexes[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, expected, nil
+}
+
+// SasS管理者用API
+// テナントDBに足りないインデックスをバックグラウンドで追加する
+// POST /api/admin/tenants/:tenant_id/indexes/build
+// 大きなテナントDBでも、スコアの登録などをインデックス全体の追加が終わるまで止めないためのもの
+// 進捗は GET /api/admin/tenants/:tenant_id/indexes/build で確認する
+func indexBuildHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	ctx := context.Background()
+	if _, err := retrieveTenant(ctx, tenantID); err != nil {
+		return err
+	}
+	storage, err := retrieveTenantStorage(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveTenantStorage: %w", err)
+	}
+	if storage == TenantStorageMySQL {
+		// MySQLのテーブルは全テナントで共有しているので、テナントごとにはインデックスを追加しない
+		return apperr.Validation("tenant storage is %s", storage).WithCode(ErrTenantStorageUnsupported.Code)
+	}
+
+	indexBuildJobsMu.Lock()
+	defer indexBuildJobsMu.Unlock()
+	if j, ok := indexBuildJobs[tenantID]; ok && j.running() {
+		return ErrIndexBuildAlreadyRunning
+	}
+
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: id=%d, %w", tenantID, err)
+	}
+	names, expected, err := retrieveMissingIndexes(ctx, tenantDB)
+	if err != nil {
+		return err
+	}
+
+	j := &indexBuildJob{
+		tenantID:  tenantID,
+		state:     IndexBuildStateRunning,
+		indexes:   names,
+		startedAt: time.Now().Unix(),
+	}
+	indexBuildJobs[tenantID] = j
+	go buildTenantIndexes(j, tenantDB, expected)
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: j.Detail()})
+}
+
+// SasS管理者用API
+// テナントDBへのインデックスの追加の進捗を返す
+// GET /api/admin/tenants/:tenant_id/indexes/build
+func indexBuildProgressHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	tenantID, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64)
+	if err != nil {
+		return apperr.InvalidField("tenant_id", "invalid tenant_id")
+	}
+
+	indexBuildJobsMu.Lock()
+	j, ok := indexBuildJobs[tenantID]
+	indexBuildJobsMu.Unlock()
+	if !ok {
+		return ErrIndexBuildNotFound
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: j.Detail()})
+}
+
+// インデックスを1つずつ追加する
+// SQLiteはインデックスを作っている間は書き込めないので、インデックスごとにテナントのロックを取り直す
+func buildTenantIndexes(j *indexBuildJob, tenantDB *sqlx.DB, expected *tenantSchema) {
+	ctx := context.Background()
+	fail := func(err error) {
+		log.Printf("error buildTenantIndexes: tenantID=%d, %s", j.tenantID, err)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.state = IndexBuildStateFailed
+		j.current = ""
+		j.err = err.Error()
+		j.finishedAt = time.Now().Unix()
+	}
+
+	for i, name := range j.indexes {
+		if i > 0 {
+			time.Sleep(indexBuildPause())
+		}
+		j.mu.Lock()
+		j.current = name
+		j.mu.Unlock()
+
+		if err := buildTenantIndex(ctx, j.tenantID, tenantDB, name, expected.Indexes[name]); err != nil {
+			fail(err)
+			return
+		}
+
+		j.mu.Lock()
+		j.done++
+		j.mu.Unlock()
+	}
+
+	// スキーマの差分のメトリクスを更新する tenant_schema.go を参照
+	verifyTenantSchema(ctx, j.tenantID, tenantDB)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = IndexBuildStateDone
+	j.current = ""
+	j.finishedAt = time.Now().Unix()
+	log.Printf("tenant indexes built: tenantID=%d, indexes=%d", j.tenantID, j.done)
+}
+
+func buildTenantIndex(ctx context.Context, tenantID int64, tenantDB *sqlx.DB, name, stmt string) error {
+	fl, err := flockByTenantID(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	// 自動のマイグレーションなどで既に追加されている場合がある
+	var exists int
+	if err := tenantDB.GetContext(
+		ctx,
+		&exists,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?",
+		name,
+	); err != nil {
+		return fmt.Errorf("error Select sqlite_master: index=%s, %w", name, err)
+	}
+	if exists > 0 {
+		return nil
+	}
+	if _, err := tenantDB.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("error create index: index=%s, %w", name, err)
+	}
+	return nil
+}
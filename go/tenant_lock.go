@@ -0,0 +1,93 @@
+package isuports
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// テナントのロックの方式
+const (
+	// プロセス内のテナントごとのsync.RWMutex ファイルシステムにアクセスしない
+	TenantLockProcess = "process"
+	// ロックファイルのflock 複数のプロセスが同じテナントDBにアクセスする場合に使う
+	TenantLockFlock = "flock"
+)
+
+// 環境変数 ISUCON_TENANT_LOCK で process か flock を指定する
+// 未設定の場合、リスナーごとにプロセスを分けるなら flock、そうでなければ process
+// MySQLに置いたテナントはどちらの場合もMySQLのロックを使う
+func tenantLockMode() string {
+	switch getEnv("ISUCON_TENANT_LOCK", "") {
+	case TenantLockProcess:
+		return TenantLockProcess
+	case TenantLockFlock:
+		return TenantLockFlock
+	}
+	if listenerCount() > 1 && listenerMode() == ListenerModeProcess {
+		return TenantLockFlock
+	}
+	return TenantLockProcess
+}
+
+// テナントごとのロック 一度作ったものは捨てない
+var tenantMutexes sync.Map // map[int64]*sync.RWMutex
+
+// プロセス内のロックを解放するio.Closer
+// flockと同じく2回Closeしても問題ないようにする
+type tenantMutexLock struct {
+	mu     *sync.RWMutex
+	shared bool
+	closed int32
+}
+
+func (l *tenantMutexLock) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return nil
+	}
+	if l.shared {
+		l.mu.RUnlock()
+	} else {
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// プロセス内のロックを取る sharedなら共有ロック
+// ロックを待っている間にcontextが終わった場合はErrLockUnavailableを返し、後から取れたロックはすぐに解放する
+func lockTenantInProcess(ctx context.Context, tenantID int64, shared bool) (io.Closer, error) {
+	v, _ := tenantMutexes.LoadOrStore(tenantID, &sync.RWMutex{})
+	l := &tenantMutexLock{mu: v.(*sync.RWMutex), shared: shared}
+	lock, tryLock := l.mu.Lock, l.mu.TryLock
+	if shared {
+		lock, tryLock = l.mu.RLock, l.mu.TryRLock
+	}
+	// 競合していなければgoroutineを作らずに取る
+	// TryRLockは排他ロックを待っているgoroutineがいれば失敗するので、待つ順番は変わらない
+	if tryLock() {
+		return l, nil
+	}
+	if ctx.Done() == nil {
+		lock()
+		return l, nil
+	}
+
+	// sync.RWMutexはcontextで待つのをやめられないので、別のgoroutineで待つ
+	// TryLockで待つと共有ロックが途切れない間は排他ロックが取れないので、待つ順番を守れるLockを使う
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return l, nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			l.Close()
+		}()
+		return nil, ErrLockUnavailable
+	}
+}
@@ -0,0 +1,210 @@
+package isuports
+
+import (
+	"context"
+	"embed"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// テナントDBのスキーマのマイグレーション
+// tenant_migration/ の NNNN_名前.sql を番号順に適用し、適用済みの番号をSQLiteの user_version に記録する
+// sqlite3コマンドを使わずに、新規のテナントDBの作成と既存のテナントDBの更新を同じ仕組みで行う
+
+//go:embed tenant_migration/*.sql
+var tenantMigrationFS embed.FS
+
+// 適用したマイグレーションの数
+// デバッグ用のlistenerの /debug/vars で見られる debug_listener.go を参照
+var tenantMigrationAppliedVar = expvar.NewInt("tenant_migration_applied")
+
+type tenantMigration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// 埋め込んだマイグレーションを番号順に返す
+func loadTenantMigrations() ([]tenantMigration, error) {
+	names, err := fs.Glob(tenantMigrationFS, "tenant_migration/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("error fs.Glob: %w", err)
+	}
+	migrations := make([]tenantMigration, 0, len(names))
+	for _, name := range names {
+		base := path.Base(name)
+		num, _, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid tenant migration file name: %s", base)
+		}
+		b, err := tenantMigrationFS.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("error ReadFile: name=%s, %w", name, err)
+		}
+		migrations = append(migrations, tenantMigration{Version: version, Name: base, SQL: string(b)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("tenant migration version is not sequential: %s", m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+// テナントDBにまだ適用していないマイグレーションを適用する
+// 同じテナントDBに複数の接続から同時に呼ばれてもよいように、書き込みのロックを取ってから適用済みの番号を読む
+// user_versionが0でもテーブルがあるDBは、sqlite3コマンドで作ったものなので最初のマイグレーションとの差分を埋めて適用済みとして扱う
+// 初期データのテナントDBもこれにあたる
+func migrateTenantDB(ctx context.Context, db *sqlx.DB) (int, error) {
+	migrations, err := loadTenantMigrations()
+	if err != nil {
+		return 0, err
+	}
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error db.Connx: %w", err)
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.GetContext(ctx, &version, "PRAGMA user_version"); err != nil {
+		return 0, fmt.Errorf("error PRAGMA user_version: %w", err)
+	}
+	if version >= len(migrations) {
+		return 0, nil
+	}
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return 0, fmt.Errorf("error BEGIN IMMEDIATE: %w", err)
+	}
+	applied, err := applyTenantMigrations(ctx, conn, migrations)
+	if err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return 0, err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return 0, fmt.Errorf("error COMMIT: %w", err)
+	}
+	tenantMigrationAppliedVar.Add(int64(applied))
+	return applied, nil
+}
+
+func applyTenantMigrations(ctx context.Context, conn *sqlx.Conn, migrations []tenantMigration) (int, error) {
+	var version int
+	if err := conn.GetContext(ctx, &version, "PRAGMA user_version"); err != nil {
+		return 0, fmt.Errorf("error PRAGMA user_version: %w", err)
+	}
+	if version == 0 {
+		var tables int
+		if err := conn.GetContext(ctx, &tables, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'competition'"); err != nil {
+			return 0, fmt.Errorf("error Select sqlite_master: %w", err)
+		}
+		if tables > 0 {
+			if err := upgradeLegacyTenantDB(ctx, conn, migrations[0]); err != nil {
+				return 0, fmt.Errorf("error upgradeLegacyTenantDB: %w", err)
+			}
+			version = 1
+		}
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, m.SQL); err != nil {
+			return applied, fmt.Errorf("error apply tenant migration: name=%s, %w", m.Name, err)
+		}
+		applied++
+		version = m.Version
+	}
+	// PRAGMAではプレースホルダを使えない
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return applied, fmt.Errorf("error PRAGMA user_version: %w", err)
+	}
+	return applied, nil
+}
+
+var (
+	baselineTenantSchema   *tenantSchema
+	baselineTenantSchemaMu sync.Mutex
+)
+
+// 最初のマイグレーションだけを適用したスキーマを返す
+func retrieveBaselineTenantSchema(ctx context.Context, m tenantMigration) (*tenantSchema, error) {
+	baselineTenantSchemaMu.Lock()
+	defer baselineTenantSchemaMu.Unlock()
+	if baselineTenantSchema != nil {
+		return baselineTenantSchema, nil
+	}
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.Open: %w", err)
+	}
+	defer db.Close()
+	// :memory: は接続ごとに別のDBになる
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, m.SQL); err != nil {
+		return nil, fmt.Errorf("error apply tenant migration: name=%s, %w", m.Name, err)
+	}
+	s, err := readTenantSchema(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	baselineTenantSchema = s
+	return s, nil
+}
+
+// user_versionを記録していないテナントDBに、最初のマイグレーションにあって足りないテーブルとカラムを追加する
+// sqlite3コマンドで 20_migration.sql を適用していたのと同じく、既存のテーブルへのインデックスは追加しない
+// 大きなテナントDBでは時間がかかるので、インデックスは verifyTenantSchema やインデックスの追加のAPI(tenant_index_build.go)で追加する
+func upgradeLegacyTenantDB(ctx context.Context, conn *sqlx.Conn, baseline tenantMigration) error {
+	expected, err := retrieveBaselineTenantSchema(ctx, baseline)
+	if err != nil {
+		return err
+	}
+	actual, err := readTenantSchema(ctx, conn)
+	if err != nil {
+		return err
+	}
+	d := diffTenantSchema(expected, actual)
+	missingTables := map[string]bool{}
+	for _, name := range d.MissingTables {
+		missingTables[name] = true
+	}
+	indexes := []string{}
+	for _, name := range d.MissingIndexes {
+		if missingTables[expected.IndexTables[name]] {
+			indexes = append(indexes, name)
+		}
+	}
+	d.MissingIndexes = indexes
+	migrated, err := migrateTenantSchema(ctx, conn, expected, d)
+	tenantSchemaMigratedVar.Add(migrated)
+	return err
+}
+
+// テナントDBを開いてマイグレーションを適用する
+// 失敗してもテナントDBは使えるようにしておくため、エラーはログに出すだけにする
+func migrateTenantDBOrLog(ctx context.Context, id int64, db *sqlx.DB) {
+	applied, err := migrateTenantDB(ctx, db)
+	if err != nil {
+		log.Printf("error migrateTenantDB: tenantID=%d, %s", id, err)
+		return
+	}
+	if applied > 0 {
+		log.Printf("tenant DB migrated: tenantID=%d, applied=%d", id, applied)
+	}
+}
@@ -0,0 +1,142 @@
+-- テナントDBの最初のスキーマ go/tenant_migration.go を参照
+-- 適用済みのファイルは変更せず、スキーマの変更は番号を増やした新しいファイルに書く
+-- sql/tenant/10_schema.sql も合わせて変更すること
+
+CREATE TABLE competition (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  finished_at BIGINT NULL,
+  tie_break VARCHAR(16) NOT NULL DEFAULT 'earliest',
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX created_at_idx ON competition (created_at);
+
+CREATE TABLE player (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  display_name TEXT NOT NULL,
+  is_disqualified BOOLEAN NOT NULL,
+  deleted_at BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE player_score (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  score BIGINT NOT NULL,
+  row_num BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX tenant_idx ON player_score (tenant_id);
+
+CREATE INDEX tenant_player_idx ON player_score (tenant_id, player_id);
+
+CREATE INDEX tenant_player_competition_row_idx ON player_score (tenant_id, player_id, competition_id, row_num DESC);
+
+CREATE INDEX tenant_competition_row_idx ON player_score (tenant_id, competition_id, row_num DESC);
+
+CREATE INDEX comp_idx ON player_score (competition_id ASC);
+
+-- CSVを再アップロードしても消えないスコアの履歴
+CREATE TABLE player_score_history (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  score BIGINT NOT NULL,
+  row_num BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX history_tenant_player_idx ON player_score_history (tenant_id, player_id);
+
+-- スコアのアップロードごとの記録
+CREATE TABLE score_upload (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  row_count BIGINT NOT NULL,
+  added_count BIGINT NOT NULL,
+  removed_count BIGINT NOT NULL,
+  changed_count BIGINT NOT NULL,
+  created_at BIGINT NOT NULL
+);
+
+CREATE INDEX score_upload_competition_idx ON score_upload (tenant_id, competition_id, created_at);
+
+-- アップロードで直前の有効なスコアから変わった参加者
+CREATE TABLE score_upload_diff (
+  upload_id VARCHAR(255) NOT NULL,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  change_type VARCHAR(16) NOT NULL,
+  previous_score BIGINT NULL,
+  score BIGINT NULL
+);
+
+CREATE INDEX score_upload_diff_upload_idx ON score_upload_diff (tenant_id, upload_id);
+
+-- 終了した大会のスコアへの参加者からの異議申し立て
+CREATE TABLE score_dispute (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  reason TEXT NOT NULL,
+  claimed_score BIGINT NULL,
+  status VARCHAR(16) NOT NULL,
+  resolution TEXT NULL,
+  corrected_score BIGINT NULL,
+  resolved_at BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX score_dispute_competition_idx ON score_dispute (tenant_id, competition_id, created_at);
+
+CREATE INDEX score_dispute_player_idx ON score_dispute (tenant_id, player_id);
+
+-- テナントごとにIDを発行する場合の次の連番 go/id_namespace.go を参照
+CREATE TABLE id_sequence (
+  tenant_id BIGINT NOT NULL PRIMARY KEY,
+  next_id BIGINT NOT NULL
+);
+
+-- 参加者への通知 大会の終了時の最終順位など go/notification.go を参照
+CREATE TABLE notification (
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  kind VARCHAR(32) NOT NULL,
+  `rank` BIGINT NOT NULL,
+  score BIGINT NOT NULL,
+  percentile REAL NOT NULL,
+  player_count BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, competition_id, kind, player_id)
+);
+
+CREATE INDEX notification_player_idx ON notification (tenant_id, player_id, created_at);
+
+-- スコアのアップロードの直後のランキングと、その前のアップロードの直後の順位 go/ranking_snapshot.go を参照
+CREATE TABLE ranking_snapshot (
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  upload_id VARCHAR(255) NOT NULL,
+  `rank` BIGINT NOT NULL,
+  score BIGINT NOT NULL,
+  previous_rank BIGINT NULL,
+  previous_score BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, competition_id, player_id)
+);
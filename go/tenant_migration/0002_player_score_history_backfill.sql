@@ -0,0 +1,5 @@
+-- player_score_historyを作る前に登録したスコアを履歴に入れる
+-- 初期データのテナントDBなど、player_scoreにだけ行があるテナントDBが対象
+INSERT INTO player_score_history (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at)
+  SELECT id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at FROM player_score
+  WHERE NOT EXISTS (SELECT 1 FROM player_score_history WHERE player_score_history.id = player_score.id);
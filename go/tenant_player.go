@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -30,7 +32,7 @@ func playersListHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -42,7 +44,7 @@ func playersListHandler(c echo.Context) error {
 	if err := tenantDB.SelectContext(
 		ctx,
 		&pls,
-		"SELECT * FROM player WHERE tenant_id=? ORDER BY created_at DESC",
+		"SELECT * FROM player WHERE tenant_id=? AND deleted_at IS NULL ORDER BY created_at DESC",
 		v.tenantID,
 	); err != nil {
 		return fmt.Errorf("error Select player: %w", err)
@@ -75,7 +77,7 @@ func playersAddHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -87,19 +89,38 @@ func playersAddHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("error c.FormParams: %w", err)
 	}
-	displayNames := params["display_name[]"]
+	pds, err := addPlayers(ctx, tenantDB, v.tenantID, params["display_name[]"])
+	if err != nil {
+		return err
+	}
+
+	res := PlayersAddHandlerResult{
+		Players: pds,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
 
+// 参加者を追加する
+// RESTのAPIとgRPCのAPI(grpc.go)で共通の処理
+func addPlayers(ctx context.Context, tenantDB *sqlx.DB, tenantID int64, displayNames []string) ([]PlayerDetail, error) {
 	pds := make([]PlayerDetail, 0, len(displayNames))
 
 	players := make([]PlayerRow, 0, len(displayNames))
 	for _, displayName := range displayNames {
-		id, err := dispenseID(ctx)
+		id, err := dispenseTenantID(ctx, tenantID)
 		if err != nil {
-			return fmt.Errorf("error dispenseID: %w", err)
+			return nil, fmt.Errorf("error dispenseTenantID: %w", err)
 		}
 
 		now := time.Now().Unix()
-		player := PlayerRow{v.tenantID, id, displayName, false, now, now}
+		player := PlayerRow{
+			TenantID:       tenantID,
+			ID:             id,
+			DisplayName:    displayName,
+			IsDisqualified: false,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
 		players = append(players, player)
 
 		pds = append(pds, PlayerDetail{
@@ -111,18 +132,17 @@ func playersAddHandler(c echo.Context) error {
 		playerCache.Set(id, player)
 	}
 
-	_, err = tenantDB.NamedExec("INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) values (:id, :tenant_id, :display_name, :is_disqualified, :created_at, :updated_at)", players)
+	if len(players) == 0 {
+		return pds, nil
+	}
+	_, err := tenantDB.NamedExecContext(ctx, "INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) values (:id, :tenant_id, :display_name, :is_disqualified, :created_at, :updated_at)", players)
 	if err != nil {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"error Insert player at tenantDB: %w",
 			err,
 		)
 	}
-
-	res := PlayersAddHandlerResult{
-		Players: pds,
-	}
-	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+	return pds, nil
 }
 
 type PlayerDisqualifiedHandlerResult struct {
@@ -132,13 +152,14 @@ type PlayerDisqualifiedHandlerResult struct {
 // テナント管理者向けAPI
 // POST /api/organizer/player/:player_id/disqualified
 // 参加者を失格にする
+// reason(任意)はHooks.OnPlayerDisqualifiedにだけ渡し、保存はしない
 func playerDisqualifiedHandler(c echo.Context) error {
 	ctx := context.Background()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+		return ErrRoleOrganizerRequired
 	}
 
 	tenantDB, err := connectToTenantDB(v.tenantID)
@@ -147,6 +168,7 @@ func playerDisqualifiedHandler(c echo.Context) error {
 	}
 
 	playerID := c.Param("player_id")
+	reason := c.FormValue("reason")
 
 	now := time.Now().Unix()
 	if _, err := tenantDB.ExecContext(
@@ -164,10 +186,15 @@ func playerDisqualifiedHandler(c echo.Context) error {
 	if err != nil {
 		// 存在しないプレイヤー
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+			return ErrPlayerNotFound
 		}
 		return fmt.Errorf("error retrievePlayer: %w", err)
 	}
+	hooks.playerDisqualified(ctx, PlayerDisqualifiedEvent{
+		TenantID: v.tenantID,
+		PlayerID: p.ID,
+		Reason:   reason,
+	})
 
 	res := PlayerDisqualifiedHandlerResult{
 		Player: PlayerDetail{
@@ -178,3 +205,273 @@ func playerDisqualifiedHandler(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
+
+type PlayerReinstateHandlerResult struct {
+	Player PlayerDetail `json:"player"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/reinstate
+// 失格にした参加者を復帰させる
+func playerReinstateHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	playerID := c.Param("player_id")
+
+	now := time.Now().Unix()
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE player SET is_disqualified = ?, updated_at = ? WHERE id = ?",
+		false, now, playerID,
+	); err != nil {
+		return fmt.Errorf(
+			"error Update player: isDisqualified=%t, updatedAt=%d, id=%s, %w",
+			false, now, playerID, err,
+		)
+	}
+	// 失格状態のままキャッシュされているとauthorizePlayerで弾かれ続けるので消す
+	playerCache.Delete(playerID)
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		// 存在しないプレイヤー
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPlayerNotFound
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+
+	res := PlayerReinstateHandlerResult{
+		Player: PlayerDetail{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: p.IsDisqualified,
+		},
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type PlayerDeleteHandlerResult struct {
+	Player PlayerDetail `json:"player"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/delete
+// 参加者を論理削除する
+// 参加者一覧とランキングからは消えるが、課金計算のためにスコアは残す
+func playerDeleteHandler(c echo.Context) error {
+	return updatePlayerDeletedAt(c, sql.NullInt64{Int64: time.Now().Unix(), Valid: true})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/restore
+// 論理削除した参加者を元に戻す
+func playerRestoreHandler(c echo.Context) error {
+	return updatePlayerDeletedAt(c, sql.NullInt64{})
+}
+
+func updatePlayerDeletedAt(c echo.Context, deletedAt sql.NullInt64) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	playerID := c.Param("player_id")
+
+	now := time.Now().Unix()
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE player SET deleted_at = ?, updated_at = ? WHERE id = ? AND tenant_id = ?",
+		deletedAt, now, playerID, v.tenantID,
+	); err != nil {
+		return fmt.Errorf(
+			"error Update player: deletedAt=%v, updatedAt=%d, id=%s, %w",
+			deletedAt, now, playerID, err,
+		)
+	}
+	playerCache.Delete(playerID)
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		// 存在しないプレイヤー
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPlayerNotFound
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	// ランキングに載るかどうかが変わる
+	if err := invalidateRankingByPlayer(ctx, tenantDB, v.tenantID, playerID); err != nil {
+		return fmt.Errorf("error invalidateRankingByPlayer: %w", err)
+	}
+
+	res := PlayerDeleteHandlerResult{
+		Player: PlayerDetail{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: p.IsDisqualified,
+		},
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type PlayerMergeHandlerResult struct {
+	Player PlayerDetail `json:"player"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:src_id/merge/:dst_id
+// 二重登録された参加者をまとめる
+// src_idのスコアと閲覧履歴をdst_idに付け替えて、src_idの参加者を削除する
+func playerMergeHandler(c echo.Context) error {
+	ctx := context.Background()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	} else if v.role != RoleOrganizer {
+		return ErrRoleOrganizerRequired
+	}
+
+	tenantDB, err := connectToTenantDB(v.tenantID)
+	if err != nil {
+		return err
+	}
+
+	srcID, dstID := c.Param("src_id"), c.Param("dst_id")
+	if srcID == dstID {
+		return ErrPlayerMergeSelf
+	}
+	for _, id := range []string{srcID, dstID} {
+		p, err := retrievePlayer(ctx, tenantDB, id)
+		if err != nil {
+			// 存在しないプレイヤー
+			if errors.Is(err, sql.ErrNoRows) {
+				return apperr.NotFound("player not found: %s", id).WithCode(ErrPlayerNotFound.Code)
+			}
+			return fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		if p.TenantID != v.tenantID {
+			return apperr.NotFound("player not found: %s", id).WithCode(ErrPlayerNotFound.Code)
+		}
+	}
+
+	// player_scoreを書き換えている間にランキングを参照されないようにロックする
+	fl, err := flockByTenantID(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	// 付け替えで内容が変わる大会
+	competitionIDs := []string{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&competitionIDs,
+		"SELECT DISTINCT(competition_id) FROM player_score WHERE tenant_id = ? AND player_id = ?",
+		v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", v.tenantID, srcID, err)
+	}
+	visitedCompetitionIDs := []string{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&visitedCompetitionIDs,
+		"SELECT DISTINCT(competition_id) FROM visit_history WHERE tenant_id = ? AND player_id = ?",
+		v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Select visit_history: tenantID=%d, playerID=%s, %w", v.tenantID, srcID, err)
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE player_score SET player_id = ?, updated_at = ? WHERE tenant_id = ? AND player_id = ?",
+		dstID, now, v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Update player_score: src=%s, dst=%s, %w", srcID, dstID, err)
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE player_score_history SET player_id = ?, updated_at = ? WHERE tenant_id = ? AND player_id = ?",
+		dstID, now, v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Update player_score_history: src=%s, dst=%s, %w", srcID, dstID, err)
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE score_upload_diff SET player_id = ? WHERE tenant_id = ? AND player_id = ?",
+		dstID, v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Update score_upload_diff: src=%s, dst=%s, %w", srcID, dstID, err)
+	}
+	// 統合先と同じ大会の行があると主キーが重なるので、統合元の順位のスナップショットは捨てる
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM ranking_snapshot WHERE tenant_id = ? AND player_id = ?",
+		v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Delete ranking_snapshot: playerID=%s, %w", srcID, err)
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM player WHERE tenant_id = ? AND id = ?",
+		v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Delete player: id=%s, %w", srcID, err)
+	}
+	if _, err := adminDB.ExecContext(
+		ctx,
+		"UPDATE visit_history SET player_id = ?, updated_at = ? WHERE tenant_id = ? AND player_id = ?",
+		dstID, now, v.tenantID, srcID,
+	); err != nil {
+		return fmt.Errorf("error Update visit_history: src=%s, dst=%s, %w", srcID, dstID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+
+	playerCache.Delete(srcID)
+	playerCache.Delete(dstID)
+	for _, id := range competitionIDs {
+		invalidateRanking(id)
+	}
+	vhsCache.Delete(v.tenantID)
+	scoredPlayerCache.Delete(v.tenantID)
+	if err := invalidateBillingReports(ctx, v.tenantID, append(competitionIDs, visitedCompetitionIDs...)); err != nil {
+		return fmt.Errorf("error invalidateBillingReports: %w", err)
+	}
+
+	p, err := retrievePlayer(ctx, tenantDB, dstID)
+	if err != nil {
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	res := PlayerMergeHandlerResult{
+		Player: PlayerDetail{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: p.IsDisqualified,
+		},
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,320 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// テナントDBのテーブルやカラムがスキーマのファイルと一致しているかを確認するか
+// 環境変数 ISUCON_TENANT_SCHEMA_CHECK=0 で無効になる
+// 20_migration.sql を一部だけ適用したテナントDBを、実行時のエラーになる前に見つけるためのもの
+// 期待するスキーマは tenant_migration/ のマイグレーションを全て適用したもの tenant_migration.go を参照
+func tenantSchemaCheckEnabled() bool {
+	return getEnv("ISUCON_TENANT_SCHEMA_CHECK", "1") != "0"
+}
+
+// 足りないテーブル、カラム、インデックスを自動で追加するか
+// 環境変数 ISUCON_TENANT_SCHEMA_AUTO_MIGRATE=1 で有効になる
+func tenantSchemaAutoMigrateEnabled() bool {
+	return getEnv("ISUCON_TENANT_SCHEMA_AUTO_MIGRATE", "0") == "1"
+}
+
+var (
+	// スキーマが一致しないテナントごとの差分の数
+	// デバッグ用のlistenerの /debug/vars で見られる debug_listener.go を参照
+	tenantSchemaDriftVar = expvar.NewMap("tenant_schema_drift")
+	// 自動で追加したテーブル、カラム、インデックスの数
+	tenantSchemaMigratedVar = expvar.NewInt("tenant_schema_auto_migrated")
+)
+
+type tenantColumnSchema struct {
+	Name    string         `db:"name"`
+	Type    string         `db:"type"`
+	NotNull bool           `db:"notnull"`
+	Default sql.NullString `db:"dflt_value"`
+	PK      int64          `db:"pk"`
+}
+
+type tenantTableSchema struct {
+	SQL     string
+	Columns []tenantColumnSchema
+}
+
+// テナントDBのスキーマ
+type tenantSchema struct {
+	Tables map[string]tenantTableSchema
+	// インデックス名からCREATE INDEX文
+	Indexes map[string]string
+	// インデックス名からテーブル名
+	IndexTables map[string]string
+}
+
+var (
+	expectedTenantSchema    *tenantSchema
+	expectedTenantSchemaErr error
+	expectedTenantSchemaMu  sync.Mutex
+)
+
+// 期待するテナントDBのスキーマを返す
+// 初回に埋め込んだマイグレーションをメモリ上のSQLiteに適用し、その結果をプロセスの中に持っておく
+func retrieveExpectedTenantSchema(ctx context.Context) (*tenantSchema, error) {
+	expectedTenantSchemaMu.Lock()
+	defer expectedTenantSchemaMu.Unlock()
+	if expectedTenantSchema != nil || expectedTenantSchemaErr != nil {
+		return expectedTenantSchema, expectedTenantSchemaErr
+	}
+
+	expectedTenantSchema, expectedTenantSchemaErr = loadExpectedTenantSchema(ctx)
+	return expectedTenantSchema, expectedTenantSchemaErr
+}
+
+func loadExpectedTenantSchema(ctx context.Context) (*tenantSchema, error) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.Open: %w", err)
+	}
+	defer db.Close()
+	// :memory: は接続ごとに別のDBになる
+	db.SetMaxOpenConns(1)
+	if _, err := migrateTenantDB(ctx, db); err != nil {
+		return nil, fmt.Errorf("error migrateTenantDB: %w", err)
+	}
+	return readTenantSchema(ctx, db)
+}
+
+// DBのテーブル、カラム、インデックスを読み込む
+func readTenantSchema(ctx context.Context, db sqlx.QueryerContext) (*tenantSchema, error) {
+	type masterRow struct {
+		Type    string         `db:"type"`
+		Name    string         `db:"name"`
+		TblName string         `db:"tbl_name"`
+		SQL     sql.NullString `db:"sql"`
+	}
+	rows := []masterRow{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&rows,
+		"SELECT type, name, tbl_name, sql FROM sqlite_master WHERE type IN ('table', 'index') AND name NOT LIKE 'sqlite_%'",
+	); err != nil {
+		return nil, fmt.Errorf("error Select sqlite_master: %w", err)
+	}
+
+	s := &tenantSchema{
+		Tables:      map[string]tenantTableSchema{},
+		Indexes:     map[string]string{},
+		IndexTables: map[string]string{},
+	}
+	for _, r := range rows {
+		if r.Type == "index" {
+			s.Indexes[r.Name] = r.SQL.String
+			s.IndexTables[r.Name] = r.TblName
+			continue
+		}
+		cols := []tenantColumnSchema{}
+		if err := sqlx.SelectContext(
+			ctx,
+			db,
+			&cols,
+			"SELECT name, type, \"notnull\", dflt_value, pk FROM pragma_table_info(?)",
+			r.Name,
+		); err != nil {
+			return nil, fmt.Errorf("error Select pragma_table_info: table=%s, %w", r.Name, err)
+		}
+		s.Tables[r.Name] = tenantTableSchema{SQL: r.SQL.String, Columns: cols}
+	}
+	return s, nil
+}
+
+// 期待するスキーマとの差分
+// 余分なカラムもSELECT *で構造体に読み込むときにエラーになるので差分とする
+type TenantSchemaDrift struct {
+	MissingTables     []string `json:"missing_tables"`
+	MissingColumns    []string `json:"missing_columns"`
+	UnexpectedColumns []string `json:"unexpected_columns"`
+	MissingIndexes    []string `json:"missing_indexes"`
+}
+
+func (d *TenantSchemaDrift) Count() int {
+	return len(d.MissingTables) + len(d.MissingColumns) + len(d.UnexpectedColumns) + len(d.MissingIndexes)
+}
+
+func (d *TenantSchemaDrift) String() string {
+	parts := []string{}
+	for _, p := range []struct {
+		label string
+		names []string
+	}{
+		{"missing tables", d.MissingTables},
+		{"missing columns", d.MissingColumns},
+		{"unexpected columns", d.UnexpectedColumns},
+		{"missing indexes", d.MissingIndexes},
+	} {
+		if len(p.names) > 0 {
+			parts = append(parts, p.label+"="+strings.Join(p.names, ","))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func diffTenantSchema(expected, actual *tenantSchema) *TenantSchemaDrift {
+	d := &TenantSchemaDrift{}
+	for name, et := range expected.Tables {
+		at, ok := actual.Tables[name]
+		if !ok {
+			d.MissingTables = append(d.MissingTables, name)
+			continue
+		}
+		actualCols := map[string]bool{}
+		for _, c := range at.Columns {
+			actualCols[c.Name] = true
+		}
+		expectedCols := map[string]bool{}
+		for _, c := range et.Columns {
+			expectedCols[c.Name] = true
+			if !actualCols[c.Name] {
+				d.MissingColumns = append(d.MissingColumns, name+"."+c.Name)
+			}
+		}
+		for _, c := range at.Columns {
+			if !expectedCols[c.Name] {
+				d.UnexpectedColumns = append(d.UnexpectedColumns, name+"."+c.Name)
+			}
+		}
+	}
+	for name := range expected.Indexes {
+		if _, ok := actual.Indexes[name]; !ok {
+			d.MissingIndexes = append(d.MissingIndexes, name)
+		}
+	}
+	sort.Strings(d.MissingTables)
+	sort.Strings(d.MissingColumns)
+	sort.Strings(d.UnexpectedColumns)
+	sort.Strings(d.MissingIndexes)
+	return d
+}
+
+// 足りないテーブル、カラム、インデックスを追加する
+// NOT NULLでデフォルト値のないカラムは既存の行を埋められないので追加しない
+func migrateTenantSchema(ctx context.Context, db sqlx.ExecerContext, expected *tenantSchema, d *TenantSchemaDrift) (int64, error) {
+	var migrated int64
+	for _, name := range d.MissingTables {
+		if _, err := db.ExecContext(ctx, expected.Tables[name].SQL); err != nil {
+			return migrated, fmt.Errorf("error create table: table=%s, %w", name, err)
+		}
+		migrated++
+	}
+	for _, tc := range d.MissingColumns {
+		table, column, _ := strings.Cut(tc, ".")
+		var col tenantColumnSchema
+		for _, c := range expected.Tables[table].Columns {
+			if c.Name == column {
+				col = c
+			}
+		}
+		if col.PK > 0 || (col.NotNull && !col.Default.Valid) {
+			return migrated, fmt.Errorf("cannot add NOT NULL column without default: column=%s", tc)
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col.Name, col.Type)
+		if col.NotNull {
+			stmt += " NOT NULL"
+		}
+		if col.Default.Valid {
+			stmt += " DEFAULT " + col.Default.String
+		}
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return migrated, fmt.Errorf("error add column: column=%s, %w", tc, err)
+		}
+		migrated++
+	}
+	for _, name := range d.MissingIndexes {
+		if _, err := db.ExecContext(ctx, expected.Indexes[name]); err != nil {
+			return migrated, fmt.Errorf("error create index: index=%s, %w", name, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// テナントDBのスキーマを確認する
+// 差分があればログに出してメトリクスに記録し、設定されていれば足りないものを追加する
+// 確認に失敗してもテナントDBは使えるようにしておくため、エラーはログに出すだけにする
+func verifyTenantSchema(ctx context.Context, id int64, db *sqlx.DB) {
+	if !tenantSchemaCheckEnabled() {
+		return
+	}
+	key := strconv.FormatInt(id, 10)
+	expected, err := retrieveExpectedTenantSchema(ctx)
+	if err != nil {
+		log.Printf("tenant schema check skipped: %s", err)
+		return
+	}
+	actual, err := readTenantSchema(ctx, db)
+	if err != nil {
+		log.Printf("error readTenantSchema: tenantID=%d, %s", id, err)
+		return
+	}
+	d := diffTenantSchema(expected, actual)
+	if d.Count() == 0 {
+		tenantSchemaDriftVar.Delete(key)
+		return
+	}
+	log.Printf("tenant schema drift detected: tenantID=%d, %s", id, d)
+
+	if tenantSchemaAutoMigrateEnabled() {
+		migrated, err := migrateTenantSchema(ctx, db, expected, d)
+		tenantSchemaMigratedVar.Add(migrated)
+		if err != nil {
+			log.Printf("error migrateTenantSchema: tenantID=%d, %s", id, err)
+		}
+		if actual, err := readTenantSchema(ctx, db); err == nil {
+			d = diffTenantSchema(expected, actual)
+		}
+		if d.Count() == 0 {
+			log.Printf("tenant schema migrated: tenantID=%d, changes=%d", id, migrated)
+			tenantSchemaDriftVar.Delete(key)
+			return
+		}
+		log.Printf("tenant schema drift remains: tenantID=%d, %s", id, d)
+	}
+	drift := new(expvar.Int)
+	drift.Set(int64(d.Count()))
+	tenantSchemaDriftVar.Set(key, drift)
+}
+
+// 起動時にSQLiteに置いた全テナントのDBにマイグレーションを適用し、スキーマを確認する
+func verifyAllTenantSchemas(ctx context.Context) error {
+	if tenantSchemaCheckEnabled() {
+		if _, err := retrieveExpectedTenantSchema(ctx); err != nil {
+			return err
+		}
+	}
+	var ids []int64
+	if err := adminDB.SelectContext(ctx, &ids, "SELECT id FROM tenant WHERE storage = ?", TenantStorageSQLite); err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+	for _, id := range ids {
+		p := tenantDBPath(id)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		db, err := sqlx.Open(sqliteDriverName, tenantDBDSN(p))
+		if err != nil {
+			return fmt.Errorf("failed to open tenant DB: %w", err)
+		}
+		migrateTenantDBOrLog(ctx, id, db)
+		verifyTenantSchema(ctx, id, db)
+		db.Close()
+	}
+	return nil
+}
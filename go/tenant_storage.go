@@ -0,0 +1,222 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/logica0419/helpisu"
+)
+
+// テナントのデータ(player, competition, player_scoreなど)の保存先
+// tenant.storageにテナントごとに記録する
+const (
+	// テナントごとのSQLiteのファイル
+	TenantStorageSQLite = "sqlite"
+	// 全テナントで共有するMySQLのテーブル sql/admin/20_tenant_schema.sql を参照
+	TenantStorageMySQL = "mysql"
+)
+
+// 新しく作るテナントの保存先
+// 環境変数 ISUCON_TENANT_DB_BACKEND で変更できる
+func defaultTenantStorage() string {
+	return getEnv("ISUCON_TENANT_DB_BACKEND", TenantStorageSQLite)
+}
+
+func validateTenantStorage(storage string) error {
+	switch storage {
+	case TenantStorageSQLite, TenantStorageMySQL:
+		return nil
+	}
+	return fmt.Errorf("invalid storage: %s", storage)
+}
+
+var tenantStorageCache = helpisu.NewCache[int64, string]()
+
+// テナントのデータの保存先を返す
+func retrieveTenantStorage(ctx context.Context, tenantID int64) (string, error) {
+	if storage, ok := tenantStorageCache.Get(tenantID); ok {
+		return storage, nil
+	}
+	var storage string
+	if err := adminDB.GetContext(ctx, &storage, "SELECT storage FROM tenant WHERE id = ?", tenantID); err != nil {
+		return "", fmt.Errorf("error Select tenant.storage: id=%d, %w", tenantID, err)
+	}
+	tenantStorageCache.Set(tenantID, storage)
+	return storage, nil
+}
+
+var (
+	tenantMySQLDB   *sqlx.DB
+	tenantMySQLDBMu sync.Mutex
+	// ロック(GET_LOCK)だけに使う接続 lockTenantMySQLを参照
+	tenantMySQLLockDB *sqlx.DB
+)
+
+// ロックに使う接続の数の上限
+// 環境変数 ISUCON_TENANT_MYSQL_LOCK_CONNS で変更できる
+func tenantMySQLLockConns() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_TENANT_MYSQL_LOCK_CONNS", "64"))
+	if err != nil || n <= 0 {
+		return 64
+	}
+	return n
+}
+
+// テナントのデータを置くMySQLに接続する
+// 環境変数 ISUCON_TENANT_MYSQL_* が未設定の場合は管理用DBと同じデータベースを使う
+func connectTenantMySQLDB() (*sqlx.DB, error) {
+	tenantMySQLDBMu.Lock()
+	defer tenantMySQLDBMu.Unlock()
+	if tenantMySQLDB != nil {
+		return tenantMySQLDB, nil
+	}
+
+	db, err := sqlx.Open("mysql", tenantMySQLDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenant MySQL: %w", err)
+	}
+	db.SetMaxOpenConns(32)
+	db.SetMaxIdleConns(32)
+	tenantMySQLDB = db
+	return db, nil
+}
+
+// ロックを待つ間も接続を占有するので、クエリと同じ接続を使うとロックを持っている処理のクエリが接続を取れなくなる
+// ロックだけに使う接続を別に開く
+func connectTenantMySQLLockDB() (*sqlx.DB, error) {
+	tenantMySQLDBMu.Lock()
+	defer tenantMySQLDBMu.Unlock()
+	if tenantMySQLLockDB != nil {
+		return tenantMySQLLockDB, nil
+	}
+
+	db, err := sqlx.Open("mysql", tenantMySQLDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenant MySQL for lock: %w", err)
+	}
+	db.SetMaxOpenConns(tenantMySQLLockConns())
+	db.SetMaxIdleConns(tenantMySQLLockConns())
+	tenantMySQLLockDB = db
+	return db, nil
+}
+
+func tenantMySQLDSN() string {
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = getEnv("ISUCON_TENANT_MYSQL_HOST", appConfig.AdminDB.Host) + ":" +
+		getEnv("ISUCON_TENANT_MYSQL_PORT", appConfig.AdminDB.Port)
+	config.User = getEnv("ISUCON_TENANT_MYSQL_USER", appConfig.AdminDB.User)
+	config.Passwd = getEnv("ISUCON_TENANT_MYSQL_PASSWORD", appConfig.AdminDB.Password)
+	config.DBName = getEnv("ISUCON_TENANT_MYSQL_NAME", appConfig.AdminDB.Name)
+	config.InterpolateParams = true
+	return config.FormatDSN()
+}
+
+// テナントのデータを置くMySQLへの接続を閉じる
+func closeTenantMySQLDB() error {
+	tenantMySQLDBMu.Lock()
+	defer tenantMySQLDBMu.Unlock()
+	if tenantMySQLLockDB != nil {
+		tenantMySQLLockDB.Close()
+		tenantMySQLLockDB = nil
+	}
+	if tenantMySQLDB == nil {
+		return nil
+	}
+	err := tenantMySQLDB.Close()
+	tenantMySQLDB = nil
+	return err
+}
+
+// MySQLに置いたテナントのロック
+// 複数のサーバーで共有できるようにGET_LOCKを使う
+type tenantMySQLLock struct {
+	conn *sql.Conn
+	name string
+}
+
+const tenantMySQLLockTimeoutSeconds = 60
+
+func lockTenantMySQL(ctx context.Context, tenantID int64) (io.Closer, error) {
+	db, err := connectTenantMySQLLockDB()
+	if err != nil {
+		return nil, err
+	}
+	// GET_LOCKは接続に紐づくので、解放するまで接続を占有する
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrLockUnavailable
+		}
+		return nil, fmt.Errorf("error db.Conn: %w", err)
+	}
+	name := fmt.Sprintf("isuports_tenant_%d", tenantID)
+	var got sql.NullInt64
+	// contextが終わるとクエリが中断され、接続ごと捨てられるのでロックも解放される
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, tenantMySQLLockTimeoutSeconds).Scan(&got); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ErrLockUnavailable
+		}
+		return nil, fmt.Errorf("error GET_LOCK: name=%s, %w", name, err)
+	}
+	if !got.Valid || got.Int64 != 1 {
+		conn.Close()
+		// タイムアウトした
+		if got.Valid {
+			return nil, ErrLockUnavailable
+		}
+		return nil, fmt.Errorf("failed to GET_LOCK: name=%s", name)
+	}
+	return &tenantMySQLLock{conn: conn, name: name}, nil
+}
+
+func (l *tenantMySQLLock) Close() error {
+	defer l.conn.Close()
+	if _, err := l.conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", l.name); err != nil {
+		return fmt.Errorf("error RELEASE_LOCK: name=%s, %w", l.name, err)
+	}
+	return nil
+}
+
+// テナントのデータを全て削除する
+// SQLiteの場合はファイルを、MySQLの場合はテナントの行を削除する
+func deleteTenantData(ctx context.Context, tenantID int64) error {
+	storage, err := retrieveTenantStorage(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	if storage == TenantStorageMySQL {
+		db, err := connectTenantMySQLDB()
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"ranking_snapshot", "notification", "id_sequence", "score_dispute", "score_upload_diff", "score_upload", "player_score_history", "player_score", "competition", "player"} {
+			if _, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE tenant_id = ?", tenantID); err != nil {
+				return fmt.Errorf("error Delete %s: %w", table, err)
+			}
+		}
+		return nil
+	}
+
+	closeMemoryTenantDB(tenantID)
+	if db, ok := tenantDBCache.GetAndDelete(tenantID); ok {
+		db.Close()
+	}
+	p := tenantDBPath(tenantID)
+	for _, f := range []string{p, p + "-wal", p + "-shm", p + "-journal"} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error os.Remove: path=%s, %w", f, err)
+		}
+	}
+	return nil
+}
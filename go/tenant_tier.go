@@ -0,0 +1,258 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テナントの温度
+// アクセスの多いテナントはDBへの接続やキャッシュを保持し続け、
+// アクセスのないテナントは接続を閉じてキャッシュを捨てる
+const (
+	TenantTierHot  = "hot"
+	TenantTierWarm = "warm"
+	TenantTierCold = "cold"
+)
+
+// テナントの温度による管理をするか
+// 環境変数 ISUCON_TENANT_TIERING=1 で有効になる
+func tenantTieringEnabled() bool {
+	return getEnv("ISUCON_TENANT_TIERING", "0") == "1"
+}
+
+// 温度の判定に使う閾値
+type TenantTierConfig struct {
+	// 判定する間隔(ミリ秒)
+	IntervalMs int `json:"interval_ms"`
+	// この秒間リクエスト数以上ならhot
+	HotRequestsPerSecond float64 `json:"hot_requests_per_second"`
+	// この秒数アクセスがなければcoldにして追い出す
+	ColdIdleSeconds int64 `json:"cold_idle_seconds"`
+}
+
+func tenantTierConfig() TenantTierConfig {
+	conf := TenantTierConfig{
+		IntervalMs:           10000,
+		HotRequestsPerSecond: 1,
+		ColdIdleSeconds:      60,
+	}
+	if n, err := strconv.Atoi(getEnv("ISUCON_TENANT_TIER_INTERVAL_MS", "")); err == nil && n > 0 {
+		conf.IntervalMs = n
+	}
+	if f, err := strconv.ParseFloat(getEnv("ISUCON_TENANT_TIER_HOT_RPS", ""), 64); err == nil && f > 0 {
+		conf.HotRequestsPerSecond = f
+	}
+	if n, err := strconv.ParseInt(getEnv("ISUCON_TENANT_TIER_COLD_IDLE_SECONDS", ""), 10, 64); err == nil && n > 0 {
+		conf.ColdIdleSeconds = n
+	}
+	return conf
+}
+
+type tenantTierState struct {
+	// 今の判定期間のリクエスト数
+	requests int64
+	// 直前の判定期間の秒間リクエスト数
+	requestsPerSecond float64
+	lastAccessedAt    int64
+	tier              string
+	evictions         int64
+}
+
+var (
+	tenantTiers   = map[int64]*tenantTierState{}
+	tenantTiersMu sync.Mutex
+)
+
+// テナントへのリクエストを記録する
+func recordTenantAccess(tenantID int64) {
+	if !tenantTieringEnabled() {
+		return
+	}
+	tenantTiersMu.Lock()
+	defer tenantTiersMu.Unlock()
+	st, ok := tenantTiers[tenantID]
+	if !ok {
+		st = &tenantTierState{tier: TenantTierWarm}
+		tenantTiers[tenantID] = st
+	}
+	st.requests++
+	st.lastAccessedAt = time.Now().Unix()
+	// 追い出されたテナントに再びアクセスがあった
+	if st.tier == TenantTierCold {
+		st.tier = TenantTierWarm
+	}
+}
+
+// テナントの温度を判定し、coldになったテナントを追い出す
+func tenantTierJob() {
+	conf := tenantTierConfig()
+	now := time.Now().Unix()
+
+	tenantTiersMu.Lock()
+	evicts := []int64{}
+	for id, st := range tenantTiers {
+		st.requestsPerSecond = float64(st.requests) * 1000 / float64(conf.IntervalMs)
+		st.requests = 0
+		switch {
+		case st.requestsPerSecond >= conf.HotRequestsPerSecond:
+			st.tier = TenantTierHot
+		case now-st.lastAccessedAt >= conf.ColdIdleSeconds:
+			if st.tier != TenantTierCold {
+				st.tier = TenantTierCold
+				st.evictions++
+				evicts = append(evicts, id)
+			}
+		default:
+			st.tier = TenantTierWarm
+		}
+	}
+	tenantTiersMu.Unlock()
+
+	// テナントのロックを取る処理があるので、tenantTiersMuを持ったまま追い出さない
+	ctx := context.Background()
+	for _, id := range evicts {
+		if err := evictTenant(ctx, id); err != nil {
+			log.Printf("error evictTenant: id=%d, %s", id, err)
+		}
+	}
+}
+
+// テナントのDBへの接続を閉じ、テナントのキャッシュを捨てる
+// データは消えないので、次にアクセスがあったときに読み込み直す
+func evictTenant(ctx context.Context, tenantID int64) error {
+	storage, err := retrieveTenantStorage(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	tenantDB, err := connectToTenantDB(tenantID)
+	if err != nil {
+		return fmt.Errorf("error connectToTenantDB: %w", err)
+	}
+
+	competitionIDs := []string{}
+	if err := tenantDB.SelectContext(ctx, &competitionIDs, "SELECT id FROM competition WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	playerIDs := []string{}
+	if err := tenantDB.SelectContext(ctx, &playerIDs, "SELECT id FROM player WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select player: tenantID=%d, %w", tenantID, err)
+	}
+
+	// MySQLの接続は全テナントで共有しているので閉じない
+	if storage == TenantStorageSQLite {
+		if tenantDBMemoryEnabled() {
+			memoryTenantDBMu.Lock()
+			a, ok := memoryTenantDBs[tenantID]
+			memoryTenantDBMu.Unlock()
+			if ok {
+				if err := writeBackMemoryTenantDB(ctx, tenantID, a.conn); err != nil {
+					return fmt.Errorf("error writeBackMemoryTenantDB: %w", err)
+				}
+			}
+			closeMemoryTenantDB(tenantID)
+		} else {
+			// tenant_db_pool.go を参照
+			evictTenantDB(tenantID)
+		}
+	}
+
+	// ランキングのバージョンは残し、計算済みのページだけを捨てる
+	for _, id := range competitionIDs {
+		competitionCache.Delete(id)
+		rankingPageCache.Delete(id)
+		latestScoresCache.Delete(id)
+		billingReportCache.Delete(strconv.FormatInt(tenantID, 10) + id)
+	}
+	for _, id := range playerIDs {
+		playerCache.Delete(id)
+	}
+	vhsCache.Delete(tenantID)
+	scoredPlayerCache.Delete(tenantID)
+	walStatsCache.Delete(tenantID)
+	return nil
+}
+
+// テナントの温度を返す
+// 記録がないテナントはwarmとして扱う
+func retrieveTenantTier(tenantID int64) string {
+	tenantTiersMu.Lock()
+	defer tenantTiersMu.Unlock()
+	if st, ok := tenantTiers[tenantID]; ok {
+		return st.tier
+	}
+	return TenantTierWarm
+}
+
+type TenantTierDetail struct {
+	TenantID          string  `json:"tenant_id"`
+	Tier              string  `json:"tier"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	LastAccessedAt    int64   `json:"last_accessed_at"`
+	Evictions         int64   `json:"evictions"`
+}
+
+type TenantTiersHandlerResult struct {
+	Enabled bool               `json:"enabled"`
+	Config  TenantTierConfig   `json:"config"`
+	Hot     int64              `json:"hot"`
+	Warm    int64              `json:"warm"`
+	Cold    int64              `json:"cold"`
+	Tenants []TenantTierDetail `json:"tenants"`
+}
+
+// SasS管理者用API
+// テナントの温度の判定結果と閾値を取得する
+// GET /api/admin/tenants/tiers
+func tenantTiersHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	res := TenantTiersHandlerResult{
+		Enabled: tenantTieringEnabled(),
+		Config:  tenantTierConfig(),
+		Tenants: []TenantTierDetail{},
+	}
+	tenantTiersMu.Lock()
+	ids := make([]int64, 0, len(tenantTiers))
+	for id := range tenantTiers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		st := tenantTiers[id]
+		switch st.tier {
+		case TenantTierHot:
+			res.Hot++
+		case TenantTierCold:
+			res.Cold++
+		default:
+			res.Warm++
+		}
+		res.Tenants = append(res.Tenants, TenantTierDetail{
+			TenantID:          strconv.FormatInt(id, 10),
+			Tier:              st.tier,
+			RequestsPerSecond: st.requestsPerSecond,
+			LastAccessedAt:    st.lastAccessedAt,
+			Evictions:         st.evictions,
+		})
+	}
+	tenantTiersMu.Unlock()
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナントの温度の記録を全て捨てる
+func resetTenantTiers() {
+	tenantTiersMu.Lock()
+	defer tenantTiersMu.Unlock()
+	tenantTiers = map[int64]*tenantTierState{}
+}
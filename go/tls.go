@@ -0,0 +1,131 @@
+package isuports
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// リバースプロキシを置かずにHTTPSで直接受け付ける
+// 設定ファイルの tls か環境変数 ISUCON_TLS_* で設定する config.go を参照
+// - cert_file, key_file: 証明書と秘密鍵のファイル *.t.isucon.dev のワイルドカード証明書をそのまま使える
+// - autocert: Let's Encryptから証明書を取得する
+//   ワイルドカード証明書はDNS-01でしか取得できないので、テナントのドメインごとにTLS-ALPN-01で取得する
+//   取得できるのは hostname.base の直下にある存在するテナントと hostname.admin だけ
+// 証明書を指定した場合はautocertより優先する
+func tlsEnabled() bool {
+	return appConfig.TLS.CertFile != "" || appConfig.TLS.Autocert
+}
+
+// HTTPSのリスナーに使うtls.Configと、http_portで受け付けるハンドラを返す
+// HTTPSを使わない場合はどちらもnil http_portが空の場合はハンドラはnil
+func newTLSConfig() (*tls.Config, http.Handler, error) {
+	cfg := appConfig.TLS
+	if !tlsEnabled() {
+		return nil, nil, nil
+	}
+	var redirect http.Handler
+	if cfg.HTTPPort != "" {
+		redirect = http.HandlerFunc(redirectToHTTPS)
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error tls.LoadX509KeyPair: cert=%s, key=%s, %w", cfg.CertFile, cfg.KeyFile, err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+			MinVersion:   tls.VersionTLS12,
+		}, redirect, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		HostPolicy: autocertHostPolicy,
+		Email:      cfg.AutocertEmail,
+	}
+	if redirect != nil {
+		// HTTP-01のチャレンジにも応答し、それ以外はHTTPSへリダイレクトする
+		redirect = m.HTTPHandler(redirect)
+	}
+	tlsCfg := m.TLSConfig()
+	tlsCfg.MinVersion = tls.VersionTLS12
+	return tlsCfg, redirect, nil
+}
+
+// 証明書を取得してよいホストか
+// 存在しないテナントのドメインで証明書を要求されてLet's Encryptのレート制限に達しないようにする
+func autocertHostPolicy(ctx context.Context, host string) error {
+	if host == appConfig.Hostname.Admin {
+		return nil
+	}
+	tenantName := strings.TrimSuffix(host, appConfig.Hostname.Base)
+	if tenantName == host || tenantName == "" || strings.Contains(tenantName, ".") {
+		return fmt.Errorf("autocert: host not allowed: %s", host)
+	}
+	var id int64
+	if err := adminDB.GetContext(ctx, &id, "SELECT id FROM tenant WHERE name = ?", tenantName); err != nil {
+		return fmt.Errorf("autocert: tenant not found: host=%s, %w", host, err)
+	}
+	return nil
+}
+
+// HTTPSのリスナーを作る
+func listenTLS(address string, tlsCfg *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error Listen: address=%s, %w", address, err)
+	}
+	return tls.NewListener(l, tlsCfg), nil
+}
+
+// 同じURLのHTTPSへリダイレクトする
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port := appConfig.Server.Port; port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	// POSTなどのメソッドとボディを保ったままリダイレクトさせる
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// http_portでlistenしてhandlerで受け付ける
+// 終了するときに処理中のリクエストを待てるようにextraServersに加える shutdown.go を参照
+func startHTTPRedirect(handler http.Handler) error {
+	address := fmt.Sprintf(":%s", appConfig.TLS.HTTPPort)
+	var (
+		l   net.Listener
+		err error
+	)
+	if listenerCount() > 1 {
+		// 子プロセスごとに同じポートをlistenする
+		l, err = listenReusePort(address)
+	} else {
+		l, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return fmt.Errorf("error Listen: address=%s, %w", address, err)
+	}
+	srv := &http.Server{Handler: handler}
+	extraServersMu.Lock()
+	extraServers = append(extraServers, srv)
+	extraServersMu.Unlock()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("error http redirect server: address=%s, %s", address, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,285 @@
+package isuports
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// 閲覧履歴のジャーナル
+// 有効にすると、ランキングの閲覧はメモリ上のvisitHistoriesではなくジャーナルのファイルに1行ずつ追記する
+// delayedInsertVisitHistoryは追記するファイルを切り替えてから、閉じたファイルを古い順にvisit_historyに書き込んで削除する
+// プロセスが落ちても書き込む前の閲覧履歴はファイルに残り、次の起動時に書き込む
+// 追記はOSのページキャッシュまでなので、OSごと落ちた場合は直前の閲覧履歴が失われることがある
+// visit_historyに書き込んでからファイルを消すまでの間に落ちると同じ閲覧履歴を2回書き込むが、
+// 課金の計算は最初に閲覧した日時(MIN(created_at))しか使わないので請求金額は変わらない
+// リスナーのプロセスを分けた場合(listener.go)に同じファイルに追記しないように、プロセスごとにサブディレクトリ(p{リスナーの番号})を使い、
+// ディレクトリのロックファイルをflockする 起動時にはロックを取れた他のディレクトリ(終了したプロセスのもの)のファイルも引き取って書き込む
+
+// ジャーナルのファイルを置くディレクトリ
+// 環境変数 ISUCON_VISIT_HISTORY_JOURNAL_DIR で指定する 空ならジャーナルを使わない
+func visitHistoryJournalDir() string {
+	return getEnv("ISUCON_VISIT_HISTORY_JOURNAL_DIR", "")
+}
+
+const visitHistoryJournalExt = ".jsonl"
+
+const visitHistoryJournalLockFile = ".lock"
+
+// 追記中のファイル visitHistoriesMuで保護する
+// ファイル名は連番で、seqより小さい番号のファイルは閉じていて書き込みを待っている
+var visitHistoryJournal struct {
+	dir  string
+	lock *flock.Flock
+	f    *os.File
+	seq  int64
+	rows int // 追記中のファイルの行数
+}
+
+func visitHistoryJournalEnabled() bool {
+	return visitHistoryJournal.f != nil
+}
+
+func visitHistoryJournalPath(seq int64) string {
+	return visitHistoryJournalSegmentPath(visitHistoryJournal.dir, seq)
+}
+
+func visitHistoryJournalSegmentPath(dir string, seq int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, visitHistoryJournalExt))
+}
+
+// ジャーナルを開く 前回のプロセスが残したファイルは閉じたファイルとして扱う
+// 起動時に1回だけ呼ぶ
+func openVisitHistoryJournal(base string) error {
+	dir := filepath.Join(base, "p"+getEnv(listenerIndexEnv, "0"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error os.MkdirAll: %w", err)
+	}
+	// 同時に起動した他のプロセスがファイルを引き取るために一時的にロックを取っていることがあるので、少し待つ
+	lock := flock.New(filepath.Join(dir, visitHistoryJournalLockFile))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	locked, err := lock.TryLockContext(ctx, 100*time.Millisecond)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("error flock: %w", err)
+	}
+	if !locked {
+		return fmt.Errorf("visit history journal is used by another process: dir=%s", dir)
+	}
+	visitHistoryJournal.dir = dir
+	visitHistoryJournal.lock = lock
+
+	seqs, err := visitHistoryJournalSegments(dir)
+	if err != nil {
+		return err
+	}
+	var seq int64 = 1
+	if len(seqs) > 0 {
+		seq = seqs[len(seqs)-1] + 1
+	}
+	if seq, err = adoptVisitHistoryJournals(base, seq); err != nil {
+		return err
+	}
+	return switchVisitHistoryJournal(seq)
+}
+
+// 他のディレクトリに残っている書き込み前のファイルを、seqからの番号で自分のディレクトリに移す 次に使う番号を返す
+// ロックを取れないディレクトリは動いている他のプロセスのものなので触らない
+// baseの直下のファイルはサブディレクトリに分ける前のもの
+func adoptVisitHistoryJournals(base string, seq int64) (int64, error) {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return seq, fmt.Errorf("error os.ReadDir: %w", err)
+	}
+	dirs := []string{base}
+	for _, e := range entries {
+		if p := filepath.Join(base, e.Name()); e.IsDir() && p != visitHistoryJournal.dir {
+			dirs = append(dirs, p)
+		}
+	}
+	for _, dir := range dirs {
+		lock := flock.New(filepath.Join(dir, visitHistoryJournalLockFile))
+		locked, err := lock.TryLock()
+		if err != nil {
+			return seq, fmt.Errorf("error flock: %w", err)
+		}
+		if !locked {
+			continue
+		}
+		seqs, err := visitHistoryJournalSegments(dir)
+		if err == nil {
+			for _, s := range seqs {
+				if err = os.Rename(visitHistoryJournalSegmentPath(dir, s), visitHistoryJournalPath(seq)); err != nil {
+					err = fmt.Errorf("error os.Rename: %w", err)
+					break
+				}
+				seq++
+			}
+		}
+		lock.Unlock()
+		if err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// seqのファイルを新しく作って追記先にする 前のファイルは閉じる
+func switchVisitHistoryJournal(seq int64) error {
+	f, err := os.OpenFile(visitHistoryJournalPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error os.OpenFile: %w", err)
+	}
+	if visitHistoryJournal.f != nil {
+		if err := visitHistoryJournal.f.Close(); err != nil {
+			f.Close()
+			return fmt.Errorf("error Close visit history journal: %w", err)
+		}
+	}
+	visitHistoryJournal.f = f
+	visitHistoryJournal.seq = seq
+	visitHistoryJournal.rows = 0
+	return nil
+}
+
+// ディレクトリにあるジャーナルのファイルの番号を昇順で返す
+func visitHistoryJournalSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error os.ReadDir: %w", err)
+	}
+	seqs := []int64{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, visitHistoryJournalExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, visitHistoryJournalExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// 閲覧履歴を1行追記する visitHistoriesMuを取ってから呼ぶ
+func appendVisitHistoryJournal(vh VisitHistoryRow) error {
+	b, err := json.Marshal(vh)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	if _, err := visitHistoryJournal.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error Write visit history journal: %w", err)
+	}
+	visitHistoryJournal.rows++
+	return nil
+}
+
+// 追記するファイルを切り替えて、閉じたファイルの閲覧履歴をinsertに渡す
+// insertが成功したファイルは削除し、失敗したファイルは次に呼んだときにもう一度渡す
+// visitHistoryFlushMuを取ってから呼ぶ
+func drainVisitHistoryJournal(insert func([]VisitHistoryRow) error) ([]VisitHistoryRow, error) {
+	visitHistoriesMu.Lock()
+	err := switchVisitHistoryJournal(visitHistoryJournal.seq + 1)
+	current := visitHistoryJournal.seq
+	visitHistoriesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	seqs, err := visitHistoryJournalSegments(visitHistoryJournal.dir)
+	if err != nil {
+		return nil, err
+	}
+	drained := []VisitHistoryRow{}
+	for _, seq := range seqs {
+		if seq >= current {
+			break
+		}
+		p := visitHistoryJournalPath(seq)
+		rows, err := readVisitHistoryJournal(p)
+		if err != nil {
+			return drained, err
+		}
+		if len(rows) > 0 {
+			if err := insert(rows); err != nil {
+				return drained, err
+			}
+		}
+		if err := os.Remove(p); err != nil {
+			return drained, fmt.Errorf("error os.Remove: %w", err)
+		}
+		drained = append(drained, rows...)
+	}
+	return drained, nil
+}
+
+// ジャーナルのファイルを読む
+// 書き込みの途中で落ちた最後の行は読めないので捨てる
+func readVisitHistoryJournal(p string) ([]VisitHistoryRow, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("error os.Open: %w", err)
+	}
+	defer f.Close()
+
+	rows := []VisitHistoryRow{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var vh VisitHistoryRow
+		if err := json.Unmarshal(s.Bytes(), &vh); err != nil {
+			continue
+		}
+		rows = append(rows, vh)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error read visit history journal: path=%s, %w", p, err)
+	}
+	return rows, nil
+}
+
+// 書き込んでいない閲覧履歴を捨てる 初期化のときに呼ぶ
+// visitHistoryFlushMuを取ってから呼ぶ
+func discardVisitHistoryJournal() error {
+	visitHistoriesMu.Lock()
+	defer visitHistoriesMu.Unlock()
+	seqs, err := visitHistoryJournalSegments(visitHistoryJournal.dir)
+	if err != nil {
+		return err
+	}
+	if err := switchVisitHistoryJournal(visitHistoryJournal.seq + 1); err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if err := os.Remove(visitHistoryJournalPath(seq)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error os.Remove: %w", err)
+		}
+	}
+	return nil
+}
+
+// 追記中のファイルを閉じる 終了するときに呼ぶ
+func closeVisitHistoryJournal() {
+	visitHistoriesMu.Lock()
+	defer visitHistoriesMu.Unlock()
+	if visitHistoryJournal.f != nil {
+		visitHistoryJournal.f.Close()
+		visitHistoryJournal.f = nil
+	}
+	if visitHistoryJournal.lock != nil {
+		visitHistoryJournal.lock.Unlock()
+		visitHistoryJournal.lock = nil
+	}
+}
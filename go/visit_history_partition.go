@@ -0,0 +1,142 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// visit_historyは月ごとにパーティションを切っている
+// パーティション名は p{YYYYMM} で、その月の末尾(翌月1日0時)未満の行が入る
+// pmax は MAXVALUE のパーティションで、まだパーティションが作られていない未来の行を受け止める
+const visitHistoryMaxPartition = "pmax"
+
+type visitHistoryPartition struct {
+	Name        sql.NullString `db:"PARTITION_NAME"`
+	Description sql.NullString `db:"PARTITION_DESCRIPTION"`
+}
+
+// 課金計算のためにvisit_historyを保持する月数
+// 0の場合は古いパーティションを削除しない
+// 保持期間は大会ごとの削除(visit_history_purge.go)で決めるのが基本で、こちらは削除しきった古い月のパーティションを片付けるために使う
+// どちらも課金レポートをbilling_reportに保存した大会の閲覧履歴しか消さないので、両方を有効にしても請求金額は変わらない
+// 開催中の大会や課金レポートを保存していない大会の閲覧履歴が残っている月のパーティションは、保持期間を過ぎても削除しない
+func visitHistoryRetentionMonths() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_VISIT_HISTORY_RETENTION_MONTHS", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// 月の初日0時を返す
+func beginningOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// visit_historyのパーティションを保守する
+// 今月と来月のパーティションを用意し、保持期間を過ぎて締まった月のパーティションを削除する
+func maintainVisitHistoryPartitions(ctx context.Context, now time.Time) error {
+	parts := []visitHistoryPartition{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&parts,
+		"SELECT PARTITION_NAME, PARTITION_DESCRIPTION FROM information_schema.PARTITIONS "+
+			"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'visit_history' ORDER BY PARTITION_ORDINAL_POSITION",
+	); err != nil {
+		return fmt.Errorf("error Select information_schema.PARTITIONS: %w", err)
+	}
+	if len(parts) == 0 || !parts[0].Name.Valid {
+		// パーティションが切られていない古いスキーマ sql/admin/migration/013_visit_history_partition.sql を実行するまで何もしない
+		log.Printf("visit_history is not partitioned, skip partition maintenance")
+		return nil
+	}
+
+	existing := make(map[string]struct{}, len(parts))
+	for _, p := range parts {
+		existing[p.Name.String] = struct{}{}
+	}
+	if _, ok := existing[visitHistoryMaxPartition]; !ok {
+		return fmt.Errorf("visit_history has no %s partition", visitHistoryMaxPartition)
+	}
+
+	// 今月と来月のパーティションをpmaxから切り出す
+	thisMonth := beginningOfMonth(now)
+	for _, month := range []time.Time{thisMonth, thisMonth.AddDate(0, 1, 0)} {
+		name := month.Format("p200601")
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		lessThan := month.AddDate(0, 1, 0).Unix()
+		if _, err := adminDB.ExecContext(
+			ctx,
+			fmt.Sprintf(
+				"ALTER TABLE visit_history REORGANIZE PARTITION %s INTO (PARTITION %s VALUES LESS THAN (%d), PARTITION %s VALUES LESS THAN MAXVALUE)",
+				visitHistoryMaxPartition, name, lessThan, visitHistoryMaxPartition,
+			),
+		); err != nil {
+			return fmt.Errorf("error Reorganize visit_history partition: name=%s, %w", name, err)
+		}
+	}
+
+	retention := visitHistoryRetentionMonths()
+	if retention == 0 {
+		return nil
+	}
+	// 保持期間より前に締まった月のパーティションを削除する
+	cutoff := thisMonth.AddDate(0, -retention, 0).Unix()
+	dropped := false
+	for _, p := range parts {
+		if p.Name.String == visitHistoryMaxPartition || !p.Description.Valid {
+			continue
+		}
+		lessThan, err := strconv.ParseInt(p.Description.String, 10, 64)
+		if err != nil {
+			continue
+		}
+		if lessThan > cutoff {
+			continue
+		}
+		var unsettled bool
+		if err := adminDB.GetContext(
+			ctx,
+			&unsettled,
+			fmt.Sprintf(
+				"SELECT EXISTS (SELECT 1 FROM visit_history PARTITION (%s) AS vh WHERE NOT EXISTS "+
+					"(SELECT 1 FROM billing_report AS br WHERE br.tenant_id = vh.tenant_id AND br.competition_id = vh.competition_id))",
+				p.Name.String,
+			),
+		); err != nil {
+			return fmt.Errorf("error Select visit_history partition: name=%s, %w", p.Name.String, err)
+		}
+		if unsettled {
+			log.Printf("skip dropping visit_history partition %s: it has visits of competitions without billing_report", p.Name.String)
+			continue
+		}
+		if _, err := adminDB.ExecContext(
+			ctx,
+			fmt.Sprintf("ALTER TABLE visit_history DROP PARTITION %s", p.Name.String),
+		); err != nil {
+			return fmt.Errorf("error Drop visit_history partition: name=%s, %w", p.Name.String, err)
+		}
+		log.Printf("dropped visit_history partition %s", p.Name.String)
+		dropped = true
+	}
+	if dropped {
+		// 削除した分の閲覧履歴は課金計算に使えなくなる
+		vhsCache.Reset()
+		// 削除した閲覧の後の閲覧を記録し直す
+		visitedCompetitionCache.Reset()
+	}
+	return nil
+}
+
+// visit_historyのパーティションの保守を定期的に実行する
+func visitHistoryPartitionJob() {
+	if err := maintainVisitHistoryPartitions(context.Background(), time.Now()); err != nil {
+		log.Printf("error maintainVisitHistoryPartitions: %s", err)
+	}
+}
@@ -0,0 +1,271 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon12-qualify/webapp/go/internal/apperr"
+	"github.com/labstack/echo/v4"
+)
+
+// 終了した大会のvisit_historyの削除
+// 課金レポートをbilling_reportに保存した大会の閲覧履歴は課金の計算に使わないので、保持期間を過ぎたら行ごとに削除する
+// 保持期間はこちらで決める 月ごとのパーティションの削除(visit_history_partition.go)は、
+// この削除で課金レポートを保存した大会の閲覧履歴だけになった古い月のパーティションを片付けるためのもの
+// 削除した後に単価の変更などでbilling_reportの行を消すと、計算し直した閲覧者数は削除した分だけ少なくなる
+// スコアの訂正や削除では行を消さずに参加者数だけを計算し直し、閲覧者数は保存した値を残す(recalculateBillingReportPlayers)
+
+const (
+	VisitHistoryPurgeStateRunning = "running"
+	VisitHistoryPurgeStateDone    = "done"
+	VisitHistoryPurgeStateFailed  = "failed"
+)
+
+// 終了した大会のvisit_historyを保持する日数
+// 環境変数 ISUCON_VISIT_HISTORY_PURGE_RETENTION_DAYS で変更できる 0の場合は定期的には削除しない
+func visitHistoryPurgeRetentionDays() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_VISIT_HISTORY_PURGE_RETENTION_DAYS", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// 定期的に削除する間隔
+// 環境変数 ISUCON_VISIT_HISTORY_PURGE_INTERVAL_MS で変更できる
+func visitHistoryPurgeIntervalMs() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_VISIT_HISTORY_PURGE_INTERVAL_MS", "3600000"))
+	if err != nil || n <= 0 {
+		return 3600000
+	}
+	return n
+}
+
+// 1回のDELETEで削除する行数の上限
+// 環境変数 ISUCON_VISIT_HISTORY_PURGE_BATCH_SIZE で変更できる
+func visitHistoryPurgeBatchSize() int {
+	n, err := strconv.Atoi(getEnv("ISUCON_VISIT_HISTORY_PURGE_BATCH_SIZE", "10000"))
+	if err != nil || n <= 0 {
+		return 10000
+	}
+	return n
+}
+
+// visit_historyの削除の進捗
+type visitHistoryPurgeProgress struct {
+	mu            sync.Mutex
+	state         string
+	trigger       string // "ticker" または "admin"
+	retentionDays int
+	cutoff        int64
+	competitions  int
+	done          int
+	deletedRows   int64
+	startedAt     int64
+	finishedAt    int64
+	err           string
+}
+
+type VisitHistoryPurgeDetail struct {
+	State         string `json:"state"`
+	Trigger       string `json:"trigger"`
+	RetentionDays int    `json:"retention_days"`
+	Cutoff        int64  `json:"cutoff"`       // この時刻(unix秒)より前の閲覧履歴を削除する
+	Competitions  int    `json:"competitions"` // 削除の対象の終了した大会の数
+	Done          int    `json:"done"`
+	DeletedRows   int64  `json:"deleted_rows"`
+	StartedAt     int64  `json:"started_at"`
+	FinishedAt    *int64 `json:"finished_at"`
+	Error         string `json:"error,omitempty"`
+}
+
+func (j *visitHistoryPurgeProgress) Detail() VisitHistoryPurgeDetail {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d := VisitHistoryPurgeDetail{
+		State:         j.state,
+		Trigger:       j.trigger,
+		RetentionDays: j.retentionDays,
+		Cutoff:        j.cutoff,
+		Competitions:  j.competitions,
+		Done:          j.done,
+		DeletedRows:   j.deletedRows,
+		StartedAt:     j.startedAt,
+		Error:         j.err,
+	}
+	if j.finishedAt != 0 {
+		finishedAt := j.finishedAt
+		d.FinishedAt = &finishedAt
+	}
+	return d
+}
+
+// 最後に実行した削除
+// プロセスのメモリ上にだけ持つので、再起動すると進捗は見られなくなる
+var (
+	visitHistoryPurge   *visitHistoryPurgeProgress
+	visitHistoryPurgeMu sync.Mutex
+)
+
+func resetVisitHistoryPurge() {
+	visitHistoryPurgeMu.Lock()
+	defer visitHistoryPurgeMu.Unlock()
+	if visitHistoryPurge != nil && visitHistoryPurge.Detail().State == VisitHistoryPurgeStateRunning {
+		// 実行中の削除は終わるまで見えるように残す
+		return
+	}
+	visitHistoryPurge = nil
+}
+
+// 削除を始める 既に実行中ならnilを返す
+func startVisitHistoryPurge(trigger string, retentionDays int, now time.Time) *visitHistoryPurgeProgress {
+	visitHistoryPurgeMu.Lock()
+	defer visitHistoryPurgeMu.Unlock()
+	if visitHistoryPurge != nil && visitHistoryPurge.Detail().State == VisitHistoryPurgeStateRunning {
+		return nil
+	}
+	j := &visitHistoryPurgeProgress{
+		state:         VisitHistoryPurgeStateRunning,
+		trigger:       trigger,
+		retentionDays: retentionDays,
+		cutoff:        now.AddDate(0, 0, -retentionDays).Unix(),
+		startedAt:     now.Unix(),
+	}
+	visitHistoryPurge = j
+	return j
+}
+
+// 保存した課金レポートのある大会のうち、cutoffより前に終了した大会の閲覧履歴でcutoffより前のものを削除する
+// 行ロックを長く持たないように、大会ごとにbatchSize行ずつ削除する
+func purgeVisitHistory(ctx context.Context, j *visitHistoryPurgeProgress, batchSize int) {
+	fail := func(err error) {
+		log.Printf("error purgeVisitHistory: %s", err)
+		j.mu.Lock()
+		j.state = VisitHistoryPurgeStateFailed
+		j.err = err.Error()
+		j.finishedAt = time.Now().Unix()
+		j.mu.Unlock()
+	}
+
+	type target struct {
+		TenantID      int64  `db:"tenant_id"`
+		CompetitionID string `db:"competition_id"`
+	}
+	targets := []target{}
+	if err := adminDB.SelectContext(
+		ctx,
+		&targets,
+		"SELECT tenant_id, competition_id FROM billing_report WHERE finished_at < ? ORDER BY tenant_id, competition_id",
+		j.cutoff,
+	); err != nil {
+		fail(fmt.Errorf("error Select billing_report: %w", err))
+		return
+	}
+	j.mu.Lock()
+	j.competitions = len(targets)
+	j.mu.Unlock()
+
+	for _, t := range targets {
+		var deleted int64
+		for {
+			r, err := adminDB.ExecContext(
+				ctx,
+				"DELETE FROM visit_history WHERE tenant_id = ? AND competition_id = ? AND created_at < ? LIMIT ?",
+				t.TenantID, t.CompetitionID, j.cutoff, batchSize,
+			)
+			if err != nil {
+				fail(fmt.Errorf("error Delete visit_history: tenantID=%d, competitionID=%s, %w", t.TenantID, t.CompetitionID, err))
+				return
+			}
+			n, err := r.RowsAffected()
+			if err != nil {
+				fail(fmt.Errorf("error RowsAffected: %w", err))
+				return
+			}
+			deleted += n
+			j.mu.Lock()
+			j.deletedRows += n
+			j.mu.Unlock()
+			if n < int64(batchSize) {
+				break
+			}
+		}
+		if deleted > 0 {
+			vhsCache.Delete(t.TenantID)
+		}
+		j.mu.Lock()
+		j.done++
+		j.mu.Unlock()
+	}
+
+	j.mu.Lock()
+	j.state = VisitHistoryPurgeStateDone
+	j.finishedAt = time.Now().Unix()
+	j.mu.Unlock()
+	log.Printf("purged visit_history: cutoff=%d, rows=%d", j.cutoff, j.Detail().DeletedRows)
+}
+
+// 保持期間を過ぎた終了した大会のvisit_historyを定期的に削除する
+func visitHistoryPurgeJob() {
+	days := visitHistoryPurgeRetentionDays()
+	if days == 0 {
+		return
+	}
+	j := startVisitHistoryPurge("ticker", days, time.Now())
+	if j == nil {
+		return
+	}
+	purgeVisitHistory(context.Background(), j, visitHistoryPurgeBatchSize())
+}
+
+// SasS管理者用API
+// 終了した大会のvisit_historyの削除をバックグラウンドで始める
+// POST /api/admin/visit_history/purge
+// フォームのretention_daysで保持する日数を指定する 省略した場合はISUCON_VISIT_HISTORY_PURGE_RETENTION_DAYS
+// 進捗は GET /api/admin/visit_history/purge で確認する
+func visitHistoryPurgeHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	days := visitHistoryPurgeRetentionDays()
+	if s := c.FormValue("retention_days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return apperr.InvalidField("retention_days", "retention_days must be a non-negative integer")
+		}
+		days = n
+	} else if days == 0 {
+		return apperr.InvalidField("retention_days", "retention_days is required when ISUCON_VISIT_HISTORY_PURGE_RETENTION_DAYS is not set")
+	}
+
+	j := startVisitHistoryPurge("admin", days, time.Now())
+	if j == nil {
+		return ErrVisitHistoryPurgeAlreadyRunning
+	}
+	go purgeVisitHistory(context.Background(), j, visitHistoryPurgeBatchSize())
+
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: j.Detail()})
+}
+
+// SasS管理者用API
+// 最後に実行したvisit_historyの削除の進捗を返す
+// GET /api/admin/visit_history/purge
+func visitHistoryPurgeProgressHandler(c echo.Context) error {
+	if _, err := authorizeAdmin(c); err != nil {
+		return err
+	}
+
+	visitHistoryPurgeMu.Lock()
+	j := visitHistoryPurge
+	visitHistoryPurgeMu.Unlock()
+	if j == nil {
+		return ErrVisitHistoryPurgeNotFound
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: j.Detail()})
+}
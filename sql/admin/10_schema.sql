@@ -6,10 +6,27 @@ DROP TABLE IF EXISTS `id_generator`;
 
 DROP TABLE IF EXISTS `visit_history`;
 
+DROP TABLE IF EXISTS `billing_plan`;
+
+DROP TABLE IF EXISTS `impersonation`;
+
+DROP TABLE IF EXISTS `credential`;
+
+DROP TABLE IF EXISTS `revoked_session`;
+
+DROP TABLE IF EXISTS `ip_allowlist`;
+
+DROP TABLE IF EXISTS `billing_receipt`;
+
+DROP TABLE IF EXISTS `billing_report`;
+
 CREATE TABLE `tenant` (
   `id` BIGINT NOT NULL AUTO_INCREMENT,
   `name` VARCHAR(255) NOT NULL,
   `display_name` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(16) NOT NULL DEFAULT 'active',
+  `storage` VARCHAR(16) NOT NULL DEFAULT 'sqlite',
+  `sandbox_of` BIGINT NULL,
   `created_at` BIGINT NOT NULL,
   `updated_at` BIGINT NOT NULL,
   PRIMARY KEY (`id`),
@@ -29,7 +46,100 @@ CREATE TABLE `visit_history` (
   `competition_id` VARCHAR(255) NOT NULL,
   `created_at` BIGINT NOT NULL,
   `updated_at` BIGINT NOT NULL,
-  INDEX `player_id_idx` (`player_id`, `competition_id`, `tenant_id`),
+  INDEX `player_id_idx` (`player_id`, `competition_id`, `tenant_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4
+-- 月ごとにパーティションを分けて、古い月はパーティションごと捨てられるようにする
+-- 新しい月のパーティションはアプリケーションが pmax を分割して作る
+PARTITION BY RANGE (`created_at`) (
+  PARTITION p202205 VALUES LESS THAN (1654009200),
+  PARTITION pmax VALUES LESS THAN MAXVALUE
+);
+
+CREATE INDEX tenant_competition_idx ON visit_history (tenant_id, competition_id);
+
+CREATE TABLE `billing_plan` (
+  `tenant_id` BIGINT NOT NULL,
+  `player_yen` BIGINT NOT NULL,
+  `visitor_yen` BIGINT NOT NULL,
+  `tier` VARCHAR(16) NOT NULL DEFAULT 'standard',
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`)
 ) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
 
-CREATE INDEX tenant_competition_idx ON visit_history (tenant_id, competition_id);
\ No newline at end of file
+-- SaaS管理者によるテナント管理者へのなりすましの記録
+CREATE TABLE `impersonation` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `admin_subject` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `reason` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  INDEX `tenant_id_idx` (`tenant_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- ログインAPIで使うパスワードとログアウトしたセッション
+CREATE TABLE `credential` (
+  `tenant_id` BIGINT NOT NULL,
+  `login_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `password_hash` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `login_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE `revoked_session` (
+  `jti` VARCHAR(64) NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  PRIMARY KEY (`jti`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- 接続元IPアドレスの許可リスト tenant_idが0の行はSaaS管理者向けAPIのもの
+CREATE TABLE `ip_allowlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `cidr` VARCHAR(64) NOT NULL,
+  `note` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `tenant_cidr` (`tenant_id`, `cidr`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- 大会の終了時に確定した請求の記録 更新しない
+CREATE TABLE `billing_receipt` (
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `finished_at` BIGINT NOT NULL,
+  `player_count` BIGINT NOT NULL,
+  `visitor_count` BIGINT NOT NULL,
+  `player_yen` BIGINT NOT NULL,
+  `visitor_yen` BIGINT NOT NULL,
+  `billing_yen` BIGINT NOT NULL,
+  `scores_hash` CHAR(64) NOT NULL,
+  `visits_hash` CHAR(64) NOT NULL,
+  `input_hash` CHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `competition_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- 終了した大会の課金レポート 大会の終了時に計算して保存する
+CREATE TABLE `billing_report` (
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `finished_at` BIGINT NOT NULL,
+  `player_count` BIGINT NOT NULL,
+  `visitor_count` BIGINT NOT NULL,
+  `billing_player_yen` BIGINT NOT NULL,
+  `billing_visitor_yen` BIGINT NOT NULL,
+  `plan` VARCHAR(16) NOT NULL,
+  `discount_yen` BIGINT NOT NULL,
+  `billing_yen` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `competition_id`),
+  INDEX `finished_at_idx` (`finished_at`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
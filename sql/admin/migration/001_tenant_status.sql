@@ -0,0 +1,4 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+ALTER TABLE `tenant` ADD COLUMN `status` VARCHAR(16) NOT NULL DEFAULT 'active' AFTER `display_name`;
@@ -0,0 +1,11 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+CREATE TABLE IF NOT EXISTS `billing_plan` (
+  `tenant_id` BIGINT NOT NULL,
+  `player_yen` BIGINT NOT NULL,
+  `visitor_yen` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
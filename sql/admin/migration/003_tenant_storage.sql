@@ -0,0 +1,5 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+-- あわせて 20_tenant_schema.sql も実行すること
+USE `isuports`;
+
+ALTER TABLE `tenant` ADD COLUMN `storage` VARCHAR(16) NOT NULL DEFAULT 'sqlite' AFTER `status`;
@@ -0,0 +1,15 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+CREATE TABLE IF NOT EXISTS `impersonation` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `admin_subject` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `reason` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  INDEX `tenant_id_idx` (`tenant_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
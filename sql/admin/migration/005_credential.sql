@@ -0,0 +1,18 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+CREATE TABLE IF NOT EXISTS `credential` (
+  `tenant_id` BIGINT NOT NULL,
+  `login_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `password_hash` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `login_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `revoked_session` (
+  `jti` VARCHAR(64) NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  PRIMARY KEY (`jti`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
@@ -0,0 +1,4 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+ALTER TABLE `tenant` ADD COLUMN `sandbox_of` BIGINT NULL AFTER `storage`;
@@ -0,0 +1,12 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+CREATE TABLE IF NOT EXISTS `ip_allowlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `cidr` VARCHAR(64) NOT NULL,
+  `note` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `tenant_cidr` (`tenant_id`, `cidr`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
@@ -0,0 +1,18 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+CREATE TABLE IF NOT EXISTS `billing_receipt` (
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `finished_at` BIGINT NOT NULL,
+  `player_count` BIGINT NOT NULL,
+  `visitor_count` BIGINT NOT NULL,
+  `player_yen` BIGINT NOT NULL,
+  `visitor_yen` BIGINT NOT NULL,
+  `billing_yen` BIGINT NOT NULL,
+  `scores_hash` CHAR(64) NOT NULL,
+  `visits_hash` CHAR(64) NOT NULL,
+  `input_hash` CHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `competition_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
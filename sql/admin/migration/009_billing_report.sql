@@ -0,0 +1,17 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+-- 既存の終了した大会の行は、課金レポートのAPIで最初に読んだときに作られる
+USE `isuports`;
+
+CREATE TABLE IF NOT EXISTS `billing_report` (
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `finished_at` BIGINT NOT NULL,
+  `player_count` BIGINT NOT NULL,
+  `visitor_count` BIGINT NOT NULL,
+  `billing_player_yen` BIGINT NOT NULL,
+  `billing_visitor_yen` BIGINT NOT NULL,
+  `billing_yen` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `competition_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
@@ -0,0 +1,9 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+ALTER TABLE `billing_plan` ADD COLUMN `tier` VARCHAR(16) NOT NULL DEFAULT 'standard' AFTER `visitor_yen`;
+
+-- 保存済みの課金レポートはプランを反映していないので捨てる 次に読んだときに計算し直す
+DELETE FROM `billing_report`;
+ALTER TABLE `billing_report` ADD COLUMN `plan` VARCHAR(16) NOT NULL AFTER `billing_visitor_yen`;
+ALTER TABLE `billing_report` ADD COLUMN `discount_yen` BIGINT NOT NULL AFTER `plan`;
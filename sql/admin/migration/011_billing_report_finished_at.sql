@@ -0,0 +1,5 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+-- visit_historyの削除(visit_history_purge.go)で終了日時で対象の大会を探す
+CREATE INDEX finished_at_idx ON billing_report (finished_at);
@@ -0,0 +1,5 @@
+-- 20_tenant_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+-- storageがmysqlのテナントの大会に、ランキングの同点の扱いを追加する
+ALTER TABLE `competition` ADD COLUMN `tie_break` VARCHAR(16) NOT NULL DEFAULT 'earliest' AFTER `finished_at`;
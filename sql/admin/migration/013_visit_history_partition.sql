@@ -0,0 +1,11 @@
+-- 10_schema.sql より前に作られた既存のDBに対して一度だけ実行する
+USE `isuports`;
+
+-- visit_historyを月ごとのパーティションに分ける(visit_history_partition.go)
+-- 新しい月のパーティションはアプリケーションが pmax を分割して作る
+-- 行数が多い場合はテーブルを作り直すので時間がかかる
+ALTER TABLE `visit_history`
+PARTITION BY RANGE (`created_at`) (
+  PARTITION p202205 VALUES LESS THAN (1654009200),
+  PARTITION pmax VALUES LESS THAN MAXVALUE
+);
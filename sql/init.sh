@@ -3,6 +3,8 @@
 set -ex
 cd `dirname $0`
 
+# アプリケーションの POST /initialize は go/initialize.go で同じことを行う
+
 ISUCON_DB_HOST=${ISUCON_DB_HOST:-127.0.0.1}
 ISUCON_DB_PORT=${ISUCON_DB_PORT:-3306}
 ISUCON_DB_USER=${ISUCON_DB_USER:-isucon}
@@ -19,3 +21,8 @@ mysql -u"$ISUCON_DB_USER" \
 # SQLiteのデータベースを初期化
 rm -f ../tenant_db/*.db
 cp -r ../../initial_data/*.db ../tenant_db/
+
+# 初期データのテナントDBにスキーマの追加分を反映
+for db in ../tenant_db/*.db; do
+	sqlite3 "$db" < tenant/20_migration.sql
+done
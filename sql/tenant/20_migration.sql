@@ -0,0 +1,104 @@
+ALTER TABLE player ADD COLUMN deleted_at BIGINT NULL;
+
+-- ランキングの同点の扱い go/ranking_tie_break.go を参照
+ALTER TABLE competition ADD COLUMN tie_break VARCHAR(16) NOT NULL DEFAULT 'earliest';
+
+CREATE TABLE IF NOT EXISTS player_score_history (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  score BIGINT NOT NULL,
+  row_num BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS history_tenant_player_idx ON player_score_history (tenant_id, player_id);
+
+-- player_score_historyを作る前に登録したスコアを履歴に入れる
+INSERT INTO player_score_history (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at)
+  SELECT id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at FROM player_score
+  WHERE NOT EXISTS (SELECT 1 FROM player_score_history WHERE player_score_history.id = player_score.id);
+
+-- スコアのアップロードごとの記録
+CREATE TABLE IF NOT EXISTS score_upload (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  row_count BIGINT NOT NULL,
+  added_count BIGINT NOT NULL,
+  removed_count BIGINT NOT NULL,
+  changed_count BIGINT NOT NULL,
+  created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS score_upload_competition_idx ON score_upload (tenant_id, competition_id, created_at);
+
+-- アップロードで直前の有効なスコアから変わった参加者
+CREATE TABLE IF NOT EXISTS score_upload_diff (
+  upload_id VARCHAR(255) NOT NULL,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  change_type VARCHAR(16) NOT NULL,
+  previous_score BIGINT NULL,
+  score BIGINT NULL
+);
+
+CREATE INDEX IF NOT EXISTS score_upload_diff_upload_idx ON score_upload_diff (tenant_id, upload_id);
+
+-- 終了した大会のスコアへの参加者からの異議申し立て
+CREATE TABLE IF NOT EXISTS score_dispute (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  reason TEXT NOT NULL,
+  claimed_score BIGINT NULL,
+  status VARCHAR(16) NOT NULL,
+  resolution TEXT NULL,
+  corrected_score BIGINT NULL,
+  resolved_at BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS score_dispute_competition_idx ON score_dispute (tenant_id, competition_id, created_at);
+
+CREATE INDEX IF NOT EXISTS score_dispute_player_idx ON score_dispute (tenant_id, player_id);
+
+-- テナントごとにIDを発行する場合の次の連番 go/id_namespace.go を参照
+CREATE TABLE IF NOT EXISTS id_sequence (
+  tenant_id BIGINT NOT NULL PRIMARY KEY,
+  next_id BIGINT NOT NULL
+);
+
+-- 参加者への通知 大会の終了時の最終順位など go/notification.go を参照
+CREATE TABLE IF NOT EXISTS notification (
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  kind VARCHAR(32) NOT NULL,
+  `rank` BIGINT NOT NULL,
+  score BIGINT NOT NULL,
+  percentile REAL NOT NULL,
+  player_count BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, competition_id, kind, player_id)
+);
+
+CREATE INDEX IF NOT EXISTS notification_player_idx ON notification (tenant_id, player_id, created_at);
+
+-- スコアのアップロードの直後のランキングと、その前のアップロードの直後の順位 go/ranking_snapshot.go を参照
+CREATE TABLE IF NOT EXISTS ranking_snapshot (
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  upload_id VARCHAR(255) NOT NULL,
+  `rank` BIGINT NOT NULL,
+  score BIGINT NOT NULL,
+  previous_rank BIGINT NULL,
+  previous_score BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, competition_id, player_id)
+);